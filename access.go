@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	permList   = "storage.objects.list"
+	permGet    = "storage.objects.get"
+	permCreate = "storage.objects.create"
+	permDelete = "storage.objects.delete"
+)
+
+type AccessError struct {
+	Bucket  string
+	Missing []string // <= permissions not granted, empty when bucket does not exist
+}
+
+func (e *AccessError) Error() string {
+	if len(e.Missing) == 0 {
+		return fmt.Sprintf("bucket not found: gs://%s", e.Bucket)
+	}
+
+	return fmt.Sprintf("missing %s on gs://%s", strings.Join(e.Missing, ", "), e.Bucket)
+}
+
+func (e *AccessError) Unwrap() error {
+	if len(e.Missing) == 0 {
+		return storage.ErrBucketNotExist
+	}
+
+	return nil
+}
+
+/*
+	Check before job starts that bucket exists and caller holds permissions, so it fails with
+	actionable message instead of opaque listing or download error
+*/
+func (s *Storage) CheckAccess(bucket string, permissions ...string) error {
+	uri := "gs://" + bucket
+
+	var denied *AccessError
+	attempt, err := s.Retry(uri, func() error {
+		var err error
+		denied, err = s.testAccess(bucket, permissions)
+		return err
+	})
+	if err != nil {
+		return &TransferError{Object: uri, Attempt: attempt, Err: err}
+	}
+	if denied != nil {
+		return &TransferError{Object: uri, Attempt: attempt, Err: denied}
+	}
+
+	return nil
+}
+
+/*
+	Call testIamPermissions, APIs without it (e.g. emulators) skip the check
+*/
+func (s *Storage) testAccess(bucket string, permissions []string) (*AccessError, error) {
+	ctx, cancel := s.objectContext()
+	defer cancel()
+
+	handle := s.Bucket(bucket)
+	granted, err := handle.IAM().TestPermissions(ctx, permissions)
+
+	var apiErr *googleapi.Error
+	switch {
+	case err == nil:
+	case errors.As(err, &apiErr) && apiErr.Code == 404:
+		// Missing bucket and missing method look the same, bucket metadata tells them apart
+		_, err := handle.Attrs(ctx)
+		switch {
+		case err == nil:
+			return nil, nil
+		case isRetryable(err):
+			return nil, fmt.Errorf("Bucket(%q).Attrs: %w", bucket, err)
+		}
+		return &AccessError{Bucket: bucket}, nil
+	case isRetryable(err):
+		return nil, fmt.Errorf("Bucket(%q).TestPermissions: %w", bucket, err)
+	default:
+		return nil, nil // <= listing reports the error if there is one
+	}
+
+	have := map[string]bool{}
+	for _, permission := range granted {
+		have[permission] = true
+	}
+	var lacking []string
+	for _, permission := range permissions {
+		if !have[permission] {
+			lacking = append(lacking, permission)
+		}
+	}
+	if len(lacking) > 0 {
+		return &AccessError{Bucket: bucket, Missing: lacking}, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+type ACLEntry struct {
+	Entity        string `json:"entity"`
+	Role          string `json:"role"`
+	Email         string `json:"email,omitempty"`
+	Domain        string `json:"domain,omitempty"`
+	ProjectNumber string `json:"project_number,omitempty"`
+	ProjectTeam   string `json:"project_team,omitempty"`
+}
+
+type IAMBinding struct {
+	Role    string   `json:"role"`
+	Members []string `json:"members"`
+}
+
+type BucketAccess struct {
+	UniformAccess bool         `json:"uniform_bucket_level_access"`
+	IAM           []IAMBinding `json:"iam_bindings,omitempty"`
+	IAMError      string       `json:"iam_error,omitempty"` // <= policy could not be read, e.g. missing permission
+}
+
+type ACLSidecar struct {
+	URI        string        `json:"uri"`
+	Generation int64         `json:"generation"`
+	ACL        []ACLEntry    `json:"acl"`
+	Bucket     *BucketAccess `json:"bucket"`
+}
+
+type ACLExporter struct {
+	mu      sync.Mutex
+	buckets map[string]*BucketAccess
+}
+
+/*
+	Create exporter of ACL sidecars, bucket access context is fetched once per bucket
+*/
+func NewACLExporter() *ACLExporter {
+	return &ACLExporter{buckets: map[string]*BucketAccess{}}
+}
+
+/*
+	Write "<file>.acl.json" sidecar with object ACL and bucket IAM context
+*/
+func (s *Storage) WriteACLSidecar(ctx context.Context, t *Transfer, generation int64) error {
+	access, err := s.ACLs.bucketAccess(ctx, s.Bucket(t.Bucket), t.Bucket)
+	if err != nil {
+		return err
+	}
+
+	sidecar := ACLSidecar{URI: t.URI(), Generation: generation, ACL: []ACLEntry{}, Bucket: access}
+
+	// Object ACLs are disabled with uniform bucket-level access
+	if !access.UniformAccess {
+		if sidecar.ACL, err = s.objectACL(ctx, t.Bucket, t.Object, generation); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(sidecar, "", "  ")
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	if err := os.WriteFile(t.Destination+".acl.json", append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("os.WriteFile: %w", err)
+	}
+
+	return nil
+}
+
+/*
+	ACL of downloaded object generation, storage client lists ACL of live generation only
+*/
+func (s *Storage) objectACL(ctx context.Context, bucket, object string, generation int64) ([]ACLEntry, error) {
+	query := url.Values{}
+	if generation != 0 {
+		query.Set("generation", fmt.Sprint(generation))
+	}
+	uri := s.bucketURL(bucket, "o/"+url.PathEscape(object)+"/acl", query)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequest: %w", err)
+	}
+	_, hc := s.route(bucket)
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Object(%q).ACL: %w", object, err)
+	}
+	defer resp.Body.Close()
+
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return nil, fmt.Errorf("Object(%q).ACL: %w", object, err)
+	}
+
+	var list struct {
+		Items []struct {
+			Entity      string `json:"entity"`
+			Role        string `json:"role"`
+			Email       string `json:"email"`
+			Domain      string `json:"domain"`
+			ProjectTeam *struct {
+				ProjectNumber string `json:"projectNumber"`
+				Team          string `json:"team"`
+			} `json:"projectTeam"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("json.Decode: %w", err)
+	}
+
+	entries := []ACLEntry{}
+	for _, rule := range list.Items {
+		entry := ACLEntry{Entity: rule.Entity, Role: rule.Role, Email: rule.Email, Domain: rule.Domain}
+		if rule.ProjectTeam != nil {
+			entry.ProjectNumber = rule.ProjectTeam.ProjectNumber
+			entry.ProjectTeam = rule.ProjectTeam.Team
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func (e *ACLExporter) bucketAccess(ctx context.Context, bucket *storage.BucketHandle, name string) (*BucketAccess, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if access, ok := e.buckets[name]; ok {
+		return access, nil
+	}
+
+	attrs, err := bucket.Attrs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Bucket(%q).Attrs: %w", name, err)
+	}
+	access := &BucketAccess{UniformAccess: attrs.UniformBucketLevelAccess.Enabled}
+
+	// Reading policy needs storage.buckets.getIamPolicy, object data may still be exported without it
+	policy, err := bucket.IAM().Policy(ctx)
+	if err != nil {
+		access.IAMError = err.Error()
+	} else {
+		for _, role := range policy.Roles() {
+			access.IAM = append(access.IAM, IAMBinding{Role: string(role), Members: policy.Members(role)})
+		}
+	}
+
+	e.buckets[name] = access
+
+	return access, nil
+}
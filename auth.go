@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+/*
+	Create token source from credentials, called again when tokens are rejected
+*/
+type credentialMinter func(ctx context.Context) (oauth2.TokenSource, error)
+
+/*
+	Token source which re-mints credentials on demand, e.g. expired impersonation chain in long jobs
+*/
+type renewingTokenSource struct {
+	ctx  context.Context
+	mint credentialMinter
+
+	mu      sync.Mutex
+	current oauth2.TokenSource
+	minted  time.Time
+}
+
+type reauthTransport struct {
+	base   http.RoundTripper
+	source *renewingTokenSource
+}
+
+/*
+	Application default credentials (GOOGLE_APPLICATION_CREDENTIALS, gcloud, metadata server)
+*/
+func defaultCredentials(ctx context.Context) (oauth2.TokenSource, error) {
+	creds, err := google.FindDefaultCredentials(ctx, storage.ScopeFullControl)
+	if err != nil {
+		return nil, fmt.Errorf("google.FindDefaultCredentials: %w", err)
+	}
+
+	return creds.TokenSource, nil
+}
+
+/*
+	Credentials of service account or authorized user JSON key file, read again on each mint
+*/
+func fileCredentials(path string) credentialMinter {
+	return func(ctx context.Context) (oauth2.TokenSource, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("os.ReadFile: %w", err)
+		}
+		creds, err := google.CredentialsFromJSON(ctx, data, storage.ScopeFullControl)
+		if err != nil {
+			return nil, fmt.Errorf("google.CredentialsFromJSON: %s: %w", path, err)
+		}
+
+		return creds.TokenSource, nil
+	}
+}
+
+func newRenewingTokenSource(ctx context.Context, mint credentialMinter) (*renewingTokenSource, error) {
+	ts := &renewingTokenSource{ctx: ctx, mint: mint}
+
+	// Missing credentials fail at start, not with first request
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if err := ts.renew(); err != nil {
+		return nil, err
+	}
+
+	return ts, nil
+}
+
+func (ts *renewingTokenSource) Token() (*oauth2.Token, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	token, err := ts.current.Token()
+	if err == nil {
+		return token, nil
+	}
+
+	// Refresh failed, fresh credentials may still work
+	if rerr := ts.renew(); rerr != nil {
+		return nil, err
+	}
+
+	return ts.current.Token()
+}
+
+/*
+	Mint new credentials unless it happened after rejected request was sent
+*/
+func (ts *renewingTokenSource) Renew(sent time.Time) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.minted.After(sent) {
+		return nil
+	}
+
+	return ts.renew()
+}
+
+func (ts *renewingTokenSource) renew() error {
+	source, err := ts.mint(ts.ctx)
+	if err != nil {
+		return err
+	}
+	ts.current = source
+	ts.minted = time.Now()
+
+	return nil
+}
+
+/*
+	Send request again with renewed credentials once when token was rejected
+*/
+func (t *reauthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	sent := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	// Body of request can not be sent twice
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return resp, err
+	}
+
+	if rerr := t.source.Renew(sent); rerr != nil {
+		console.Errorf("Access token rejected, renewing credentials failed: %v\n", rerr)
+		return resp, err
+	}
+	resp.Body.Close()
+	console.Errorf("Access token rejected, credentials renewed: %s %s\n", req.Method, req.URL.Path)
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, fmt.Errorf("req.GetBody: %w", err)
+		}
+	}
+
+	return t.base.RoundTrip(retry)
+}
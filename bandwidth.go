@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const minBandwidthChunk = 16 << 10 // <= reads are split so throttled job sleeps often and briefly
+
+type BandwidthRule struct {
+	From  string `json:"from"`  // <= local time "HH:MM" the limit starts, e.g. "08:00"
+	To    string `json:"to"`    // <= end of limit, before "from" when the window spans midnight
+	Limit string `json:"limit"` // <= bytes per second of all transfers, e.g. "100MiB"
+
+	from, to int // <= minutes since midnight
+	limit    int64
+}
+
+/*
+	Bandwidth of all transfers of this process, limit is looked up by time of day for each chunk
+*/
+type BandwidthLimiter struct {
+	Rules    []*BandwidthRule
+	Share    int  // <= limits are divided by it, in worker processes by their count
+	Announce bool // <= print limit changes
+
+	mu      sync.Mutex
+	next    time.Time // <= when data read so far is paid for
+	current *BandwidthRule
+	started bool
+}
+
+type throttledReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	limiter *BandwidthLimiter
+}
+
+/*
+	Validate bandwidth rule
+*/
+func (br *BandwidthRule) Check() error {
+	var err error
+	if br.from, err = parseClock(br.From, false); err != nil {
+		return fmt.Errorf("invalid \"from\": %w", err)
+	}
+	if br.to, err = parseClock(br.To, true); err != nil {
+		return fmt.Errorf("invalid \"to\": %w", err)
+	}
+	if br.from == br.to {
+		return fmt.Errorf("%s-%s: \"from\" and \"to\" must differ", br.From, br.To)
+	}
+	if br.limit, err = parseSize(br.Limit); err != nil || br.limit == 0 {
+		return fmt.Errorf("%s-%s: \"limit\" must be positive size per second, e.g. \"100MiB\"", br.From, br.To)
+	}
+
+	return nil
+}
+
+/*
+	Parse "HH:MM" as minutes since midnight, "24:00" is allowed as end of day
+*/
+func parseClock(clock string, end bool) (int, error) {
+	if end && clock == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("time must look like HH:MM: %q", clock)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+/*
+	Check if local time is within window of rule
+*/
+func (br *BandwidthRule) Active(now time.Time) bool {
+	minute := now.Hour()*60 + now.Minute()
+	if br.from < br.to {
+		return minute >= br.from && minute < br.to
+	}
+
+	return minute >= br.from || minute < br.to
+}
+
+/*
+	Create limiter for rules of config, nil without rules
+*/
+func NewBandwidthLimiter(rules []*BandwidthRule, share int, announce bool) *BandwidthLimiter {
+	if len(rules) == 0 {
+		return nil
+	}
+	if share < 1 {
+		share = 1
+	}
+
+	return &BandwidthLimiter{Rules: rules, Share: share, Announce: announce}
+}
+
+/*
+	First rule active at given time, nil means unlimited
+*/
+func (l *BandwidthLimiter) Rule(now time.Time) *BandwidthRule {
+	for _, rule := range l.Rules {
+		if rule.Active(now) {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+/*
+	Limit in bytes per second at given time, 0 means unlimited
+*/
+func (l *BandwidthLimiter) Limit(now time.Time) int64 {
+	rule := l.Rule(now)
+	if rule == nil {
+		return 0
+	}
+
+	return rule.limit / int64(l.Share)
+}
+
+/*
+	Wait until n more bytes fit in current limit, bytes of all transfers are paid for in turn
+*/
+func (l *BandwidthLimiter) Wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	rule := l.Rule(now)
+	if l.Announce && (rule != l.current || !l.started) {
+		l.announce(rule)
+	}
+	l.current, l.started = rule, true
+
+	if rule == nil {
+		l.next = time.Time{}
+		l.mu.Unlock()
+		return nil
+	}
+	if l.next.Before(now) {
+		l.next = now
+	}
+	limit := rule.limit / int64(l.Share)
+	l.next = l.next.Add(time.Duration(float64(n) / float64(limit) * float64(time.Second)))
+	wait := l.next.Sub(now)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *BandwidthLimiter) announce(rule *BandwidthRule) {
+	if rule == nil {
+		if l.started {
+			console.Printf("Bandwidth unlimited\n")
+		}
+		return
+	}
+
+	console.Printf("Bandwidth limited to %s/s until %s\n", formatBytes(rule.limit/int64(l.Share)), rule.To)
+}
+
+/*
+	Largest read keeping waits short, about eighth of a second at current limit
+*/
+func (l *BandwidthLimiter) chunk() int {
+	limit := l.Limit(time.Now())
+	if limit == 0 {
+		return 0
+	}
+	if chunk := int(limit / 8); chunk > minBandwidthChunk {
+		return chunk
+	}
+
+	return minBandwidthChunk
+}
+
+/*
+	Wrap reader to keep bandwidth schedule, nil limiter returns reader as is
+*/
+func (l *BandwidthLimiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+
+	return &throttledReader{ctx: ctx, reader: r, limiter: l}
+}
+
+func (r *throttledReader) Read(b []byte) (int, error) {
+	if chunk := r.limiter.chunk(); chunk > 0 && len(b) > chunk {
+		b = b[:chunk]
+	}
+
+	n, err := r.reader.Read(b)
+	if n > 0 {
+		if werr := r.limiter.Wait(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+type BrowserEntry struct {
+	Name  string               // <= object name or prefix ending with "/"
+	Attrs *storage.ObjectAttrs // <= nil for prefixes
+}
+
+type Browser struct {
+	Storage *Storage
+	Prefix  string
+	Entries []BrowserEntry
+	Marked  map[string]*storage.ObjectAttrs // <= nil for prefixes
+}
+
+const browserHelp = `Commands:
+  ls                 List current prefix
+  cd <n|name|..>     Enter prefix (".." goes up, "/" goes to bucket root)
+  stat <n|name>      Show object metadata
+  mark <n|name|*>    Mark object or prefix for download
+  unmark <n|name|*>  Remove mark
+  marked             Show marked objects and prefixes
+  get <path>         Download marked items to local path and exit
+  help               Show this help
+  quit               Exit without downloading`
+
+/*
+	Run interactive bucket browser and return objects selected for download
+*/
+func (s *Storage) Browse(in io.Reader) ([]*storage.ObjectAttrs, error) {
+	prefix := s.Config.Prefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	b := &Browser{
+		Storage: s,
+		Prefix:  prefix,
+		Marked:  map[string]*storage.ObjectAttrs{},
+	}
+	if err := b.List(); err != nil {
+		return nil, err
+	}
+	b.Print()
+
+	scanner := bufio.NewScanner(in)
+	for {
+		console.Printf("gs://%s/%s> ", s.Config.BucketName, b.Prefix)
+		if !scanner.Scan() {
+			console.Printf("\n")
+			return nil, scanner.Err()
+		}
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		command, args := fields[0], fields[1:]
+		arg := strings.Join(args, " ")
+
+		var err error
+		switch command {
+		case "ls":
+			err = b.List()
+			if err == nil {
+				b.Print()
+			}
+		case "cd":
+			err = b.Enter(arg)
+		case "stat":
+			err = b.Stat(arg)
+		case "mark":
+			err = b.Mark(arg, true)
+		case "unmark":
+			err = b.Mark(arg, false)
+		case "marked":
+			b.PrintMarked()
+		case "get":
+			if arg == "" {
+				err = fmt.Errorf("destination path is required")
+				break
+			}
+			objects, err := b.Selection()
+			if err != nil {
+				console.Printf("Error: %v\n", err)
+				continue
+			}
+			if len(objects) == 0 {
+				console.Printf("Nothing is marked.\n")
+				continue
+			}
+			if s.Config.DestinationPath, err = normalizePath(arg); err != nil {
+				console.Printf("Error: %v\n", err)
+				continue
+			}
+			return objects, nil
+		case "help", "?":
+			console.Printf("%s\n", browserHelp)
+		case "quit", "exit", "q":
+			return nil, nil
+		default:
+			err = fmt.Errorf("unknown command %q, type \"help\" for usage", command)
+		}
+		if err != nil {
+			console.Printf("Error: %v\n", err)
+		}
+	}
+}
+
+/*
+	Load entries of current prefix using delimiter listing
+*/
+func (b *Browser) List() error {
+	ctx, cancel := b.Storage.listContext()
+	defer cancel()
+
+	it := b.Storage.Bucket(b.Storage.Config.BucketName).Objects(ctx, &storage.Query{
+		Prefix:    b.Prefix,
+		Delimiter: "/",
+	})
+
+	var entries []BrowserEntry
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		// Skip placeholder of current prefix itself
+		if attrs.Name == b.Prefix && attrs.Prefix == "" {
+			continue
+		}
+		if attrs.Prefix != "" {
+			entries = append(entries, BrowserEntry{Name: attrs.Prefix})
+		} else {
+			entries = append(entries, BrowserEntry{Name: attrs.Name, Attrs: attrs})
+		}
+	}
+
+	// Prefixes first, then objects
+	sort.SliceStable(entries, func(i, j int) bool {
+		if (entries[i].Attrs == nil) != (entries[j].Attrs == nil) {
+			return entries[i].Attrs == nil
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	b.Entries = entries
+
+	return nil
+}
+
+/*
+	Print entries of current prefix
+*/
+func (b *Browser) Print() {
+	if len(b.Entries) == 0 {
+		console.Printf("  (empty)\n")
+		return
+	}
+
+	for i, e := range b.Entries {
+		mark := " "
+		if _, ok := b.Marked[e.Name]; ok {
+			mark = "*"
+		}
+		name := strings.TrimPrefix(e.Name, b.Prefix)
+		if e.Attrs == nil {
+			console.Printf("%s %4d  %-40s %12s\n", mark, i+1, name, "PREFIX")
+			continue
+		}
+		console.Printf("%s %4d  %-40s %12d  %s\n", mark, i+1, name, e.Attrs.Size, e.Attrs.Updated.Format(time.RFC3339))
+	}
+}
+
+/*
+	Resolve entry by its index or name relative to current prefix
+*/
+func (b *Browser) Resolve(arg string) (*BrowserEntry, error) {
+	if arg == "" {
+		return nil, fmt.Errorf("entry number or name is required")
+	}
+
+	if n, err := strconv.Atoi(arg); err == nil {
+		if n < 1 || n > len(b.Entries) {
+			return nil, fmt.Errorf("no entry with number %d", n)
+		}
+		return &b.Entries[n-1], nil
+	}
+
+	for i, e := range b.Entries {
+		name := strings.TrimPrefix(e.Name, b.Prefix)
+		if name == arg || name == arg+"/" {
+			return &b.Entries[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("no such entry: %s", arg)
+}
+
+/*
+	Change current prefix
+*/
+func (b *Browser) Enter(arg string) error {
+	switch arg {
+	case "", "/":
+		b.Prefix = ""
+	case "..":
+		if b.Prefix == "" {
+			return nil
+		}
+		parent := path.Dir(strings.TrimSuffix(b.Prefix, "/"))
+		if parent == "." {
+			parent = ""
+		} else {
+			parent += "/"
+		}
+		b.Prefix = parent
+	default:
+		entry, err := b.Resolve(arg)
+		if err != nil {
+			return err
+		}
+		if entry.Attrs != nil {
+			return fmt.Errorf("not a prefix: %s", entry.Name)
+		}
+		b.Prefix = entry.Name
+	}
+
+	if err := b.List(); err != nil {
+		return err
+	}
+	b.Print()
+
+	return nil
+}
+
+/*
+	Print object metadata
+*/
+func (b *Browser) Stat(arg string) error {
+	entry, err := b.Resolve(arg)
+	if err != nil {
+		return err
+	}
+	if entry.Attrs == nil {
+		return fmt.Errorf("not an object: %s", entry.Name)
+	}
+
+	a := entry.Attrs
+	console.Printf("gs://%s/%s\n", a.Bucket, a.Name)
+	console.Printf("  Size:            %d\n", a.Size)
+	console.Printf("  Content-Type:    %s\n", a.ContentType)
+	console.Printf("  Storage class:   %s\n", a.StorageClass)
+	console.Printf("  Created:         %s\n", a.Created.Format(time.RFC3339))
+	console.Printf("  Updated:         %s\n", a.Updated.Format(time.RFC3339))
+	if !a.CustomTime.IsZero() {
+		console.Printf("  Custom time:     %s\n", a.CustomTime.Format(time.RFC3339))
+	}
+	console.Printf("  Generation:      %d\n", a.Generation)
+	console.Printf("  Metageneration:  %d\n", a.Metageneration)
+	console.Printf("  CRC32C:          %08x\n", a.CRC32C)
+	for k, v := range a.Metadata {
+		console.Printf("  Metadata %s: %s\n", k, v)
+	}
+
+	return nil
+}
+
+/*
+	Mark or unmark entry, "*" applies to all entries of current prefix
+*/
+func (b *Browser) Mark(arg string, marked bool) error {
+	var entries []BrowserEntry
+	if arg == "*" {
+		entries = b.Entries
+	} else {
+		entry, err := b.Resolve(arg)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, *entry)
+	}
+
+	for _, entry := range entries {
+		if marked {
+			b.Marked[entry.Name] = entry.Attrs
+		} else {
+			delete(b.Marked, entry.Name)
+		}
+	}
+	console.Printf("%d item(s) marked.\n", len(b.Marked))
+
+	return nil
+}
+
+/*
+	Print marked items
+*/
+func (b *Browser) PrintMarked() {
+	if len(b.Marked) == 0 {
+		console.Printf("Nothing is marked.\n")
+		return
+	}
+
+	var names []string
+	for name := range b.Marked {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		console.Printf("  gs://%s/%s\n", b.Storage.Config.BucketName, name)
+	}
+}
+
+/*
+	Expand marked prefixes into objects
+*/
+func (b *Browser) Selection() ([]*storage.ObjectAttrs, error) {
+	ctx, cancel := b.Storage.listContext()
+	defer cancel()
+
+	seen := map[string]bool{}
+	var objects []*storage.ObjectAttrs
+	for name, attrs := range b.Marked {
+		if attrs != nil {
+			if !seen[name] {
+				seen[name] = true
+				objects = append(objects, attrs)
+			}
+			continue
+		}
+
+		it := b.Storage.Bucket(b.Storage.Config.BucketName).Objects(ctx, &storage.Query{
+			Prefix: name,
+		})
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if !seen[attrs.Name] {
+				seen[attrs.Name] = true
+				objects = append(objects, attrs)
+			}
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+
+	return objects, nil
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	bundleVersion    = 1
+	maxBundleExpires = 7 * 24 * time.Hour // <= longest validity of V4 signed URLs
+)
+
+var ErrBundleExpired = errors.New("bundle expired")
+
+/*
+	Objects shared by signed URLs, fetched by "fetch-bundle" without any Google credentials
+*/
+type Bundle struct {
+	Version int           `json:"version"`
+	Source  string        `json:"source"`
+	Created time.Time     `json:"created"`
+	Expires time.Time     `json:"expires"` // <= signed URLs stop working then
+	Objects int           `json:"objects"`
+	Bytes   int64         `json:"bytes"`
+	Files   []*BundleFile `json:"files"`
+}
+
+type BundleFile struct {
+	Name   string `json:"name"`   // <= relative path, "/" separated
+	Source string `json:"source"` // <= gs:// URL, for messages only
+	URL    string `json:"url"`
+	Size   int64  `json:"size"`
+	MD5    string `json:"md5,omitempty"` // <= hex, composite objects have none
+	CRC32C string `json:"crc32c"`
+}
+
+/*
+	Signer of V4 URLs and reports with service account key
+*/
+type URLSigner struct {
+	AccessID   string
+	KeyID      string // <= names public certificate of service account verifying signatures
+	PrivateKey []byte
+	Endpoint   *url.URL // <= scheme and host of signed URLs, emulator in tests
+}
+
+/*
+	Run "bundle" command: sign URLs of selected objects and write bundle file for external counterparts
+*/
+func runBundleCommand(args []string) {
+	fs := flag.NewFlagSet("bundle", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s bundle [OPTIONS] -o bundle.json bucket_name[/path]\n\nOptions:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	common := addCommandFlags(fs)
+	output := fs.String("o", "", "Bundle file to write (required)")
+	expires := fs.Duration("expires", 24*time.Hour, "Validity of signed URLs, at most 168h")
+	keyFile := fs.String("key-file", "", "Service account JSON key signing URLs (defaults to GOOGLE_APPLICATION_CREDENTIALS)")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || *output == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *expires <= 0 || *expires > maxBundleExpires {
+		exception(fmt.Errorf("-expires must be between 0 and %s", maxBundleExpires))
+	}
+
+	// Key is checked before listing, bundle of unsigned URLs is useless
+	signer, err := NewURLSigner(*keyFile)
+	if err != nil {
+		exception(err)
+	}
+
+	cfg, err := common.newConfig("bundle")
+	if err != nil {
+		exception(err)
+	}
+	cfg.Uri = fs.Arg(0)
+	if cfg.BucketName, cfg.Prefix, err = parseGCSUrl(cfg.Uri); err != nil {
+		exception(err)
+	}
+	if hasGlob(cfg.Prefix) {
+		if cfg.Glob, err = compileGlob(cfg.Prefix); err != nil {
+			exception(err)
+		}
+	}
+	cfg.CreateDirs = true
+
+	s, err := NewStorageWithConfig(cfg)
+	if err != nil {
+		exception(err)
+	}
+	defer s.Client.Close()
+
+	transfers, err := s.Plan()
+	if err != nil {
+		s.Abort(nil, err)
+	}
+	bundle, err := NewBundle(cfg.Uri, transfers, signer, time.Now().Add(*expires))
+	if err != nil {
+		exception(err)
+	}
+	if err := bundle.Save(*output); err != nil {
+		exception(err)
+	}
+
+	console.Printf("Bundle of %d objects (%s) valid until %s written to %s\n",
+		bundle.Objects, formatBytes(bundle.Bytes), bundle.Expires.Format(time.RFC3339), *output)
+}
+
+/*
+	Read signing identity from service account key, other credentials can not sign locally
+*/
+func NewURLSigner(keyFile string) (*URLSigner, error) {
+	if keyFile == "" {
+		keyFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if keyFile == "" {
+		return nil, fmt.Errorf("signing needs service account key: -key-file or GOOGLE_APPLICATION_CREDENTIALS")
+	}
+
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile: %w", err)
+	}
+	conf, err := google.JWTConfigFromJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("google.JWTConfigFromJSON: %s: %w", keyFile, err)
+	}
+	endpoint, err := url.Parse(jsonEndpoint())
+	if err != nil {
+		return nil, fmt.Errorf("url.Parse: %w", err)
+	}
+
+	return &URLSigner{AccessID: conf.Email, KeyID: conf.PrivateKeyID, PrivateKey: conf.PrivateKey, Endpoint: endpoint}, nil
+}
+
+/*
+	Sign data with RSA SHA-256 (PKCS #1 v1.5), as "openssl dgst -sha256 -verify" checks it
+*/
+func (us *URLSigner) SignBytes(data []byte) ([]byte, error) {
+	block, _ := pem.Decode(us.PrivateKey)
+	if block == nil {
+		return nil, fmt.Errorf("private key of %s is not PEM encoded", us.AccessID)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("x509.ParsePKCS8PrivateKey: %w", err)
+		}
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key of %s is not RSA", us.AccessID)
+	}
+
+	digest := sha256.Sum256(data)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return nil, fmt.Errorf("rsa.SignPKCS1v15: %w", err)
+	}
+
+	return signature, nil
+}
+
+/*
+	Sign GET of object until expiry
+*/
+func (us *URLSigner) Sign(bucket, object string, expires time.Time) (string, error) {
+	signed, err := storage.SignedURL(bucket, object, &storage.SignedURLOptions{
+		GoogleAccessID: us.AccessID,
+		PrivateKey:     us.PrivateKey,
+		Method:         http.MethodGet,
+		Expires:        expires,
+		Scheme:         storage.SigningSchemeV4,
+		Style:          storage.PathStyle(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("storage.SignedURL: %w", err)
+	}
+
+	u, err := url.Parse(signed)
+	if err != nil {
+		return "", fmt.Errorf("url.Parse: %w", err)
+	}
+	u.Scheme, u.Host = us.Endpoint.Scheme, us.Endpoint.Host
+
+	return u.String(), nil
+}
+
+/*
+	Describe planned downloads with signed URLs, names are destinations of cp into empty path
+*/
+func NewBundle(source string, transfers []*Transfer, signer *URLSigner, expires time.Time) (*Bundle, error) {
+	expires = expires.UTC().Truncate(time.Second)
+	bundle := &Bundle{
+		Version: bundleVersion,
+		Source:  source,
+		Created: time.Now().UTC(),
+		Expires: expires,
+	}
+
+	for _, t := range transfers {
+		if t.Directory || t.Attrs == nil {
+			continue
+		}
+		signed, err := signer.Sign(t.Bucket, t.Object, expires)
+		if err != nil {
+			return nil, err
+		}
+		bundle.Files = append(bundle.Files, &BundleFile{
+			Name:   filepath.ToSlash(t.Destination),
+			Source: t.URI(),
+			URL:    signed,
+			Size:   t.Attrs.Size,
+			MD5:    hex.EncodeToString(t.Attrs.MD5),
+			CRC32C: fmt.Sprintf("%08x", t.Attrs.CRC32C),
+		})
+		bundle.Bytes += t.Attrs.Size
+	}
+	bundle.Objects = len(bundle.Files)
+
+	if bundle.Objects == 0 {
+		return nil, fmt.Errorf("%w: %s has only folder placeholders", ErrNoURLsMatched, source)
+	}
+
+	return bundle, nil
+}
+
+/*
+	Write bundle as indented JSON
+*/
+func (b *Bundle) Save(path string) error {
+	// URLs stay readable, "&" is not escaped
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(b); err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	// Signed URLs grant access to whoever holds the file
+	if err := os.WriteFile(path, data.Bytes(), 0600); err != nil {
+		return fmt.Errorf("os.WriteFile: %w", err)
+	}
+
+	return nil
+}
+
+/*
+	Read bundle file
+*/
+func LoadBundle(path string) (*Bundle, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile: %w", err)
+	}
+
+	bundle := &Bundle{}
+	if err := json.Unmarshal(data, bundle); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	if bundle.Version != bundleVersion {
+		return nil, fmt.Errorf("bundle %s has unsupported version %d", path, bundle.Version)
+	}
+	if len(bundle.Files) == 0 {
+		return nil, fmt.Errorf("bundle has no files: %s", path)
+	}
+
+	return bundle, nil
+}
+
+/*
+	Run "fetch-bundle" command: download files of bundle into directory, no Google credentials are used
+*/
+func runFetchBundleCommand(args []string) {
+	fs := flag.NewFlagSet("fetch-bundle", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s fetch-bundle [OPTIONS] bundle.json directory\n\nOptions:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	errorFormat := fs.String("errors", "text", "Error output format: \"text\" or \"json\" (records on stderr)")
+	timeout := fs.Duration("timeout", 0, "Overall time limit of the command (0 means no limit)")
+	retries := fs.Int("retry-max-attempts", 3, "Maximum attempts per file, 1 disables retries")
+	jobs := fs.Int("j", 4, "Files downloaded in parallel")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *errorFormat != "text" && *errorFormat != "json" {
+		exception(fmt.Errorf("unsupported errors format: %s", *errorFormat))
+	}
+	console.ErrorFormat = *errorFormat
+	if *jobs <= 0 {
+		exception(fmt.Errorf("-j must be positive"))
+	}
+	retry, err := NewRetryPolicy(*retries, time.Second, 30*time.Second, defaultRetryJitter, defaultRetryOn)
+	if err != nil {
+		exception(err)
+	}
+
+	bundle, err := LoadBundle(fs.Arg(0))
+	if err != nil {
+		exception(err)
+	}
+	dir, err := normalizePath(fs.Arg(1))
+	if err != nil {
+		exception(err)
+	}
+
+	ctx, cancel := context.WithCancel(serviceCtx)
+	if *timeout > 0 {
+		ctx, cancel = context.WithTimeout(serviceCtx, *timeout)
+	}
+	defer cancel()
+
+	if err := bundle.Fetch(ctx, dir, *jobs, retry); err != nil {
+		exception(err)
+	}
+	console.Printf("Fetched %d files (%s) into %s\n", bundle.Objects, formatBytes(bundle.Bytes), dir)
+}
+
+/*
+	Download files of bundle into directory with workers, first error stops the others
+*/
+func (b *Bundle) Fetch(ctx context.Context, dir string, workers int, retry *RetryPolicy) error {
+	if time.Now().After(b.Expires) {
+		return fmt.Errorf("%w at %s, ask for new one", ErrBundleExpired, b.Expires.Format(time.RFC3339))
+	}
+
+	// Names come from bundle file and may try to escape directory
+	destinations := make([]string, len(b.Files))
+	for i, f := range b.Files {
+		destination, err := safeJoin(dir, filepath.FromSlash(f.Name), false)
+		if err != nil {
+			return err
+		}
+		destinations[i] = destination
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var jobErr error
+
+	jobs := make(chan int, len(b.Files))
+	for i := range b.Files {
+		jobs <- i
+	}
+	close(jobs)
+
+	for w := 0; w < workers && w < len(b.Files); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				if err := fetchBundleFile(ctx, b.Files[i], destinations[i], retry); err != nil {
+					once.Do(func() {
+						jobErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return jobErr
+}
+
+/*
+	Download one file of bundle with retries, checked by size and checksums of bundle
+*/
+func fetchBundleFile(ctx context.Context, f *BundleFile, destination string, retry *RetryPolicy) error {
+	for attempt := 1; ; attempt++ {
+		err := downloadSignedURL(ctx, f, destination)
+		if err == nil {
+			console.Printf("Fetched %s => %s\n", f.Name, destination)
+			return nil
+		}
+		if attempt >= retry.MaxAttempts || !retry.ShouldRetry(err) {
+			return &TransferError{Object: f.Source, Attempt: attempt, Err: err}
+		}
+
+		delay := retry.Delay(attempt+1, err)
+		console.Printf("Retrying %s in %s (attempt %d/%d): %v\n", f.Name, delay, attempt+1, retry.MaxAttempts, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return &TransferError{Object: f.Source, Attempt: attempt, Err: ctx.Err()}
+		}
+	}
+}
+
+func downloadSignedURL(ctx context.Context, f *BundleFile, destination string) error {
+	t := &Transfer{Destination: destination}
+	var err error
+	if t.Bucket, t.Object, err = parseGCSUrl(f.Source); err != nil {
+		return err
+	}
+	if t.MD5, err = decodeChecksum(f.MD5, md5.Size); err != nil {
+		return fmt.Errorf("md5: %w", err)
+	}
+	if t.CRC32C, err = decodeChecksum(f.CRC32C, crc32.Size); err != nil {
+		return fmt.Errorf("crc32c: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.URL, nil)
+	if err != nil {
+		return fmt.Errorf("http.NewRequest: %w", err)
+	}
+	// Stored gzip data is asked for as is, Go would decompress it behind size and checksums of bundle otherwise
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("http.Get: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Same classification and Retry-After handling as API errors
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &googleapi.Error{Code: resp.StatusCode, Header: resp.Header, Body: string(body),
+			Message: fmt.Sprintf("GET %s: %s", f.Name, http.StatusText(resp.StatusCode))}
+	}
+
+	out, err := LocalSink{}.Create(ctx, t, nil)
+	if err != nil {
+		return err
+	}
+	// Size and checksums are of stored data, gzip objects are decompressed into file like downloads
+	stored := &countingWriter{w: io.Discard}
+	hashed := []io.Writer{stored}
+	checksums := newChecksumWriter(t)
+	if checksums != nil {
+		hashed = append(hashed, checksums)
+	}
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		_, err = copyDecompressed(out, io.TeeReader(resp.Body, io.MultiWriter(hashed...)), make([]byte, 32*1024))
+		if err == nil {
+			_, err = io.Copy(io.MultiWriter(hashed...), resp.Body) // <= bytes after end of gzip stream
+		}
+	} else if _, err = io.Copy(io.MultiWriter(append(hashed, out)...), resp.Body); err != nil {
+		err = fmt.Errorf("io.Copy: %w", err)
+	}
+	if err == nil && stored.n != f.Size {
+		err = fmt.Errorf("%w: %s has %d bytes, expected %d", ErrChecksumMismatch, f.Name, stored.n, f.Size)
+	}
+	if err == nil && checksums != nil {
+		err = checksums.Verify()
+	}
+
+	// Incomplete or corrupted copy must not be left behind
+	if err != nil {
+		out.Abort()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+/*
+	Cancel job on SIGINT (Ctrl-C) or SIGTERM, objects in flight roll back their partial files; second signal exits at once
+*/
+func (s *Storage) HandleCancelSignals() (stop func()) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig, ok := <-signals
+		if !ok {
+			return
+		}
+		s.interrupted.Store(sig)
+		console.Status("")
+		console.Errorf("Canceling on %s, waiting for objects in flight (signal again to exit now)\n", sig)
+		s.Cancel()
+
+		if sig, ok = <-signals; ok {
+			console.Status("")
+			console.Flush()
+			os.Exit(signalExitCode(sig))
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(signals)
+	}
+}
+
+/*
+	Signal which canceled job, nil unless job was interrupted
+*/
+func (s *Storage) Interrupted() os.Signal {
+	sig, _ := s.interrupted.Load().(os.Signal)
+
+	return sig
+}
+
+/*
+	Error of interrupted job with number of objects completed before cancellation
+*/
+func (s *Storage) interruptError(err error) error {
+	progress := s.Status.Progress()
+
+	return fmt.Errorf("canceled by %s after %d of %d objects completed: %w", s.Interrupted(), progress.Done, progress.Total, err)
+}
+
+/*
+	Exit code of process stopped by signal, same as shells report: 128 + signal number
+*/
+func signalExitCode(sig os.Signal) int {
+	if n, ok := sig.(syscall.Signal); ok {
+		return 128 + int(n)
+	}
+
+	return exitFailure
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+	Write contents of objects to stdout, only byte range of each with -range
+*/
+func runCatCommand(args []string) {
+	fs := flag.NewFlagSet("cat", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s cat [OPTIONS] bucket_name/object...\n\nOptions:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	common := addCommandFlags(fs)
+	byteRange := fs.String("range", "", "Bytes to output: \"start-end\" (inclusive), \"start-\" or \"-n\" for last n bytes")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	offset, length, err := parseByteRange(*byteRange)
+	if err != nil {
+		exception(err)
+	}
+
+	type target struct{ uri, bucket, object string }
+	var targets []target
+	for _, uri := range fs.Args() {
+		bucket, object, err := parseGCSUrl(uri)
+		if err != nil {
+			exception(err)
+		}
+		if object == "" || strings.HasSuffix(object, "/") {
+			exception(fmt.Errorf("cat needs object URL: %s", uri))
+		}
+		targets = append(targets, target{uri, bucket, object})
+	}
+
+	console.RedirectStdout(os.Stderr) // <= messages must not mix with object data
+	s, err := common.storage("cat")
+	if err != nil {
+		exception(err)
+	}
+	defer s.Client.Close()
+
+	for _, t := range targets {
+		if err := s.CatObject(os.Stdout, t.bucket, t.object, offset, length); err != nil {
+			exception(err)
+		}
+	}
+}
+
+/*
+	Parse -range value into offset and length of NewRangeReader, negative offset counts from end, -1 length reads to end
+*/
+func parseByteRange(spec string) (int64, int64, error) {
+	if spec == "" {
+		return 0, -1, nil
+	}
+	bounds := strings.SplitN(spec, "-", 2)
+	if len(bounds) != 2 || bounds[0] == "" && bounds[1] == "" {
+		return 0, 0, fmt.Errorf("invalid range %q, want start-end, start- or -n", spec)
+	}
+
+	if bounds[0] == "" {
+		n, err := strconv.ParseInt(bounds[1], 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, fmt.Errorf("invalid range %q: last byte count must be positive", spec)
+		}
+		return -n, -1, nil
+	}
+
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("invalid range %q: start must be non-negative integer", spec)
+	}
+	if bounds[1] == "" {
+		return start, -1, nil
+	}
+	end, err := strconv.ParseInt(bounds[1], 10, 64)
+	if err != nil || end < start {
+		return 0, 0, fmt.Errorf("invalid range %q: end must be integer not less than start", spec)
+	}
+
+	return start, end - start + 1, nil
+}
+
+/*
+	Copy byte range of object to w, retries continue after written bytes of same generation as data can not be taken back
+*/
+func (s *Storage) CatObject(w io.Writer, bucket, object string, offset, length int64) error {
+	uri := fmt.Sprintf("gs://%s/%s", bucket, object)
+	handle := s.Bucket(bucket).Object(object)
+
+	written := int64(0)
+	attempt, err := s.Retry(uri, func() error {
+		remain := int64(-1)
+		if length >= 0 {
+			remain = length - written
+		}
+		sr, err := handle.NewRangeReader(s.Ctx, offset+written, remain)
+		if err != nil {
+			return fmt.Errorf("Object(%q).NewRangeReader: %w", object, err)
+		}
+		defer sr.Close()
+
+		if written == 0 {
+			handle = handle.Generation(sr.Attrs.Generation) // <= never mix generations
+			if offset < 0 {
+				offset, length = sr.Attrs.StartOffset, sr.Remain() // <= suffix is known once object size is
+			}
+		}
+
+		buf := s.Buffers.Get()
+		defer s.Buffers.Put(buf)
+		n, err := io.CopyBuffer(w, s.Bandwidth.Reader(s.Ctx, sr), *buf)
+		written += n
+		if err != nil {
+			return fmt.Errorf("io.CopyBuffer: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return &TransferError{Object: object, Attempt: attempt, Err: err}
+	}
+
+	return nil
+}
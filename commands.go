@@ -0,0 +1,452 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+/*
+	Subcommands by name, each parses own flags into own flag set.
+	Function rather than variable, "service run" runs other subcommands through it
+*/
+func subcommands() map[string]func(args []string) {
+	return map[string]func(args []string){
+		"browse":         runBrowseCommand,
+		"bundle":         runBundleCommand,
+		"cat":            runCatCommand,
+		"config":         runConfigCommand,
+		"cp":             runCopyCommand,
+		"du":             runDiskUsageCommand,
+		"enqueue":        runEnqueueCommand,
+		"export":         runExportCommand,
+		"fetch-bundle":   runFetchBundleCommand,
+		"import":         runImportCommand,
+		"ls":             runListCommand,
+		"rm":             runRemoveCommand,
+		"rsync":          runRsyncCommand,
+		"service":        runServiceCommand,
+		"spot-verify":    runSpotVerifyCommand,
+		"stat":           runStatCommand,
+		"state":          runStateCommand,
+		"verify":         runVerifyCommand,
+		"verify-dataset": runVerifyDatasetCommand,
+		"watch-local":    runWatchLocalCommand,
+	}
+}
+
+/*
+	Run gcs-cp command line like main does
+*/
+func runCommand(args []string) {
+	// Arguments without known subcommand are of cp
+	commands := subcommands()
+	name := "cp"
+	if len(args) > 0 && commands[args[0]] != nil {
+		name, args = args[0], args[1:]
+	}
+	commands[name](args)
+}
+
+type commandFlags struct {
+	config      *string
+	errorFormat *string
+	timeout     *time.Duration
+	retries     *int
+	billing     *string
+}
+
+/*
+	Register flags shared by object subcommands
+*/
+func addCommandFlags(fs *flag.FlagSet) *commandFlags {
+	return &commandFlags{
+		config:      fs.String("config", "", "JSON config file, its credentials and bandwidth sections are used"),
+		errorFormat: fs.String("errors", "text", "Error output format: \"text\" or \"json\" (records on stderr)"),
+		timeout:     fs.Duration("timeout", 0, "Overall time limit of the command (0 means no limit)"),
+		retries:     fs.Int("retry-max-attempts", 3, "Maximum attempts per operation, 1 disables retries"),
+		billing:     fs.String("billing-project", "", "Project billed for requests to requester-pays buckets (userProject)"),
+	}
+}
+
+/*
+	Create storage for subcommand with default transport settings
+*/
+func (cf *commandFlags) storage(command string) (*Storage, error) {
+	cfg, err := cf.newConfig(command)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewStorageWithConfig(cfg)
+}
+
+/*
+	Config of subcommand with default transport settings, commands with more options extend it
+*/
+func (cf *commandFlags) newConfig(command string) (*Config, error) {
+	if *cf.errorFormat != "text" && *cf.errorFormat != "json" {
+		return nil, fmt.Errorf("unsupported errors format: %s", *cf.errorFormat)
+	}
+	console.ErrorFormat = *cf.errorFormat
+
+	fileConfig := &FileConfig{}
+	if *cf.config != "" {
+		var err error
+		if fileConfig, err = LoadFileConfig(*cf.config); err != nil {
+			return nil, err
+		}
+	}
+
+	retry, err := NewRetryPolicy(*cf.retries, time.Second, 30*time.Second, defaultRetryJitter, defaultRetryOn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Config{
+		Command:        command,
+		Retry:          retry,
+		Timeout:        *cf.timeout,
+		BillingProject: *cf.billing,
+		Transport: &TransportConfig{
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+			DialTimeout:         30 * time.Second,
+			Quota:               NewQuotaLimiter(true),
+		},
+		Credentials: fileConfig.Credentials,
+		Bandwidth:   fileConfig.Bandwidth,
+	}, nil
+}
+
+/*
+	List objects and prefixes like a directory, recursively with -r
+*/
+func runListCommand(args []string) {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s ls [OPTIONS] bucket_name[/path]\n\nOptions:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	common := addCommandFlags(fs)
+	recursive := fs.Bool("r", false, "List all objects under prefix instead of one level")
+	long := fs.Bool("l", false, "Long listing: size, storage class, update time and CRC32C of objects, with total")
+	jsonOut := fs.Bool("json", false, "Print one JSON object per entry (NDJSON) with attributes of -l")
+	versions := fs.Bool("a", false, "List noncurrent generations of objects too, URLs get \"#generation\" suffix")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	bucket, prefix, err := parseGCSUrl(fs.Arg(0))
+	if err != nil {
+		exception(err)
+	}
+
+	s, err := common.storage("ls")
+	if err != nil {
+		exception(err)
+	}
+	defer s.Client.Close()
+
+	if err := s.CheckAccess(bucket, permList); err != nil {
+		exception(err)
+	}
+
+	var entries []*storage.ObjectAttrs
+	attempt, err := s.Retry(fs.Arg(0), func() error {
+		if *versions {
+			entries, err = s.ListVersions(bucket, listingPrefix(prefix), *recursive)
+		} else {
+			entries, err = s.ListLevel(bucket, listingPrefix(prefix), *recursive)
+		}
+		return err
+	})
+	if err != nil {
+		exception(&TransferError{Object: fs.Arg(0), Attempt: attempt, Err: err})
+	}
+	if len(entries) == 0 {
+		exception(fmt.Errorf("%w: %s", ErrNoURLsMatched, fs.Arg(0)))
+	}
+
+	objects, bytes := 0, int64(0)
+	for _, attrs := range entries {
+		if attrs.Prefix == "" {
+			objects++
+			bytes += attrs.Size
+		}
+		// Generation URLs can be copied as they are, "gs://bucket/object#generation"
+		suffix := ""
+		if *versions && attrs.Prefix == "" {
+			suffix = fmt.Sprintf("#%d", attrs.Generation)
+		}
+		if *jsonOut {
+			entry := NewListEntry(bucket, attrs)
+			entry.URL += suffix
+			line, err := json.Marshal(entry)
+			if err != nil {
+				exception(fmt.Errorf("json.Marshal: %w", err))
+			}
+			console.Printf("%s\n", line)
+			continue
+		}
+		console.Printf("%s%s\n", formatListEntry(bucket, attrs, *long), suffix) // <= URL ends both formats
+	}
+	if *long && !*jsonOut {
+		console.Printf("TOTAL: %d objects, %d bytes (%s)\n", objects, bytes, formatBytes(bytes))
+	}
+}
+
+// Entry of "ls -json", prefixes of one level listing have URL only
+type ListEntry struct {
+	URL          string     `json:"url"`
+	Prefix       bool       `json:"prefix,omitempty"`
+	Size         int64      `json:"size"`
+	StorageClass string     `json:"storage_class,omitempty"`
+	Updated      *time.Time `json:"updated,omitempty"`
+	CRC32C       string     `json:"crc32c,omitempty"` // <= base64, as shown by gsutil
+	Generation   int64      `json:"generation,omitempty"`
+}
+
+/*
+	Describe listed object or prefix
+*/
+func NewListEntry(bucket string, attrs *storage.ObjectAttrs) *ListEntry {
+	if attrs.Prefix != "" {
+		return &ListEntry{URL: fmt.Sprintf("gs://%s/%s", bucket, attrs.Prefix), Prefix: true}
+	}
+
+	return &ListEntry{
+		URL:          fmt.Sprintf("gs://%s/%s", bucket, attrs.Name),
+		Size:         attrs.Size,
+		StorageClass: attrs.StorageClass,
+		Updated:      &attrs.Updated,
+		CRC32C:       encodeCRC32C(attrs.CRC32C),
+		Generation:   attrs.Generation,
+	}
+}
+
+/*
+	Line of listing, long format aligns attributes before URL like "gsutil ls -l"
+*/
+func formatListEntry(bucket string, attrs *storage.ObjectAttrs, long bool) string {
+	entry := NewListEntry(bucket, attrs)
+	if !long {
+		return entry.URL
+	}
+	if entry.Prefix {
+		return fmt.Sprintf("%56s%s", "", entry.URL) // <= "directory" of one level listing
+	}
+
+	return fmt.Sprintf("%12d  %s  %-8s  %s  %s", entry.Size, entry.Updated.UTC().Format(time.RFC3339),
+		entry.StorageClass, entry.CRC32C, entry.URL)
+}
+
+func encodeCRC32C(sum uint32) string {
+	b := make([]byte, crc32.Size)
+	binary.BigEndian.PutUint32(b, sum)
+
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+/*
+	List objects by prefix, without recursion deeper prefixes are returned as entries with Prefix set
+*/
+func (s *Storage) ListLevel(bucket, prefix string, recursive bool) ([]*storage.ObjectAttrs, error) {
+	return s.listLevel(bucket, prefix, recursive, false)
+}
+
+/*
+	Listing of ListLevel with noncurrent generations, each object's generations follow its name
+*/
+func (s *Storage) ListVersions(bucket, prefix string, recursive bool) ([]*storage.ObjectAttrs, error) {
+	return s.listLevel(bucket, prefix, recursive, true)
+}
+
+func (s *Storage) listLevel(bucket, prefix string, recursive, versions bool) ([]*storage.ObjectAttrs, error) {
+	ctx, cancel := s.listContext()
+	defer cancel()
+
+	query := &storage.Query{Prefix: prefix, Versions: versions}
+	if !recursive {
+		query.Delimiter = "/"
+	}
+
+	var entries []*storage.ObjectAttrs
+	it := s.Bucket(bucket).Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Bucket(%q).Objects: %w", bucket, err)
+		}
+		entries = append(entries, attrs)
+	}
+}
+
+/*
+	Delete objects given by URL, all objects under prefixes with -r
+*/
+func runRemoveCommand(args []string) {
+	fs := flag.NewFlagSet("rm", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s rm [OPTIONS] bucket_name/object...\n", os.Args[0])
+		fmt.Printf("       %s rm -r [OPTIONS] bucket_name[/prefix]...\n\nOptions:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	common := addCommandFlags(fs)
+	recursive := fs.Bool("r", false, "Delete all objects under given prefixes")
+	isMultiThread := fs.Bool("m", false, "Delete objects in parallel")
+	jobs := fs.Int("j", 0, "Workers pool size of parallel deletion (defaults to number of CPUs), implies -m")
+	confirmObjects := fs.Int("confirm-objects", 100, "Ask for confirmation before deleting more objects (0 never asks)")
+	force := fs.Bool("force", false, "Delete without confirmation, needed when stdin is not a terminal")
+	batch := fs.Int("batch", defaultDeleteBatch, fmt.Sprintf("Objects deleted per batch request, at most %d", maxDeleteBatch))
+	maxQPS := fs.Float64("max-qps", 0, "Maximum object deletions per second, batched ones count each (0 is not limited)")
+	continueOnError := fs.Bool("continue-on-error", false, "Keep deleting after failed batches, print table of failed objects at end")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *jobs < 0 {
+		exception(fmt.Errorf("-j must be positive"))
+	}
+	if *batch < 1 || *batch > maxDeleteBatch {
+		exception(fmt.Errorf("-batch must be between 1 and %d", maxDeleteBatch))
+	}
+	if *maxQPS < 0 {
+		exception(fmt.Errorf("-max-qps must not be negative"))
+	}
+
+	// All URLs are checked before anything is deleted
+	type target struct{ uri, bucket, object string }
+	var targets []target
+	for _, uri := range fs.Args() {
+		bucket, object, err := parseGCSUrl(uri)
+		if err != nil {
+			exception(err)
+		}
+		if object == "" && !*recursive {
+			exception(fmt.Errorf("rm needs object URL, not bucket: %s (-r deletes all objects)", uri))
+		}
+		targets = append(targets, target{uri, bucket, object})
+	}
+
+	cfg, err := common.newConfig("rm")
+	if err != nil {
+		exception(err)
+	}
+	cfg.isMultiThread = *isMultiThread || *jobs > 0
+	cfg.Jobs = *jobs
+	cfg.MaxQPS = *maxQPS
+	cfg.ContinueOnError = *continueOnError
+	s, err := NewStorageWithConfig(cfg)
+	if err != nil {
+		exception(err)
+	}
+	defer s.Client.Close()
+
+	checked := map[string]bool{}
+	for _, t := range targets {
+		if !checked[t.bucket] {
+			if err := s.CheckAccess(t.bucket, permDelete); err != nil {
+				exception(err)
+			}
+			checked[t.bucket] = true
+		}
+	}
+
+	var removals []*Transfer
+	for _, t := range targets {
+		if !*recursive {
+			removals = append(removals, &Transfer{Bucket: t.bucket, Object: t.object})
+			continue
+		}
+		listed, err := s.ListRemovals(t.bucket, t.object)
+		if err != nil {
+			exception(err)
+		}
+		if len(listed) == 0 {
+			exception(fmt.Errorf("%w: %s", ErrNoURLsMatched, t.uri))
+		}
+		removals = append(removals, listed...)
+	}
+
+	if *confirmObjects > 0 && len(removals) > *confirmObjects && !*force {
+		if err := confirm(fmt.Sprintf("Delete %d objects?", len(removals)), os.Stdin); err != nil {
+			exception(err)
+		}
+	}
+
+	if err := s.RemoveObjects(removals, *batch); err != nil {
+		var failures *FailuresError
+		if errors.As(err, &failures) {
+			printFailures(failures)
+		}
+		exception(err)
+	}
+	console.Printf("Operation completed over %d objects.\n", len(removals))
+}
+
+/*
+	Objects deleted by "rm -r": object named by prefix and all objects under it, not those merely sharing its start
+*/
+func (s *Storage) ListRemovals(bucket, prefix string) ([]*Transfer, error) {
+	var entries []*storage.ObjectAttrs
+	attempt, err := s.Retry(fmt.Sprintf("gs://%s/%s", bucket, prefix), func() (err error) {
+		entries, err = s.ListLevel(bucket, prefix, true)
+		return err
+	})
+	if err != nil {
+		return nil, &TransferError{Object: prefix, Attempt: attempt, Err: err}
+	}
+
+	dir := strings.TrimSuffix(prefix, "/") + "/"
+	var removals []*Transfer
+	for _, attrs := range entries {
+		if prefix == "" || attrs.Name == prefix || strings.HasPrefix(attrs.Name, dir) {
+			removals = append(removals, &Transfer{Bucket: bucket, Object: attrs.Name})
+		}
+	}
+
+	return removals, nil
+}
+
+/*
+	Delete object with retries, object missing on retry was deleted by lost attempt
+*/
+func (s *Storage) RemoveObject(bucket, object string) error {
+	uri := fmt.Sprintf("gs://%s/%s", bucket, object)
+
+	attempt, err := s.Retry(uri, func() error {
+		ctx, cancel := s.objectContext()
+		defer cancel()
+
+		if err := s.Bucket(bucket).Object(object).Delete(ctx); err != nil {
+			return s.explainImmutable(ctx, bucket, object, fmt.Errorf("Object(%q).Delete: %w", object, err))
+		}
+		return nil
+	})
+	if err != nil && attempt > 1 && errors.Is(err, storage.ErrObjectNotExist) {
+		return nil
+	}
+	if err != nil {
+		return &TransferError{Object: object, Attempt: attempt, Err: err}
+	}
+
+	return nil
+}
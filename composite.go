@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+/*
+	Number of components of composite object generation, 0 for objects uploaded at once; storage client does not expose it
+*/
+func (s *Storage) ComponentCount(ctx context.Context, bucket, object string, generation int64) (int64, error) {
+	query := url.Values{"fields": {"componentCount"}}
+	if generation != 0 {
+		query.Set("generation", fmt.Sprint(generation))
+	}
+	uri := s.bucketURL(bucket, "o/"+url.PathEscape(object), query)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return 0, fmt.Errorf("http.NewRequest: %w", err)
+	}
+	_, hc := s.route(bucket)
+	resp, err := hc.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("Object(%q).componentCount: %w", object, err)
+	}
+	defer resp.Body.Close()
+
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return 0, fmt.Errorf("Object(%q).componentCount: %w", object, err)
+	}
+
+	var attrs struct {
+		ComponentCount int64 `json:"componentCount"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&attrs); err != nil {
+		return 0, fmt.Errorf("json.Decode: %w", err)
+	}
+
+	return attrs.ComponentCount, nil
+}
+
+/*
+	Attributes of downloaded generation, read again when listing describes other generation or there was none
+*/
+func (s *Storage) generationAttrs(ctx context.Context, t *Transfer, generation int64) (*storage.ObjectAttrs, error) {
+	// Listing attributes may describe other generation, URL list entries have none
+	if t.Attrs != nil && t.Attrs.Generation == generation {
+		return t.Attrs, nil
+	}
+
+	attrs, err := s.Bucket(t.Bucket).Object(t.Object).Generation(generation).Attrs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Object(%q).Attrs: %w", t.Object, err)
+	}
+
+	return attrs, nil
+}
+
+/*
+	Expected checksums of downloaded generation, objects without MD5 (e.g. composite) have CRC32C only
+*/
+func (s *Storage) objectChecksums(ctx context.Context, t *Transfer, generation int64) (*Transfer, error) {
+	attrs, err := s.generationAttrs(ctx, t, generation)
+	if err != nil {
+		return nil, err
+	}
+
+	expected := *t
+	expected.MD5 = attrs.MD5
+	expected.CRC32C = make([]byte, 4)
+	binary.BigEndian.PutUint32(expected.CRC32C, attrs.CRC32C)
+
+	return &expected, nil
+}
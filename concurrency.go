@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+)
+
+type ConcurrencyRule struct {
+	Buckets string `json:"buckets"`          // <= bucket name pattern, e.g. "prod-*"
+	Prefix  string `json:"prefix,omitempty"` // <= object name prefix, empty matches all objects
+	Max     int    `json:"max"`              // <= parallel downloads of all matching objects
+}
+
+type ConcurrencyLimit struct {
+	Rule  *ConcurrencyRule
+	slots chan struct{}
+}
+
+/*
+	Validate concurrency rule
+*/
+func (cr *ConcurrencyRule) Check() error {
+	if _, err := path.Match(cr.Buckets, ""); err != nil || cr.Buckets == "" {
+		return fmt.Errorf("invalid buckets pattern: %q", cr.Buckets)
+	}
+	if cr.Max < 1 {
+		return fmt.Errorf("buckets %q: \"max\" must be positive", cr.Buckets)
+	}
+
+	return nil
+}
+
+/*
+	Create limits for concurrency rules, in config order
+*/
+func NewConcurrencyLimits(rules []*ConcurrencyRule) []*ConcurrencyLimit {
+	limits := make([]*ConcurrencyLimit, 0, len(rules))
+	for _, rule := range rules {
+		limits = append(limits, &ConcurrencyLimit{Rule: rule, slots: make(chan struct{}, rule.Max)})
+	}
+
+	return limits
+}
+
+/*
+	Wait for free slot of first rule matching object, returned function releases it
+*/
+func (s *Storage) acquireSlot(ctx context.Context, t *Transfer) (func(), error) {
+	for _, limit := range s.Limits {
+		if ok, _ := path.Match(limit.Rule.Buckets, t.Bucket); !ok || !strings.HasPrefix(t.Object, limit.Rule.Prefix) {
+			continue
+		}
+
+		select {
+		case limit.slots <- struct{}{}:
+			return func() { <-limit.slots }, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return func() {}, nil
+}
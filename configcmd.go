@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const redacted = "<redacted>"
+
+// Secrets of config file and headers, printed as redacted
+var secretFields = map[string]bool{"password": true, "webhook_url": true}
+
+// Variables changing behaviour of job besides flags and config file
+var configEnvironment = []string{"GOOGLE_APPLICATION_CREDENTIALS", "STORAGE_EMULATOR_HOST", "GOMEMLIMIT"}
+
+/*
+	Run "config" command: validate file or print merged configuration
+*/
+func runConfigCommand(args []string) {
+	usage := func() {
+		fmt.Printf("Usage: %s config validate file\n", os.Args[0])
+		fmt.Printf("       %s config print-effective [browse|verify] [OPTIONS] ARGUMENTS\n", os.Args[0])
+		fmt.Println("\nOptions and arguments of print-effective are those of cp, browse or verify command, nothing is transferred.")
+	}
+	if len(args) == 0 {
+		usage()
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "validate":
+		if len(args) != 2 {
+			usage()
+			os.Exit(1)
+		}
+		fc, err := LoadFileConfig(args[1])
+		if err != nil {
+			exception(err)
+		}
+		console.Printf("Config %s is valid: %d credentials, %d concurrency, %d mirrors, %d bandwidth rules, notify %t, prices %t\n",
+			args[1], len(fc.Credentials), len(fc.Concurrency), len(fc.Mirrors), len(fc.Bandwidth), fc.Notify != nil, fc.Prices != nil)
+	case "print-effective":
+		// Flags are checked like for real job, invalid combination is reported the same way
+		name, args := "cp", args[1:]
+		if len(args) > 0 && (args[0] == "cp" || args[0] == "browse" || args[0] == "verify") {
+			name, args = args[0], args[1:]
+		}
+		cfg := NewConfig(name, args)
+		var out strings.Builder
+		encoder := json.NewEncoder(&out)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(effectiveConfig(cfg)); err != nil {
+			exception(fmt.Errorf("json.Encode: %w", err))
+		}
+		console.Printf("%s", out.String())
+	default:
+		usage()
+		os.Exit(1)
+	}
+}
+
+/*
+	Merged configuration with environment it depends on, secrets are redacted
+*/
+func effectiveConfig(cfg *Config) map[string]interface{} {
+	config := effectiveValue(reflect.ValueOf(cfg)).(map[string]interface{})
+	config["MultiThread"] = cfg.isMultiThread
+	// Raw command line is already merged, it may hold secret headers
+	delete(config, "CommandFlags")
+	delete(config, "CommandArgs")
+
+	environment := map[string]string{"endpoint": jsonEndpoint()}
+	for _, name := range configEnvironment {
+		if value, ok := os.LookupEnv(name); ok {
+			environment[name] = value
+		}
+	}
+
+	return map[string]interface{}{"config": config, "environment": environment}
+}
+
+/*
+	Convert value to JSON-friendly form, fields are named by json tag where there is one
+*/
+func effectiveValue(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+
+	switch value := v.Interface().(type) {
+	case time.Duration:
+		return value.String()
+	case *url.URL:
+		if value == nil {
+			return nil
+		}
+		return value.String()
+	case *regexp.Regexp:
+		if value == nil {
+			return nil
+		}
+		return value.String()
+	case HeaderFlags:
+		headers := map[string][]string{}
+		for name, values := range value {
+			if http.CanonicalHeaderKey(name) == "Authorization" {
+				values = []string{redacted}
+			}
+			headers[name] = values
+		}
+		return headers
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return effectiveValue(v.Elem())
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			items[i] = effectiveValue(v.Index(i))
+		}
+		return items
+	case reflect.Map:
+		items := map[string]interface{}{}
+		for _, key := range v.MapKeys() {
+			items[fmt.Sprint(key.Interface())] = effectiveValue(v.MapIndex(key))
+		}
+		return items
+	case reflect.Struct:
+		fields := map[string]interface{}{}
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.PkgPath != "" {
+				continue // <= unexported
+			}
+			name := field.Name
+			if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag != "" && tag != "-" {
+				name = tag
+			}
+			if secretFields[name] && !v.Field(i).IsZero() {
+				fields[name] = redacted
+				continue
+			}
+			fields[name] = effectiveValue(v.Field(i))
+		}
+		return fields
+	}
+
+	return v.Interface()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type FileConfig struct {
+	Notify      *NotifyConfig      `json:"notify,omitempty"`
+	Credentials []*CredentialRule  `json:"credentials,omitempty"`
+	Concurrency []*ConcurrencyRule `json:"concurrency,omitempty"`
+	Mirrors     []*MirrorRule      `json:"mirrors,omitempty"`
+	Bandwidth   []*BandwidthRule   `json:"bandwidth,omitempty"`
+	Prices      *PriceTable        `json:"prices,omitempty"` // <= of -estimate-cost, merged into defaults
+}
+
+/*
+	Load JSON config file, unknown fields are rejected to catch typos
+*/
+func LoadFileConfig(path string) (*FileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile: %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	fc := &FileConfig{}
+	if err := decoder.Decode(fc); err != nil {
+		// Syntax and type errors know their position, others stop where decoder is
+		offset := decoder.InputOffset()
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			offset = syntaxErr.Offset
+		case errors.As(err, &typeErr):
+			offset = typeErr.Offset
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			// Decoder is past value of unknown field, its key is found backwards
+			key := strings.TrimPrefix(err.Error(), "json: unknown field ")
+			if i := bytes.LastIndex(data[:offset], []byte(key)); i >= 0 {
+				offset = int64(i)
+			}
+		}
+		return nil, fmt.Errorf("config %s:%d: %w", path, lineOf(data, offset), err)
+	}
+
+	if fc.Notify != nil {
+		if err := fc.Notify.Check(); err != nil {
+			return nil, fmt.Errorf("config %s:%d: notify: %w", path, sectionLine(data, "notify", -1), err)
+		}
+	}
+
+	for i, rule := range fc.Credentials {
+		if err := rule.Check(); err != nil {
+			return nil, fmt.Errorf("config %s:%d: credentials %d: %w", path, sectionLine(data, "credentials", i), i+1, err)
+		}
+	}
+
+	for i, rule := range fc.Concurrency {
+		if err := rule.Check(); err != nil {
+			return nil, fmt.Errorf("config %s:%d: concurrency %d: %w", path, sectionLine(data, "concurrency", i), i+1, err)
+		}
+	}
+
+	for i, rule := range fc.Mirrors {
+		if err := rule.Check(); err != nil {
+			return nil, fmt.Errorf("config %s:%d: mirrors %d: %w", path, sectionLine(data, "mirrors", i), i+1, err)
+		}
+	}
+
+	for i, rule := range fc.Bandwidth {
+		if err := rule.Check(); err != nil {
+			return nil, fmt.Errorf("config %s:%d: bandwidth %d: %w", path, sectionLine(data, "bandwidth", i), i+1, err)
+		}
+	}
+
+	if fc.Prices != nil {
+		if err := fc.Prices.Check(); err != nil {
+			return nil, fmt.Errorf("config %s:%d: prices: %w", path, sectionLine(data, "prices", -1), err)
+		}
+	}
+
+	return fc, nil
+}
+
+/*
+	Line number of byte offset, starting with 1
+*/
+func lineOf(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+/*
+	Line of top-level section or of its element with index, 0 if not found
+*/
+func sectionLine(data []byte, section string, index int) int {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if t, err := decoder.Token(); err != nil || t != json.Delim('{') {
+		return 0
+	}
+
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return 0
+		}
+		start := decoder.InputOffset()
+		if key != section {
+			var skip json.RawMessage
+			if decoder.Decode(&skip) != nil {
+				return 0
+			}
+			continue
+		}
+		if index < 0 {
+			return lineOf(data, start+leadingSpace(data[start:]))
+		}
+
+		// Offsets point behind previous token, element starts after whitespace and comma
+		if t, err := decoder.Token(); err != nil || t != json.Delim('[') {
+			return 0
+		}
+		for i := 0; decoder.More(); i++ {
+			start := decoder.InputOffset()
+			if i == index {
+				return lineOf(data, start+leadingSpace(data[start:]))
+			}
+			var skip json.RawMessage
+			if decoder.Decode(&skip) != nil {
+				return 0
+			}
+		}
+		return 0
+	}
+
+	return 0
+}
+
+func leadingSpace(data []byte) int64 {
+	return int64(len(data) - len(bytes.TrimLeft(data, " \t\r\n,:")))
+}
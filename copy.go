@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+	Check if both arguments are GCS URLs, objects are copied server-side
+*/
+func isBucketCopy(source, destination string) bool {
+	return strings.HasPrefix(source, "gs://") && strings.HasPrefix(destination, "gs://")
+}
+
+/*
+	Plan copies of listed objects, object names are kept under destination prefix like under local path
+*/
+func (s *Storage) PlanCopies() ([]*Transfer, error) {
+	if err := s.CheckAccess(s.Config.BucketName, permList, permGet); err != nil {
+		return nil, err
+	}
+	if err := s.CheckAccess(s.Config.DestBucket, permCreate); err != nil {
+		return nil, err
+	}
+
+	objects, err := s.ListObjects()
+	if err != nil {
+		return nil, &TransferError{Object: s.Config.Uri, Attempt: 1, Err: err}
+	}
+
+	prefix := s.Config.DestPrefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	transfers := make([]*Transfer, 0, len(objects))
+	for _, attrs := range objects {
+		object := prefix + attrs.Name
+		if attrs.Bucket == s.Config.DestBucket && object == attrs.Name {
+			return nil, fmt.Errorf("gs://%s/%s would be copied onto itself", attrs.Bucket, attrs.Name)
+		}
+		transfers = append(transfers, &Transfer{
+			Bucket:      attrs.Bucket,
+			Object:      attrs.Name,
+			Destination: fmt.Sprintf("gs://%s/%s", s.Config.DestBucket, object),
+			Attrs:       attrs,
+		})
+	}
+
+	return transfers, nil
+}
+
+/*
+	Copy objects sequentially or with workers pool, stops on first error
+*/
+func (s *Storage) CopyObjects(transfers []*Transfer) error {
+	return s.RunTransfers(transfers, s.TransferCopy)
+}
+
+/*
+	Copy object with pausing, retries and progress tracking
+*/
+func (s *Storage) TransferCopy(t *Transfer) error {
+	return s.RetryTransfer(t, s.CopyObject)
+}
+
+/*
+	Copy listed generation of object to destination URL with rewrite calls, data does not pass through this machine
+*/
+func (s *Storage) CopyObject(t *Transfer) (err error) {
+	bucket, object, err := parseGCSUrl(t.Destination)
+	if err != nil {
+		return err
+	}
+
+	size := int64(-1)
+	src := s.Bucket(t.Bucket).Object(t.Object)
+	if t.Attrs != nil {
+		size = t.Attrs.Size
+		src = src.Generation(t.Attrs.Generation)
+	}
+	ctx, deadline := s.NewObjectDeadline(s.Ctx, size)
+	defer deadline.Stop()
+	defer func() {
+		err = deadline.Err(err)
+	}()
+
+	progress := s.Status.Start(t.URI())
+	atomic.StoreInt64(&progress.Size, size)
+	s.Printf(t.URI(), "Copying %s => %s\n", t.URI(), t.Destination)
+
+	// Large or cross-location objects take several rewrite calls
+	copier := s.Bucket(bucket).Object(object).CopierFrom(src)
+	copier.ProgressFunc = func(copied, total uint64) {
+		atomic.StoreInt64(&progress.Written, int64(copied))
+	}
+
+	attrs, err := copier.Run(ctx)
+	if err != nil {
+		return s.explainImmutable(ctx, bucket, object, fmt.Errorf("Object(%q).CopierFrom: %w", object, err))
+	}
+	atomic.StoreInt64(&progress.Written, attrs.Size)
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+const (
+	defaultEgressNetwork = "internet"
+	gib                  = float64(1 << 30)
+)
+
+// Storage classes of price table, legacy classes are billed as STANDARD
+var storageClasses = []string{"STANDARD", "NEARLINE", "COLDLINE", "ARCHIVE"}
+
+/*
+	Prices of "prices" config section, missing entries keep defaults
+*/
+type PriceTable struct {
+	Currency  string             `json:"currency,omitempty"`
+	Egress    map[string]float64 `json:"egress_per_gib,omitempty"`    // <= by destination network of -egress-network
+	Retrieval map[string]float64 `json:"retrieval_per_gib,omitempty"` // <= by storage class of source object
+	ClassA    map[string]float64 `json:"class_a_per_10k,omitempty"`   // <= writes (uploads, copies) by storage class
+	ClassB    map[string]float64 `json:"class_b_per_10k,omitempty"`   // <= reads (downloads) by storage class
+}
+
+type CostEstimate struct {
+	Network    string
+	Currency   string
+	Objects    int
+	Unknown    int   // <= objects without listing size, their bytes are not counted
+	Bytes      int64 // <= leaving bucket over network, downloads and copies only
+	Egress     float64
+	Retrieval  float64
+	Operations float64
+	Classes    map[string]int64 // <= bytes read by storage class
+}
+
+/*
+	USD list prices of multi-region buckets, to be replaced by those of contract in config file
+*/
+func DefaultPrices() *PriceTable {
+	return &PriceTable{
+		Currency:  "USD",
+		Egress:    map[string]float64{"internet": 0.12, "same-region": 0, "same-continent": 0.02, "cross-continent": 0.08},
+		Retrieval: map[string]float64{"STANDARD": 0, "NEARLINE": 0.01, "COLDLINE": 0.02, "ARCHIVE": 0.05},
+		ClassA:    map[string]float64{"STANDARD": 0.05, "NEARLINE": 0.10, "COLDLINE": 0.20, "ARCHIVE": 0.50},
+		ClassB:    map[string]float64{"STANDARD": 0.004, "NEARLINE": 0.01, "COLDLINE": 0.10, "ARCHIVE": 0.50},
+	}
+}
+
+/*
+	Check prices of config file, they must not be negative and storage classes must be known
+*/
+func (p *PriceTable) Check() error {
+	for name, prices := range map[string]map[string]float64{"retrieval_per_gib": p.Retrieval, "class_a_per_10k": p.ClassA, "class_b_per_10k": p.ClassB} {
+		for class, price := range prices {
+			if !knownStorageClass(class) {
+				return fmt.Errorf("%s: unknown storage class %q, want one of %s", name, class, strings.Join(storageClasses, ", "))
+			}
+			if price < 0 || math.IsNaN(price) {
+				return fmt.Errorf("%s: %s price must not be negative", name, class)
+			}
+		}
+	}
+	for network, price := range p.Egress {
+		if price < 0 || math.IsNaN(price) {
+			return fmt.Errorf("egress_per_gib: %s price must not be negative", network)
+		}
+	}
+
+	return nil
+}
+
+/*
+	Default prices with those of config file, nil file prices keep defaults
+*/
+func mergePrices(file *PriceTable) *PriceTable {
+	prices := DefaultPrices()
+	if file == nil {
+		return prices
+	}
+
+	if file.Currency != "" {
+		prices.Currency = file.Currency
+	}
+	for _, m := range []struct{ dst, src map[string]float64 }{
+		{prices.Egress, file.Egress}, {prices.Retrieval, file.Retrieval}, {prices.ClassA, file.ClassA}, {prices.ClassB, file.ClassB},
+	} {
+		for key, price := range m.src {
+			m.dst[key] = price
+		}
+	}
+
+	return prices
+}
+
+/*
+	Check -egress-network against price table
+*/
+func (p *PriceTable) CheckNetwork(network string) error {
+	if _, ok := p.Egress[network]; ok {
+		return nil
+	}
+	networks := make([]string, 0, len(p.Egress))
+	for name := range p.Egress {
+		networks = append(networks, name)
+	}
+	sort.Strings(networks)
+
+	return fmt.Errorf("unknown egress network %q, want one of %s (egress_per_gib of config)", network, strings.Join(networks, ", "))
+}
+
+/*
+	Multiply planned bytes and operations of command by prices: downloads pay egress, retrieval and reads,
+	copies pay egress, retrieval and writes, uploads writes only
+*/
+func (p *PriceTable) Estimate(command, network string, transfers []*Transfer) *CostEstimate {
+	e := &CostEstimate{Network: network, Currency: p.Currency, Classes: map[string]int64{}}
+	operations := map[string]int{} // <= by storage class
+
+	for _, t := range transfers {
+		e.Objects++
+		class := "STANDARD"
+		size := int64(-1)
+		if t.Attrs != nil {
+			size = t.Attrs.Size
+			if knownStorageClass(t.Attrs.StorageClass) {
+				class = t.Attrs.StorageClass
+			}
+		}
+		operations[class]++
+
+		if command == "upload" {
+			continue
+		}
+		if size < 0 {
+			e.Unknown++
+			continue
+		}
+		e.Bytes += size
+		e.Classes[class] += size
+		e.Retrieval += float64(size) / gib * p.Retrieval[class]
+	}
+
+	e.Egress = float64(e.Bytes) / gib * p.Egress[network]
+	ops := p.ClassB
+	if command == "upload" || command == "copy" {
+		ops = p.ClassA
+	}
+	for class, n := range operations {
+		e.Operations += float64(n) / 10000 * ops[class]
+	}
+
+	return e
+}
+
+/*
+	Estimate of planned transfers with prices of config and -egress-network
+*/
+func (s *Storage) EstimateCost(transfers []*Transfer) *CostEstimate {
+	return s.Config.Prices.Estimate(s.Config.Command, s.Config.EgressNetwork, transfers)
+}
+
+func knownStorageClass(class string) bool {
+	for _, known := range storageClasses {
+		if class == known {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (e *CostEstimate) Total() float64 {
+	return e.Egress + e.Retrieval + e.Operations
+}
+
+/*
+	Estimate lines, bytes by storage class show expensive retrievals
+*/
+func (e *CostEstimate) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Estimated cost: %.2f %s for %d objects (egress %.2f for %s to %s, retrieval %.2f, operations %.2f)\n",
+		e.Total(), e.Currency, e.Objects, e.Egress, formatBytes(e.Bytes), e.Network, e.Retrieval, e.Operations)
+	for _, class := range storageClasses[1:] {
+		if e.Classes[class] > 0 {
+			fmt.Fprintf(&b, "  %s retrieval: %s\n", class, formatBytes(e.Classes[class]))
+		}
+	}
+	if e.Unknown > 0 {
+		fmt.Fprintf(&b, "  %d objects of unknown size are not counted\n", e.Unknown)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+
+	"cloud.google.com/go/storage"
+)
+
+type CredentialRule struct {
+	Buckets   string `json:"buckets"`             // <= bucket name pattern, e.g. "org-a-*"
+	File      string `json:"file,omitempty"`      // <= service account or authorized user JSON key
+	Anonymous bool   `json:"anonymous,omitempty"` // <= public buckets
+}
+
+type ClientRoute struct {
+	Pattern string
+	Client  *storage.Client
+	HTTP    *http.Client
+}
+
+/*
+	Validate credential rule
+*/
+func (cr *CredentialRule) Check() error {
+	if _, err := path.Match(cr.Buckets, ""); err != nil || cr.Buckets == "" {
+		return fmt.Errorf("invalid buckets pattern: %q", cr.Buckets)
+	}
+	if (cr.File == "") == !cr.Anonymous {
+		return fmt.Errorf("buckets %q: exactly one of \"file\" or \"anonymous\" is required", cr.Buckets)
+	}
+
+	return nil
+}
+
+/*
+	Create storage clients for credential rules, in config order
+*/
+func newClientRoutes(ctx context.Context, cfg *Config) ([]*ClientRoute, error) {
+	var routes []*ClientRoute
+	for _, rule := range cfg.Credentials {
+		var credentials credentialMinter // <= nil for anonymous rule
+		if !rule.Anonymous {
+			credentials = fileCredentials(rule.File)
+		}
+
+		hc, err := newHTTPClient(ctx, cfg.Transport, credentials)
+		if err != nil {
+			return nil, fmt.Errorf("buckets %q: %w", rule.Buckets, err)
+		}
+		client, err := storage.NewClient(ctx, clientOptions(hc)...)
+		if err != nil {
+			return nil, fmt.Errorf("buckets %q: storage.NewClient: %w", rule.Buckets, err)
+		}
+
+		routes = append(routes, &ClientRoute{Pattern: rule.Buckets, Client: client, HTTP: hc})
+	}
+
+	return routes, nil
+}
+
+/*
+	Pick client by bucket name, first matching credential rule wins
+*/
+func (s *Storage) route(bucket string) (*storage.Client, *http.Client) {
+	for _, r := range s.Routes {
+		if ok, _ := path.Match(r.Pattern, bucket); ok {
+			return r.Client, r.HTTP
+		}
+	}
+
+	return s.Client, s.HTTP
+}
+
+/*
+	Bucket handle authenticated with credentials of the bucket, requests are billed to -billing-project when set
+*/
+func (s *Storage) Bucket(name string) *storage.BucketHandle {
+	client, _ := s.route(name)
+
+	bucket := client.Bucket(name)
+	if s.Config.BillingProject != "" {
+		bucket = bucket.UserProject(s.Config.BillingProject)
+	}
+
+	return bucket
+}
+
+/*
+	URL of raw JSON API request on resource of bucket, billed to -billing-project like requests of bucket handles
+*/
+func (s *Storage) bucketURL(bucket, resource string, query url.Values) string {
+	if query == nil {
+		query = url.Values{}
+	}
+	if s.Config.BillingProject != "" {
+		query.Set("userProject", s.Config.BillingProject)
+	}
+
+	return fmt.Sprintf("%sb/%s/%s?%s", s.Endpoint, url.PathEscape(bucket), resource, query.Encode())
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+const customTimeMtime = "mtime" // <= -custom-time value taking modification time of each uploaded file
+
+/*
+	Check -custom-time value: RFC 3339 time or "mtime"
+*/
+func parseCustomTime(value string) (time.Time, error) {
+	if value == "" || value == customTimeMtime {
+		return time.Time{}, nil
+	}
+	ct, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid -custom-time %q, want RFC 3339 time or %q", value, customTimeMtime)
+	}
+
+	return ct, nil
+}
+
+/*
+	Custom time of uploaded object: planned one restored from dataset, else of -custom-time; zero sets none
+*/
+func (s *Storage) uploadCustomTime(t *Transfer, info os.FileInfo) time.Time {
+	if t.Attrs != nil && !t.Attrs.CustomTime.IsZero() {
+		return t.Attrs.CustomTime
+	}
+	if s.Config.CustomTime == customTimeMtime {
+		return info.ModTime()
+	}
+	ct, _ := parseCustomTime(s.Config.CustomTime) // <= checked with flags
+
+	return ct
+}
+
+/*
+	Set modification time of downloaded file: object modification time with -preserve-mtime, custom time of object
+	with -mtime-from-custom-time; files of objects without one keep download time
+*/
+func (s *Storage) RestoreMtime(ctx context.Context, t *Transfer, path string, generation int64) error {
+	attrs, err := s.generationAttrs(ctx, t, generation)
+	if err != nil {
+		return err
+	}
+
+	var mtime time.Time
+	if s.Config.PreserveMtime {
+		mtime = objectMtime(attrs)
+	}
+	if s.Config.MtimeFromCustomTime && !attrs.CustomTime.IsZero() {
+		mtime = attrs.CustomTime
+	}
+	if mtime.IsZero() {
+		return nil
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		return fmt.Errorf("os.Chtimes: %w", err)
+	}
+
+	return nil
+}
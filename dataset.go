@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	datasetData     = "data"          // <= directory of exported objects
+	datasetManifest = "manifest.json" // <= usable as -manifest to download dataset again
+	datasetInfo     = "dataset.json"
+	importReport    = "import-report.json"
+	signatureSuffix = ".sig" // <= detached signature next to signed file
+)
+
+var ErrDatasetInvalid = errors.New("dataset invalid")
+
+type DatasetEntry struct {
+	ManifestEntry            // <= destination is slash-separated path relative to dataset directory
+	Size          int64      `json:"size"`
+	Generation    int64      `json:"generation"`
+	CustomTime    *time.Time `json:"custom_time,omitempty"`      // <= restored by import
+	Encoding      string     `json:"content_encoding,omitempty"` // <= "gzip" files are stored data, restored by import
+}
+
+type DatasetInfo struct {
+	Source   string    `json:"source"`
+	Exported time.Time `json:"exported"`
+	Objects  int       `json:"objects"`
+	Bytes    int64     `json:"bytes"`
+	Verify   string    `json:"verify"` // <= command checking files against manifest
+}
+
+/*
+	Objects created by "import" from dataset, signed by service account of import
+*/
+type ImportReport struct {
+	Dataset     string        `json:"dataset"` // <= source of export
+	Exported    time.Time     `json:"exported"`
+	Destination string        `json:"destination"`
+	Imported    time.Time     `json:"imported"`
+	Objects     int           `json:"objects"`
+	Bytes       int64         `json:"bytes"`
+	SignedBy    string        `json:"signed_by"`
+	KeyID       string        `json:"key_id"`
+	Entries     []ImportEntry `json:"entries"`
+}
+
+type ImportEntry struct {
+	Source           string `json:"source"` // <= object of export
+	SourceGeneration int64  `json:"source_generation"`
+	Object           string `json:"object"`
+	Generation       int64  `json:"generation"` // <= created by import, checked after all uploads
+	Size             int64  `json:"size"`
+	MD5              string `json:"md5,omitempty"`
+	CRC32C           string `json:"crc32c"`
+}
+
+type DatasetReport struct {
+	Files      int
+	Missing    []string
+	Mismatched []string
+	Unexpected []string // <= files under data directory not in manifest
+}
+
+/*
+	Run "export" command: download objects with manifest of checksums and generations
+*/
+func runExportCommand(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s export [OPTIONS] bucket_name[/path] directory\n\nOptions:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	common := addCommandFlags(fs)
+	isMultiThread := fs.Bool("m", false, "Run command in multi-threading mode")
+	jobs := fs.Int("j", 0, "Workers pool size of multi-threading mode (defaults to number of CPUs), implies -m")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *jobs < 0 {
+		exception(fmt.Errorf("-j must be positive"))
+	}
+
+	cfg, err := common.newConfig("export")
+	if err != nil {
+		exception(err)
+	}
+	cfg.Uri = fs.Arg(0)
+	if cfg.BucketName, cfg.Prefix, err = parseGCSUrl(cfg.Uri); err != nil {
+		exception(err)
+	}
+	if hasGlob(cfg.Prefix) {
+		if cfg.Glob, err = compileGlob(cfg.Prefix); err != nil {
+			exception(err)
+		}
+	}
+	dir, err := normalizePath(fs.Arg(1))
+	if err != nil {
+		exception(err)
+	}
+	cfg.DestinationPath = filepath.Join(dir, datasetData)
+	cfg.isMultiThread = *isMultiThread || *jobs > 0
+	cfg.Jobs = *jobs
+	cfg.CreateDirs = true
+	cfg.OnConflict = "fail"
+	cfg.NameCase = "preserve"
+	cfg.ReconnectAttempts = 5
+	cfg.NoDecompress = true // <= files of stored gzip objects match checksums of manifest
+
+	s, err := NewStorageWithConfig(cfg)
+	if err != nil {
+		exception(err)
+	}
+	defer s.Client.Close()
+
+	transfers, err := s.ExportDataset(dir)
+	if err != nil {
+		s.Abort(transfers, err)
+	}
+	console.Printf("Exported %d objects to %s, verify with: %s verify-dataset %s\n", len(transfers), dir, os.Args[0], dir)
+}
+
+/*
+	Download listed objects into data directory of dataset, verified by listing checksums, then write manifest
+*/
+func (s *Storage) ExportDataset(dir string) ([]*Transfer, error) {
+	transfers, err := s.Plan()
+	if err != nil {
+		return nil, err
+	}
+
+	// Listed checksums are kept in manifest, downloaded data must match them
+	var entries []DatasetEntry
+	info := DatasetInfo{Source: s.Config.Uri, Exported: time.Now().UTC(), Verify: "gcs-cp verify-dataset ."}
+	for _, t := range transfers {
+		if t.Directory {
+			continue
+		}
+		t.MD5 = t.Attrs.MD5
+		t.CRC32C = make([]byte, crc32.Size)
+		binary.BigEndian.PutUint32(t.CRC32C, t.Attrs.CRC32C)
+
+		rel, err := filepath.Rel(dir, t.Destination)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, DatasetEntry{
+			ManifestEntry: ManifestEntry{
+				Source:      t.URI(),
+				Destination: filepath.ToSlash(rel),
+				MD5:         base64.StdEncoding.EncodeToString(t.MD5),
+				CRC32C:      base64.StdEncoding.EncodeToString(t.CRC32C),
+			},
+			Size:       t.Attrs.Size,
+			Generation: t.Attrs.Generation,
+			Encoding:   t.Attrs.ContentEncoding,
+		})
+		if !t.Attrs.CustomTime.IsZero() {
+			entries[len(entries)-1].CustomTime = &t.Attrs.CustomTime
+		}
+		info.Objects++
+		info.Bytes += t.Attrs.Size
+	}
+
+	if err := s.DownloadObjects(transfers); err != nil {
+		return transfers, err
+	}
+
+	// Manifest is written last, dataset without it is incomplete
+	if err := writeJSONFile(filepath.Join(dir, datasetInfo), info); err != nil {
+		return transfers, err
+	}
+	if err := writeJSONFile(filepath.Join(dir, datasetManifest), entries); err != nil {
+		return transfers, err
+	}
+
+	return transfers, nil
+}
+
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("json.MarshalIndent: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0666); err != nil {
+		return fmt.Errorf("os.WriteFile: %w", err)
+	}
+
+	return nil
+}
+
+/*
+	Run "verify-dataset" command: check exported files against manifest, no GCS access needed
+*/
+func runVerifyDatasetCommand(args []string) {
+	if len(args) != 1 || strings.HasPrefix(args[0], "-") {
+		fmt.Printf("Usage: %s verify-dataset directory\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	report, err := VerifyDataset(args[0])
+	if err != nil {
+		exception(err)
+	}
+	for _, name := range report.Missing {
+		console.Printf("Missing %s\n", name)
+	}
+	for _, name := range report.Mismatched {
+		console.Printf("Mismatched %s\n", name)
+	}
+	for _, name := range report.Unexpected {
+		console.Printf("Unexpected %s\n", name)
+	}
+
+	if problems := len(report.Missing) + len(report.Mismatched) + len(report.Unexpected); problems > 0 {
+		exception(fmt.Errorf("%w: %d of %d files missing or mismatched, %d unexpected", ErrDatasetInvalid,
+			len(report.Missing)+len(report.Mismatched), report.Files, len(report.Unexpected)))
+	}
+	console.Printf("Verified %d files of %s\n", report.Files, args[0])
+}
+
+/*
+	Compare files of dataset directory with sizes and checksums of its manifest
+*/
+func VerifyDataset(dir string) (*DatasetReport, error) {
+	entries, err := loadDatasetManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &DatasetReport{Files: len(entries)}
+	known := map[string]bool{}
+	buf := make([]byte, 1<<20)
+
+	for i, entry := range entries {
+		fpath, err := safeJoin(dir, entry.Destination, false)
+		if err != nil {
+			return nil, fmt.Errorf("manifest %s entry %d: %w", datasetManifest, i+1, err)
+		}
+		known[fpath] = true
+
+		expected := &Transfer{Object: entry.Destination}
+		if expected.MD5, err = decodeChecksum(entry.MD5, md5.Size); err != nil {
+			return nil, fmt.Errorf("manifest %s entry %d: %w", datasetManifest, i+1, err)
+		}
+		if expected.CRC32C, err = decodeChecksum(entry.CRC32C, crc32.Size); err != nil {
+			return nil, fmt.Errorf("manifest %s entry %d: %w", datasetManifest, i+1, err)
+		}
+
+		same, err := sameFile(fpath, entry.Size, expected, buf)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			report.Missing = append(report.Missing, entry.Destination)
+		case err != nil:
+			return nil, err
+		case !same:
+			report.Mismatched = append(report.Mismatched, entry.Destination)
+		}
+	}
+
+	err = filepath.WalkDir(filepath.Join(dir, datasetData), func(fpath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && !known[fpath] {
+			rel, _ := filepath.Rel(dir, fpath)
+			report.Unexpected = append(report.Unexpected, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("filepath.WalkDir: %w", err)
+	}
+	sort.Strings(report.Unexpected)
+
+	return report, nil
+}
+
+/*
+	Compare local file with expected size and checksums
+*/
+func sameFile(fpath string, size int64, expected *Transfer, buf []byte) (bool, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return false, fmt.Errorf("os.Stat: %w", err)
+	}
+	if info.Size() != size {
+		return false, nil
+	}
+
+	checksums := newChecksumWriter(expected)
+	if checksums == nil {
+		return true, nil
+	}
+	if _, err := io.CopyBuffer(checksums, f, buf); err != nil {
+		return false, fmt.Errorf("io.CopyBuffer: %w", err)
+	}
+
+	return checksums.Verify() == nil, nil
+}
+
+/*
+	Run "import" command: upload files of verified dataset under prefix and write signed report of created objects
+*/
+func runImportCommand(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s import [OPTIONS] directory bucket_name[/path]\n\nOptions:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	common := addCommandFlags(fs)
+	isMultiThread := fs.Bool("m", false, "Run command in multi-threading mode")
+	jobs := fs.Int("j", 0, "Workers pool size of multi-threading mode (defaults to number of CPUs), implies -m")
+	output := fs.String("o", "", "Import report to write, signature is written next to it (defaults to "+importReport+" in directory)")
+	keyFile := fs.String("key-file", "", "Service account JSON key signing report (defaults to GOOGLE_APPLICATION_CREDENTIALS)")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *jobs < 0 {
+		exception(fmt.Errorf("-j must be positive"))
+	}
+
+	// Key is checked before uploads, unsigned report proves nothing
+	signer, err := NewURLSigner(*keyFile)
+	if err != nil {
+		exception(err)
+	}
+
+	dir, err := normalizePath(fs.Arg(0))
+	if err != nil {
+		exception(err)
+	}
+	cfg, err := common.newConfig("import")
+	if err != nil {
+		exception(err)
+	}
+	cfg.Uri = fs.Arg(1)
+	if cfg.BucketName, cfg.Prefix, err = parseGCSUrl(cfg.Uri); err != nil {
+		exception(err)
+	}
+	cfg.isMultiThread = *isMultiThread || *jobs > 0
+	cfg.Jobs = *jobs
+
+	s, err := NewStorageWithConfig(cfg)
+	if err != nil {
+		exception(err)
+	}
+	defer s.Client.Close()
+
+	report, err := s.ImportDataset(dir)
+	if err != nil {
+		s.Abort(nil, err)
+	}
+
+	path := *output
+	if path == "" {
+		path = filepath.Join(dir, importReport)
+	}
+	if err := report.Save(path, signer); err != nil {
+		exception(err)
+	}
+	console.Printf("Imported %d objects (%s) to %s, signed report written to %s\n",
+		report.Objects, formatBytes(report.Bytes), cfg.Uri, path)
+}
+
+/*
+	Verify dataset, upload its files under prefix and check created objects against manifest
+*/
+func (s *Storage) ImportDataset(dir string) (*ImportReport, error) {
+	verified, err := VerifyDataset(dir)
+	if err != nil {
+		return nil, err
+	}
+	if problems := len(verified.Missing) + len(verified.Mismatched); problems > 0 {
+		return nil, fmt.Errorf("%w: %d of %d files missing or mismatched, run verify-dataset %s", ErrDatasetInvalid,
+			problems, verified.Files, dir)
+	}
+
+	entries, err := loadDatasetManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	info := DatasetInfo{}
+	if data, err := os.ReadFile(filepath.Join(dir, datasetInfo)); err == nil {
+		json.Unmarshal(data, &info)
+	}
+
+	prefix := s.Config.Prefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	transfers := make([]*Transfer, 0, len(entries))
+	for i, entry := range entries {
+		rel := strings.TrimPrefix(entry.Destination, datasetData+"/")
+		if rel == entry.Destination {
+			return nil, fmt.Errorf("manifest %s entry %d: %s is not under %s", datasetManifest, i+1, entry.Destination, datasetData)
+		}
+		t := s.newUpload(filepath.Join(dir, filepath.FromSlash(entry.Destination)), prefix+rel, entry.Size)
+		t.MD5, _ = decodeChecksum(entry.MD5, md5.Size) // <= checked by verification of dataset
+		t.CRC32C, _ = decodeChecksum(entry.CRC32C, crc32.Size)
+		if entry.CustomTime != nil {
+			t.Attrs.CustomTime = *entry.CustomTime
+		}
+		t.Attrs.ContentEncoding = entry.Encoding
+		transfers = append(transfers, t)
+	}
+
+	if err := s.UploadObjects(transfers); err != nil {
+		return nil, err
+	}
+
+	// Objects are read back once all are uploaded, overwritten or altered ones are found
+	report := &ImportReport{
+		Dataset:     info.Source,
+		Exported:    info.Exported,
+		Destination: s.Config.Uri,
+		Imported:    time.Now().UTC(),
+	}
+	for i, t := range transfers {
+		generation := t.Attrs.Generation
+		attrs, err := s.Bucket(t.Bucket).Object(t.Object).Attrs(s.Ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Object(%q).Attrs: %w", t.Object, err)
+		}
+		if attrs.Generation != generation {
+			return nil, fmt.Errorf("%w: %s has generation %d, import created %d", ErrDatasetInvalid, t.URI(), attrs.Generation, generation)
+		}
+		crc := make([]byte, crc32.Size)
+		binary.BigEndian.PutUint32(crc, attrs.CRC32C)
+		if attrs.Size != entries[i].Size || (len(t.CRC32C) > 0 && !bytes.Equal(crc, t.CRC32C)) || (len(t.MD5) > 0 && !bytes.Equal(attrs.MD5, t.MD5)) {
+			return nil, fmt.Errorf("%w: %s differs from manifest entry %s", ErrChecksumMismatch, t.URI(), entries[i].Destination)
+		}
+
+		report.Entries = append(report.Entries, ImportEntry{
+			Source:           entries[i].Source,
+			SourceGeneration: entries[i].Generation,
+			Object:           t.URI(),
+			Generation:       generation,
+			Size:             attrs.Size,
+			MD5:              entries[i].MD5,
+			CRC32C:           entries[i].CRC32C,
+		})
+		report.Objects++
+		report.Bytes += attrs.Size
+	}
+
+	return report, nil
+}
+
+/*
+	Write report and its detached signature "<path>.sig"
+*/
+func (r *ImportReport) Save(path string, signer *URLSigner) error {
+	r.SignedBy, r.KeyID = signer.AccessID, signer.KeyID
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("json.MarshalIndent: %w", err)
+	}
+	data = append(data, '\n')
+	signature, err := signer.SignBytes(data)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path, data, 0666); err != nil {
+		return fmt.Errorf("os.WriteFile: %w", err)
+	}
+	if err := os.WriteFile(path+signatureSuffix, signature, 0666); err != nil {
+		return fmt.Errorf("os.WriteFile: %w", err)
+	}
+
+	return nil
+}
+
+/*
+	Read entries of dataset manifest
+*/
+func loadDatasetManifest(dir string) ([]DatasetEntry, error) {
+	data, err := os.ReadFile(filepath.Join(dir, datasetManifest))
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile: %w", err)
+	}
+	var entries []DatasetEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("manifest %s: %w", datasetManifest, err)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+type AttemptRecord struct {
+	Attempt  int       `json:"attempt"`
+	Started  time.Time `json:"started"`
+	Duration string    `json:"duration"`
+	Code     string    `json:"code"`
+	Message  string    `json:"message"`
+}
+
+type DeadLetter struct {
+	Time        time.Time       `json:"time"`
+	URI         string          `json:"uri"`
+	Destination string          `json:"destination,omitempty"`
+	Code        string          `json:"code"`
+	Retryable   bool            `json:"retryable"`
+	Message     string          `json:"message"`
+	Attempts    int             `json:"attempts"`
+	History     []AttemptRecord `json:"history"`
+	TraceID     string          `json:"trace_id,omitempty"`
+}
+
+type DeadLetterLog struct {
+	mu      sync.Mutex
+	path    string
+	out     *os.File
+	traceID string
+}
+
+/*
+	Create dead-letter log, file is opened for appending on first record
+*/
+func NewDeadLetterLog(path, traceID string) *DeadLetterLog {
+	return &DeadLetterLog{path: path, traceID: traceID}
+}
+
+/*
+	Append record of permanently failed object as JSON line
+*/
+func (dl *DeadLetterLog) Add(t *Transfer, err error, history []AttemptRecord) error {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	if dl.out == nil {
+		out, err := os.OpenFile(dl.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("os.OpenFile: %w", err)
+		}
+		dl.out = out
+	}
+
+	line, err := json.Marshal(DeadLetter{
+		Time:        time.Now().UTC(),
+		URI:         t.URI(),
+		Destination: t.Destination,
+		Code:        errorCode(err),
+		Retryable:   isRetryable(err),
+		Message:     err.Error(),
+		Attempts:    len(history),
+		History:     history,
+		TraceID:     dl.traceID,
+	})
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+
+	if _, err := dl.out.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("os.Write: %w", err)
+	}
+
+	return nil
+}
+
+/*
+	Close dead-letter file if it was opened
+*/
+func (dl *DeadLetterLog) Close() error {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	if dl.out == nil {
+		return nil
+	}
+
+	return dl.out.Close()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+type ObjectDeadline struct {
+	Timeout    time.Duration // <= limit for object of unknown or zero size, 0 means no limit
+	Throughput int64         // <= minimum bytes per second, 0 keeps fixed timeout
+	Limit      time.Duration // <= current limit since start
+
+	started time.Time
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	expired int32
+}
+
+/*
+	Context of one listing, limited by -list-timeout when set
+*/
+func (s *Storage) listContext() (context.Context, context.CancelFunc) {
+	if s.Config.ListTimeout > 0 {
+		return context.WithTimeout(s.Ctx, s.Config.ListTimeout)
+	}
+
+	return context.WithCancel(s.Ctx)
+}
+
+/*
+	Context of one metadata request on object, limited by -object-timeout when set
+*/
+func (s *Storage) objectContext() (context.Context, context.CancelFunc) {
+	if s.Config.ObjectTimeout > 0 {
+		return context.WithTimeout(s.Ctx, s.Config.ObjectTimeout)
+	}
+
+	return context.WithCancel(s.Ctx)
+}
+
+/*
+	Create context of one object download attempt limited by object size and minimum throughput
+*/
+func (s *Storage) NewObjectDeadline(parent context.Context, size int64) (context.Context, *ObjectDeadline) {
+	ctx, cancel := context.WithCancel(parent)
+	d := &ObjectDeadline{
+		Timeout:    s.Config.ObjectTimeout,
+		Throughput: s.Config.MinThroughput,
+		started:    time.Now(),
+		cancel:     cancel,
+	}
+
+	// Timer instead of context deadline, size may be known only once reader is open
+	d.Limit = d.limit(size)
+	if d.Limit > 0 {
+		d.timer = time.AfterFunc(d.Limit, func() {
+			atomic.StoreInt32(&d.expired, 1)
+			cancel()
+		})
+	}
+
+	return ctx, d
+}
+
+/*
+	Time allowed for object of given size, negative size means unknown
+*/
+func (d *ObjectDeadline) limit(size int64) time.Duration {
+	if d.Timeout <= 0 {
+		return 0
+	}
+	if size <= 0 || d.Throughput <= 0 {
+		return d.Timeout
+	}
+
+	return d.Timeout + time.Duration(float64(size)/float64(d.Throughput)*float64(time.Second))
+}
+
+/*
+	Recompute limit once object size is known
+*/
+func (d *ObjectDeadline) SetSize(size int64) {
+	limit := d.limit(size)
+	if d.timer == nil || limit == d.Limit || atomic.LoadInt32(&d.expired) == 1 {
+		return
+	}
+
+	if d.timer.Stop() {
+		d.Limit = limit
+		d.timer.Reset(time.Until(d.started.Add(limit)))
+	}
+}
+
+/*
+	Release timer and context of finished attempt
+*/
+func (d *ObjectDeadline) Stop() {
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.cancel()
+}
+
+/*
+	Report expired deadline as timeout instead of cancellation, so attempt may be retried
+*/
+func (d *ObjectDeadline) Err(err error) error {
+	if err == nil || atomic.LoadInt32(&d.expired) == 0 {
+		return err
+	}
+
+	return fmt.Errorf("%w: %s", ErrObjectTimeout, d.Limit.Round(time.Second))
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+type DiskUsage struct {
+	URL     string
+	Objects int64
+	Bytes   int64
+}
+
+/*
+	Total object sizes per "directory" one level below prefixes, only of prefixes with -s
+*/
+func runDiskUsageCommand(args []string) {
+	fs := flag.NewFlagSet("du", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s du [OPTIONS] bucket_name[/path]...\n\nOptions:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	common := addCommandFlags(fs)
+	summary := fs.Bool("s", false, "Print only total of each prefix")
+	human := fs.Bool("h", false, "Print sizes in human-readable units (KiB, MiB, ...)")
+	jobs := fs.Int("j", 0, "Prefixes totaled in parallel (defaults to number of CPUs)")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *jobs < 0 {
+		exception(fmt.Errorf("-j must be positive"))
+	}
+
+	type target struct{ uri, bucket, prefix string }
+	var targets []target
+	for _, uri := range fs.Args() {
+		bucket, prefix, err := parseGCSUrl(uri)
+		if err != nil {
+			exception(err)
+		}
+		targets = append(targets, target{uri, bucket, listingPrefix(prefix)})
+	}
+
+	cfg, err := common.newConfig("du")
+	if err != nil {
+		exception(err)
+	}
+	cfg.Jobs = *jobs
+	s, err := NewStorageWithConfig(cfg)
+	if err != nil {
+		exception(err)
+	}
+	defer s.Client.Close()
+
+	for _, t := range targets {
+		if err := s.CheckAccess(t.bucket, permList); err != nil {
+			exception(err)
+		}
+		entries, total, err := s.PrefixUsage(t.bucket, t.prefix)
+		if err != nil {
+			exception(err)
+		}
+		if total.Objects == 0 {
+			exception(fmt.Errorf("%w: %s", ErrNoURLsMatched, t.uri))
+		}
+		if !*summary {
+			for _, entry := range entries {
+				console.Printf("%s\n", formatDiskUsage(entry, *human))
+			}
+		}
+		console.Printf("%s\n", formatDiskUsage(total, *human))
+	}
+}
+
+/*
+	Usage of objects and prefixes of delimiter listing, prefixes are totaled by parallel listings; total of whole prefix
+*/
+func (s *Storage) PrefixUsage(bucket, prefix string) ([]*DiskUsage, *DiskUsage, error) {
+	uri := fmt.Sprintf("gs://%s/%s", bucket, prefix)
+
+	var level []*storage.ObjectAttrs
+	attempt, err := s.Retry(uri, func() (err error) {
+		level, err = s.ListLevel(bucket, prefix, false)
+		return err
+	})
+	if err != nil {
+		return nil, nil, &TransferError{Object: prefix, Attempt: attempt, Err: err}
+	}
+
+	entries := make([]*DiskUsage, len(level))
+	var prefixes []int // <= indexes of entries still to be totaled
+	for i, attrs := range level {
+		if attrs.Prefix != "" {
+			entries[i] = &DiskUsage{URL: fmt.Sprintf("gs://%s/%s", bucket, attrs.Prefix)}
+			prefixes = append(prefixes, i)
+			continue
+		}
+		entries[i] = &DiskUsage{URL: fmt.Sprintf("gs://%s/%s", bucket, attrs.Name), Objects: 1, Bytes: attrs.Size}
+	}
+
+	if len(prefixes) > 0 {
+		_, err := s.RunPool(s.PoolSize(len(prefixes)), len(prefixes), func(i int) (int64, error) {
+			entry := entries[prefixes[i]]
+			sub := level[prefixes[i]].Prefix
+			attempt, err := s.Retry(entry.URL, func() (err error) {
+				entry.Objects, entry.Bytes, err = s.sumPrefix(bucket, sub)
+				return err
+			})
+			if err != nil {
+				return 0, &TransferError{Object: sub, Attempt: attempt, Err: err}
+			}
+			return entry.Bytes, nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	total := &DiskUsage{URL: uri}
+	for _, entry := range entries {
+		total.Objects += entry.Objects
+		total.Bytes += entry.Bytes
+	}
+
+	return entries, total, nil
+}
+
+/*
+	Count objects and bytes under prefix, listing is streamed so huge prefixes are not kept in memory
+*/
+func (s *Storage) sumPrefix(bucket, prefix string) (int64, int64, error) {
+	ctx, cancel := s.listContext()
+	defer cancel()
+
+	query := &storage.Query{Prefix: prefix}
+	if err := query.SetAttrSelection([]string{"Name", "Size"}); err != nil {
+		return 0, 0, fmt.Errorf("query.SetAttrSelection: %w", err)
+	}
+
+	objects, bytes := int64(0), int64(0)
+	it := s.Bucket(bucket).Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return objects, bytes, nil
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("Bucket(%q).Objects: %w", bucket, err)
+		}
+		objects++
+		bytes += attrs.Size
+	}
+}
+
+/*
+	Line of du: size aligned before URL
+*/
+func formatDiskUsage(usage *DiskUsage, human bool) string {
+	size := fmt.Sprint(usage.Bytes)
+	if human {
+		size = formatBytes(usage.Bytes)
+	}
+
+	return fmt.Sprintf("%12s  %s", size, usage.URL)
+}
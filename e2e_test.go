@@ -0,0 +1,3673 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+	"practical-test/testsupport"
+)
+
+/*
+	Create storage for source URL served by fake server, configure may adjust defaults
+*/
+func newTestStorage(t *testing.T, srv *testsupport.Server, uri string, configure func(*Config)) *Storage {
+	t.Helper()
+
+	retry, err := NewRetryPolicy(3, 10*time.Millisecond, 50*time.Millisecond, defaultRetryJitter, defaultRetryOn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{
+		Command:         "cp",
+		Uri:             uri,
+		DestinationPath: t.TempDir(),
+		Retry:           retry,
+		Transport: &TransportConfig{
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+			DialTimeout:         30 * time.Second,
+		},
+		CreateDirs:        true,
+		ReconnectAttempts: 5,
+	}
+	if uri != "" {
+		if cfg.BucketName, cfg.Prefix, err = parseGCSUrl(uri); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+
+	// Client and JSON endpoint read emulator host once, when storage is created, uploads need it without scheme
+	restore := setTestEnv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(srv.URL, "http://"))
+	s, err := NewStorageWithConfig(cfg)
+	restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		s.Cancel()
+		s.Client.Close()
+	})
+
+	return s
+}
+
+/*
+	Set environment variable, restore puts back previous value
+*/
+func setTestEnv(key, value string) (restore func()) {
+	prev, had := os.LookupEnv(key)
+	os.Setenv(key, value)
+
+	return func() {
+		if had {
+			os.Setenv(key, prev)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+/*
+	Plan and run transfers like main does, without exiting on failure
+*/
+func runTransfers(s *Storage) error {
+	transfers, err := s.Plan()
+	if err != nil {
+		return err
+	}
+
+	return s.DownloadObjects(transfers)
+}
+
+func assertFile(t *testing.T, path string, want []byte) {
+	t.Helper()
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s: got %d bytes, want %d", path, len(got), len(want))
+	}
+}
+
+func TestE2EDownloadPrefix(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{
+		"data/a.txt":     "alpha",
+		"data/sub/b.txt": "beta",
+		"data/empty/":    "",
+		"other/c.txt":    "gamma",
+	})
+
+	s := newTestStorage(t, srv, "gs://bkt/data", nil)
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := s.Config.DestinationPath
+	assertFile(t, filepath.Join(dest, "data", "a.txt"), []byte("alpha"))
+	assertFile(t, filepath.Join(dest, "data", "sub", "b.txt"), []byte("beta"))
+	if _, err := os.Stat(filepath.Join(dest, "other")); !os.IsNotExist(err) {
+		t.Errorf("object outside of prefix was downloaded: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "data", "empty")); !os.IsNotExist(err) {
+		t.Errorf("folder placeholder was materialized: %v", err)
+	}
+}
+
+func TestE2EGlobListing(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{
+		"dir/a.csv":               "a",
+		"dir/b.json":              "b",
+		"dir/logs/2023-01/c.json": "c",
+		"dir/logs/2024-01/d.json": "d",
+		"dir/2023-02/e.json":      "e",
+	})
+
+	cases := map[string][]string{
+		"gs://bkt/dir/*.csv":            {"dir/a.csv"},
+		"gs://bkt/dir/**/2023-*/*.json": {"dir/2023-02/e.json", "dir/logs/2023-01/c.json"},
+		"gs://bkt/dir/**.json":          {"dir/2023-02/e.json", "dir/b.json", "dir/logs/2023-01/c.json", "dir/logs/2024-01/d.json"},
+		"gs://bkt/dir/[ab].?s*":         {"dir/a.csv", "dir/b.json"},
+		"gs://bkt/dir/logs/202[!3]-*/*": {"dir/logs/2024-01/d.json"},
+	}
+	for uri, want := range cases {
+		glob, err := compileGlob(strings.TrimPrefix(uri, "gs://bkt/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := newTestStorage(t, srv, uri, func(cfg *Config) { cfg.Glob = glob })
+		objects, err := s.ListObjects()
+		if err != nil {
+			t.Fatalf("%s: %v", uri, err)
+		}
+		var names []string
+		for _, attrs := range objects {
+			names = append(names, attrs.Name)
+		}
+		if strings.Join(names, " ") != strings.Join(want, " ") {
+			t.Errorf("%s: got %v, want %v", uri, names, want)
+		}
+	}
+
+	if _, err := compileGlob("dir/[ab.csv"); err == nil {
+		t.Error("unterminated character class was accepted")
+	}
+}
+
+func TestE2EIncludeExclude(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{
+		"dir/a.csv":          "a",
+		"dir/_SUCCESS":       "",
+		"dir/part.tmp":       "t",
+		"dir/logs/b.csv":     "b",
+		"dir/logs/c.tmp":     "c",
+		"dir/tmp-1/d.csv":    "d",
+		"dir/logs/2024/e.gz": "e",
+	})
+
+	cases := []struct {
+		include, exclude []string
+		want             string
+	}{
+		{nil, []string{"*.tmp", "_SUCCESS"}, "dir/a.csv dir/logs/2024/e.gz dir/logs/b.csv dir/tmp-1/d.csv"},
+		{[]string{"*.csv"}, []string{"re:/tmp-[0-9]+/"}, "dir/a.csv dir/logs/b.csv"},
+		{[]string{"dir/logs/**"}, []string{"*.tmp"}, "dir/logs/2024/e.gz dir/logs/b.csv"},
+		{[]string{"re:\\.(gz|tmp)$"}, nil, "dir/logs/2024/e.gz dir/logs/c.tmp dir/part.tmp"},
+	}
+	for _, c := range cases {
+		s := newTestStorage(t, srv, "gs://bkt/dir", func(cfg *Config) {
+			for _, p := range c.include {
+				if err := cfg.Include.Set(p); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, p := range c.exclude {
+				if err := cfg.Exclude.Set(p); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+		objects, err := s.ListObjects()
+		if err != nil {
+			t.Fatalf("%v %v: %v", c.include, c.exclude, err)
+		}
+		var names []string
+		for _, attrs := range objects {
+			names = append(names, attrs.Name)
+		}
+		if got := strings.Join(names, " "); got != c.want {
+			t.Errorf("%v %v: got %s, want %s", c.include, c.exclude, got, c.want)
+		}
+	}
+
+	// Nothing left after filters is reported like unmatched URL
+	s := newTestStorage(t, srv, "gs://bkt/dir", func(cfg *Config) { cfg.Include.Set("*.parquet") })
+	if _, err := s.ListObjects(); !errors.Is(err, ErrNoURLsMatched) {
+		t.Errorf("got %v, want ErrNoURLsMatched", err)
+	}
+	if _, err := ParseNameFilter("re:("); err == nil {
+		t.Error("invalid regular expression was accepted")
+	}
+}
+
+func TestE2EInputListStdin(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{"a.txt": "alpha", "dir/b.txt": "beta", "c.txt": "gamma"})
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+	go func() {
+		fmt.Fprint(w, "gs://bkt/a.txt\n# skipped\n\ngs://bkt/dir/b.txt\ngs://bkt/a.txt\n")
+		w.Close()
+	}()
+
+	s := newTestStorage(t, srv, "", func(cfg *Config) {
+		cfg.InputList = stdinList
+	})
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, filepath.Join(s.Config.DestinationPath, "a.txt"), []byte("alpha"))
+	assertFile(t, filepath.Join(s.Config.DestinationPath, "dir", "b.txt"), []byte("beta"))
+	if _, err := os.Stat(filepath.Join(s.Config.DestinationPath, "c.txt")); err == nil {
+		t.Error("object missing from list was copied")
+	}
+
+	// Destination directory as -I value means list on stdin, list file does not
+	if !pipedListDestination(t.TempDir()) || pipedListDestination("gs://bkt/list.txt") || pipedListDestination(stdinList) {
+		t.Error("wrong -I values taken for destination")
+	}
+	list := filepath.Join(t.TempDir(), "list.txt")
+	os.WriteFile(list, []byte("gs://bkt/a.txt\n"), 0644)
+	if pipedListDestination(list) {
+		t.Error("list file taken for destination")
+	}
+}
+
+func TestE2EDownloadMultiThread(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+
+	fixtures := map[string]string{}
+	for i := 0; i < 50; i++ {
+		fixtures[fmt.Sprintf("logs/%02d.log", i)] = fmt.Sprintf("line %d\n", i)
+	}
+	srv.Seed("bkt", fixtures)
+
+	s := newTestStorage(t, srv, "gs://bkt/logs/", func(cfg *Config) {
+		cfg.isMultiThread = true
+	})
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range fixtures {
+		assertFile(t, filepath.Join(s.Config.DestinationPath, name), []byte(content))
+	}
+	if done, total := s.Status.Done, s.Status.Total; done != 50 || total != 50 {
+		t.Errorf("status: %d/%d objects done, want 50/50", done, total)
+	}
+}
+
+func TestE2EProgressAndQuiet(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{"a.txt": "alpha", "b.txt": "beta"})
+
+	// Per-object messages are dropped with -quiet
+	var out bytes.Buffer
+	console.RedirectStdout(&out)
+	defer console.RedirectStdout(os.Stdout)
+	for _, quiet := range []bool{false, true} {
+		out.Reset()
+		s := newTestStorage(t, srv, "gs://bkt/", func(cfg *Config) {
+			cfg.Quiet = quiet
+		})
+		if err := runTransfers(s); err != nil {
+			t.Fatal(err)
+		}
+		console.Flush()
+		if strings.Contains(out.String(), "Copying") == quiet {
+			t.Errorf("quiet %t: output %q", quiet, out.String())
+		}
+
+		progress := s.Status.Progress()
+		if progress.Done != 2 || progress.Bytes != 9 || progress.TotalBytes != 9 {
+			t.Errorf("progress: %+v", progress)
+		}
+	}
+
+	meter := &rateMeter{}
+	started := time.Now()
+	meter.Update(0, started)
+	rate := meter.Update(4096, started.Add(2*time.Second))
+
+	lines := map[string]string{
+		formatProgress(ProgressSnapshot{Total: 3, Done: 1, Bytes: 1024, TotalBytes: 10240,
+			InFlight: []ObjectProgress{{Name: "gs://bkt/c.bin", Size: 5120, Written: 1024}}}, rate, false): "gs://bkt/c.bin 1.0 KiB/5.0 KiB (20.0%) | 2.0 KiB/s | ETA 2s | object 2/3",
+		formatProgress(ProgressSnapshot{Total: 3, Done: 1, Bytes: 1024, TotalBytes: 10240,
+			InFlight: []ObjectProgress{{}, {}}}, rate, true): "Objects 1/3 | 1.0 KiB/10.0 KiB (10.0%) | 2.0 KiB/s | ETA 5s | 2 in flight",
+		formatProgress(ProgressSnapshot{Total: 3}, 0, true): "Objects 0/3 | 0 B | 0 B/s",
+	}
+	for got, want := range lines {
+		if got != want {
+			t.Errorf("progress line %q, want %q", got, want)
+		}
+	}
+}
+
+func TestE2EReconnectInterruptedDownload(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	srv.Put("bkt", "big.bin", content)
+	srv.Truncate("bkt", "big.bin", 1000)
+
+	s := newTestStorage(t, srv, "gs://bkt/big.bin", nil)
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+
+	assertFile(t, filepath.Join(s.Config.DestinationPath, "big.bin"), content)
+	if n := srv.CountRequests("GET", "/bkt/big.bin"); n != 2 {
+		t.Errorf("got %d media requests, want 2 (initial and range)", n)
+	}
+
+	// Reconnects follow -retry-on like other retries
+	retry, err := NewRetryPolicy(1, 10*time.Millisecond, 50*time.Millisecond, defaultRetryJitter, "5xx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Truncate("bkt", "big.bin", 1000)
+	s = newTestStorage(t, srv, "gs://bkt/big.bin", func(cfg *Config) {
+		cfg.Retry = retry
+	})
+	if err := runTransfers(s); errorCode(err) != "connection_interrupted" {
+		t.Errorf("reconnect without connection_interrupted in -retry-on: %v", err)
+	}
+	if n := srv.CountRequests("GET", "/bkt/big.bin"); n != 3 {
+		t.Errorf("got %d media requests, want 3 (no reconnect)", n)
+	}
+}
+
+func TestE2ERetryInterruptedDownload(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+
+	content := bytes.Repeat([]byte("x"), 100000)
+	srv.Put("bkt", "big.bin", content)
+	srv.Truncate("bkt", "big.bin", 1000)
+
+	s := newTestStorage(t, srv, "gs://bkt/big.bin", func(cfg *Config) {
+		cfg.ReconnectAttempts = 0
+	})
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+
+	assertFile(t, filepath.Join(s.Config.DestinationPath, "big.bin"), content)
+	if n := srv.CountRequests("GET", "/bkt/big.bin"); n != 2 {
+		t.Errorf("got %d media requests, want 2 attempts", n)
+	}
+}
+
+func TestE2ESlicedDownload(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+
+	content := make([]byte, 1<<20+12345)
+	rand.Read(content)
+	srv.Put("bkt", "big.bin", content)
+	srv.Truncate("bkt", "big.bin", 50000)
+
+	s := newTestStorage(t, srv, "gs://bkt/big.bin", func(cfg *Config) {
+		cfg.Slices = 4
+		cfg.SliceSize = 100 << 10
+	})
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+
+	assertFile(t, filepath.Join(s.Config.DestinationPath, "big.bin"), content)
+	// 11 ranges, one of them reconnected
+	if n := srv.CountRequests("GET", "/bkt/big.bin"); n != 12 {
+		t.Errorf("got %d media requests, want 12", n)
+	}
+	if max := srv.MaxConcurrentMedia(); max > 4 {
+		t.Errorf("got %d concurrent media requests, want at most 4", max)
+	}
+}
+
+func TestE2EAutoSlicedDownload(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+
+	content := make([]byte, 20<<20)
+	rand.Read(content)
+	srv.Put("bkt", "big.bin", content)
+
+	var out bytes.Buffer
+	console.RedirectStdout(&out)
+	defer console.RedirectStdout(os.Stdout)
+	s := newTestStorage(t, srv, "gs://bkt/big.bin", func(cfg *Config) {
+		cfg.Slices = 4
+		cfg.SliceSize = 0
+	})
+
+	// Slow stream of 1MiB/s reads 4MiB in slice time, ranges are not smaller than 8MiB
+	s.Streams.Observe(2<<20, 2*time.Second)
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	console.Flush()
+	assertFile(t, filepath.Join(s.Config.DestinationPath, "big.bin"), content)
+	if want := "into 3 parallel ranges of 8.0 MiB (1.0 MiB/s per stream measured)"; !strings.Contains(out.String(), want) {
+		t.Errorf("output %q, want %q", out.String(), want)
+	}
+	if n := srv.CountRequests("GET", "/bkt/big.bin"); n != 3 {
+		t.Errorf("got %d media requests, want 3", n)
+	}
+
+	// Ranges of local server measured fast stream, which reads whole object in slice time
+	if rate, _ := s.Streams.Rate(); rate < 5<<20 {
+		t.Fatalf("got stream rate %.0f, want measured rate above 5MiB/s", rate)
+	}
+	out.Reset()
+	s.Config.DestinationPath = t.TempDir()
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	console.Flush()
+	assertFile(t, filepath.Join(s.Config.DestinationPath, "big.bin"), content)
+	if strings.Contains(out.String(), "Slicing") {
+		t.Errorf("fast stream sliced object: %q", out.String())
+	}
+	if n := srv.CountRequests("GET", "/bkt/big.bin"); n != 4 {
+		t.Errorf("got %d media requests, want 4", n)
+	}
+}
+
+func TestE2EResumePartialDownload(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	srv.Put("bkt", "big.bin", content)
+	srv.Truncate("bkt", "big.bin", 40000)
+
+	s := newTestStorage(t, srv, "gs://bkt/big.bin", func(cfg *Config) {
+		cfg.ReconnectAttempts = 0
+		cfg.Resume = true
+	})
+	fpath := filepath.Join(s.Config.DestinationPath, "big.bin")
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, fpath, content)
+	if _, err := os.Stat(fpath + partialSuffix); !os.IsNotExist(err) {
+		t.Errorf("partial file was left behind: %v", err)
+	}
+
+	// Resumed data is verified together with partial file, corrupt one is not kept
+	generation := srv.Object("bkt", "big.bin").Generation
+	os.Remove(fpath)
+	os.WriteFile(fpath+partialSuffix, bytes.Repeat([]byte("x"), 50000), 0644)
+	os.WriteFile(fpath+resumeSuffix, []byte(fmt.Sprintf(`{"uri":"gs://bkt/big.bin","generation":%d,"offset":50000}`, generation)), 0644)
+	if err := runTransfers(s); errorCode(err) != "checksum_mismatch" {
+		t.Fatalf("got %v, want checksum_mismatch of resumed download", err)
+	}
+	if _, err := os.Stat(fpath + partialSuffix); !os.IsNotExist(err) {
+		t.Errorf("corrupt partial file was kept: %v", err)
+	}
+
+	// Partial data of replaced generation is not resumed
+	os.WriteFile(fpath+partialSuffix, bytes.Repeat([]byte("x"), 50000), 0644)
+	os.WriteFile(fpath+resumeSuffix, []byte(fmt.Sprintf(`{"uri":"gs://bkt/big.bin","generation":%d,"offset":50000}`, generation)), 0644)
+	srv.Put("bkt", "big.bin", content)
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, fpath, content)
+	if _, err := os.Stat(fpath + resumeSuffix); !os.IsNotExist(err) {
+		t.Errorf("resume state was left behind: %v", err)
+	}
+}
+
+func TestE2EResumeVersionedBucket(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Versioned = map[string]bool{"bkt": true}
+
+	first := bytes.Repeat([]byte("0123456789"), 10000)
+	second := bytes.Repeat([]byte("abcdefghij"), 10000)
+	old := srv.Put("bkt", "big.bin", first)
+	live := srv.Put("bkt", "big.bin", second)
+
+	// Replaced generation is still readable as noncurrent one, its partial data is not resumed
+	s := newTestStorage(t, srv, "gs://bkt/big.bin", func(cfg *Config) {
+		cfg.Resume = true
+	})
+	fpath := filepath.Join(s.Config.DestinationPath, "big.bin")
+	writePartial := func(content []byte, generation int64) {
+		os.Remove(fpath)
+		os.WriteFile(fpath+partialSuffix, content[:50000], 0644)
+		os.WriteFile(fpath+resumeSuffix, []byte(fmt.Sprintf(`{"uri":"gs://bkt/big.bin","generation":%d,"offset":50000}`, generation)), 0644)
+	}
+	writePartial(first, old.Generation)
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, fpath, second)
+
+	// Explicit generation is downloaded even though partial data is of live one
+	s = newTestStorage(t, srv, "gs://bkt/big.bin", func(cfg *Config) {
+		cfg.Resume = true
+		cfg.Generation = old.Generation
+	})
+	fpath = filepath.Join(s.Config.DestinationPath, "big.bin")
+	writePartial(second, live.Generation)
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, fpath, first)
+}
+
+func TestE2EInjectedFaults(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	srv.Put("bkt", "big.bin", content)
+
+	faults, err := ParseFaultConfig("truncate=30000,match=big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestStorage(t, srv, "gs://bkt/big.bin", func(cfg *Config) {
+		cfg.Transport.Faults = faults
+	})
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, filepath.Join(s.Config.DestinationPath, "big.bin"), content)
+	if n := srv.CountRequests("GET", "/bkt/big.bin"); n != 4 {
+		t.Errorf("got %d media requests, want 4 for 3 reconnects", n)
+	}
+
+	// Same seed gives same faults
+	pattern := func() string {
+		ft := newFaultTransport(http.DefaultTransport, &FaultConfig{ErrorRate: 0.5, ErrorCode: 503, Seed: 7})
+		var codes []string
+		for i := 0; i < 16; i++ {
+			req, _ := http.NewRequest(http.MethodGet, srv.Endpoint()+"b/bkt", nil)
+			resp, err := ft.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			codes = append(codes, fmt.Sprint(resp.StatusCode))
+		}
+		return strings.Join(codes, " ")
+	}
+	first := pattern()
+	if first != pattern() || !strings.Contains(first, "503") || !strings.Contains(first, "200") {
+		t.Errorf("faults are not deterministic or not mixed: %s", first)
+	}
+
+	if _, err := ParseFaultConfig("error-rate=2"); err == nil {
+		t.Error("error rate above 1 was accepted")
+	}
+}
+
+func TestE2ERetryBackoff(t *testing.T) {
+	policy, err := NewRetryPolicy(5, 100*time.Millisecond, 300*time.Millisecond, 0.5, defaultRetryOn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for attempt := 2; attempt <= 5; attempt++ {
+		backoff := policy.Backoff(attempt)
+		if delay := policy.Delay(attempt, errors.New("reset")); delay < backoff/2 || delay > backoff {
+			t.Errorf("attempt %d: delay %s outside jitter range of %s", attempt, delay, backoff)
+		}
+	}
+	if _, err := NewRetryPolicy(3, time.Second, time.Second, 1.5, defaultRetryOn); err == nil {
+		t.Error("jitter above 1 was accepted")
+	}
+
+	// Retry-After of server wins over shorter backoff, but not over max backoff
+	throttled := &googleapi.Error{Code: 429, Header: http.Header{"Retry-After": {"1"}}}
+	if !policy.ShouldRetry(throttled) {
+		t.Error("429 is not retried")
+	}
+	if delay := policy.Delay(2, throttled); delay != 300*time.Millisecond {
+		t.Errorf("got delay %s, want max backoff 300ms", delay)
+	}
+	policy.MaxBackoff = 5 * time.Second
+	if delay := policy.Delay(2, throttled); delay != time.Second {
+		t.Errorf("got delay %s, want Retry-After of 1s", delay)
+	}
+	if policy.ShouldRetry(&googleapi.Error{Code: 404}) {
+		t.Error("404 is retried")
+	}
+}
+
+func TestE2EQuotaThrottling(t *testing.T) {
+	urls := map[string]string{
+		"http://h/storage/v1/b/bkt/o?alt=json":         "bkt",
+		"http://h/upload/storage/v1/b/bkt/o":           "bkt",
+		"http://h/b/bkt/o/a.txt":                       "bkt",
+		"https://storage.googleapis.com/bkt/dir/a.txt": "bkt",
+		"http://h/storage/v1/b?project=p":              "",
+	}
+	for raw, want := range urls {
+		u, _ := url.Parse(raw)
+		if got := requestBucket(u); got != want {
+			t.Errorf("%s: got bucket %q, want %q", raw, got, want)
+		}
+	}
+	slow := &googleapi.Error{Code: 503, Errors: []googleapi.ErrorItem{{Reason: "slowDown"}}}
+	if code := errorCode(slow); code != "rate_limited" {
+		t.Errorf("503 slowDown: got %s, want rate_limited", code)
+	}
+
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{"a.txt": "alpha", "b.txt": "beta"})
+	srv.Seed("down", map[string]string{"c.txt": "gamma"})
+	srv.Fail("GET", "/b/bkt/o", 429, 1)
+	srv.Fail("GET", "/b/down/o", 503, 1)
+
+	quota := NewQuotaLimiter(false)
+	for _, uri := range []string{"gs://bkt/", "gs://down/"} {
+		s := newTestStorage(t, srv, uri, func(cfg *Config) {
+			cfg.Transport.Quota = quota
+		})
+		if err := runTransfers(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	rate := quota.Rate("bkt", now)
+	if rate < quotaMinRate {
+		t.Fatalf("throttled bucket not limited: rate %g", rate)
+	}
+	// Plain 503 is an outage, only rate limit reasons slow down
+	if got := quota.Rate("down", now); got != 0 {
+		t.Errorf("bucket failing with 503 limited to %g/s", got)
+	}
+
+	// First throttling halves rate of recent requests, concurrent ones do not reduce it again
+	busy := NewQuotaLimiter(false)
+	for i := 0; i < 100; i++ {
+		if err := busy.Wait(context.Background(), "busy"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	busy.Throttled("busy", "rateLimitExceeded", now)
+	rate = busy.Rate("busy", now)
+	if rate < quotaMinRate || rate > 50 {
+		t.Fatalf("100 requests throttled: got rate %g, want at most 50", rate)
+	}
+	busy.Throttled("busy", "rateLimitExceeded", now.Add(100*time.Millisecond))
+	if got := busy.Rate("busy", now); got != rate {
+		t.Errorf("concurrent throttling reduced rate again: %g, want %g", got, rate)
+	}
+	busy.Throttled("busy", "rateLimitExceeded", now.Add(2*quotaHold))
+	if got := busy.Rate("busy", now); got != rate/2 {
+		t.Errorf("later throttling: got rate %g, want %g", got, rate/2)
+	}
+
+	// Probing raises rate until limit is lifted
+	at := now
+	for i := 0; quota.Rate("bkt", at) != 0; i++ {
+		if i > 10 {
+			t.Fatal("limit of bucket is not lifted")
+		}
+		at = at.Add(quotaProbeInterval)
+	}
+}
+
+func TestE2EPermanentListingFailure(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{"a.txt": "alpha"})
+	srv.Fail("GET", "/b/bkt/o", 403, 10)
+
+	s := newTestStorage(t, srv, "gs://bkt/", nil)
+	err := runTransfers(s)
+
+	var terr *TransferError
+	if !errors.As(err, &terr) || errorCode(err) != "permission_denied" {
+		t.Fatalf("got %v, want permission_denied transfer error", err)
+	}
+	if terr.Attempt != 1 || srv.CountRequests("GET", "/b/bkt/o") != 1 {
+		t.Errorf("permanent failure was retried: attempt %d", terr.Attempt)
+	}
+}
+
+func TestE2EBucketAccessCheck(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{"a.txt": "alpha"})
+	srv.Permissions = map[string][]string{"bkt": {"storage.objects.get"}}
+
+	s := newTestStorage(t, srv, "gs://bkt/", nil)
+	err := runTransfers(s)
+	if errorCode(err) != "permission_denied" || err.Error() != "missing storage.objects.list on gs://bkt" {
+		t.Errorf("got %v (%s), want missing storage.objects.list", err, errorCode(err))
+	}
+	if srv.CountRequests("GET", "/b/bkt/o") != 0 {
+		t.Error("bucket was listed without permission")
+	}
+
+	s = newTestStorage(t, srv, "gs://nope/", nil)
+	err = runTransfers(s)
+	if errorCode(err) != "bucket_not_found" || err.Error() != "bucket not found: gs://nope" {
+		t.Errorf("got %v (%s), want bucket not found", err, errorCode(err))
+	}
+}
+
+func TestE2ENoURLsMatched(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{"a.txt": "alpha"})
+
+	s := newTestStorage(t, srv, "gs://bkt/missing/", nil)
+	if err := runTransfers(s); !errors.Is(err, ErrNoURLsMatched) {
+		t.Fatalf("got %v, want %v", err, ErrNoURLsMatched)
+	}
+}
+
+func TestE2ECancel(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.BytesPerSecond = 10000
+	srv.Put("bkt", "slow.bin", make([]byte, 100000))
+
+	s := newTestStorage(t, srv, "gs://bkt/slow.bin", nil)
+	time.AfterFunc(300*time.Millisecond, s.Cancel)
+
+	started := time.Now()
+	err := runTransfers(s)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("cancel took %s", elapsed)
+	}
+	if n := srv.CountRequests("GET", "/bkt/slow.bin"); n != 1 {
+		t.Errorf("canceled download was retried: %d media requests", n)
+	}
+}
+
+func TestE2EAtomicDownload(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.BytesPerSecond = 50000
+	content := bytes.Repeat([]byte("d"), 20000)
+	srv.Put("bkt", "slow.bin", content)
+
+	s := newTestStorage(t, srv, "gs://bkt/slow.bin", nil)
+	fpath := filepath.Join(s.Config.DestinationPath, "slow.bin")
+	os.WriteFile(fpath, []byte("old copy"), 0644)
+
+	// Old copy stays in place until new data is complete
+	var inFlight []string
+	var during []byte
+	checked := make(chan struct{})
+	time.AfterFunc(200*time.Millisecond, func() {
+		inFlight, _ = filepath.Glob(fpath + tempSuffix + "*")
+		during, _ = os.ReadFile(fpath)
+		close(checked)
+	})
+
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	<-checked
+	if len(inFlight) != 1 || string(during) != "old copy" {
+		t.Errorf("while downloading: temp files %v, destination %q", inFlight, during)
+	}
+	assertFile(t, fpath, content)
+	if left, _ := filepath.Glob(fpath + tempSuffix + "*"); len(left) > 0 {
+		t.Errorf("temp files left: %v", left)
+	}
+}
+
+func TestE2ECancelSignal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("interrupt can not be sent to own process on Windows")
+	}
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.BytesPerSecond = 10000
+	srv.Put("bkt", "a.txt", []byte("a"))
+	srv.Put("bkt", "slow.bin", make([]byte, 100000))
+
+	s := newTestStorage(t, srv, "gs://bkt/", nil)
+	defer s.HandleCancelSignals()()
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(300*time.Millisecond, func() { self.Signal(os.Interrupt) })
+
+	err = runTransfers(s)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	if sig := s.Interrupted(); sig != os.Interrupt {
+		t.Fatalf("got signal %v, want %v", sig, os.Interrupt)
+	}
+	if msg := s.interruptError(err).Error(); !strings.HasPrefix(msg, "canceled by interrupt after 1 of 2 objects completed") {
+		t.Errorf("got %q", msg)
+	}
+	assertFile(t, filepath.Join(s.Config.DestinationPath, "a.txt"), []byte("a"))
+	if _, err := os.Stat(filepath.Join(s.Config.DestinationPath, "slow.bin")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("partial file of canceled download was left: %v", err)
+	}
+}
+
+/*
+	Not a test: worker process of -processes started by TestE2EWorkerProcessesCancel
+*/
+func TestWorkerProcess(t *testing.T) {
+	if os.Getenv("GCS_CP_WORKER_PROCESS") != "1" {
+		t.Skip("helper process")
+	}
+
+	args := flag.Args() // <= worker flags and arguments of coordinator follow "--"
+	retry, _ := NewRetryPolicy(3, 10*time.Millisecond, 50*time.Millisecond, defaultRetryJitter, defaultRetryOn)
+	cfg := &Config{
+		Command:         "cp",
+		DestinationPath: args[len(args)-1],
+		Retry:           retry,
+		Transport:       &TransportConfig{DialTimeout: 30 * time.Second},
+		CreateDirs:      true,
+	}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-worker=") {
+			cfg.Worker = strings.TrimPrefix(arg, "-worker=")
+		}
+	}
+	s, err := NewStorageWithConfig(cfg)
+	if err == nil {
+		err = s.RunWorker()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0) // <= no test output on stdout, it goes to console of coordinator
+}
+
+func TestE2EWorkerProcesses(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{
+		"a.txt":     "alpha",
+		"b.txt":     "beta",
+		"dir/c.txt": "gamma",
+		"dir/d.txt": "delta",
+		"gone.txt":  "gone",
+	})
+	srv.Fail("GET", "/bkt/gone.txt", http.StatusNotFound, 10)
+
+	defer setTestEnv("GCS_CP_WORKER_PROCESS", "1")()
+	defer setTestEnv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(srv.URL, "http://"))() // <= read by worker processes
+	s := newTestStorage(t, srv, "gs://bkt/", func(cfg *Config) {
+		cfg.Processes = 2
+		cfg.ContinueOnError = true
+		cfg.CommandFlags = []string{"-test.run=^TestWorkerProcess$", "--"}
+		cfg.CommandArgs = []string{cfg.Uri, cfg.DestinationPath}
+	})
+	s.State = &StateFile{Objects: map[string]*StateEntry{}}
+	transfers, err := s.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Objects are shared by processes, their failures and versions are reported to coordinator
+	err = s.DownloadObjectsWithProcesses(transfers)
+	var failures *FailuresError
+	if !errors.As(err, &failures) || len(failures.Failures) != 1 {
+		t.Fatalf("got %v, want failure of one object", err)
+	}
+	if failure := failures.Failures[0]; failure.Object != "gone.txt" || errorCode(failure) != "object_not_found" || isRetryable(failure) {
+		t.Errorf("got failure %v of %s, code %s", failure, failure.Object, errorCode(failure))
+	}
+	for name, content := range map[string]string{"a.txt": "alpha", "b.txt": "beta", "dir/c.txt": "gamma", "dir/d.txt": "delta"} {
+		assertFile(t, filepath.Join(s.Config.DestinationPath, filepath.FromSlash(name)), []byte(content))
+		if !s.Status.Completed("gs://bkt/" + name) {
+			t.Errorf("%s is not completed", name)
+		}
+	}
+	if progress := s.Status.Progress(); progress.Done != 4 || progress.Bytes != 19 {
+		t.Errorf("got %d objects, %d bytes done, want 4 and 19", progress.Done, progress.Bytes)
+	}
+	for _, tr := range transfers {
+		entry := s.State.Get(tr.Destination)
+		if (entry == nil) != (tr.Object == "gone.txt") {
+			t.Errorf("%s: got state %+v", tr.Object, entry)
+		} else if entry != nil && entry.Generation != srv.Object("bkt", tr.Object).Generation {
+			t.Errorf("%s: got generation %d in state", tr.Object, entry.Generation)
+		}
+	}
+}
+
+func TestE2EWorkerProcessesCancel(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("interrupt can not be sent to own process on Windows")
+	}
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.BytesPerSecond = 10000
+	srv.Put("bkt", "a.txt", []byte("a"))
+	srv.Put("bkt", "slow.bin", make([]byte, 100000))
+
+	defer setTestEnv("GCS_CP_WORKER_PROCESS", "1")()
+	defer setTestEnv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(srv.URL, "http://"))() // <= read by worker processes
+	s := newTestStorage(t, srv, "gs://bkt/", func(cfg *Config) {
+		cfg.Processes = 2
+		cfg.CommandFlags = []string{"-test.run=^TestWorkerProcess$", "--"}
+		cfg.CommandArgs = []string{cfg.Uri, cfg.DestinationPath}
+	})
+	transfers, err := s.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.HandleCancelSignals()()
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(time.Second, func() { self.Signal(os.Interrupt) })
+
+	// Interrupt reaches coordinator only, it stops workers with SIGTERM and reports objects left
+	err = s.DownloadObjectsWithProcesses(transfers)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	if msg := s.interruptError(err).Error(); !strings.HasPrefix(msg, "canceled by interrupt after 1 of 2 objects completed") {
+		t.Errorf("got %q", msg)
+	}
+	assertFile(t, filepath.Join(s.Config.DestinationPath, "a.txt"), []byte("a"))
+	entries, _ := os.ReadDir(s.Config.DestinationPath)
+	if len(entries) != 1 {
+		t.Errorf("partial file of stopped worker was left: %v", entries)
+	}
+}
+
+func TestE2EObjectTimeout(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.BytesPerSecond = 10000
+	srv.Put("bkt", "slow.bin", make([]byte, 100000))
+
+	s := newTestStorage(t, srv, "gs://bkt/slow.bin", func(cfg *Config) {
+		cfg.ObjectTimeout = 200 * time.Millisecond
+		cfg.Retry.MaxAttempts = 2
+	})
+
+	err := runTransfers(s)
+	if !errors.Is(err, ErrObjectTimeout) {
+		t.Fatalf("got %v, want %v", err, ErrObjectTimeout)
+	}
+	if n := srv.CountRequests("GET", "/bkt/slow.bin"); n != 2 {
+		t.Errorf("got %d media requests, want 2 attempts", n)
+	}
+}
+
+func TestE2EListAndObjectTimeouts(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.BytesPerSecond = 10000
+	content := bytes.Repeat([]byte("s"), 4000)
+	srv.Put("bkt", "slow.bin", content)
+
+	// Without per-object limit slow download completes, 200ms would have expired
+	s := newTestStorage(t, srv, "gs://bkt/slow.bin", func(cfg *Config) {
+		cfg.ObjectTimeout = 0
+		cfg.MinThroughput = 0
+	})
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, filepath.Join(s.Config.DestinationPath, "slow.bin"), content)
+
+	faults, err := ParseFaultConfig("latency=500ms,match=/b/bkt/o")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = newTestStorage(t, srv, "gs://bkt/", func(cfg *Config) {
+		cfg.ListTimeout = 100 * time.Millisecond
+		cfg.Retry.MaxAttempts = 1
+		cfg.Transport.Faults = faults
+	})
+	started := time.Now()
+	if _, err := s.Plan(); errorCode(err) != "deadline_exceeded" {
+		t.Fatalf("got %v, want deadline_exceeded of listing", err)
+	}
+	if elapsed := time.Since(started); elapsed > 400*time.Millisecond {
+		t.Errorf("listing was stopped after %s", elapsed)
+	}
+}
+
+func TestE2EChecksumMismatch(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Put("bkt", "a.txt", []byte("alpha"))
+	srv.Put("bkt", "b.txt", []byte("beta"))
+
+	manifest := filepath.Join(t.TempDir(), "manifest.csv")
+	rows := "source,destination,md5\n" +
+		"gs://bkt/a.txt,a.txt,2c1743a391305fbf367df8e4f069f9f9\n" + // <= md5 of "alpha"
+		"gs://bkt/b.txt,b.txt,00000000000000000000000000000000\n"
+	if err := os.WriteFile(manifest, []byte(rows), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestStorage(t, srv, "", func(cfg *Config) {
+		cfg.Manifest = manifest
+	})
+	err := runTransfers(s)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("got %v, want %v", err, ErrChecksumMismatch)
+	}
+
+	dest := s.Config.DestinationPath
+	assertFile(t, filepath.Join(dest, "a.txt"), []byte("alpha"))
+	if _, err := os.Stat(filepath.Join(dest, "b.txt")); !os.IsNotExist(err) {
+		t.Errorf("corrupted file was kept: %v", err)
+	}
+	if n := srv.CountRequests("GET", "/bkt/b.txt"); n != 1 {
+		t.Errorf("checksum mismatch was retried: %d media requests", n)
+	}
+}
+
+func TestE2EContinueOnError(t *testing.T) {
+	for _, multiThread := range []bool{false, true} {
+		srv := testsupport.NewServer()
+		srv.Seed("bkt", map[string]string{"a.txt": "alpha", "b.txt": "beta", "c.txt": "gamma", "d.txt": "delta"})
+		srv.Fail("GET", "/bkt/b.txt", 403, 10)
+		srv.Fail("GET", "/bkt/d.txt", 403, 10)
+
+		s := newTestStorage(t, srv, "gs://bkt/", func(cfg *Config) {
+			cfg.ContinueOnError = true
+			cfg.isMultiThread = multiThread
+		})
+		err := runTransfers(s)
+		srv.Close()
+
+		var failures *FailuresError
+		if !errors.As(err, &failures) || errorCode(err) != "transfers_failed" {
+			t.Fatalf("multi-thread %v: got %v, want transfers_failed", multiThread, err)
+		}
+		if len(failures.Failures) != 2 || failures.Failures[0].Object != "b.txt" || failures.Failures[1].Object != "d.txt" {
+			t.Errorf("multi-thread %v: got failures %v, want b.txt and d.txt", multiThread, failures.Failures)
+		}
+		if code := errorCode(failures.Failures[0]); code != "permission_denied" {
+			t.Errorf("got failure code %s, want permission_denied", code)
+		}
+		if err.Error() != "2 of 4 objects failed" {
+			t.Errorf("got %q", err.Error())
+		}
+
+		dest := s.Config.DestinationPath
+		assertFile(t, filepath.Join(dest, "a.txt"), []byte("alpha"))
+		assertFile(t, filepath.Join(dest, "c.txt"), []byte("gamma"))
+	}
+}
+
+func TestE2EPlanOutAndIn(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{"a.txt": "alpha", "dir/b.txt": "beta"})
+
+	planned := newTestStorage(t, srv, "gs://bkt/", nil)
+	transfers, err := planned.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "plan.json")
+	if err := NewTransferPlan(planned.Config, transfers).Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := LoadTransferPlan(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Objects != 2 || plan.Bytes != 9 || plan.Transfers[0].Object.Generation == 0 {
+		t.Fatalf("got plan of %d objects, %d bytes", plan.Objects, plan.Bytes)
+	}
+
+	// Applied plan is not listed again, its checksums verify the data
+	s := newTestStorage(t, srv, "", func(cfg *Config) {
+		cfg.DestinationPath = planned.Config.DestinationPath
+		cfg.Plan = plan
+	})
+	if transfers, err = s.PlanOrLoad(s.Plan); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DownloadObjects(transfers); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, filepath.Join(s.Config.DestinationPath, "a.txt"), []byte("alpha"))
+	assertFile(t, filepath.Join(s.Config.DestinationPath, "dir", "b.txt"), []byte("beta"))
+	if n := srv.CountRequests("GET", "/b/bkt/o"); n != 1 {
+		t.Errorf("got %d JSON requests, want listing of planning only", n)
+	}
+
+	plan.Transfers[1].Destination = plan.Transfers[0].Destination
+	if _, err := plan.NewTransfers(); err == nil {
+		t.Error("plan with duplicate destination was accepted")
+	}
+}
+
+func TestE2EBundle(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Put("bkt", "share/a.txt", []byte("alpha"))
+	srv.Put("bkt", "share/sub/b.txt", []byte("beta"))
+	logs := bytes.Repeat([]byte("GET /index.html 200\n"), 90)
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write(logs)
+	gw.Close()
+	srv.PutObject(testsupport.Object{Bucket: "bkt", Name: "share/logs.txt", Content: gzipped.Bytes(), ContentEncoding: "gzip"})
+
+	// Throwaway service account key, emulator does not check signatures
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	keyJSON, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "vendor-share@project.iam.gserviceaccount.com",
+		"private_key":  string(pemKey),
+	})
+	keyFile := filepath.Join(t.TempDir(), "key.json")
+	os.WriteFile(keyFile, keyJSON, 0600)
+
+	os.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(srv.URL, "http://"))
+	signer, err := NewURLSigner(keyFile)
+	os.Unsetenv("STORAGE_EMULATOR_HOST")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestStorage(t, srv, "gs://bkt/share/", func(cfg *Config) {
+		cfg.DestinationPath = ""
+	})
+	transfers, err := s.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := NewBundle(s.Config.Uri, transfers, signer, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "bundle.json")
+	if err := bundle.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if bundle, err = LoadBundle(path); err != nil {
+		t.Fatal(err)
+	}
+	if bundle.Objects != 3 || !strings.Contains(bundle.Files[0].URL, "X-Goog-Signature=") {
+		t.Fatalf("unexpected bundle: %d files, url %s", bundle.Objects, bundle.Files[0].URL)
+	}
+
+	dir := t.TempDir()
+	if err := bundle.Fetch(context.Background(), dir, 2, s.Config.Retry); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, filepath.Join(dir, "share", "a.txt"), []byte("alpha"))
+	assertFile(t, filepath.Join(dir, "share", "sub", "b.txt"), []byte("beta"))
+	assertFile(t, filepath.Join(dir, "share", "logs.txt"), logs) // <= verified as stored, written decompressed
+
+	// Data changed after bundle was made is not kept
+	srv.Put("bkt", "share/a.txt", []byte("ALPHA"))
+	dir = t.TempDir()
+	if err := bundle.Fetch(context.Background(), dir, 1, s.Config.Retry); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("got %v, want %v", err, ErrChecksumMismatch)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "share", "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("corrupt file was left: %v", err)
+	}
+
+	bundle.Files[0].Name = "../a.txt"
+	if err := bundle.Fetch(context.Background(), dir, 1, s.Config.Retry); !errors.Is(err, ErrPathEscape) {
+		t.Errorf("got %v, want %v", err, ErrPathEscape)
+	}
+	bundle.Expires = time.Now().Add(-time.Minute)
+	if err := bundle.Fetch(context.Background(), dir, 1, s.Config.Retry); !errors.Is(err, ErrBundleExpired) {
+		t.Errorf("got %v, want %v", err, ErrBundleExpired)
+	}
+}
+
+func TestE2EVerifyListedObjects(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Put("bkt", "a.txt", []byte("alpha"))
+	srv.Corrupt("bkt", "a.txt", 2)
+
+	s := newTestStorage(t, srv, "gs://bkt/a.txt", func(cfg *Config) {
+		cfg.KeepCorrupt = true
+	})
+	fpath := filepath.Join(s.Config.DestinationPath, "a.txt")
+	if err := runTransfers(s); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("got %v, want %v", err, ErrChecksumMismatch)
+	}
+	if _, err := os.Stat(fpath); !os.IsNotExist(err) {
+		t.Errorf("corrupted file was left in place: %v", err)
+	}
+	assertFile(t, fpath+corruptSuffix, []byte("\x9elpha"))
+
+	// Raw speed, nothing is checked
+	s.Config.NoVerify, s.Config.KeepCorrupt = true, false
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, fpath, []byte("\x9elpha"))
+}
+
+func TestE2EPreflightConfirmation(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{"a.txt": "alpha", "b.txt": "beta"})
+
+	s := newTestStorage(t, srv, "gs://bkt/", func(cfg *Config) {
+		cfg.ConfirmBytes = 5
+	})
+	transfers, err := s.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e := EstimateTransfers(transfers); e.Objects != 2 || e.Bytes != 9 || e.Unknown != 0 {
+		t.Errorf("got estimate %+v, want 2 objects of 9 bytes", e)
+	}
+	if err := s.Preflight(transfers, strings.NewReader("n\n")); !errors.Is(err, ErrNotConfirmed) {
+		t.Errorf("got %v, want %v", err, ErrNotConfirmed)
+	}
+	if err := s.Preflight(transfers, strings.NewReader("yes\n")); err != nil {
+		t.Errorf("confirmed transfer failed preflight: %v", err)
+	}
+}
+
+func TestE2EDiskUsage(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{
+		"data/a.txt":       "alpha",
+		"data/sub/b.txt":   "beta",
+		"data/sub/c/d.txt": "delta",
+		"data/tmp/e.txt":   "e",
+		"database.txt":     "other",
+	})
+
+	s := newTestStorage(t, srv, "", nil)
+	entries, total, err := s.PrefixUsage("bkt", listingPrefix("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, entry := range entries {
+		lines = append(lines, formatDiskUsage(entry, false))
+	}
+	want := []string{
+		"           5  gs://bkt/data/a.txt",
+		"           9  gs://bkt/data/sub/",
+		"           1  gs://bkt/data/tmp/",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got usage:\n%s\nwant:\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+	if total.Objects != 4 || total.Bytes != 15 || total.URL != "gs://bkt/data/" {
+		t.Errorf("total %+v", total)
+	}
+	if line := formatDiskUsage(&DiskUsage{URL: "gs://bkt/big/", Bytes: 3 << 20}, true); line != "     3.0 MiB  gs://bkt/big/" {
+		t.Errorf("human-readable line: %q", line)
+	}
+}
+
+func TestE2ECostEstimate(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{"a.txt": "alpha", "b.txt": "beta", "c.txt": "gamma"})
+
+	config := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(config, []byte(`{"prices": {"currency": "EUR", "egress_per_gib": {"interconnect": 0.01}, "retrieval_per_gib": {"ARCHIVE": 0.1}}}`), 0644)
+	fc, err := LoadFileConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prices := mergePrices(fc.Prices)
+	if err := prices.CheckNetwork("interconnect"); err != nil {
+		t.Fatal(err)
+	}
+	if err := prices.CheckNetwork("moon"); err == nil {
+		t.Error("unknown network accepted")
+	}
+
+	s := newTestStorage(t, srv, "gs://bkt/", func(cfg *Config) {
+		cfg.EstimateCost = true
+		cfg.EgressNetwork = "internet"
+		cfg.Prices = prices
+	})
+	transfers, err := s.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sizes of listing are replaced to get cents, one object is archived, one of unknown size
+	transfers[0].Attrs.Size, transfers[0].Attrs.StorageClass = 10<<30, "ARCHIVE"
+	transfers[1].Attrs.Size = 20 << 30
+	transfers[2].Attrs = nil
+
+	e := s.EstimateCost(transfers)
+	if e.Bytes != 30<<30 || e.Unknown != 1 || e.Currency != "EUR" {
+		t.Errorf("estimate %+v", e)
+	}
+	if math.Abs(e.Egress-3.6) > 1e-9 || math.Abs(e.Retrieval-1.0) > 1e-9 || math.Abs(e.Operations-(0.5+2*0.004)/10000) > 1e-12 {
+		t.Errorf("egress %.4f, retrieval %.4f, operations %.6f", e.Egress, e.Retrieval, e.Operations)
+	}
+	if out := e.String(); !strings.Contains(out, "Estimated cost: 4.60 EUR for 3 objects") || !strings.Contains(out, "ARCHIVE retrieval: 10.0 GiB") {
+		t.Errorf("estimate output:\n%s", out)
+	}
+
+	// Uploads pay writes only
+	upload := prices.Estimate("upload", "internet", transfers[:2])
+	if upload.Egress != 0 || upload.Retrieval != 0 || math.Abs(upload.Operations-(0.5+0.05)/10000) > 1e-12 {
+		t.Errorf("upload estimate %+v", upload)
+	}
+
+	os.WriteFile(config, []byte(`{"prices": {"class_b_per_10k": {"GLACIER": 1}}}`), 0644)
+	if _, err := LoadFileConfig(config); err == nil || !strings.Contains(err.Error(), "unknown storage class") {
+		t.Errorf("unknown storage class: %v", err)
+	}
+}
+
+func TestE2EPathEscapeRefused(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{"data/ok.txt": "ok", "data/../../evil.txt": "evil"})
+
+	s := newTestStorage(t, srv, "gs://bkt/data/", nil)
+	if err := runTransfers(s); !errors.Is(err, ErrPathEscape) {
+		t.Fatalf("got %v, want %v", err, ErrPathEscape)
+	}
+	if n := srv.CountRequests("GET", "evil.txt"); n != 0 {
+		t.Errorf("escaping object was downloaded: %d media requests", n)
+	}
+}
+
+func TestE2EOnConflict(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{"A.txt": "upper", "a.txt": "lower"})
+
+	for policy, want := range map[string]map[string]string{
+		"skip":        {"a.txt": "upper"},
+		"overwrite":   {"a.txt": "lower"},
+		"rename":      {"a.txt": "upper", "a-1.txt": "lower"},
+		"rename-hash": {"a.txt": "upper", "a-cfc7b488.txt": "lower"},
+	} {
+		s := newTestStorage(t, srv, "gs://bkt/", func(cfg *Config) {
+			cfg.NameCase = "lower"
+			cfg.OnConflict = policy
+		})
+		if err := runTransfers(s); err != nil {
+			t.Fatalf("%s: %v", policy, err)
+		}
+
+		entries, _ := os.ReadDir(s.Config.DestinationPath)
+		if len(entries) != len(want) {
+			t.Errorf("%s: got %d files, want %d", policy, len(entries), len(want))
+		}
+		for name, content := range want {
+			assertFile(t, filepath.Join(s.Config.DestinationPath, name), []byte(content))
+		}
+	}
+
+	s := newTestStorage(t, srv, "gs://bkt/", func(cfg *Config) {
+		cfg.NameCase = "lower"
+	})
+	if _, err := s.Plan(); err == nil {
+		t.Error("conflicting destinations were planned without policy")
+	}
+}
+
+func TestE2EStripPrefixAndFlatten(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{
+		"logs/2024/01/a.gz": "a",
+		"logs/2024/02/b.gz": "b",
+		"logs/2024/02/c.gz": "c",
+		"logs/2025/01/a.gz": "new a",
+	})
+
+	for prefix, want := range map[string]string{
+		"logs/2024":       "logs/2024/",
+		"logs/2024/":      "logs/2024/",
+		"logs/2024/a.gz":  "logs/2024/",
+		"logs/202?/01/*":  "logs/",
+		"**/a.gz":         "",
+		"logs/2024/01/a*": "logs/2024/01/",
+	} {
+		if got := strippedPrefix(prefix, hasGlob(prefix)); got != want {
+			t.Errorf("%s: got %q, want %q", prefix, got, want)
+		}
+	}
+
+	strip := func(cfg *Config) {
+		strip := strippedPrefix(cfg.Prefix, false)
+		cfg.Rename = RenameRules{{Pattern: regexp.MustCompile("^" + regexp.QuoteMeta(strip))}}
+	}
+	s := newTestStorage(t, srv, "gs://bkt/logs/2024", strip)
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, filepath.Join(s.Config.DestinationPath, "01", "a.gz"), []byte("a"))
+	assertFile(t, filepath.Join(s.Config.DestinationPath, "02", "c.gz"), []byte("c"))
+
+	s = newTestStorage(t, srv, "gs://bkt/logs/2024", func(cfg *Config) { cfg.Flatten = true })
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(s.Config.DestinationPath)
+	if len(entries) != 3 {
+		t.Errorf("got %d entries of flattened download, want 3 files", len(entries))
+	}
+	assertFile(t, filepath.Join(s.Config.DestinationPath, "b.gz"), []byte("b"))
+
+	// Same base names are conflicts, not overwrites
+	s = newTestStorage(t, srv, "gs://bkt/logs", func(cfg *Config) { cfg.Flatten = true })
+	if _, err := s.Plan(); err == nil || !strings.Contains(err.Error(), "same destination") {
+		t.Errorf("got %v, want conflict of flattened names", err)
+	}
+}
+
+func TestE2ENoClobberAndNewerOnly(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	updated := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for name, content := range map[string]string{"newer.txt": "remote", "older.txt": "remote", "same.txt": "remote", "new.txt": "remote"} {
+		srv.PutObject(testsupport.Object{Bucket: "bkt", Name: name, Content: []byte(content), Updated: updated})
+	}
+
+	dir := t.TempDir()
+	for name, mtime := range map[string]time.Time{
+		"newer.txt": updated.Add(time.Minute),
+		"older.txt": updated.Add(-time.Minute),
+		"same.txt":  updated,
+	} {
+		fpath := filepath.Join(dir, name)
+		if err := os.WriteFile(fpath, []byte("LOCAL!"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fpath, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	download := func(configure func(*Config)) {
+		t.Helper()
+		s := newTestStorage(t, srv, "gs://bkt/", func(cfg *Config) {
+			cfg.DestinationPath = dir
+			configure(cfg)
+		})
+		transfers, err := s.Plan()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DownloadObjects(transfers); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Older file is replaced, newer one and one of same size and time are kept
+	download(func(cfg *Config) { cfg.NewerOnly = true })
+	assertFile(t, filepath.Join(dir, "newer.txt"), []byte("LOCAL!"))
+	assertFile(t, filepath.Join(dir, "older.txt"), []byte("remote"))
+	assertFile(t, filepath.Join(dir, "same.txt"), []byte("LOCAL!"))
+	assertFile(t, filepath.Join(dir, "new.txt"), []byte("remote"))
+
+	// Existing files are kept whatever their time
+	if err := os.WriteFile(filepath.Join(dir, "older.txt"), []byte("edited"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(dir, "new.txt"))
+	download(func(cfg *Config) { cfg.NoClobber = true })
+	assertFile(t, filepath.Join(dir, "older.txt"), []byte("edited"))
+	assertFile(t, filepath.Join(dir, "new.txt"), []byte("remote"))
+}
+
+func TestE2EStateDBSkipsUnchanged(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{"a.txt": "alpha", "b.txt": "beta"})
+
+	db := filepath.Join(t.TempDir(), "state.db")
+	dest := t.TempDir()
+	run := func() {
+		s := newTestStorage(t, srv, "gs://bkt/", func(cfg *Config) {
+			cfg.DestinationPath = dest
+			cfg.StateDB = db
+		})
+		defer s.State.Close()
+		if err := runTransfers(s); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.State.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run()
+	srv.Put("bkt", "b.txt", []byte("beta 2"))
+	run()
+
+	if n := srv.CountRequests("GET", "/bkt/a.txt"); n != 1 {
+		t.Errorf("unchanged object was downloaded %d times", n)
+	}
+	if n := srv.CountRequests("GET", "/bkt/b.txt"); n != 2 {
+		t.Errorf("changed object was downloaded %d times, want 2", n)
+	}
+	assertFile(t, filepath.Join(dest, "b.txt"), []byte("beta 2"))
+
+	state, err := OpenStateDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+	if entry := state.Get(filepath.Join(dest, "b.txt")); entry == nil || entry.Size != 6 {
+		t.Errorf("got state entry %+v, want size 6", entry)
+	}
+}
+
+func TestE2EEndpointFailover(t *testing.T) {
+	primary := testsupport.NewServer()
+	defer primary.Close()
+	primary.Seed("bkt", map[string]string{"a.txt": "alpha"})
+	primary.Fail("", "/", 503, 100)
+
+	secondary := testsupport.NewServer()
+	defer secondary.Close()
+	secondary.Seed("bkt", map[string]string{"a.txt": "alpha"})
+
+	var endpoints EndpointFlags
+	for _, srv := range []*testsupport.Server{primary, secondary} {
+		if err := endpoints.Set(srv.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newTestStorage(t, primary, "gs://bkt/", func(cfg *Config) {
+		cfg.Transport.Endpoints = endpoints
+	})
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+
+	assertFile(t, filepath.Join(s.Config.DestinationPath, "a.txt"), []byte("alpha"))
+	if n := primary.CountRequests("GET", "/"); n != 1 {
+		t.Errorf("failed endpoint got %d requests, want 1", n)
+	}
+}
+
+func TestE2EIfGenerationMatch(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	old := srv.Put("bkt", "a.txt", []byte("alpha"))
+	srv.Put("bkt", "a.txt", []byte("alpha 2"))
+
+	s := newTestStorage(t, srv, "gs://bkt/a.txt", func(cfg *Config) {
+		cfg.IfGenerationMatch = old.Generation
+	})
+	err := runTransfers(s)
+	if errorCode(err) != "precondition_failed" || isRetryable(err) {
+		t.Fatalf("got %v, want precondition_failed", err)
+	}
+	if _, err := os.Stat(filepath.Join(s.Config.DestinationPath, "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("changed object was written: %v", err)
+	}
+
+	s = newTestStorage(t, srv, "gs://bkt/", func(cfg *Config) {
+		cfg.IfGenerationMatch = old.Generation
+	})
+	if _, err := s.Plan(); err == nil {
+		t.Error("condition was accepted for prefix")
+	}
+}
+
+func TestE2EKeyResolver(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	key := bytes.Repeat([]byte("k"), csekSize)
+	encoded := base64.StdEncoding.EncodeToString(key)
+	srv.PutObject(testsupport.Object{Bucket: "bkt", Name: "data/secret.txt", Content: []byte("secret"), EncryptionKey: key})
+	srv.Put("bkt", "data/plain.txt", []byte("plain"))
+
+	s := newTestStorage(t, srv, "gs://bkt/data/secret.txt", nil)
+	if err := runTransfers(s); err == nil {
+		t.Fatal("encrypted object was downloaded without key")
+	}
+
+	var mu sync.Mutex
+	asked := map[string]int{}
+	resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		object := r.URL.Query().Get("object")
+		mu.Lock()
+		asked[object]++
+		mu.Unlock()
+		if object != "gs://bkt/data/secret.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintln(w, encoded)
+	}))
+	defer resolver.Close()
+
+	s = newTestStorage(t, srv, "gs://bkt/data/", func(cfg *Config) {
+		cfg.KeyResolver = resolver.URL
+	})
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, filepath.Join(s.Config.DestinationPath, "data", "secret.txt"), []byte("secret"))
+	assertFile(t, filepath.Join(s.Config.DestinationPath, "data", "plain.txt"), []byte("plain"))
+	if asked["gs://bkt/data/secret.txt"] != 1 || asked["gs://bkt/data/plain.txt"] != 1 {
+		t.Errorf("got resolver requests %v, want one per object", asked)
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	script := filepath.Join(t.TempDir(), "key.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\ncase \"$2\" in *secret*) echo \"$1\";; esac\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s = newTestStorage(t, srv, "gs://bkt/data/", func(cfg *Config) {
+		cfg.KeyResolver = script + " " + encoded + " {}"
+	})
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, filepath.Join(s.Config.DestinationPath, "data", "secret.txt"), []byte("secret"))
+
+	s = newTestStorage(t, srv, "gs://bkt/data/secret.txt", func(cfg *Config) {
+		cfg.KeyResolver = script + " c2hvcnQ= {}"
+	})
+	if err := runTransfers(s); !errors.Is(err, ErrKeyResolver) || errorCode(err) != "key_resolver_failed" {
+		t.Errorf("short key: got %v, want %v", err, ErrKeyResolver)
+	}
+}
+
+func TestE2EEncryptionKey(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("bkt")
+	key := bytes.Repeat([]byte("e"), csekSize)
+	encoded := base64.StdEncoding.EncodeToString(key)
+
+	os.Setenv("GCS_CP_TEST_CSEK", encoded)
+	defer os.Unsetenv("GCS_CP_TEST_CSEK")
+	if got, err := parseEncryptionKey("env:GCS_CP_TEST_CSEK"); err != nil || !bytes.Equal(got, key) {
+		t.Errorf("key of environment variable: %q %v", got, err)
+	}
+	for _, value := range []string{"c2hvcnQ=", "not base64", "env:GCS_CP_TEST_MISSING"} {
+		if _, err := parseEncryptionKey(value); err == nil {
+			t.Errorf("invalid key %q is accepted", value)
+		}
+	}
+
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestStorage(t, srv, "gs://bkt/data", func(cfg *Config) {
+		cfg.Command = "upload"
+		cfg.SourcePath = src
+		cfg.EncryptionKey = key
+	})
+	uploads, err := s.PlanUploads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UploadObjects(uploads); err != nil {
+		t.Fatal(err)
+	}
+	if obj := srv.Object("bkt", "data/secret.txt"); obj == nil || !bytes.Equal(obj.EncryptionKey, key) {
+		t.Fatalf("uploaded object is not encrypted with key: %+v", obj)
+	}
+
+	s = newTestStorage(t, srv, "gs://bkt/data/secret.txt", nil)
+	if err := runTransfers(s); err == nil {
+		t.Fatal("encrypted object was downloaded without key")
+	}
+	s = newTestStorage(t, srv, "gs://bkt/data/secret.txt", func(cfg *Config) {
+		cfg.EncryptionKey = key
+	})
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, filepath.Join(s.Config.DestinationPath, "data", "secret.txt"), []byte("secret"))
+}
+
+func TestE2EVerifyComposite(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("bkt")
+	srv.PutObject(testsupport.Object{Bucket: "bkt", Name: "joined.csv", Content: []byte("a,b\nc,d\n"), ComponentCount: 3})
+
+	s := newTestStorage(t, srv, "gs://bkt/", func(cfg *Config) {
+		cfg.VerifyComposite = true
+		cfg.MetadataSidecar = true
+	})
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(s.Config.DestinationPath, "joined.csv")
+	assertFile(t, dest, []byte("a,b\nc,d\n"))
+
+	var sidecar MetadataSidecar
+	data, err := os.ReadFile(dest + ".gcs.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &sidecar); err != nil {
+		t.Fatal(err)
+	}
+	if sidecar.ComponentCount != 3 || sidecar.MD5 != "" {
+		t.Errorf("got component count %d and md5 %q, want 3 and none", sidecar.ComponentCount, sidecar.MD5)
+	}
+}
+
+func TestE2EMetadataSidecar(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Versioned = map[string]bool{"bkt": true}
+	old := srv.Put("bkt", "data/a.txt", []byte("first"))
+	live := srv.Put("bkt", "data/a.txt", []byte("second"))
+	srv.PutObject(testsupport.Object{Bucket: "bkt", Name: "data/joined.csv", Content: []byte("a,b\nc,d\n"), ComponentCount: 3})
+
+	readSidecar := func(path string) MetadataSidecar {
+		t.Helper()
+		var sidecar MetadataSidecar
+		data, err := os.ReadFile(path + ".gcs.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, &sidecar); err != nil {
+			t.Fatal(err)
+		}
+		return sidecar
+	}
+	checksums := func(content []byte) (string, string) {
+		md5sum := md5.Sum(content)
+		crc := make([]byte, crc32.Size)
+		binary.BigEndian.PutUint32(crc, crc32.Checksum(content, crc32.MakeTable(crc32.Castagnoli)))
+		return base64.StdEncoding.EncodeToString(md5sum[:]), base64.StdEncoding.EncodeToString(crc)
+	}
+
+	s := newTestStorage(t, srv, "gs://bkt/data/", func(cfg *Config) {
+		cfg.MetadataSidecar = true
+	})
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	sidecar := readSidecar(filepath.Join(s.Config.DestinationPath, "data", "a.txt"))
+	md5sum, crc := checksums([]byte("second"))
+	if sidecar.URI != "gs://bkt/data/a.txt" || sidecar.Generation != live.Generation || sidecar.Size != 6 ||
+		sidecar.MD5 != md5sum || sidecar.CRC32C != crc || sidecar.ComponentCount != 0 {
+		t.Errorf("sidecar of live generation: %+v", sidecar)
+	}
+
+	// Composite object has CRC32C and component count only
+	sidecar = readSidecar(filepath.Join(s.Config.DestinationPath, "data", "joined.csv"))
+	_, crc = checksums([]byte("a,b\nc,d\n"))
+	if sidecar.ComponentCount != 3 || sidecar.MD5 != "" || sidecar.CRC32C != crc {
+		t.Errorf("sidecar of composite object: %+v", sidecar)
+	}
+
+	// Sidecar of "#generation" download describes that generation, not live one
+	uri := fmt.Sprintf("gs://bkt/data/a.txt#%d", old.Generation)
+	s = newTestStorage(t, srv, "", func(cfg *Config) {
+		cfg.Uri = uri
+		cfg.BucketName, cfg.Prefix, cfg.Generation, _ = parseVersionedUrl(uri)
+		cfg.MetadataSidecar = true
+	})
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	sidecar = readSidecar(filepath.Join(s.Config.DestinationPath, "data", "a.txt"))
+	md5sum, crc = checksums([]byte("first"))
+	if sidecar.Generation != old.Generation || sidecar.Size != 5 || sidecar.MD5 != md5sum || sidecar.CRC32C != crc {
+		t.Errorf("sidecar of generation %d: %+v", old.Generation, sidecar)
+	}
+}
+
+func TestE2EACLSidecarGeneration(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Versioned = map[string]bool{"bkt": true}
+	old := srv.PutObject(testsupport.Object{Bucket: "bkt", Name: "data/a.txt", Content: []byte("first"), ACL: map[string]string{"allUsers": "READER"}})
+	srv.PutObject(testsupport.Object{Bucket: "bkt", Name: "data/a.txt", Content: []byte("second"), ACL: map[string]string{"user-owner@example.com": "OWNER"}})
+
+	// ACL of downloaded generation is exported, not of live one
+	uri := fmt.Sprintf("gs://bkt/data/a.txt#%d", old.Generation)
+	s := newTestStorage(t, srv, "", func(cfg *Config) {
+		cfg.Uri = uri
+		cfg.BucketName, cfg.Prefix, cfg.Generation, _ = parseVersionedUrl(uri)
+		cfg.ACLSidecar = true
+	})
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	var sidecar ACLSidecar
+	data, err := os.ReadFile(filepath.Join(s.Config.DestinationPath, "data", "a.txt.acl.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &sidecar); err != nil {
+		t.Fatal(err)
+	}
+	if sidecar.Generation != old.Generation || len(sidecar.ACL) != 1 || sidecar.ACL[0].Entity != "allUsers" || sidecar.ACL[0].Role != "READER" {
+		t.Errorf("sidecar of generation %d: %+v", old.Generation, sidecar)
+	}
+}
+
+func TestE2ETarSink(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{"data/a.txt": "alpha", "data/sub/b.txt": "beta"})
+
+	archive := filepath.Join(t.TempDir(), "out.tar")
+	s := newTestStorage(t, srv, "gs://bkt/data", func(cfg *Config) {
+		cfg.DestinationPath = ""
+		cfg.Sink = "tar:" + archive
+	})
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	entries := map[string]string{}
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(tr)
+		entries[header.Name] = string(data)
+	}
+	if entries["data/a.txt"] != "alpha" || entries["data/sub/b.txt"] != "beta" || len(entries) != 2 {
+		t.Errorf("got archive entries %v", entries)
+	}
+}
+
+func TestE2EArchiveFormats(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{"data/a.txt": "alpha", "data/sub/b.txt": "beta"})
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write([]byte("gamma"))
+	gw.Close()
+	srv.PutObject(testsupport.Object{Bucket: "bkt", Name: "data/c.log", Content: gzipped.Bytes(), ContentEncoding: "gzip"})
+
+	dir := t.TempDir()
+	for _, format := range []string{"tar.gz", "zip"} {
+		// Tar headers need sizes, decompressed size is known only at end of entry
+		want := map[string]string{"data/a.txt": "alpha", "data/sub/b.txt": "beta", "data/c.log": "gamma"}
+		if format == "tar.gz" {
+			want["data/c.log"] = gzipped.String()
+		}
+		archive := filepath.Join(dir, "out."+format)
+		s := newTestStorage(t, srv, "gs://bkt/data", func(cfg *Config) {
+			cfg.DestinationPath = ""
+			cfg.Sink = format + ":" + archive
+			cfg.NoDecompress = format == "tar.gz"
+		})
+		if err := runTransfers(s); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if err := s.Sink.Close(); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+
+		entries := map[string]string{}
+		if format == "zip" {
+			zr, err := zip.OpenReader(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range zr.File {
+				r, err := f.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := io.ReadAll(r) // <= fails on CRC-32 of entry not matching data
+				if err != nil {
+					t.Fatalf("%s: %v", f.Name, err)
+				}
+				entries[f.Name] = string(data)
+			}
+			zr.Close()
+		} else {
+			f, err := os.Open(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gr, err := gzip.NewReader(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tr := tar.NewReader(gr)
+			for {
+				header, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, _ := io.ReadAll(tr)
+				entries[header.Name] = string(data)
+			}
+			f.Close()
+		}
+		if len(entries) != len(want) {
+			t.Errorf("%s: got archive entries %v", format, entries)
+		}
+		for name, content := range want {
+			if entries[name] != content {
+				t.Errorf("%s: entry %s is %q, want %q", format, name, entries[name], content)
+			}
+		}
+	}
+}
+
+func TestE2EChecksumIndex(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{"data/a.csv": "alpha", "data/sub/b.csv": "beta", "data/c.csv": "gamma"})
+
+	dir := t.TempDir()
+	index := filepath.Join(dir, "files.idx")
+	s := newTestStorage(t, srv, "gs://bkt/data/", func(cfg *Config) {
+		cfg.ChecksumIndex = index
+		cfg.NoVerify = true // <= index computes CRC32C itself
+	})
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var entries []IndexEntry
+	header, err := ReadChecksumIndex(index, func(entry IndexEntry) { entries = append(entries, entry) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Kind != indexFiles || len(entries) != 3 || entries[0].Offset != -1 ||
+		entries[0].CRC32C != crc32.Checksum(srv.Object("bkt", entries[0].Name).Content, crc32.MakeTable(crc32.Castagnoli)) {
+		t.Fatalf("index %+v: %+v", header, entries)
+	}
+
+	report, err := SpotVerify(index, 1, 0, 1, 2)
+	if err != nil || report.Checked != 3 || len(report.Mismatched) != 0 {
+		t.Fatalf("spot-verify: %+v %v", report, err)
+	}
+	os.WriteFile(filepath.Join(s.Config.DestinationPath, "data", "sub", "b.csv"), []byte("bete"), 0644)
+	if report, err = SpotVerify(index, 0, 2, 1, 1); err != nil || report.Checked != 2 || report.Indexed != 3 {
+		t.Fatalf("sample of 2: %+v %v", report, err)
+	}
+	if report, _ = SpotVerify(index, 1, 0, 1, 1); len(report.Mismatched) != 1 || !strings.HasPrefix(report.Mismatched[0], "data/sub/b.csv: crc32c") {
+		t.Errorf("changed file: %+v", report.Mismatched)
+	}
+
+	// Entries of tar archive are checked at their data offset
+	archive := filepath.Join(dir, "data.tar")
+	s = newTestStorage(t, srv, "gs://bkt/data/", func(cfg *Config) {
+		cfg.DestinationPath = ""
+		cfg.Sink = "tar:" + archive
+		cfg.ChecksumIndex = index
+	})
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	s.Sink.Close()
+	s.Index.Close()
+	if report, err := SpotVerify(index, 1, 0, 1, 2); err != nil || report.Checked != 3 || len(report.Mismatched) != 0 {
+		t.Errorf("spot-verify of tar: %+v %v", report, err)
+	}
+
+	os.WriteFile(index, []byte(indexMagic+"d"), 0644)
+	if _, err := SpotVerify(index, 1, 0, 1, 1); errorCode(err) != "index_corrupt" {
+		t.Errorf("truncated index: %v", err)
+	}
+	for _, spec := range []string{"0%", "150%", "-3", "x"} {
+		if _, _, err := parseSample(spec); err == nil {
+			t.Errorf("sample %q was accepted", spec)
+		}
+	}
+}
+
+func TestE2EStdoutSink(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{"data/a.json": `{"a":1}`, "data/b.json": `{"b":2}`})
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	srv.Put("bkt", "big.bin", content)
+
+	stdout := func(uri string, configure func(*Config)) (*Storage, *bytes.Buffer) {
+		s := newTestStorage(t, srv, uri, func(cfg *Config) {
+			cfg.DestinationPath = ""
+			cfg.Sink = stdoutSink
+			if configure != nil {
+				configure(cfg)
+			}
+		})
+		out := &bytes.Buffer{}
+		s.Sink = &StdoutSink{w: out}
+		return s, out
+	}
+
+	s, out := stdout("gs://bkt/data/a.json", nil)
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != `{"a":1}` {
+		t.Errorf("got stdout %q", out.String())
+	}
+
+	s, out = stdout("gs://bkt/data/", nil)
+	if err := runTransfers(s); err == nil || !strings.Contains(err.Error(), "2 objects matched") || out.Len() != 0 {
+		t.Errorf("prefix of 2 objects: got %v, %d bytes written", err, out.Len())
+	}
+
+	// Reconnect continues stream, retry of written data would repeat it
+	srv.Truncate("bkt", "big.bin", 1000)
+	s, out = stdout("gs://bkt/big.bin", nil)
+	if err := runTransfers(s); err != nil || !bytes.Equal(out.Bytes(), content) {
+		t.Errorf("reconnected stream: %v, got %d bytes", err, out.Len())
+	}
+	srv.Truncate("bkt", "big.bin", 1000)
+	s, out = stdout("gs://bkt/big.bin", func(cfg *Config) {
+		cfg.ReconnectAttempts = 0
+	})
+	if err := runTransfers(s); !errors.Is(err, ErrSinkBroken) || out.Len() != 1000 {
+		t.Errorf("retried stream: got %v, %d bytes written", err, out.Len())
+	}
+}
+
+func TestE2EHTTPSink(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{"data/a.txt": "alpha"})
+
+	var mu sync.Mutex
+	received := map[string]string{}
+	headers := http.Header{}
+	hang := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/hang/") {
+			<-hang // <= no response until test ends, canceled job must stop request
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		received[r.Method+" "+r.URL.Path] = string(data)
+		headers = r.Header.Clone()
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer target.Close()
+	defer close(hang)
+
+	// Requests carry headers and user agent of flags like requests to GCS
+	s := newTestStorage(t, srv, "gs://bkt/data", func(cfg *Config) {
+		cfg.DestinationPath = ""
+		cfg.Sink = target.URL + "/upload/"
+		cfg.Transport.UserAgent = "nightly-export"
+		cfg.Transport.Headers = HeaderFlags{"X-Goog-Custom-Audit-Trace-Id": {"trace-1"}}
+	})
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := received["PUT /upload/data/a.txt"]; got != "alpha" {
+		t.Errorf("got requests %v", received)
+	}
+	if !strings.HasPrefix(headers.Get("User-Agent"), "nightly-export") || headers.Get("X-Goog-Custom-Audit-Trace-Id") != "trace-1" {
+		t.Errorf("got headers %v", headers)
+	}
+
+	// Canceled job stops PUT in flight
+	s = newTestStorage(t, srv, "gs://bkt/data", func(cfg *Config) {
+		cfg.DestinationPath = ""
+		cfg.Sink = target.URL + "/hang/"
+	})
+	time.AfterFunc(200*time.Millisecond, s.Cancel)
+	done := make(chan error, 1)
+	go func() { done <- runTransfers(s) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("canceled job is still waiting for PUT")
+	}
+}
+
+/*
+	Not a test: -pipe-to consumer started by TestE2EPipeToAck, confirms each tar entry
+*/
+func TestPipeConsumerProcess(t *testing.T) {
+	if os.Getenv("GCS_CP_PIPE_CONSUMER") != "1" {
+		t.Skip("helper process")
+	}
+
+	tr := tar.NewReader(os.Stdin)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			os.Exit(0) // <= no test output on stdout, it carries confirmations
+		}
+		io.Copy(io.Discard, tr)
+		fmt.Println(header.Name)
+	}
+}
+
+func TestE2EPipeToAck(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{"data/a.txt": "alpha", "data/b.txt": "beta"})
+
+	defer setTestEnv("GCS_CP_PIPE_CONSUMER", "1")()
+	db := filepath.Join(t.TempDir(), "state.db")
+	s := newTestStorage(t, srv, "gs://bkt/data", func(cfg *Config) {
+		cfg.DestinationPath = ""
+		cfg.PipeTo = []string{os.Args[0], "-test.run=^TestPipeConsumerProcess$"}
+		cfg.PipeAck = true
+		cfg.StateDB = db
+	})
+	defer s.State.Close()
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"data/a.txt", "data/b.txt"} {
+		if entry := s.State.Get(name); entry == nil || entry.URI != "gs://bkt/"+name {
+			t.Errorf("confirmed object %s is not recorded: %+v", name, entry)
+		}
+	}
+}
+
+func TestE2EConcurrencyLimit(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.BytesPerSecond = 20000
+
+	fixtures := map[string]string{}
+	for i := 0; i < 8; i++ {
+		fixtures[fmt.Sprintf("serving/%d.bin", i)] = strings.Repeat("x", 1000)
+	}
+	srv.Seed("prod-eu", fixtures)
+
+	s := newTestStorage(t, srv, "gs://prod-eu/serving/", func(cfg *Config) {
+		cfg.isMultiThread = true
+		cfg.Jobs = 4
+		cfg.Concurrency = []*ConcurrencyRule{{Buckets: "prod-*", Prefix: "serving/", Max: 2}}
+	})
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := srv.MaxConcurrentMedia(); n > 2 {
+		t.Errorf("%d objects were downloaded at the same time, limit is 2", n)
+	}
+}
+
+func TestE2EBandwidthSchedule(t *testing.T) {
+	dir := t.TempDir()
+	fpath := filepath.Join(dir, "config.json")
+	content := `{"bandwidth": [{"from": "08:00", "to": "18:00", "limit": "100MiB"}, {"from": "22:00", "to": "06:00", "limit": "0"}]}`
+	if err := os.WriteFile(fpath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFileConfig(fpath); err == nil || !strings.Contains(err.Error(), "bandwidth 2:") {
+		t.Errorf("zero limit: got %v", err)
+	}
+
+	// Limit follows time of day, night window spans midnight
+	rules := []*BandwidthRule{
+		{From: "08:00", To: "18:00", Limit: "100MiB"},
+		{From: "22:00", To: "06:00", Limit: "1GiB"},
+	}
+	for _, rule := range rules {
+		if err := rule.Check(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	limiter := NewBandwidthLimiter(rules, 2, false)
+	limits := map[string]int64{"07:59": 0, "08:00": 50 << 20, "17:59": 50 << 20, "18:00": 0, "23:30": 512 << 20, "05:59": 512 << 20}
+	for clock, want := range limits {
+		at, _ := time.ParseInLocation("2006-01-02 15:04", "2024-03-01 "+clock, time.Local)
+		if got := limiter.Limit(at); got != want {
+			t.Errorf("limit at %s: got %d, want %d", clock, got, want)
+		}
+	}
+
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{"big.bin": strings.Repeat("x", 192<<10)})
+
+	allDay := []*BandwidthRule{{From: "00:00", To: "24:00", Limit: "256KiB"}}
+	if err := allDay[0].Check(); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestStorage(t, srv, "gs://bkt/big.bin", nil)
+	s.Bandwidth = NewBandwidthLimiter(allDay, 1, false)
+
+	started := time.Now()
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(started); elapsed < 500*time.Millisecond {
+		t.Errorf("192KiB at 256KiB/s took %s", elapsed)
+	}
+}
+
+func TestE2EUploadTree(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("bkt")
+
+	src := t.TempDir()
+	files := map[string]string{
+		"a.txt":          "alpha",
+		"sub/b.json":     `{"beta":true}`,
+		"sub/deep/c.bin": strings.Repeat("c", 70000),
+		"empty.txt":      "",
+	}
+	for name, content := range files {
+		fpath := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fpath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := newTestStorage(t, srv, "gs://bkt/backup", func(cfg *Config) {
+		cfg.Command = "upload"
+		cfg.SourcePath = src
+		cfg.isMultiThread = true
+		cfg.Jobs = 3
+	})
+	uploads, err := s.PlanUploads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UploadObjects(uploads); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range files {
+		obj := srv.Object("bkt", "backup/"+name)
+		if obj == nil {
+			t.Fatalf("backup/%s was not uploaded", name)
+		}
+		if string(obj.Content) != content {
+			t.Errorf("backup/%s: got %d bytes, want %d", name, len(obj.Content), len(content))
+		}
+	}
+	if ct := srv.Object("bkt", "backup/sub/b.json").ContentType; ct != "application/json" {
+		t.Errorf("content type of backup/sub/b.json is %q", ct)
+	}
+	if s.Status.Done != len(files) || s.Status.Bytes != int64(5+13+70000) {
+		t.Errorf("status: %d objects, %d bytes", s.Status.Done, s.Status.Bytes)
+	}
+}
+
+func TestE2EUploadFile(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("bkt")
+
+	fpath := filepath.Join(t.TempDir(), "report.csv")
+	if err := os.WriteFile(fpath, []byte("a,b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prefix ending with slash is a directory, otherwise it names the object
+	for uri, object := range map[string]string{"gs://bkt/in/": "in/report.csv", "gs://bkt/in/latest.csv": "in/latest.csv"} {
+		s := newTestStorage(t, srv, uri, func(cfg *Config) {
+			cfg.Command = "upload"
+			cfg.SourcePath = fpath
+		})
+		uploads, err := s.PlanUploads()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(uploads) != 1 || uploads[0].Object != object {
+			t.Fatalf("%s: planned %v, want %s", uri, uploads, object)
+		}
+
+		// Failed attempt is retried, data is sent again from start
+		srv.Fail("POST", "/upload/", http.StatusServiceUnavailable, 1)
+		if err := s.UploadObjects(uploads); err != nil {
+			t.Fatal(err)
+		}
+		if obj := srv.Object("bkt", object); obj == nil || string(obj.Content) != "a,b\n" {
+			t.Errorf("%s was not uploaded", object)
+		}
+	}
+}
+
+func TestE2ECustomTime(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("bkt")
+	ct := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	srv.PutObject(testsupport.Object{Bucket: "bkt", Name: "set/a.csv", Content: []byte("alpha"), CustomTime: ct})
+	srv.Put("bkt", "set/b.csv", []byte("beta"))
+
+	// Downloaded file takes custom time, file of object without one keeps time of download
+	s := newTestStorage(t, srv, "gs://bkt/set/", func(cfg *Config) {
+		cfg.MtimeFromCustomTime = true
+	})
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(s.Config.DestinationPath, "set", "a.csv")); err != nil || !info.ModTime().Equal(ct) {
+		t.Errorf("a.csv modification time: %v %v, want %s", info.ModTime(), err, ct)
+	}
+	if info, err := os.Stat(filepath.Join(s.Config.DestinationPath, "set", "b.csv")); err != nil || info.ModTime().Before(ct.AddDate(1, 0, 0)) {
+		t.Errorf("b.csv modification time: %v %v", info.ModTime(), err)
+	}
+
+	fpath := filepath.Join(t.TempDir(), "report.csv")
+	if err := os.WriteFile(fpath, []byte("a,b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.Chtimes(fpath, mtime, mtime)
+	for value, want := range map[string]time.Time{"2024-02-03T04:05:06Z": time.Date(2024, 2, 3, 4, 5, 6, 0, time.UTC), customTimeMtime: mtime} {
+		s := newTestStorage(t, srv, "gs://bkt/in/"+value, func(cfg *Config) {
+			cfg.Command = "upload"
+			cfg.SourcePath = fpath
+			cfg.CustomTime = value
+		})
+		uploads, err := s.PlanUploads()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.UploadObjects(uploads); err != nil {
+			t.Fatal(err)
+		}
+		if obj := srv.Object("bkt", "in/"+value); obj == nil || !obj.CustomTime.Equal(want) {
+			t.Errorf("-custom-time %s: got %+v, want %s", value, obj, want)
+		}
+	}
+	if _, err := parseCustomTime("yesterday"); err == nil {
+		t.Error("invalid -custom-time was accepted")
+	}
+
+	// Dataset keeps custom time, import restores it
+	dir := t.TempDir()
+	s = newTestStorage(t, srv, "gs://bkt/set", func(cfg *Config) {
+		cfg.DestinationPath = filepath.Join(dir, datasetData)
+	})
+	if _, err := s.ExportDataset(dir); err != nil {
+		t.Fatal(err)
+	}
+	s = newTestStorage(t, srv, "gs://bkt/restored", nil)
+	if _, err := s.ImportDataset(dir); err != nil {
+		t.Fatal(err)
+	}
+	if obj := srv.Object("bkt", "restored/set/a.csv"); obj == nil || !obj.CustomTime.Equal(ct) {
+		t.Errorf("imported object: %+v", obj)
+	}
+	if obj := srv.Object("bkt", "restored/set/b.csv"); obj == nil || !obj.CustomTime.IsZero() {
+		t.Errorf("imported object without custom time: %+v", obj)
+	}
+}
+
+func TestE2EGzipContentEncoding(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte(strings.Repeat("compressible line\n", 100)))
+	gz.Close()
+	srv.PutObject(testsupport.Object{Bucket: "bkt", Name: "logs.txt", Content: gzipped.Bytes(), ContentEncoding: "gzip"})
+
+	// Both modes verify stored data against checksums of object
+	for _, compressed := range []bool{false, true} {
+		s := newTestStorage(t, srv, "gs://bkt/logs.txt", func(cfg *Config) { cfg.NoDecompress = compressed })
+		if err := runTransfers(s); err != nil {
+			t.Fatalf("no-decompress %t: %v", compressed, err)
+		}
+		want := []byte(strings.Repeat("compressible line\n", 100))
+		if compressed {
+			want = gzipped.Bytes()
+		}
+		assertFile(t, filepath.Join(s.Config.DestinationPath, "logs.txt"), want)
+	}
+
+	// Stored data is verified before it is written as stored
+	srv.Corrupt("bkt", "logs.txt", 5)
+	s := newTestStorage(t, srv, "gs://bkt/logs.txt", func(cfg *Config) { cfg.NoDecompress = true })
+	if err := runTransfers(s); errorCode(err) != "checksum_mismatch" {
+		t.Error("corrupted gzip data was accepted")
+	}
+}
+
+func TestE2EPreserveMtimeAndMetaJSON(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	updated := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	srv.PutObject(testsupport.Object{Bucket: "bkt", Name: "plain.txt", Content: []byte("a"), Updated: updated})
+	srv.PutObject(testsupport.Object{
+		Bucket: "bkt", Name: "uploaded.txt", Content: []byte("b"), Updated: updated,
+		Metadata: map[string]string{fileMtimeKey: "1600000000", "owner": "etl"},
+	})
+
+	s := newTestStorage(t, srv, "gs://bkt/", func(cfg *Config) {
+		cfg.PreserveMtime = true
+		cfg.MetaJSONSidecar = true
+	})
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+
+	// Upload metadata of gsutil is the original file time, update time is fallback
+	for name, want := range map[string]time.Time{"plain.txt": updated, "uploaded.txt": time.Unix(1600000000, 0)} {
+		info, err := os.Stat(filepath.Join(s.Config.DestinationPath, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(want) {
+			t.Errorf("%s: got modification time %s, want %s", name, info.ModTime(), want)
+		}
+	}
+
+	assertFile(t, filepath.Join(s.Config.DestinationPath, "plain.txt.meta.json"), []byte("{}\n"))
+	var metadata map[string]string
+	data, err := os.ReadFile(filepath.Join(s.Config.DestinationPath, "uploaded.txt.meta.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &metadata); err != nil || metadata["owner"] != "etl" {
+		t.Errorf("got metadata %v: %v", metadata, err)
+	}
+}
+
+func TestE2EUploadHoldsAndRetention(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("bkt")
+
+	fpath := filepath.Join(t.TempDir(), "audit.log")
+	if err := os.WriteFile(fpath, []byte("entry\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	upload := func(configure func(*Config)) error {
+		s := newTestStorage(t, srv, "gs://bkt/logs/", func(cfg *Config) {
+			cfg.Command = "upload"
+			cfg.SourcePath = fpath
+			configure(cfg)
+		})
+		uploads, err := s.PlanUploads()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.UploadObjects(uploads)
+	}
+
+	// Retention is set on uploaded generation
+	err := upload(func(cfg *Config) {
+		cfg.EventBasedHold = true
+		cfg.RetainFor = time.Hour
+		cfg.RetentionMode = "Unlocked"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := srv.Object("bkt", "logs/audit.log")
+	if obj == nil || !obj.EventBasedHold || obj.RetentionMode != "Unlocked" || time.Until(obj.RetainUntil) < 59*time.Minute {
+		t.Fatalf("uploaded object: %+v", obj)
+	}
+
+	// Refused overwrite names what protects the object
+	err = upload(func(cfg *Config) {})
+	if errorCode(err) != "object_immutable" || !strings.Contains(err.Error(), "event-based hold, unlocked object retention until") {
+		t.Errorf("overwrite: got %v (%s)", err, errorCode(err))
+	}
+	if isRetryable(err) {
+		t.Errorf("immutable object is retried")
+	}
+}
+
+func TestE2EVerifyMirror(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{
+		"data/ok.txt":      "same",
+		"data/missing.txt": "gone",
+		"data/stale.txt":   "new version",
+		"data/bad.txt":     "good",
+		"data/dir/":        "",
+	})
+
+	local := t.TempDir()
+	for name, content := range map[string]string{"ok.txt": "same", "stale.txt": "old", "bad.txt": "evil"} {
+		if err := os.MkdirAll(filepath.Join(local, "data"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(local, "data", name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Copy written before object was replaced
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(local, "data", "stale.txt"), past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestStorage(t, srv, "", nil)
+	report, err := s.VerifyMirror(context.Background(), &MirrorRule{Source: "gs://bkt/data/", Local: local})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Objects != 4 || report.Missing != 1 || report.Stale != 1 || report.Mismatched != 1 {
+		t.Errorf("report: %+v", report)
+	}
+
+	// Mirror of stored gzip object holds decompressed data
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write([]byte("compressed"))
+	gw.Close()
+	srv.PutObject(testsupport.Object{Bucket: "bkt", Name: "logs/c.log", Content: gzipped.Bytes(), ContentEncoding: "gzip"})
+	os.MkdirAll(filepath.Join(local, "logs"), 0755)
+	os.WriteFile(filepath.Join(local, "logs", "c.log"), []byte("compressed"), 0644)
+	if report, err = s.VerifyMirror(context.Background(), &MirrorRule{Source: "gs://bkt/logs/", Local: local}); err != nil {
+		t.Fatal(err)
+	}
+	if report.Objects != 1 || report.Missing+report.Stale+report.Mismatched != 0 {
+		t.Errorf("report of gzip object: %+v", report)
+	}
+}
+
+func TestE2EHedgedStraggler(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+
+	fixtures := map[string]string{}
+	for i := 0; i < 12; i++ {
+		fixtures[fmt.Sprintf("parts/%02d.bin", i)] = fmt.Sprintf("part %d", i)
+	}
+	srv.Seed("bkt", fixtures)
+	srv.Stall("bkt", "parts/11.bin", 1) // <= last object, median is known by then
+
+	s := newTestStorage(t, srv, "gs://bkt/parts/", func(cfg *Config) {
+		cfg.Hedge = 5
+	})
+	done := make(chan error, 1)
+	go func() { done <- runTransfers(s) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("straggler was not hedged")
+	}
+
+	for name, content := range fixtures {
+		assertFile(t, filepath.Join(s.Config.DestinationPath, name), []byte(content))
+	}
+	if _, err := os.Stat(filepath.Join(s.Config.DestinationPath, "parts", "11.bin"+hedgeSuffix)); !os.IsNotExist(err) {
+		t.Errorf("staging file of hedged download was left behind: %v", err)
+	}
+	if n := srv.CountRequests("GET", "/bkt/parts/11.bin"); n != 2 {
+		t.Errorf("straggler was requested %d times, want 2", n)
+	}
+	if s.Status.Done != 12 || len(s.Status.InFlight) != 0 {
+		t.Errorf("status: %d done, %d in flight", s.Status.Done, len(s.Status.InFlight))
+	}
+}
+
+func TestE2EBucketCopy(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("src", map[string]string{
+		"data/a.txt":     "alpha",
+		"data/sub/b.txt": "beta beta beta",
+		"other/c.txt":    "gamma",
+	})
+	srv.CreateBucket("dst")
+	srv.RewriteChunk = 4 // <= several rewrite calls per object
+
+	s := newTestStorage(t, srv, "gs://src/data", func(cfg *Config) {
+		cfg.Command = "copy"
+		cfg.DestBucket, cfg.DestPrefix = "dst", "backup"
+		cfg.Jobs = 2
+		cfg.isMultiThread = true
+	})
+	copies, err := s.PlanCopies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CopyObjects(copies); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range map[string]string{"backup/data/a.txt": "alpha", "backup/data/sub/b.txt": "beta beta beta"} {
+		if obj := srv.Object("dst", name); obj == nil || string(obj.Content) != content {
+			t.Errorf("gs://dst/%s was not copied", name)
+		}
+	}
+	if srv.Object("dst", "backup/other/c.txt") != nil {
+		t.Error("object outside of prefix was copied")
+	}
+	if n := srv.CountRequests("POST", "/rewriteTo/"); n != 2+4 {
+		t.Errorf("%d rewrite calls, want 6", n)
+	}
+	if n := srv.CountRequests("GET", "/src/data"); n != 0 {
+		t.Errorf("%d objects were downloaded instead of copied server-side", n)
+	}
+	if s.Status.Bytes != int64(5+14) {
+		t.Errorf("status: %d bytes copied", s.Status.Bytes)
+	}
+}
+
+func TestE2EListAndRemove(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{
+		"data/a.txt":     "alpha",
+		"data/sub/b.txt": "beta",
+	})
+
+	s := newTestStorage(t, srv, "", nil)
+	level, err := s.ListLevel("bkt", "data/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(level) != 2 || level[0].Name != "data/a.txt" || level[1].Prefix != "data/sub/" {
+		t.Errorf("one level listing: %+v", level)
+	}
+	all, err := s.ListLevel("bkt", "data/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[1].Name != "data/sub/b.txt" {
+		t.Errorf("recursive listing: %+v", all)
+	}
+	if line := formatListEntry("bkt", level[0], true); !strings.HasPrefix(line, "           5  ") ||
+		!strings.HasSuffix(line, "  STANDARD  "+encodeCRC32C(level[0].CRC32C)+"  gs://bkt/data/a.txt") {
+		t.Errorf("long listing: %q", line)
+	}
+	if line := formatListEntry("bkt", level[1], true); strings.TrimSpace(line) != "gs://bkt/data/sub/" {
+		t.Errorf("long listing of prefix: %q", line)
+	}
+	data, _ := json.Marshal(NewListEntry("bkt", level[1]))
+	if string(data) != `{"url":"gs://bkt/data/sub/","prefix":true,"size":0}` {
+		t.Errorf("JSON listing of prefix: %s", data)
+	}
+
+	// Deleted object missing on retry is not a failure
+	srv.Fail("DELETE", "/o/data", http.StatusServiceUnavailable, 1)
+	if err := s.RemoveObject("bkt", "data/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if srv.Object("bkt", "data/a.txt") != nil {
+		t.Error("data/a.txt was not removed")
+	}
+	if err := s.RemoveObject("bkt", "data/missing.txt"); errorCode(err) != "object_not_found" {
+		t.Errorf("removing missing object: %v", err)
+	}
+
+	// Recursive removal keeps objects which only share start of prefix
+	srv.Seed("bkt", map[string]string{"logs": "marker", "logs/1.txt": "1", "logs/2/3.txt": "3", "logs2/4.txt": "4"})
+	removals, err := s.ListRemovals("bkt", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, r := range removals {
+		names = append(names, r.Object)
+	}
+	if strings.Join(names, ",") != "logs,logs/1.txt,logs/2/3.txt" {
+		t.Errorf("rm -r logs: got %v", names)
+	}
+	if err := confirm("Delete 3 objects?", strings.NewReader("")); !errors.Is(err, ErrNotConfirmed) {
+		t.Errorf("unanswered confirmation: %v", err)
+	}
+	if err := confirm("Delete 3 objects?", strings.NewReader("yes\n")); err != nil {
+		t.Errorf("confirmed removal: %v", err)
+	}
+}
+
+func TestE2EBatchedRemove(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	fixtures := map[string]string{}
+	for i := 0; i < 250; i++ {
+		fixtures[fmt.Sprintf("tmp/%03d.txt", i)] = "x"
+	}
+	srv.Seed("bkt", fixtures)
+	srv.Object("bkt", "tmp/042.txt").TemporaryHold = true
+	srv.Fail("DELETE", "/o/tmp/007.txt", http.StatusServiceUnavailable, 1)
+
+	s := newTestStorage(t, srv, "", func(cfg *Config) {
+		cfg.isMultiThread = true
+		cfg.Jobs = 2
+		cfg.ContinueOnError = true
+	})
+	removals, err := s.ListRemovals("bkt", "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Throttled call is retried with rest of its batch, held object fails alone
+	err = s.RemoveObjects(removals, 100)
+	var failures *FailuresError
+	if !errors.As(err, &failures) || len(failures.Failures) != 1 || failures.Failures[0].Object != "tmp/042.txt" ||
+		errorCode(failures.Failures[0]) != "object_immutable" {
+		t.Fatalf("batched removal: %v", err)
+	}
+	if left, _ := s.ListLevel("bkt", "tmp/", true); len(left) != 1 {
+		t.Errorf("objects left: %d, want 1", len(left))
+	}
+	if n := srv.CountRequests("POST", "/batch/storage/v1"); n != 4 {
+		t.Errorf("got %d batch requests, want 3 and 1 retry", n)
+	}
+
+	// Deletions of -max-qps wait for their slots
+	limiter := NewRateLimiter(100)
+	started := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := limiter.Wait(context.Background(), 25); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(started); elapsed < 450*time.Millisecond {
+		t.Errorf("75 deletions at 100/s took %s", elapsed)
+	}
+}
+
+func TestE2EGenerationURLs(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Versioned = map[string]bool{"bkt": true}
+	old := srv.Put("bkt", "data/a.txt", []byte("first"))
+	live := srv.Put("bkt", "data/a.txt", []byte("second"))
+	srv.Put("bkt", "data/b#c.txt", []byte("hash"))
+
+	if bucket, object, generation, err := parseVersionedUrl("gs://bkt/data/a.txt#123"); err != nil || bucket != "bkt" || object != "data/a.txt" || generation != 123 {
+		t.Errorf("parsed %q %q %d %v", bucket, object, generation, err)
+	}
+	if _, object, generation, err := parseVersionedUrl("gs://bkt/data/b#c.txt"); err != nil || object != "data/b#c.txt" || generation != 0 {
+		t.Errorf("name with \"#\": %q %d %v", object, generation, err)
+	}
+	if _, _, err := parseGCSUrl("gs://bkt/data/a.txt#123"); err == nil {
+		t.Error("generation suffix is accepted where live objects are expected")
+	}
+
+	uri := fmt.Sprintf("gs://bkt/data/a.txt#%d", old.Generation)
+	s := newTestStorage(t, srv, "", func(cfg *Config) {
+		cfg.Uri = uri
+		cfg.BucketName, cfg.Prefix, cfg.Generation, _ = parseVersionedUrl(uri)
+	})
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(s.Config.DestinationPath, "data", "a.txt")); string(data) != "first" {
+		t.Errorf("got %q of generation %d, want \"first\"", data, old.Generation)
+	}
+
+	// Noncurrent generations are listed before live one
+	versions, err := s.ListVersions("bkt", "data/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 || versions[0].Generation != old.Generation || versions[1].Generation != live.Generation || versions[2].Name != "data/b#c.txt" {
+		t.Errorf("listing of versions: %+v", versions)
+	}
+	if current, err := s.ListLevel("bkt", "data/", true); err != nil || len(current) != 2 {
+		t.Errorf("listing without versions: %+v %v", current, err)
+	}
+
+	missing := fmt.Sprintf("gs://bkt/data/a.txt#%d", live.Generation+100)
+	s = newTestStorage(t, srv, "", func(cfg *Config) {
+		cfg.Uri = missing
+		cfg.BucketName, cfg.Prefix, cfg.Generation, _ = parseVersionedUrl(missing)
+	})
+	if _, err := s.ListObjects(); !errors.Is(err, ErrNoURLsMatched) {
+		t.Errorf("missing generation: %v", err)
+	}
+}
+
+func TestE2ERequesterPays(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{"data/a.txt": "alpha", "data/sub/b.txt": "beta"})
+	srv.RequesterPays = map[string]bool{"bkt": true}
+
+	s := newTestStorage(t, srv, "gs://bkt/data", nil)
+	if _, err := s.ListObjects(); errorCode(err) != "requester_pays" {
+		t.Errorf("listing without billing project: %v (%s)", err, errorCode(err))
+	}
+
+	s = newTestStorage(t, srv, "gs://bkt/data", func(cfg *Config) {
+		cfg.BillingProject = "billed-project"
+	})
+	if err := runTransfers(s); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(s.Config.DestinationPath, "data", "sub", "b.txt")); string(data) != "beta" {
+		t.Errorf("got %q, want \"beta\"", data)
+	}
+	if level, err := s.ListLevel("bkt", "data/", false); err != nil || len(level) != 2 {
+		t.Errorf("listing with billing project: %+v %v", level, err)
+	}
+
+	// Raw JSON API requests are billed as well
+	ctx := context.Background()
+	if _, err := s.ComponentCount(ctx, "bkt", "data/a.txt", 0); err != nil {
+		t.Errorf("component count with billing project: %v", err)
+	}
+	if _, err := s.objectProtection(ctx, "bkt", "data/a.txt"); err != nil {
+		t.Errorf("protection with billing project: %v", err)
+	}
+	s.Config.RetainFor, s.Config.RetentionMode = time.Hour, "Unlocked"
+	if err := s.SetRetention(ctx, "bkt", "data/a.txt", srv.Object("bkt", "data/a.txt").Generation); err != nil {
+		t.Errorf("retention with billing project: %v", err)
+	}
+}
+
+func TestE2ECat(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	srv.Put("bkt", "big.bin", content)
+
+	s := newTestStorage(t, srv, "", nil)
+	for spec, want := range map[string][]byte{
+		"":          content,
+		"0-9":       content[:10],
+		"99990-":    content[99990:],
+		"-5":        content[len(content)-5:],
+		"10-999999": content[10:],
+	} {
+		offset, length, err := parseByteRange(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := &bytes.Buffer{}
+		if err := s.CatObject(out, "bkt", "big.bin", offset, length); err != nil {
+			t.Fatalf("range %q: %v", spec, err)
+		}
+		if !bytes.Equal(out.Bytes(), want) {
+			t.Errorf("range %q: got %d bytes, want %d", spec, out.Len(), len(want))
+		}
+	}
+	for _, spec := range []string{"5", "9-3", "-0", "a-b", "-"} {
+		if _, _, err := parseByteRange(spec); err == nil {
+			t.Errorf("range %q was accepted", spec)
+		}
+	}
+
+	// Retry continues after written bytes, also when range was given from end
+	srv.Truncate("bkt", "big.bin", 1000)
+	out := &bytes.Buffer{}
+	if err := s.CatObject(out, "bkt", "big.bin", -50000, -1); err != nil || !bytes.Equal(out.Bytes(), content[50000:]) {
+		t.Errorf("interrupted stream: %v, got %d bytes", err, out.Len())
+	}
+
+	if err := s.CatObject(io.Discard, "bkt", "missing.bin", 0, -1); errorCode(err) != "object_not_found" {
+		t.Errorf("missing object: %v", err)
+	}
+}
+
+func TestE2EStat(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	obj := srv.PutObject(testsupport.Object{
+		Bucket:         "bkt",
+		Name:           "data/a.csv",
+		Content:        []byte("alpha"),
+		ContentType:    "text/csv",
+		Metadata:       map[string]string{"owner": "etl", "batch": "42"},
+		EventBasedHold: true,
+	})
+	srv.PutObject(testsupport.Object{Bucket: "bkt", Name: "joined.bin", Content: []byte("abc"), ComponentCount: 3})
+
+	s := newTestStorage(t, srv, "", nil)
+	stat, err := s.StatObject("bkt", "data/a.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := formatObjectStat(stat)
+	for _, want := range []string{
+		"gs://bkt/data/a.csv:\n",
+		"    Content-Length:        5\n",
+		"    Content-Type:          text/csv\n",
+		"    Metadata:\n        batch:             42\n        owner:             etl\n",
+		"    Hash (crc32c):         " + encodeCRC32C(crc32.Checksum([]byte("alpha"), crc32.MakeTable(crc32.Castagnoli))) + "\n",
+		fmt.Sprintf("    Generation:            %d\n", obj.Generation),
+		"    Event-Based Hold:      Enabled\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("stat output misses %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "Temporary Hold") || strings.Contains(out, "Component-Count") {
+		t.Errorf("unset attributes printed:\n%s", out)
+	}
+
+	composite, err := s.StatObject("bkt", "joined.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if composite.ComponentCount != 3 || composite.MD5 != "" {
+		t.Errorf("composite object: %+v", composite)
+	}
+	if _, err := s.StatObject("bkt", "missing.csv"); errorCode(err) != "object_not_found" {
+		t.Errorf("missing object: %v", err)
+	}
+}
+
+func TestE2ERsync(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{
+		"data/a.txt":     "alpha",
+		"data/sub/b.txt": "beta",
+		"other/c.txt":    "gamma",
+	})
+
+	local := t.TempDir()
+	sync := func(remote string, upload, remove bool) string {
+		t.Helper()
+		s := newTestStorage(t, srv, "", func(cfg *Config) {
+			cfg.Command = "rsync"
+			cfg.OnConflict = "fail"
+			if err := setSyncPaths(cfg, remote, local, upload); err != nil {
+				t.Fatal(err)
+			}
+		})
+		run := s.SyncDownload
+		if upload {
+			run = s.SyncUpload
+		}
+		report, _, err := run(remove, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("%d copied, %d unchanged, %d removed", report.Copied, report.Unchanged, report.Removed)
+	}
+
+	// Files are placed relative to prefix, second run finds them by size and modification time
+	if got := sync("gs://bkt/data", false, false); got != "2 copied, 0 unchanged, 0 removed" {
+		t.Errorf("first download: %s", got)
+	}
+	assertFile(t, filepath.Join(local, "sub", "b.txt"), []byte("beta"))
+	if got := sync("gs://bkt/data", false, false); got != "0 copied, 2 unchanged, 0 removed" {
+		t.Errorf("second download: %s", got)
+	}
+
+	// Same size with other data is found by checksum
+	srv.PutObject(testsupport.Object{Bucket: "bkt", Name: "data/a.txt", Content: []byte("ALPHA"), Updated: time.Now().Add(time.Hour)})
+	if err := os.WriteFile(filepath.Join(local, "extra.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := sync("gs://bkt/data/", false, true); got != "1 copied, 1 unchanged, 1 removed" {
+		t.Errorf("changed download: %s", got)
+	}
+	assertFile(t, filepath.Join(local, "a.txt"), []byte("ALPHA"))
+	if _, err := os.Stat(filepath.Join(local, "extra.txt")); !os.IsNotExist(err) {
+		t.Errorf("file without object was kept: %v", err)
+	}
+
+	// Uploads record modification time of files in metadata
+	if got := sync("gs://bkt/up", true, false); got != "2 copied, 0 unchanged, 0 removed" {
+		t.Errorf("first upload: %s", got)
+	}
+	srv.Put("bkt", "up/stale.txt", []byte("old"))
+	if got := sync("gs://bkt/up", true, true); got != "0 copied, 2 unchanged, 1 removed" {
+		t.Errorf("second upload: %s", got)
+	}
+	if srv.Object("bkt", "up/stale.txt") != nil || srv.Object("bkt", "up/sub/b.txt") == nil {
+		t.Errorf("objects after upload with -d: stale %v", srv.Object("bkt", "up/stale.txt"))
+	}
+
+	// Decompressed file of stored gzip object is compared with decompressed data, not stored size
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write([]byte("delta delta delta delta"))
+	gw.Close()
+	srv.PutObject(testsupport.Object{Bucket: "bkt", Name: "logs/d.log", Content: gzipped.Bytes(), ContentEncoding: "gzip"})
+	local = t.TempDir()
+	if got := sync("gs://bkt/logs", false, false); got != "1 copied, 0 unchanged, 0 removed" {
+		t.Errorf("first download of gzip object: %s", got)
+	}
+	assertFile(t, filepath.Join(local, "d.log"), []byte("delta delta delta delta"))
+	touched := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(local, "d.log"), touched, touched)
+	if got := sync("gs://bkt/logs", false, false); got != "0 copied, 1 unchanged, 0 removed" {
+		t.Errorf("second download of gzip object: %s", got)
+	}
+	os.WriteFile(filepath.Join(local, "d.log"), []byte("delta delta delta DELTA"), 0644)
+	os.Chtimes(filepath.Join(local, "d.log"), touched, touched)
+	if got := sync("gs://bkt/logs", false, false); got != "1 copied, 0 unchanged, 0 removed" {
+		t.Errorf("changed download of gzip object: %s", got)
+	}
+}
+
+func TestE2EDryRun(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{"data/a.txt": "alpha", "data/sub/b.txt": "beta", "data/c.txt": "gamma"})
+
+	// Planned transfers are printed, destination directory is not created
+	dir := filepath.Join(t.TempDir(), "missing")
+	s := newTestStorage(t, srv, "gs://bkt/data/", func(cfg *Config) {
+		cfg.DestinationPath = dir
+		cfg.DryRun = true
+	})
+	transfers, err := s.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.PrintDryRun(transfers)
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("dry run created destination: %v", err)
+	}
+
+	// Sync counts files to copy and remove, none are changed
+	local := t.TempDir()
+	if err := os.WriteFile(filepath.Join(local, "a.txt"), []byte("alpha"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(local, "extra.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s = newTestStorage(t, srv, "", func(cfg *Config) {
+		cfg.Command = "rsync"
+		cfg.OnConflict = "fail"
+		cfg.DryRun = true
+		if err := setSyncPaths(cfg, "gs://bkt/data", local, false); err != nil {
+			t.Fatal(err)
+		}
+	})
+	report, _, err := s.SyncDownload(true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Copied != 2 || report.Unchanged != 1 || report.Removed != 1 {
+		t.Errorf("got %d to copy, %d unchanged, %d to remove", report.Copied, report.Unchanged, report.Removed)
+	}
+	entries, err := os.ReadDir(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("dry run changed directory: %d entries", len(entries))
+	}
+}
+
+func TestE2EQueueWorkers(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{
+		"data/a.txt": "alpha",
+		"data/b.txt": "beta",
+		"data/c.txt": "gamma",
+		"data/d.txt": "delta",
+		"data/e/":    "",
+		"other.txt":  "other",
+	})
+	const topic, subscription = "projects/p/topics/jobs", "projects/p/subscriptions/workers"
+	ps := testsupport.NewPubSubServer()
+	defer ps.Close()
+	ps.CreateSubscription(topic, subscription, 200*time.Millisecond)
+	os.Setenv("PUBSUB_EMULATOR_HOST", strings.TrimPrefix(ps.URL, "http://"))
+	defer os.Unsetenv("PUBSUB_EMULATOR_HOST")
+
+	s := newTestStorage(t, srv, "", nil)
+	publisher, err := NewPubSubQueue(s.Ctx, s.Config.Transport, topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, messages, err := s.EnqueueObjects(publisher, "bkt", "data/", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if objects != 4 || messages != 2 {
+		t.Fatalf("enqueued %d objects in %d messages, want 4 in 2", objects, messages)
+	}
+
+	// Worker dying after pull leaves its message to others once lease expires
+	dead, err := NewPubSubQueue(s.Ctx, s.Config.Transport, subscription)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := dead.Pull(s.Ctx); err != nil || msg == nil {
+		t.Fatalf("pull of dying worker: %v, %v", msg, err)
+	}
+
+	dest := t.TempDir()
+	workers := make([]*Storage, 2)
+	for i := range workers {
+		workers[i] = newTestStorage(t, srv, "", func(cfg *Config) {
+			cfg.Queue = subscription
+			cfg.QueueIdle = time.Second
+			cfg.DestinationPath = dest
+		})
+	}
+	errs := make([]error, len(workers))
+	var wg sync.WaitGroup
+	for i, w := range workers {
+		wg.Add(1)
+		go func(i int, w *Storage) {
+			defer wg.Done()
+			_, errs[i] = w.RunQueueWorker()
+		}(i, w)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range map[string]string{"a.txt": "alpha", "b.txt": "beta", "c.txt": "gamma", "d.txt": "delta"} {
+		assertFile(t, filepath.Join(dest, "data", name), []byte(content))
+	}
+	if left := ps.Messages(subscription); len(left) != 0 {
+		t.Errorf("messages left in queue: %+v", left)
+	}
+
+	// Batch failing permanently is done also when worker stops on it, malformed one is dropped
+	publisher.Publish(s.Ctx, []byte("not a URL\n"))
+	publisher.Publish(s.Ctx, []byte("gs://bkt/data/missing.txt\ngs://bkt/data/b.txt\n"))
+	worker := newTestStorage(t, srv, "", func(cfg *Config) {
+		cfg.Queue = subscription
+		cfg.QueueIdle = time.Second
+	})
+	failed, err := worker.RunQueueWorker()
+	var failures *FailuresError
+	if !errors.As(err, &failures) || len(failures.Failures) != 1 || errorCode(failures.Failures[0]) != "object_not_found" {
+		t.Fatalf("missing object: %v", err)
+	}
+	if len(failed) != 1 || failed[0].URI() != "gs://bkt/data/missing.txt" {
+		t.Errorf("failed objects: %v", failed)
+	}
+	assertFile(t, filepath.Join(worker.Config.DestinationPath, "data", "b.txt"), []byte("beta"))
+	if left := ps.Messages(subscription); len(left) != 0 {
+		t.Fatalf("batch with permanent failure left in queue: %+v", left)
+	}
+
+	// Permanent failures would fail every delivery, batch is done with them and copied objects are kept
+	publisher.Publish(s.Ctx, []byte("gs://bkt/data/a.txt\ngs://bkt/data/gone.txt\n"))
+	deadLetter := filepath.Join(t.TempDir(), "dead.jsonl")
+	worker = newTestStorage(t, srv, "", func(cfg *Config) {
+		cfg.Queue = subscription
+		cfg.QueueIdle = time.Second
+		cfg.ContinueOnError = true
+		cfg.DeadLetter = deadLetter
+	})
+	failed, err = worker.RunQueueWorker()
+	if !errors.Is(err, ErrTransfersFailed) || len(failed) != 1 || failed[0].URI() != "gs://bkt/data/gone.txt" {
+		t.Fatalf("permanent failure: %v, %v", failed, err)
+	}
+	worker.DeadLetters.Close()
+	assertFile(t, filepath.Join(worker.Config.DestinationPath, "data", "a.txt"), []byte("alpha"))
+	if left := ps.Messages(subscription); len(left) != 0 {
+		t.Errorf("batch with permanent failure left in queue: %+v", left)
+	}
+	if data, _ := os.ReadFile(deadLetter); !strings.Contains(string(data), "gs://bkt/data/gone.txt") || strings.Count(string(data), "\n") != 1 {
+		t.Errorf("dead letters: %s", data)
+	}
+
+	// Batch which may pass later is released with backoff, not at once
+	publisher.Publish(s.Ctx, []byte("gs://bkt/data/missing.txt\n"))
+	worker = newTestStorage(t, srv, "", func(cfg *Config) {
+		cfg.Queue = subscription
+		cfg.QueueIdle = 200 * time.Millisecond
+		cfg.ContinueOnError = true
+		cfg.Retry, _ = NewRetryPolicy(1, 10*time.Millisecond, 50*time.Millisecond, 0, "object_not_found")
+	})
+	if failed, err := worker.RunQueueWorker(); err != nil || len(failed) != 0 {
+		t.Fatalf("retryable failure: %v, %v", failed, err)
+	}
+	if msg, err := dead.Pull(s.Ctx); err != nil || msg != nil {
+		t.Fatalf("released message delivered at once: %v, %v", msg, err)
+	}
+	time.Sleep(time.Second)
+	msg, err := dead.Pull(s.Ctx)
+	if err != nil || msg == nil {
+		t.Fatalf("released message not delivered again: %v, %v", msg, err)
+	}
+	if err := dead.Ack(s.Ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestE2EQueuePriorityLanes(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{
+		"bulk/a.txt":   "alpha",
+		"bulk/b.txt":   "beta",
+		"bulk/c.txt":   "gamma",
+		"urgent/x.txt": "xray",
+	})
+	const bulk, urgent = "projects/p/subscriptions/bulk", "projects/p/subscriptions/urgent"
+	ps := testsupport.NewPubSubServer()
+	defer ps.Close()
+	ps.CreateSubscription("projects/p/topics/bulk", bulk, time.Minute)
+	ps.CreateSubscription("projects/p/topics/urgent", urgent, time.Minute)
+	os.Setenv("PUBSUB_EMULATOR_HOST", strings.TrimPrefix(ps.URL, "http://"))
+	defer os.Unsetenv("PUBSUB_EMULATOR_HOST")
+
+	// Bulk job is published first, urgent object after it
+	s := newTestStorage(t, srv, "", nil)
+	for _, job := range []struct{ topic, prefix string }{{"projects/p/topics/bulk", "bulk/"}, {"projects/p/topics/urgent", "urgent/x.txt"}} {
+		publisher, err := NewPubSubQueue(s.Ctx, s.Config.Transport, job.topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := s.EnqueueObjects(publisher, "bkt", job.prefix, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out bytes.Buffer
+	console.RedirectStdout(&out)
+	defer console.RedirectStdout(os.Stdout)
+	w := newTestStorage(t, srv, "", func(cfg *Config) {
+		cfg.Queue = urgent + "," + bulk
+		cfg.QueueIdle = 200 * time.Millisecond
+	})
+	if _, ok := w.Queue.(*PriorityQueue); !ok {
+		t.Fatalf("got queue %T, want lanes of PriorityQueue", w.Queue)
+	}
+	if _, err := w.RunQueueWorker(); err != nil {
+		t.Fatal(err)
+	}
+	console.Flush()
+
+	var order []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.HasPrefix(line, "Copying ") {
+			order = append(order, strings.Fields(line)[1])
+		}
+	}
+	want := []string{"urgent/x.txt", "bulk/a.txt", "bulk/b.txt", "bulk/c.txt"}
+	if strings.Join(order, " ") != strings.Join(want, " ") {
+		t.Errorf("copied %v, want %v", order, want)
+	}
+	for _, sub := range []string{bulk, urgent} {
+		if messages := ps.Messages(sub); len(messages) != 0 {
+			t.Errorf("%s: %d messages were not acknowledged", sub, len(messages))
+		}
+	}
+}
+
+func TestE2EWatchLocal(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("bkt")
+
+	local := t.TempDir()
+	os.WriteFile(filepath.Join(local, "a.txt"), []byte("alpha"), 0644)
+	s := newTestStorage(t, srv, "", func(cfg *Config) {
+		cfg.Command = "watch-local"
+		if err := setSyncPaths(cfg, "gs://bkt/up", local, true); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if _, _, err := s.SyncUpload(false, false); err != nil {
+		t.Fatal(err)
+	}
+	lw, err := NewLocalWatch(local, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Watcher reports new file
+	watcher, err := newDirWatcher(local, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	os.MkdirAll(filepath.Join(local, "sub"), 0755)
+	os.WriteFile(filepath.Join(local, "sub", "b.txt"), []byte("beta"), 0644)
+	select {
+	case path := <-watcher.Changes():
+		if !strings.HasPrefix(path, local) {
+			t.Errorf("change outside of watched directory: %s", path)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no change reported")
+	}
+
+	round := func(paths ...string) string {
+		t.Helper()
+		for i, path := range paths {
+			paths[i] = filepath.Join(local, path)
+		}
+		r, err := s.WatchRound(lw, paths)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("%d uploaded, %d renamed, %d removed, %d failed", r.Uploaded, r.Renamed, r.Removed, len(r.Failed))
+	}
+	if got := round("sub"); got != "1 uploaded, 0 renamed, 0 removed, 0 failed" {
+		t.Errorf("new directory: %s", got)
+	}
+	if got := round("sub/b.txt", "a.txt"); got != "0 uploaded, 0 renamed, 0 removed, 0 failed" {
+		t.Errorf("unchanged files: %s", got)
+	}
+
+	// Renamed file is copied from old object, old name is removed with -d
+	os.Rename(filepath.Join(local, "a.txt"), filepath.Join(local, "renamed.txt"))
+	os.WriteFile(filepath.Join(local, "sub", "b.txt"), []byte("BETA!"), 0644)
+	if got := round("a.txt", "renamed.txt", "sub/b.txt"); got != "1 uploaded, 1 renamed, 1 removed, 0 failed" {
+		t.Errorf("rename and change: %s", got)
+	}
+	if n := srv.CountRequests("POST", "/upload/storage/v1/b/bkt/o"); n != 3 {
+		t.Errorf("renamed file was uploaded again: %d uploads", n)
+	}
+	if obj := srv.Object("bkt", "up/renamed.txt"); obj == nil || string(obj.Content) != "alpha" {
+		t.Errorf("renamed object: %v", obj)
+	}
+	if srv.Object("bkt", "up/a.txt") != nil {
+		t.Errorf("object of old name was kept")
+	}
+
+	os.RemoveAll(filepath.Join(local, "sub"))
+	if got := round("sub"); got != "0 uploaded, 0 renamed, 1 removed, 0 failed" {
+		t.Errorf("removed directory: %s", got)
+	}
+	if srv.Object("bkt", "up/sub/b.txt") != nil {
+		t.Errorf("object of removed file was kept")
+	}
+}
+
+func TestE2EExportDataset(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{
+		"set/a.csv":     "alpha",
+		"set/sub/b.csv": "beta",
+	})
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write([]byte("gamma"))
+	gw.Close()
+	srv.PutObject(testsupport.Object{Bucket: "bkt", Name: "set/c.log", Content: gzipped.Bytes(), ContentEncoding: "gzip"})
+
+	dir := t.TempDir()
+	s := newTestStorage(t, srv, "gs://bkt/set", func(cfg *Config) {
+		cfg.DestinationPath = filepath.Join(dir, datasetData)
+		cfg.NoDecompress = true
+	})
+	if _, err := s.ExportDataset(dir); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, filepath.Join(dir, "data", "set", "sub", "b.csv"), []byte("beta"))
+	assertFile(t, filepath.Join(dir, "data", "set", "c.log"), gzipped.Bytes()) // <= stored data matches checksums of manifest
+
+	report, err := VerifyDataset(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Files != 3 || len(report.Missing)+len(report.Mismatched)+len(report.Unexpected) != 0 {
+		t.Errorf("fresh dataset: %+v", report)
+	}
+
+	// Stored gzip data is imported with its encoding
+	srv.CreateBucket("dst")
+	restore := newTestStorage(t, srv, "gs://dst/restored", nil)
+	if _, err := restore.ImportDataset(dir); err != nil {
+		t.Fatal(err)
+	}
+	if restored := srv.Object("dst", "restored/set/c.log"); restored == nil || restored.ContentEncoding != "gzip" {
+		t.Errorf("imported gzip object: %+v", restored)
+	}
+
+	// Manifest also works for downloads
+	transfers, err := LoadManifest(filepath.Join(dir, datasetManifest), dir, false)
+	if err != nil || len(transfers) != 3 || len(transfers[0].MD5) == 0 {
+		t.Errorf("dataset manifest as -manifest: %v", err)
+	}
+
+	os.WriteFile(filepath.Join(dir, "data", "set", "a.csv"), []byte("alphx"), 0644)
+	os.Remove(filepath.Join(dir, "data", "set", "sub", "b.csv"))
+	os.WriteFile(filepath.Join(dir, "data", "extra.csv"), nil, 0644)
+	if report, err = VerifyDataset(dir); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(report.Mismatched, report.Missing, report.Unexpected) != "[data/set/a.csv] [data/set/sub/b.csv] [data/extra.csv]" {
+		t.Errorf("changed dataset: %+v", report)
+	}
+}
+
+func TestE2EImportDataset(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{
+		"set/a.csv":     "alpha",
+		"set/sub/b.csv": "beta",
+	})
+	srv.CreateBucket("dst")
+
+	dir := t.TempDir()
+	s := newTestStorage(t, srv, "gs://bkt/set", func(cfg *Config) {
+		cfg.DestinationPath = filepath.Join(dir, datasetData)
+	})
+	if _, err := s.ExportDataset(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newTestStorage(t, srv, "gs://dst/restored", nil)
+	report, err := s.ImportDataset(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := srv.Object("dst", "restored/set/sub/b.csv")
+	if restored == nil || string(restored.Content) != "beta" {
+		t.Fatalf("imported object: %+v", restored)
+	}
+	if report.Objects != 2 || report.Dataset != "gs://bkt/set" || report.Entries[1].Generation != restored.Generation ||
+		report.Entries[1].SourceGeneration != srv.Object("bkt", "set/sub/b.csv").Generation {
+		t.Errorf("import report: %+v", report)
+	}
+
+	// Detached signature checks with public key of service account
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := &URLSigner{
+		AccessID:   "import@project.iam.gserviceaccount.com",
+		KeyID:      "k1",
+		PrivateKey: pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+	}
+	path := filepath.Join(dir, importReport)
+	if err := report.Save(path, signer); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	signature, _ := os.ReadFile(path + signatureSuffix)
+	digest := sha256.Sum256(data)
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		t.Errorf("report signature: %v", err)
+	}
+
+	// Changed dataset is refused before anything is uploaded
+	os.WriteFile(filepath.Join(dir, "data", "set", "a.csv"), []byte("alphx"), 0644)
+	uploads := srv.CountRequests("POST", "/upload/")
+	if uploads != 2 {
+		t.Errorf("got %d uploads, want 2", uploads)
+	}
+	s = newTestStorage(t, srv, "gs://dst/again", nil)
+	if _, err := s.ImportDataset(dir); !errors.Is(err, ErrDatasetInvalid) {
+		t.Errorf("changed dataset: got %v, want %v", err, ErrDatasetInvalid)
+	}
+	if n := srv.CountRequests("POST", "/upload/"); n != uploads {
+		t.Errorf("changed dataset uploaded %d files", n-uploads)
+	}
+}
+
+func TestE2EConfigValidation(t *testing.T) {
+	dir := t.TempDir()
+	cases := map[string]struct{ content, want string }{
+		"syntax.json":  {"{\n  \"credentials\": [\n    {\"buckets\": \"a\"}\n}\n", ":4: invalid character"},
+		"unknown.json": {"{\n  \"credentials\": [],\n  \"bogus\": 1\n}\n", ":3: json: unknown field"},
+		"rule.json":    {"{\n  \"credentials\": [\n    {\"buckets\": \"a\", \"anonymous\": true},\n    {\"buckets\": \"\"}\n  ]\n}\n", ":4: credentials 2:"},
+	}
+	for name, c := range cases {
+		fpath := filepath.Join(dir, name)
+		if err := os.WriteFile(fpath, []byte(c.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadFileConfig(fpath); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: got %v, want %q", name, err, c.want)
+		}
+	}
+
+	// Secrets never make it to printed configuration
+	cfg := &Config{
+		Notify:    &NotifyConfig{SMTP: &SMTPConfig{Addr: "mail:25", Password: "hunter2"}},
+		Transport: &TransportConfig{Headers: HeaderFlags{"Authorization": {"Bearer hunter2"}}},
+	}
+	data, err := json.Marshal(effectiveConfig(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "hunter2") || !strings.Contains(string(data), "mail:25") {
+		t.Errorf("effective config: %s", data)
+	}
+}
+
+func TestCommandFlagSets(t *testing.T) {
+	// Commands parse own flag sets, so they can be parsed again and leave global flag set alone
+	for i := 0; i < 2; i++ {
+		cfg := NewConfig("browse", []string{"-m", "gs://bkt/path/"})
+		if cfg.Command != "browse" || cfg.BucketName != "bkt" || cfg.Prefix != "path/" || !cfg.isMultiThread {
+			t.Fatalf("browse config: %+v", cfg)
+		}
+	}
+	if flag.Lookup("m") != nil {
+		t.Error("cp flags registered on global flag set")
+	}
+
+	fs := flag.NewFlagSet("cp", flag.ContinueOnError)
+	fs.Bool("temporary-hold", false, "")
+	fs.Bool("manifest", false, "")
+	if err := fs.Parse([]string{"-temporary-hold", "-manifest"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkUploadFlags(fs, "copy"); err == nil || !strings.Contains(err.Error(), "-temporary-hold") {
+		t.Errorf("upload flag of copy: %v", err)
+	}
+	if err := checkRemoteFlags(fs, "upload"); err == nil || !strings.Contains(err.Error(), "-manifest") {
+		t.Errorf("download flag of upload: %v", err)
+	}
+}
+
+func TestE2ECredentialRenewal(t *testing.T) {
+	srv := testsupport.NewServer()
+	defer srv.Close()
+	srv.Seed("bkt", map[string]string{"a.txt": "alpha"})
+	srv.Token = "token-2" // <= first token expired during job
+
+	mints := 0
+	mint := func(ctx context.Context) (oauth2.TokenSource, error) {
+		mints++
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: fmt.Sprintf("token-%d", mints)}), nil
+	}
+	hc, err := newHTTPClient(context.Background(), &TransportConfig{DialTimeout: time.Second}, mint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := hc.Get(srv.Endpoint() + "b/bkt/o")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || mints != 2 {
+		t.Errorf("got status %d after %d mints, want 200 after 2", resp.StatusCode, mints)
+	}
+}
+
+func TestServiceUnitAndNotify(t *testing.T) {
+	opts := &ServiceOptions{Name: "mirror", Args: []string{"verify", "-config", "/etc/gcs cp/mirrors.json", "-retry-on", "5xx,$CODE"}}
+	unit := systemdUnit(opts, "/usr/local/bin/gcs-cp")
+	want := `ExecStart=/usr/local/bin/gcs-cp service run -name mirror -- verify -config "/etc/gcs cp/mirrors.json" -retry-on 5xx,$$CODE`
+	if !strings.Contains(unit, want+"\n") || !strings.Contains(unit, "Type=notify\n") {
+		t.Errorf("got unit:\n%s", unit)
+	}
+
+	socket := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Skip(err) // <= datagram sockets are not available everywhere
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", socket)
+	err = notifyService("READY=1")
+	os.Unsetenv("NOTIFY_SOCKET")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "READY=1" {
+		t.Errorf("got %q, %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+var (
+	ErrNoURLsMatched    = errors.New("no URLs matched")
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	ErrValidationFailed = errors.New("validation failed")
+	ErrObjectTimeout    = errors.New("object timeout exceeded")
+	ErrNotConfirmed     = errors.New("transfer not confirmed")
+	ErrPathEscape       = errors.New("path escapes destination")
+)
+
+type TransferError struct {
+	Object  string
+	Attempt int
+	Err     error
+}
+
+type ErrorRecord struct {
+	Code      string `json:"code"`
+	Object    string `json:"object,omitempty"`
+	Attempt   int    `json:"attempt,omitempty"`
+	Retryable bool   `json:"retryable"`
+	Message   string `json:"message"`
+	TraceID   string `json:"trace_id,omitempty"`
+}
+
+func (e *TransferError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TransferError) Unwrap() error {
+	return e.Err
+}
+
+/*
+	Build machine-readable record of error
+*/
+func NewErrorRecord(err error) ErrorRecord {
+	record := ErrorRecord{
+		Code:      errorCode(err),
+		Retryable: isRetryable(err),
+		Message:   err.Error(),
+	}
+
+	var te *TransferError
+	if errors.As(err, &te) {
+		record.Object = te.Object
+		record.Attempt = te.Attempt
+	}
+
+	return record
+}
+
+/*
+	Classify error into stable code
+*/
+func errorCode(err error) string {
+	var apiErr *googleapi.Error
+	var netErr net.Error
+	var urlErr *url.Error
+	var pathErr *os.PathError
+
+	// Classified by worker process already
+	var workerErr *WorkerError
+	if errors.As(err, &workerErr) {
+		return workerErr.Code
+	}
+	var accessErr *AccessError
+	if errors.As(err, &accessErr) && len(accessErr.Missing) > 0 {
+		return "permission_denied"
+	}
+
+	switch {
+	case errors.Is(err, storage.ErrObjectNotExist):
+		return "object_not_found"
+	case errors.Is(err, storage.ErrBucketNotExist):
+		return "bucket_not_found"
+	case errors.Is(err, ErrObjectTimeout):
+		return "timeout" // <= stalled attempt, unlike job deadline it may be retried
+	case errors.Is(err, context.DeadlineExceeded):
+		return "deadline_exceeded"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, ErrObjectImmutable):
+		return "object_immutable" // <= refused with 403, waiting for hold or retention does not help
+	case errors.As(err, &apiErr):
+		switch {
+		case apiErr.Code == 401:
+			return "unauthenticated"
+		case apiErr.Code == 403:
+			return "permission_denied"
+		case apiErr.Code == 404:
+			return "not_found"
+		case apiErr.Code == 412:
+			return "precondition_failed"
+		case apiErr.Code == 400 && requesterPays(apiErr):
+			return "requester_pays"
+		case apiErr.Code == 429, apiErr.Code == 503 && slowDown(apiErr):
+			return "rate_limited"
+		case apiErr.Code >= 500:
+			return "server_error"
+		}
+		return fmt.Sprintf("http_%d", apiErr.Code)
+	case errors.Is(err, ErrNoURLsMatched):
+		return "no_urls_matched"
+	case errors.Is(err, ErrChecksumMismatch):
+		return "checksum_mismatch"
+	case errors.Is(err, ErrValidationFailed):
+		return "validation_failed"
+	case errors.Is(err, ErrNotConfirmed):
+		return "not_confirmed"
+	case errors.Is(err, ErrPathEscape):
+		return "path_escape"
+	case errors.Is(err, ErrSinkBroken):
+		return "sink_broken"
+	case errors.Is(err, ErrDatasetInvalid):
+		return "dataset_invalid"
+	case errors.Is(err, ErrIndexCorrupt):
+		return "index_corrupt"
+	case errors.Is(err, ErrTransfersFailed):
+		return "transfers_failed"
+	case errors.Is(err, ErrBundleExpired):
+		return "bundle_expired"
+	case errors.Is(err, ErrKeyResolver):
+		return "key_resolver_failed"
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "connection_interrupted"
+	case errors.As(err, &pathErr):
+		return "local_io" // <= checked before net.Error, syscall.Errno implements it
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &urlErr), errors.As(err, &netErr):
+		return "network"
+	}
+
+	return "unknown"
+}
+
+/*
+	Check if bucket refused request without -billing-project, GCS answers 400 without further reason
+*/
+func requesterPays(apiErr *googleapi.Error) bool {
+	return strings.Contains(strings.ToLower(apiErr.Message), "requester pays")
+}
+
+/*
+	Check if operation failed with error that may succeed on retry
+*/
+func isRetryable(err error) bool {
+	switch errorCode(err) {
+	case "deadline_exceeded", "rate_limited", "server_error", "connection_interrupted", "timeout", "network":
+		return true
+	}
+
+	return false
+}
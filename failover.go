@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Preferred endpoint is tried again after this time
+const endpointFailback = 5 * time.Minute
+
+type EndpointFlags []*url.URL
+
+type failoverTransport struct {
+	base      http.RoundTripper
+	endpoints []*url.URL // <= in order of preference
+
+	mu         sync.Mutex
+	current    int
+	switchedAt time.Time
+}
+
+func (e *EndpointFlags) String() string {
+	return ""
+}
+
+/*
+	Add endpoint from repeated flag, scheme defaults to https
+*/
+func (e *EndpointFlags) Set(value string) error {
+	if !strings.Contains(value, "://") {
+		value = "https://" + value
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("url.Parse: %w", err)
+	}
+	if u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("endpoint must look like \"https://host[:port]\": %s", value)
+	}
+	*e = append(*e, &url.URL{Scheme: u.Scheme, Host: u.Host})
+
+	return nil
+}
+
+/*
+	Regional endpoint of location followed by global endpoint as fallback
+*/
+func locationEndpoints(location string) EndpointFlags {
+	return EndpointFlags{
+		{Scheme: "https", Host: "storage." + strings.ToLower(location) + ".rep.googleapis.com"},
+		{Scheme: "https", Host: "storage.googleapis.com"},
+	}
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	i := t.endpoint()
+
+	// Request must not be modified, clone it first
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.endpoints[i].Scheme
+	req.URL.Host = t.endpoints[i].Host
+	req.Host = ""
+
+	resp, err := t.base.RoundTrip(req)
+	if regionalFailure(req.Context(), resp, err) {
+		t.failed(i, resp, err)
+	}
+
+	return resp, err
+}
+
+/*
+	Endpoint for next request, preferred one again once failback time passed
+*/
+func (t *failoverTransport) endpoint() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.current != 0 && time.Since(t.switchedAt) > endpointFailback {
+		console.Errorf("Endpoint %s: trying preferred endpoint %s again\n", t.endpoints[t.current].Host, t.endpoints[0].Host)
+		t.current = 0
+	}
+
+	return t.current
+}
+
+/*
+	Switch to next endpoint, retries of failed request go there
+*/
+func (t *failoverTransport) failed(i int, resp *http.Response, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Concurrent requests fail together, switch once
+	if t.current != i {
+		return
+	}
+	t.current = (i + 1) % len(t.endpoints)
+	t.switchedAt = time.Now()
+
+	reason := fmt.Sprint(err)
+	if err == nil {
+		reason = resp.Status
+	}
+	console.Errorf("Endpoint %s failed (%s), switching to %s\n", t.endpoints[i].Host, reason, t.endpoints[t.current].Host)
+}
+
+/*
+	Check if request failed in a way another region may not, canceled requests and client errors do not count
+*/
+func regionalFailure(ctx context.Context, resp *http.Response, err error) bool {
+	if err != nil {
+		return ctx.Err() == nil && !errors.Is(err, context.Canceled)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+var ErrTransfersFailed = errors.New("transfers failed")
+
+/*
+	Failed objects of -continue-on-error, job goes on and fails once all objects were tried
+*/
+type FailureReport struct {
+	mu       sync.Mutex
+	failures []*TransferError
+}
+
+type FailuresError struct {
+	Failures []*TransferError
+	Total    int
+}
+
+func (e *FailuresError) Error() string {
+	return fmt.Sprintf("%d of %d objects failed", len(e.Failures), e.Total)
+}
+
+func (e *FailuresError) Unwrap() error {
+	return ErrTransfersFailed
+}
+
+/*
+	Create report for -continue-on-error, nil keeps stopping on first error
+*/
+func NewFailureReport(enabled bool) *FailureReport {
+	if !enabled {
+		return nil
+	}
+
+	return &FailureReport{}
+}
+
+/*
+	Record failed object, returns false when job has to stop: without report, on other errors or once job is canceled
+*/
+func (r *FailureReport) Add(ctx context.Context, err error) bool {
+	te, ok := err.(*TransferError)
+	if r == nil || !ok || ctx.Err() != nil {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures = append(r.failures, te)
+
+	return true
+}
+
+/*
+	Error of job with failed objects sorted by name, nil when none failed
+*/
+func (r *FailureReport) Err(total int) error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.failures) == 0 {
+		return nil
+	}
+
+	failures := append([]*TransferError(nil), r.failures...)
+	sort.SliceStable(failures, func(i, j int) bool {
+		return failures[i].Object < failures[j].Object
+	})
+
+	return &FailuresError{Failures: failures, Total: total}
+}
+
+/*
+	Print table of failed objects with reasons, or their JSON error records with -error-format json
+*/
+func printFailures(e *FailuresError) {
+	if console.ErrorFormat == "json" {
+		for _, failure := range e.Failures {
+			console.Error(failure)
+		}
+		return
+	}
+
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "OBJECT\tCODE\tATTEMPTS\tREASON\n")
+	for _, failure := range e.Failures {
+		reason := strings.ReplaceAll(failure.Err.Error(), "\n", " ")
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", failure.Object, errorCode(failure), failure.Attempt, reason)
+	}
+	w.Flush()
+
+	console.Printf("Failed objects:\n%s", b.String())
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errInjectedReset = errors.New("injected fault: connection reset")
+
+type FaultConfig struct {
+	ErrorRate    float64 // <= share of requests failing, 0..1
+	ErrorCode    int     // <= HTTP status of failed request, 0 fails with network error
+	Latency      time.Duration
+	TruncateAt   int64   // <= media responses are cut after this many bytes, 0 disables
+	TruncateRate float64 // <= share of media responses cut
+	Seed         int64   // <= same seed and request order give same faults
+	Match        string  // <= substring of request path, empty matches all
+}
+
+type faultTransport struct {
+	base http.RoundTripper
+	cfg  *FaultConfig
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+type truncatedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+/*
+	Parse -inject-faults spec, e.g. "error-rate=0.1,error-code=503,latency=50ms,truncate=1048576,seed=7,match=/o/"
+*/
+func ParseFaultConfig(spec string) (*FaultConfig, error) {
+	cfg := &FaultConfig{ErrorCode: http.StatusServiceUnavailable, Seed: 1, TruncateRate: -1}
+
+	for _, field := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("fault must look like name=value: %s", field)
+		}
+
+		var err error
+		switch name, value := kv[0], kv[1]; name {
+		case "error-rate":
+			cfg.ErrorRate, err = parseRate(value)
+		case "error-code":
+			cfg.ErrorCode, err = strconv.Atoi(value)
+		case "latency":
+			cfg.Latency, err = time.ParseDuration(value)
+		case "truncate":
+			cfg.TruncateAt, err = parseSize(value)
+		case "truncate-rate":
+			cfg.TruncateRate, err = parseRate(value)
+		case "seed":
+			cfg.Seed, err = strconv.ParseInt(value, 10, 64)
+		case "match":
+			cfg.Match = value
+		default:
+			return nil, fmt.Errorf("unknown fault: %s", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid fault %s: %w", field, err)
+		}
+	}
+
+	// Truncation alone cuts every media response
+	if cfg.TruncateRate < 0 {
+		cfg.TruncateRate = 0
+		if cfg.TruncateAt > 0 {
+			cfg.TruncateRate = 1
+		}
+	}
+
+	return cfg, nil
+}
+
+func parseRate(value string) (float64, error) {
+	rate, err := strconv.ParseFloat(value, 64)
+	if err == nil && (rate < 0 || rate > 1) {
+		err = fmt.Errorf("rate must be between 0 and 1: %s", value)
+	}
+
+	return rate, err
+}
+
+/*
+	Wrap transport to inject faults below retries, reconnects and verification
+*/
+func newFaultTransport(base http.RoundTripper, cfg *FaultConfig) *faultTransport {
+	return &faultTransport{base: base, cfg: cfg, rng: rand.New(rand.NewSource(cfg.Seed))}
+}
+
+/*
+	Draw from shared sequence, sequential jobs see same faults every run
+*/
+func (t *faultTransport) draw(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.rng.Float64() < rate
+}
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.cfg.Match != "" && !strings.Contains(req.URL.Path, t.cfg.Match) {
+		return t.base.RoundTrip(req)
+	}
+
+	if t.cfg.Latency > 0 {
+		select {
+		case <-time.After(t.cfg.Latency):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	if t.draw(t.cfg.ErrorRate) {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		if t.cfg.ErrorCode == 0 {
+			return nil, errInjectedReset
+		}
+		body := fmt.Sprintf(`{"error":{"code":%d,"message":"injected fault"}}`, t.cfg.ErrorCode)
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", t.cfg.ErrorCode, http.StatusText(t.cfg.ErrorCode)),
+			StatusCode:    t.cfg.ErrorCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": {"application/json"}},
+			Body:          io.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	// Media responses only, JSON API responses are small
+	media := req.Method == http.MethodGet && !strings.Contains(req.URL.Path, "/storage/v1/")
+	if media && t.cfg.TruncateAt > 0 && resp.StatusCode < 300 && t.draw(t.cfg.TruncateRate) {
+		resp.Body = &truncatedBody{ReadCloser: resp.Body, remaining: t.cfg.TruncateAt}
+	}
+
+	return resp, nil
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+
+	return n, err
+}
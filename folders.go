@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// Suffix of zero-byte folder markers created by Hadoop connectors
+const hadoopFolderSuffix = "_$folder$"
+
+type folderList struct {
+	Items []struct {
+		Name string `json:"name"`
+	} `json:"items"`
+	NextPageToken string `json:"nextPageToken"`
+}
+
+/*
+	Base URL of JSON API, same as used by storage client
+*/
+func jsonEndpoint() string {
+	host := os.Getenv("STORAGE_EMULATOR_HOST")
+	if host == "" {
+		return "https://storage.googleapis.com/storage/v1/"
+	}
+
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+	if u, err := url.Parse(host); err == nil && (u.Path == "" || u.Path == "/") {
+		host = strings.TrimSuffix(host, "/") + "/storage/v1"
+	}
+
+	return strings.TrimSuffix(host, "/") + "/"
+}
+
+/*
+	List HNS folders and managed folders by prefix, storage client does not support them
+*/
+func (s *Storage) ListFolders(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	for _, kind := range []string{"folders", "managedFolders"} {
+		found, err := s.listFolders(ctx, kind, prefix)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, found...)
+	}
+
+	return names, nil
+}
+
+func (s *Storage) listFolders(ctx context.Context, kind, prefix string) ([]string, error) {
+	var names []string
+	token := ""
+
+	for {
+		query := url.Values{"prefix": {prefix}}
+		if token != "" {
+			query.Set("pageToken", token)
+		}
+		uri := s.bucketURL(s.Config.BucketName, kind, query)
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+		if err != nil {
+			return nil, fmt.Errorf("http.NewRequest: %w", err)
+		}
+		_, hc := s.route(s.Config.BucketName)
+		resp, err := hc.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("Bucket(%q).%s: %w", s.Config.BucketName, kind, err)
+		}
+
+		if err := googleapi.CheckResponse(resp); err != nil {
+			resp.Body.Close()
+
+			// Buckets without hierarchical namespace have no folders
+			var apiErr *googleapi.Error
+			if errors.As(err, &apiErr) && (apiErr.Code == http.StatusBadRequest || apiErr.Code == http.StatusNotFound) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("Bucket(%q).%s: %w", s.Config.BucketName, kind, err)
+		}
+
+		var page folderList
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("json.Decode: %w", err)
+		}
+
+		for _, item := range page.Items {
+			names = append(names, item.Name)
+		}
+		if token = page.NextPageToken; token == "" {
+			return names, nil
+		}
+	}
+}
+
+/*
+	Add folders missing in objects listing as placeholders, keeps listing order
+*/
+func mergeFolders(objects []*storage.ObjectAttrs, bucket string, folders []string) []*storage.ObjectAttrs {
+	listed := map[string]bool{}
+	for _, attrs := range objects {
+		listed[attrs.Name] = true
+	}
+
+	added := false
+	for _, name := range folders {
+		if !listed[name] {
+			listed[name] = true
+			objects = append(objects, &storage.ObjectAttrs{Bucket: bucket, Name: name})
+			added = true
+		}
+	}
+	if added {
+		sort.Slice(objects, func(i, j int) bool {
+			return objects[i].Name < objects[j].Name
+		})
+	}
+
+	return objects
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const globChars = "*?["
+
+/*
+	Check if object name pattern has wildcards
+*/
+func hasGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, globChars)
+}
+
+/*
+	Longest literal prefix of pattern, objects are listed by it and filtered by pattern
+*/
+func globPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, globChars); i >= 0 {
+		return pattern[:i]
+	}
+
+	return pattern
+}
+
+/*
+	Compile gsutil-style pattern: "*" and "?" stay within one path segment, "**" matches across "/"
+	and "**" followed by "/" also matches no directory at all
+*/
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	var re strings.Builder
+	re.WriteString("^")
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					i++
+					re.WriteString("(?:.*/)?")
+				} else {
+					re.WriteString(".*")
+				}
+				continue
+			}
+			re.WriteString("[^/]*")
+		case '?':
+			re.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated character class in pattern: %s", pattern)
+			}
+			class := pattern[i+1 : i+1+end]
+			if end == 0 {
+				return nil, fmt.Errorf("empty character class in pattern: %s", pattern)
+			}
+			if class[0] == '!' {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+
+	glob, err := regexp.Compile(re.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %s: %w", pattern, err)
+	}
+
+	return glob, nil
+}
+
+type NameFilter struct {
+	Pattern *regexp.Regexp
+	Base    bool // <= glob without "/" matches last segment of name, e.g. "*.tmp" in any directory
+}
+
+type NameFilters []*NameFilter
+
+/*
+	Parse -include/-exclude pattern: glob like source URL, or regular expression after "re:" matched anywhere in name
+*/
+func ParseNameFilter(value string) (*NameFilter, error) {
+	if expr := strings.TrimPrefix(value, "re:"); expr != value {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("regexp.Compile: %w", err)
+		}
+		return &NameFilter{Pattern: re}, nil
+	}
+
+	if value == "" {
+		return nil, fmt.Errorf("empty name filter")
+	}
+	glob, err := compileGlob(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NameFilter{Pattern: glob, Base: !strings.Contains(value, "/")}, nil
+}
+
+/*
+	Check object name against filter, folder placeholders are matched without trailing "/"
+*/
+func (f *NameFilter) Match(name string) bool {
+	if f.Base {
+		name = strings.TrimSuffix(name, "/")
+		name = name[strings.LastIndex(name, "/")+1:]
+	}
+
+	return f.Pattern.MatchString(name)
+}
+
+func (filters *NameFilters) String() string {
+	return ""
+}
+
+/*
+	Add filter from repeated flag
+*/
+func (filters *NameFilters) Set(value string) error {
+	filter, err := ParseNameFilter(value)
+	if err != nil {
+		return err
+	}
+	*filters = append(*filters, filter)
+
+	return nil
+}
+
+/*
+	Check if any filter matches name
+*/
+func (filters NameFilters) Match(name string) bool {
+	for _, filter := range filters {
+		if filter.Match(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+	Object is selected when it matches any include (or there are none) and no exclude
+*/
+func selectName(include, exclude NameFilters, name string) bool {
+	return (len(include) == 0 || include.Match(name)) && !exclude.Match(name)
+}
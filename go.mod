@@ -4,5 +4,7 @@ go 1.16
 
 require (
 	cloud.google.com/go/storage v1.14.0
+	golang.org/x/oauth2 v0.0.0-20210218202405-ba52d332ba99
+	golang.org/x/sys v0.0.0-20210225134936-a50acf3fe073
 	google.golang.org/api v0.40.0
 )
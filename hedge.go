@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	hedgeMinSamples = 10   // <= finished objects needed before median is trusted
+	hedgeWindow     = 1000 // <= median is computed of most recent objects
+	hedgeSuffix     = ".hedge"
+)
+
+type hedgeSample struct {
+	duration time.Duration
+	rate     float64 // <= bytes per second, 0 for unknown size
+}
+
+type Hedger struct {
+	Factor float64 // <= straggler takes this many times longer than median object
+
+	mu      sync.Mutex
+	samples []hedgeSample
+	next    int
+}
+
+type hedgeResult struct {
+	hedge bool
+	err   error
+}
+
+/*
+	Create straggler detector, nil when hedging is disabled
+*/
+func NewHedger(factor float64) *Hedger {
+	if factor <= 0 {
+		return nil
+	}
+
+	return &Hedger{Factor: factor}
+}
+
+/*
+	Remember time of finished object
+*/
+func (h *Hedger) Record(size int64, d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sample := hedgeSample{duration: d}
+	if size > 0 && d > 0 {
+		sample.rate = float64(size) / d.Seconds()
+	}
+
+	if len(h.samples) < hedgeWindow {
+		h.samples = append(h.samples, sample)
+		return
+	}
+	h.samples[h.next] = sample
+	h.next = (h.next + 1) % hedgeWindow
+}
+
+/*
+	Time after which object of given size is a straggler, false until enough objects finished
+*/
+func (h *Hedger) Threshold(size int64) (time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.samples) < hedgeMinSamples {
+		return 0, false
+	}
+
+	durations := make([]time.Duration, 0, len(h.samples))
+	var rates []float64
+	for _, sample := range h.samples {
+		durations = append(durations, sample.duration)
+		if sample.rate > 0 {
+			rates = append(rates, sample.rate)
+		}
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	expected := durations[len(durations)/2]
+
+	// Large objects are expected to take longer, at median throughput
+	if size > 0 && len(rates) > 0 {
+		sort.Float64s(rates)
+		if bySize := time.Duration(float64(size) / rates[len(rates)/2] * float64(time.Second)); bySize > expected {
+			expected = bySize
+		}
+	}
+
+	return time.Duration(float64(expected) * h.Factor), true
+}
+
+/*
+	Download object, straggler gets second attempt on another connection and first finished one is kept
+*/
+func (s *Storage) HedgedDownload(t *Transfer) error {
+	if s.Hedger == nil || t.Directory {
+		return s.DownloadObject(s.Ctx, t)
+	}
+
+	size := int64(-1)
+	if t.Attrs != nil {
+		size = t.Attrs.Size
+	}
+	started := time.Now()
+
+	threshold, ok := s.Hedger.Threshold(size)
+	if !ok {
+		err := s.DownloadObject(s.Ctx, t)
+		if err == nil {
+			s.Hedger.Record(size, time.Since(started))
+		}
+		return err
+	}
+
+	results := make(chan hedgeResult, 2)
+	primaryCtx, cancelPrimary := context.WithCancel(s.Ctx)
+	defer cancelPrimary()
+	go func() {
+		results <- hedgeResult{err: s.DownloadObject(primaryCtx, t)}
+	}()
+
+	timer := time.NewTimer(threshold)
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		if r.err == nil {
+			s.Hedger.Record(size, time.Since(started))
+		}
+		return r.err
+	case <-timer.C:
+	}
+
+	// Second attempt writes to staging file, HTTP/1.1 transport opens new connection for it
+	hedgeCtx, cancelHedge := context.WithCancel(s.Ctx)
+	defer cancelHedge()
+	hedge := *t
+	hedge.Destination = t.Destination + hedgeSuffix
+	hedge.hedgeOf = t
+
+	s.Printf(t.URI(), "Hedging %s, still running after %s\n", t.Object, threshold.Round(time.Millisecond))
+	go func() {
+		release, err := s.acquireSlot(hedgeCtx, t)
+		if err == nil {
+			err = s.DownloadObject(hedgeCtx, &hedge)
+			release()
+		}
+		results <- hedgeResult{hedge: true, err: err}
+	}()
+
+	// Failed attempt does not decide, the other one may still succeed
+	first := <-results
+	if first.err == nil {
+		if first.hedge {
+			cancelPrimary()
+		} else {
+			cancelHedge()
+		}
+	}
+	second := <-results
+
+	primary, secondary := first, second
+	if first.hedge {
+		primary, secondary = second, first
+	}
+
+	switch {
+	case primary.err == nil:
+		// Both may finish at the same time, first attempt is already in place
+		s.Status.Drop(hedge.statusKey())
+		os.Remove(hedge.Destination)
+	case secondary.err == nil:
+		if err := os.Rename(hedge.Destination, t.Destination); err != nil {
+			os.Remove(hedge.Destination)
+			return fmt.Errorf("os.Rename: %w", err)
+		}
+		s.Status.Move(hedge.statusKey(), t.URI())
+		s.Printf(t.URI(), "Hedged %s finished first\n", t.Object)
+	default:
+		s.Status.Drop(hedge.statusKey())
+		return primary.err
+	}
+
+	s.Hedger.Record(size, time.Since(started))
+
+	return nil
+}
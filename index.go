@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	indexMagic   = "GCSIDX1\n"
+	indexFiles   = 'd' // <= entries are files under root directory
+	indexTar     = 't' // <= entries are data ranges of root tar archive
+	maxIndexName = 64 << 10
+)
+
+var ErrIndexCorrupt = errors.New("checksum index corrupt")
+
+/*
+	Downloaded file as recorded by -checksum-index
+*/
+type IndexEntry struct {
+	Name   string // <= slash-separated path relative to root, or name of tar entry
+	Size   int64
+	CRC32C uint32
+	Offset int64 // <= of data in tar archive, -1 for files
+}
+
+type IndexHeader struct {
+	Kind byte
+	Root string // <= absolute destination directory or tar archive
+}
+
+/*
+	Binary index of downloaded files written as they complete, "spot-verify" re-checks sample of them
+*/
+type ChecksumIndex struct {
+	mu     sync.Mutex
+	file   *os.File
+	w      *bufio.Writer
+	closed bool
+}
+
+type SpotReport struct {
+	Indexed    int
+	Checked    int
+	Bytes      int64
+	Mismatched []string // <= names with reason
+}
+
+/*
+	Create index of config, nil without -checksum-index; files of local destination or entries of "tar:FILE" are indexed
+*/
+func NewChecksumIndex(cfg *Config) (*ChecksumIndex, error) {
+	if cfg.ChecksumIndex == "" {
+		return nil, nil
+	}
+
+	header := IndexHeader{Kind: indexFiles, Root: cfg.DestinationPath}
+	if strings.HasPrefix(cfg.Sink, "tar:") {
+		header = IndexHeader{Kind: indexTar, Root: strings.TrimPrefix(cfg.Sink, "tar:")}
+	}
+	root, err := filepath.Abs(header.Root)
+	if err != nil {
+		return nil, fmt.Errorf("filepath.Abs: %w", err)
+	}
+	header.Root = root
+
+	f, err := os.Create(cfg.ChecksumIndex)
+	if err != nil {
+		return nil, fmt.Errorf("os.Create: %w", err)
+	}
+	ix := &ChecksumIndex{file: f, w: bufio.NewWriter(f)}
+	ix.w.WriteString(indexMagic)
+	ix.w.WriteByte(header.Kind)
+	ix.writeString(header.Root)
+
+	return ix, nil
+}
+
+/*
+	Describe downloaded file for index, name is relative to destination or name of tar entry
+*/
+func (s *Storage) indexEntry(t *Transfer, fpath string, out SinkFile, size int64, checksums *checksumWriter) (IndexEntry, error) {
+	entry := IndexEntry{Name: sinkName(t), Size: size, CRC32C: checksums.crc32c.Sum32(), Offset: -1}
+	if archived, ok := out.(ArchivedFile); ok {
+		entry.Offset = archived.ArchiveOffset()
+		return entry, nil
+	}
+
+	root, err := filepath.Abs(s.Config.DestinationPath)
+	if err != nil {
+		return entry, fmt.Errorf("filepath.Abs: %w", err)
+	}
+	if fpath, err = filepath.Abs(fpath); err != nil {
+		return entry, fmt.Errorf("filepath.Abs: %w", err)
+	}
+	rel, err := filepath.Rel(root, fpath)
+	if err != nil {
+		return entry, fmt.Errorf("filepath.Rel: %w", err)
+	}
+	entry.Name = filepath.ToSlash(rel)
+
+	return entry, nil
+}
+
+/*
+	Writer computing CRC32C of downloads for index when nothing is verified, it expects no checksums
+*/
+func indexChecksums() *checksumWriter {
+	return &checksumWriter{transfer: &Transfer{}, md5: md5.New(), crc32c: crc32.New(crc32.MakeTable(crc32.Castagnoli))}
+}
+
+/*
+	Append entry of completed file
+*/
+func (ix *ChecksumIndex) Add(entry IndexEntry) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if ix.closed {
+		return fmt.Errorf("checksum index is closed")
+	}
+	ix.writeString(entry.Name)
+	var b [binary.MaxVarintLen64]byte
+	ix.w.Write(b[:binary.PutUvarint(b[:], uint64(entry.Size))])
+	binary.BigEndian.PutUint32(b[:4], entry.CRC32C)
+	ix.w.Write(b[:4])
+	if _, err := ix.w.Write(b[:binary.PutVarint(b[:], entry.Offset)]); err != nil {
+		return fmt.Errorf("checksum index: %w", err)
+	}
+
+	return nil
+}
+
+func (ix *ChecksumIndex) writeString(value string) {
+	var b [binary.MaxVarintLen64]byte
+	ix.w.Write(b[:binary.PutUvarint(b[:], uint64(len(value)))])
+	ix.w.WriteString(value)
+}
+
+/*
+	Flush and close index, nil index and repeated calls do nothing
+*/
+func (ix *ChecksumIndex) Close() error {
+	if ix == nil {
+		return nil
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if ix.closed {
+		return nil
+	}
+	ix.closed = true
+	if err := ix.w.Flush(); err != nil {
+		ix.file.Close()
+		return fmt.Errorf("checksum index: %w", err)
+	}
+	if err := ix.file.Close(); err != nil {
+		return fmt.Errorf("os.Close: %w", err)
+	}
+
+	return nil
+}
+
+/*
+	Read index, entries are passed to fn one at a time so large indexes need no memory
+*/
+func ReadChecksumIndex(path string, fn func(IndexEntry)) (*IndexHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.Open: %w", err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	magic := make([]byte, len(indexMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != indexMagic {
+		return nil, fmt.Errorf("%w: %s is not checksum index", ErrIndexCorrupt, path)
+	}
+	header := &IndexHeader{}
+	if header.Kind, err = r.ReadByte(); err == nil {
+		header.Root, err = readIndexString(r)
+	}
+	if err != nil || header.Kind != indexFiles && header.Kind != indexTar {
+		return nil, fmt.Errorf("%w: %s: invalid header", ErrIndexCorrupt, path)
+	}
+
+	for n := 1; ; n++ {
+		var entry IndexEntry
+		entry.Name, err = readIndexString(r)
+		if err == io.EOF {
+			return header, nil
+		}
+		var size uint64
+		var crc [4]byte
+		if err == nil {
+			size, err = binary.ReadUvarint(r)
+		}
+		if err == nil {
+			_, err = io.ReadFull(r, crc[:])
+		}
+		if err == nil {
+			entry.Offset, err = binary.ReadVarint(r)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: entry %d is truncated", ErrIndexCorrupt, path, n)
+		}
+		entry.Size = int64(size)
+		entry.CRC32C = binary.BigEndian.Uint32(crc[:])
+		fn(entry)
+	}
+}
+
+func readIndexString(r *bufio.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if n > maxIndexName {
+		return "", ErrIndexCorrupt
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", io.ErrUnexpectedEOF
+	}
+
+	return string(b), nil
+}
+
+/*
+	Parse -sample value: percentage of files ("1%") or their number ("1000")
+*/
+func parseSample(spec string) (float64, int, error) {
+	if strings.HasSuffix(spec, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(spec, "%"), 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return 0, 0, fmt.Errorf("invalid sample %q, percentage must be in (0, 100]", spec)
+		}
+		return percent / 100, 0, nil
+	}
+	count, err := strconv.Atoi(spec)
+	if err != nil || count <= 0 {
+		return 0, 0, fmt.Errorf("invalid sample %q, want percentage like 1%% or number of files", spec)
+	}
+
+	return 0, count, nil
+}
+
+/*
+	Re-check random sample of indexed files against their recorded size and CRC32C
+*/
+func runSpotVerifyCommand(args []string) {
+	fs := flag.NewFlagSet("spot-verify", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s spot-verify [OPTIONS] index\n\nOptions:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	sample := fs.String("sample", "1%", "Files to check: percentage of indexed files or their number")
+	seed := fs.Int64("seed", 0, "Seed of random sample, repeats same sample (0 picks new one)")
+	jobs := fs.Int("j", 4, "Files checked in parallel")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	fraction, count, err := parseSample(*sample)
+	if err != nil {
+		exception(err)
+	}
+	if *jobs < 1 {
+		exception(fmt.Errorf("-j must be positive"))
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	report, err := SpotVerify(fs.Arg(0), fraction, count, *seed, *jobs)
+	if err != nil {
+		exception(err)
+	}
+	for _, problem := range report.Mismatched {
+		console.Printf("Mismatched %s\n", problem)
+	}
+	if len(report.Mismatched) > 0 {
+		exception(fmt.Errorf("%w: %d of %d sampled files", ErrChecksumMismatch, len(report.Mismatched), report.Checked))
+	}
+
+	// Rule of three: no failure in n random files bounds failure rate by 3/n at 95% confidence
+	console.Printf("Spot-verified %d of %d files (%s), none mismatched", report.Checked, report.Indexed, formatBytes(report.Bytes))
+	if bound := 300 / float64(report.Checked); report.Checked > 0 && bound < 100 {
+		console.Printf(": fewer than %.3g%% of files corrupted at 95%% confidence", bound)
+	}
+	console.Printf("\n")
+}
+
+/*
+	Pick sample of index, fraction of files or reservoir of count, and verify it with parallel jobs
+*/
+func SpotVerify(path string, fraction float64, count int, seed int64, jobs int) (*SpotReport, error) {
+	rnd := rand.New(rand.NewSource(seed))
+	report := &SpotReport{}
+	var sampled []IndexEntry
+
+	header, err := ReadChecksumIndex(path, func(entry IndexEntry) {
+		report.Indexed++
+		switch {
+		case fraction > 0:
+			if rnd.Float64() < fraction {
+				sampled = append(sampled, entry)
+			}
+		case len(sampled) < count:
+			sampled = append(sampled, entry)
+		default:
+			if i := rnd.Intn(report.Indexed); i < count {
+				sampled[i] = entry
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var archive *os.File
+	if header.Kind == indexTar {
+		if archive, err = os.Open(header.Root); err != nil {
+			return nil, fmt.Errorf("os.Open: %w", err)
+		}
+		defer archive.Close()
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	entries := make(chan IndexEntry)
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, defaultBufferSize)
+			for entry := range entries {
+				err := verifyIndexEntry(header, archive, entry, buf)
+				mu.Lock()
+				report.Checked++
+				report.Bytes += entry.Size
+				if err != nil {
+					report.Mismatched = append(report.Mismatched, fmt.Sprintf("%s: %v", entry.Name, err))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, entry := range sampled {
+		entries <- entry
+	}
+	close(entries)
+	wg.Wait()
+
+	return report, nil
+}
+
+/*
+	Check size and CRC32C of file, or of data range of tar entry
+*/
+func verifyIndexEntry(header *IndexHeader, archive *os.File, entry IndexEntry, buf []byte) error {
+	var data io.Reader
+	if archive != nil {
+		data = io.NewSectionReader(archive, entry.Offset, entry.Size)
+	} else {
+		f, err := os.Open(filepath.Join(header.Root, filepath.FromSlash(entry.Name)))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		data = f
+	}
+
+	crc := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	n, err := io.CopyBuffer(crc, data, buf)
+	switch {
+	case err != nil:
+		return err
+	case n != entry.Size:
+		return fmt.Errorf("size is %d, indexed %d", n, entry.Size)
+	case crc.Sum32() != entry.CRC32C:
+		return fmt.Errorf("crc32c is %s, indexed %s", encodeCRC32C(crc.Sum32()), encodeCRC32C(entry.CRC32C))
+	}
+
+	return nil
+}
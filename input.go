@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	maxInputLine = 1024 * 1024 // <= longest accepted line of URL list
+	stdinList    = "-"         // <= -I value reading URL list from stdin
+)
+
+/*
+	Read object URLs list (-I), one gs:// URL per line, from local file, GCS object or stdin
+*/
+func (s *Storage) ReadInputList(source string) ([]*storage.ObjectAttrs, error) {
+	ctx, cancel := s.listContext()
+	defer cancel()
+
+	var in io.ReadCloser
+	if source == stdinList {
+		// Whole list is read before transfers start, producer may exit early
+		return readURLList(os.Stdin, "stdin")
+	} else if strings.HasPrefix(source, "gs://") {
+		bucket, object, err := parseGCSUrl(source)
+		if err != nil {
+			return nil, err
+		}
+		if in, err = s.Bucket(bucket).Object(object).NewReader(ctx); err != nil {
+			return nil, fmt.Errorf("Object(%q).NewReader: %w", object, err)
+		}
+	} else {
+		var err error
+		if in, err = os.Open(source); err != nil {
+			return nil, fmt.Errorf("os.Open: %w", err)
+		}
+	}
+	defer in.Close()
+
+	return readURLList(in, source)
+}
+
+/*
+	Check if -I value without destination argument is destination of list piped on stdin, not list file or object
+*/
+func pipedListDestination(value string) bool {
+	if value == stdinList || strings.HasPrefix(value, "gs://") || isTerminal(os.Stdin) {
+		return false
+	}
+	info, err := os.Stat(value)
+
+	return err != nil || !info.Mode().IsRegular()
+}
+
+/*
+	Parse URL list, blank lines and "#" comments are skipped, repeated URLs are copied once
+*/
+func readURLList(in io.Reader, source string) ([]*storage.ObjectAttrs, error) {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), maxInputLine)
+
+	var objects []*storage.ObjectAttrs
+	seen := map[string]bool{}
+
+	for line := 1; scanner.Scan(); line++ {
+		uri := strings.TrimSpace(scanner.Text())
+		if uri == "" || strings.HasPrefix(uri, "#") || seen[uri] {
+			continue
+		}
+		seen[uri] = true
+
+		bucket, object, err := parseGCSUrl(uri)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", source, line, err)
+		}
+		if object == "" || strings.HasSuffix(object, "/") {
+			return nil, fmt.Errorf("%s line %d: URL must name an object: %s", source, line, uri)
+		}
+		objects = append(objects, &storage.ObjectAttrs{Bucket: bucket, Name: object, Size: -1}) // <= size is unknown
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+
+	if len(objects) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoURLsMatched, source)
+	}
+
+	return objects, nil
+}
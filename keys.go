@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	csekSize        = 32 // <= AES-256
+	maxResolverBody = 4 << 10
+)
+
+var ErrKeyResolver = errors.New("key resolver failed")
+
+/*
+	Hook supplying customer-supplied encryption key (CSEK) of each object, command or HTTP endpoint
+*/
+type KeyResolver struct {
+	Command []string // <= "{}" arguments are replaced by object URL, which goes last without placeholder
+	URL     string   // <= GET with "object" query parameter, 404 means object has no key
+	Client  *http.Client
+	Static  []byte // <= key of -encryption-key, used for all objects
+
+	mu   sync.Mutex
+	keys map[string][]byte // <= by object URL, retries and hedges ask once
+}
+
+/*
+	Create resolver of -key-resolver: http(s):// URL or command printing base64 key on stdout, or of -encryption-key;
+	nil without both
+*/
+func NewKeyResolver(spec string, static []byte) *KeyResolver {
+	switch {
+	case static != nil:
+		return &KeyResolver{Static: static}
+	case spec == "":
+		return nil
+	case isHTTPSink(spec):
+		return &KeyResolver{URL: spec, Client: &http.Client{}, keys: map[string][]byte{}}
+	}
+
+	return &KeyResolver{Command: strings.Fields(spec), keys: map[string][]byte{}}
+}
+
+/*
+	Add key of object to handle, resolver may answer that object is not encrypted; nil resolver returns handle as is
+*/
+func (r *KeyResolver) Apply(ctx context.Context, t *Transfer, handle *storage.ObjectHandle) (*storage.ObjectHandle, error) {
+	if r == nil {
+		return handle, nil
+	}
+
+	key, err := r.Key(ctx, t.URI())
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return handle, nil
+	}
+
+	return handle.Key(key), nil
+}
+
+/*
+	Key of object, nil when it is not encrypted with customer-supplied key
+*/
+func (r *KeyResolver) Key(ctx context.Context, uri string) ([]byte, error) {
+	if r.Static != nil {
+		return r.Static, nil
+	}
+
+	r.mu.Lock()
+	key, ok := r.keys[uri]
+	r.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	var encoded string
+	var err error
+	if r.URL != "" {
+		encoded, err = r.fetch(ctx, uri)
+	} else {
+		encoded, err = r.run(ctx, uri)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if encoded != "" {
+		if key, err = base64.StdEncoding.DecodeString(encoded); err != nil || len(key) != csekSize {
+			return nil, fmt.Errorf("%w: %s: key must be base64 of %d bytes", ErrKeyResolver, uri, csekSize)
+		}
+	}
+
+	r.mu.Lock()
+	r.keys[uri] = key
+	r.mu.Unlock()
+
+	return key, nil
+}
+
+/*
+	Decode -encryption-key: base64 key or "env:NAME" of variable holding it, so key stays out of process list
+*/
+func parseEncryptionKey(value string) ([]byte, error) {
+	if name := strings.TrimPrefix(value, "env:"); name != value {
+		var ok bool
+		if value, ok = os.LookupEnv(name); !ok || value == "" {
+			return nil, fmt.Errorf("-encryption-key: environment variable %s is not set", name)
+		}
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil || len(key) != csekSize {
+		return nil, fmt.Errorf("-encryption-key must be base64 of %d bytes (AES-256)", csekSize)
+	}
+
+	return key, nil
+}
+
+/*
+	Ask endpoint for key, server errors are returned as API errors so they are retried
+*/
+func (r *KeyResolver) fetch(ctx context.Context, uri string) (string, error) {
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return "", fmt.Errorf("url.Parse: %w", err)
+	}
+	query := u.Query()
+	query.Set("object", uri)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("http.NewRequest: %w", err)
+	}
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("key resolver: %s: %w", uri, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return "", fmt.Errorf("key resolver: %s: %w", uri, err) // <= 5xx and 429 are retried
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResolverBody))
+	if err != nil {
+		return "", fmt.Errorf("io.ReadAll: %w", err)
+	}
+
+	return strings.TrimSpace(string(body)), nil
+}
+
+/*
+	Run command for key, empty output means object has no key
+*/
+func (r *KeyResolver) run(ctx context.Context, uri string) (string, error) {
+	args := make([]string, 0, len(r.Command)+1)
+	substituted := false
+	for _, arg := range r.Command {
+		if strings.Contains(arg, "{}") {
+			arg = strings.ReplaceAll(arg, "{}", uri)
+			substituted = true
+		}
+		args = append(args, arg)
+	}
+	if !substituted {
+		args = append(args, uri)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			if len(msg) > maxValidatorOutput {
+				msg = "..." + msg[len(msg)-maxValidatorOutput:]
+			}
+			return "", fmt.Errorf("%w: %s: %v: %s", ErrKeyResolver, uri, err, msg)
+		}
+		return "", fmt.Errorf("%w: %s: %v", ErrKeyResolver, uri, err)
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
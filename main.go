@@ -2,261 +2,1872 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
-	"runtime"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/storage"
 	"google.golang.org/api/iterator"
 )
 
+const (
+	exitFailure          = 1
+	exitDeadlineExceeded = 124 // <= same as timeout(1)
+)
+
 type Config struct {
-	isMultiThread   bool
-	Uri             string
-	BucketName      string
-	Prefix          string
-	DestinationPath string
+	isMultiThread       bool
+	Jobs                int // <= workers pool size of multi-threading mode, 0 means number of CPUs
+	Command             string
+	SourcePath          string // <= local file or directory of upload
+	DestBucket          string // <= destination of bucket copy
+	DestPrefix          string
+	Uri                 string
+	BucketName          string
+	Prefix              string
+	BillingProject      string         // <= project billed for requests to requester-pays buckets
+	Generation          int64          // <= exact generation of "object#generation" source URL, 0 for live object
+	Glob                *regexp.Regexp // <= set when prefix has wildcards, listed names must match it
+	Include             NameFilters    // <= listed names must match one of them, when set
+	Exclude             NameFilters    // <= listed names matching any of them are skipped
+	DestinationPath     string
+	ControlSocket       string
+	Retry               *RetryPolicy
+	Timeout             time.Duration
+	ObjectTimeout       time.Duration // <= 0 means no limit
+	ListTimeout         time.Duration // <= limit of each listing, 0 means no limit
+	MinThroughput       int64         // <= bytes per second extending object timeout by size
+	FailureManifest     string
+	Transport           *TransportConfig
+	ReconnectAttempts   int
+	MaxMemory           int64
+	PprofAddr           string
+	Deterministic       bool
+	Manifest            string
+	Plan                *TransferPlan // <= of -plan-in, replaces listing
+	PlanOut             string
+	Rename              RenameRules
+	Flatten             bool // <= files get base name of objects, directories are not created
+	NameCase            string
+	OnConflict          string // <= policy for objects mapped to same destination
+	DateLayout          string
+	CreateEmptyDirs     bool
+	CreateDirs          bool // <= create missing destination path, otherwise it has to exist
+	ValidateCmd         []string
+	KeyResolver         string // <= command or URL supplying encryption key of each object
+	EncryptionKey       []byte // <= customer-supplied key of all objects, replaces resolver
+	Notify              *NotifyConfig
+	Credentials         []*CredentialRule
+	Concurrency         []*ConcurrencyRule
+	Mirrors             []*MirrorRule // <= compared by verify daemon
+	Bandwidth           []*BandwidthRule
+	BandwidthShare      int // <= share of bandwidth limits used by this process, limits are divided by it
+	VerifyInterval      time.Duration
+	DeadLetter          string
+	ChecksumIndex       string // <= binary index of downloaded files for spot-verify
+	ContinueOnError     bool   // <= failed objects are reported at end, job does not stop on them
+	InputList           string
+	Queue               string        // <= Pub/Sub subscriptions replacing source in priority order, see RunQueueWorker
+	QueueIdle           time.Duration // <= worker exits after queue was empty this long, 0 keeps it running
+	TraceID             string
+	StateFile           string
+	StateDB             string
+	IfGenerationMatch   int64 // <= single object must have this generation, 0 disables
+	VerifyComposite     bool
+	NoVerify            bool // <= only checksums of manifest are verified
+	NoDecompress        bool // <= objects with Content-Encoding gzip are written as stored
+	KeepCorrupt         bool
+	EventBasedHold      bool // <= set on uploaded objects
+	TemporaryHold       bool
+	CustomTime          string        // <= set on uploaded objects: RFC 3339 time or "mtime" of file
+	RetainFor           time.Duration // <= object retention of uploads, 0 disables
+	RetentionMode       string        // <= "Unlocked" or "Locked"
+	Resume              bool          // <= download into <file>.partial, interrupted downloads continue at saved offset
+	Slices              int           // <= parallel byte ranges of objects larger than slice size, below 2 disables
+	SliceSize           int64         // <= 0 picks it from measured per-stream rate, see sliceCount
+	Hedge               float64       // <= straggler factor of median object time, 0 disables hedged downloads
+	Sink                string        // <= "tar:FILE", "tar.gz:FILE", "zip:FILE" or http(s):// prefix, replaces destination directory
+	PipeTo              []string      // <= long-lived command reading tar stream, replaces destination
+	PipeAck             bool
+	Processes           int      // <= worker processes, 0 transfers in this process
+	Worker              string   // <= socket of coordinating process in worker process
+	CommandFlags        []string // <= command line flags and arguments, repeated for worker processes
+	CommandArgs         []string
+	ACLSidecar          bool
+	MetadataSidecar     bool
+	MtimeFromCustomTime bool // <= downloaded files get custom time of object as modification time
+	PreserveMtime       bool // <= downloaded files get modification time of object (upload metadata or update time)
+	MetaJSONSidecar     bool // <= "<file>.meta.json" with custom metadata of object
+	Preflight           bool
+	NoClobber           bool        // <= existing files are never replaced
+	NewerOnly           bool        // <= existing files are replaced only by objects modified after them
+	DryRun              bool        // <= transfers are printed, no files, archives or commands are created
+	EstimateCost        bool        // <= print cost estimate of planned transfers before job
+	EgressNetwork       string      // <= destination network of downloads and copies, key of egress prices
+	Prices              *PriceTable // <= defaults merged with "prices" of config file
+	AllowEscape         bool        // <= object names may point outside of destination path
+	ConfirmObjects      int         // <= ask before transferring more objects, 0 disables
+	ConfirmBytes        int64       // <= ask before transferring more bytes, 0 disables
+	AssumeYes           bool
+	Quiet               bool    // <= no per-object messages and progress line, e.g. for cron
+	MaxQPS              float64 // <= delete requests per second of rm and rsync -d, 0 is not limited
 }
 
 type Storage struct {
-	Ctx    context.Context
-	Client *storage.Client
-	Config *Config
+	Ctx         context.Context
+	Cancel      context.CancelFunc
+	Client      *storage.Client
+	Config      *Config
+	Status      *JobStatus
+	Pauser      *Pauser
+	Buffers     *BufferPool
+	Log         *OrderedLog  // <= set in deterministic mode
+	HTTP        *http.Client // <= for JSON API calls not covered by storage client
+	Endpoint    string
+	DeadLetters *DeadLetterLog // <= nil unless enabled
+	Index       *ChecksumIndex // <= nil unless -checksum-index
+	State       *StateFile     // <= nil unless enabled
+	ACLs        *ACLExporter   // <= nil unless enabled
+	Routes      []*ClientRoute // <= per-bucket credentials
+	Sink        Sink           // <= local directory unless other destination is given
+	Limits      []*ConcurrencyLimit
+	Keys        *KeyResolver      // <= nil unless -key-resolver or -encryption-key
+	Hedger      *Hedger           // <= nil unless enabled
+	Bandwidth   *BandwidthLimiter // <= nil without bandwidth rules
+	Failures    *FailureReport    // <= nil unless -continue-on-error
+	Queue       WorkQueue         // <= nil unless -queue
+	Deletes     *RateLimiter      // <= nil unless -max-qps
+	Streams     *StreamMeter
+
+	interrupted atomic.Value // <= signal which canceled job, see HandleCancelSignals
 }
 
 /*
-	Create new storage config
+	Create new storage config from arguments of cp, browse or verify command; they share options
 */
-func NewConfig() *Config {
+func NewConfig(name string, args []string) *Config {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
 	// Custom usage decription
-	flag.Usage = func() {
+	fs.Usage = func() {
+		switch name {
+		case "browse":
+			fmt.Printf("Usage: %s browse [OPTIONS] bucket_name[/path]\n\nOptions:\n", os.Args[0])
+			fs.PrintDefaults()
+			return
+		case "verify":
+			fmt.Printf("Usage: %s verify [OPTIONS] -config file -pprof-addr addr\n\nOptions:\n", os.Args[0])
+			fs.PrintDefaults()
+			return
+		}
 		fmt.Printf("Usage: %s [OPTIONS] bucket_name[/path][/file] path\n", os.Args[0])
+		fmt.Printf("       %s [OPTIONS] -manifest file [path]\n", os.Args[0])
+		fmt.Printf("       %s [OPTIONS] -plan-in plan.json\n", os.Args[0])
+		fmt.Printf("       %s [OPTIONS] -I file|gs://bucket_name/file|- path\n", os.Args[0])
+		fmt.Printf("       %s [OPTIONS] -queue projects/P/subscriptions/S path\n", os.Args[0])
+		fmt.Printf("       %s [OPTIONS] -pipe-to command bucket_name[/path]\n", os.Args[0])
+		fmt.Printf("       %s [OPTIONS] path bucket_name[/path]\n", os.Args[0])
+		fmt.Printf("       %s [OPTIONS] bucket_name[/path] bucket_name[/path]\n", os.Args[0])
+		fmt.Printf("       %s browse [OPTIONS] bucket_name[/path]\n", os.Args[0])
+		fmt.Printf("       %s verify [OPTIONS] -config file -pprof-addr addr\n", os.Args[0])
+		fmt.Printf("       %s ls [OPTIONS] bucket_name[/path]\n", os.Args[0])
+		fmt.Printf("       %s rm [OPTIONS] bucket_name/object...\n", os.Args[0])
+		fmt.Printf("       %s rm -r [OPTIONS] bucket_name[/prefix]...\n", os.Args[0])
+		fmt.Printf("       %s cat [OPTIONS] bucket_name/object...\n", os.Args[0])
+		fmt.Printf("       %s stat [OPTIONS] bucket_name/object...\n", os.Args[0])
+		fmt.Printf("       %s du [OPTIONS] bucket_name[/path]...\n", os.Args[0])
+		fmt.Printf("       %s enqueue [OPTIONS] -topic projects/P/topics/T bucket_name[/path]...\n", os.Args[0])
+		fmt.Printf("       %s rsync [OPTIONS] bucket_name[/path] directory|directory bucket_name[/path]\n", os.Args[0])
+		fmt.Printf("       %s state prune|compact [OPTIONS]\n", os.Args[0])
+		fmt.Printf("       %s export [OPTIONS] bucket_name[/path] directory\n", os.Args[0])
+		fmt.Printf("       %s verify-dataset directory\n", os.Args[0])
+		fmt.Printf("       %s spot-verify [OPTIONS] index\n", os.Args[0])
+		fmt.Printf("       %s import [OPTIONS] directory bucket_name[/path]\n", os.Args[0])
+		fmt.Printf("       %s bundle [OPTIONS] -o bundle.json bucket_name[/path]\n", os.Args[0])
+		fmt.Printf("       %s fetch-bundle [OPTIONS] bundle.json directory\n", os.Args[0])
+		fmt.Printf("       %s watch-local [OPTIONS] directory bucket_name[/path]\n", os.Args[0])
+		fmt.Printf("       %s config validate|print-effective ...\n", os.Args[0])
+		fmt.Printf("       %s service install|uninstall|run [OPTIONS] -- [ARGUMENTS]\n", os.Args[0])
+		fmt.Println("\nCommand 'cp' is the default, it may be given explicitly: cp [OPTIONS] ...")
 		fmt.Println("\nArguments 'bucket_name' and 'path' are mandatory.")
 		fmt.Println("Credentials must be provided via environment variable GOOGLE_APPLICATION_CREDENTIALS.")
 		fmt.Println("Example: export GOOGLE_APPLICATION_CREDENTIALS=~/credentials.json")
 		fmt.Println("\nOptions:")
-		flag.PrintDefaults()
+		fs.PrintDefaults()
+	}
+
+	isMultiThread := fs.Bool("m", false, "Run command in multi-threading mode")
+	jobs := fs.Int("j", 0, "Workers pool size of multi-threading mode (defaults to number of CPUs), implies -m")
+	errorFormat := fs.String("errors", "text", "Error output format: \"text\" or \"json\" (records on stderr)")
+	retryMaxAttempts := fs.Int("retry-max-attempts", 3, "Maximum attempts per operation, 1 disables retries")
+	retryInitialBackoff := fs.Duration("retry-initial-backoff", time.Second, "Delay before first retry, doubled for each next one")
+	retryMaxBackoff := fs.Duration("retry-max-backoff", 30*time.Second, "Maximum delay between retries")
+	retryJitter := fs.Float64("retry-jitter", defaultRetryJitter, "Fraction of backoff dropped at random (0 to 1), so parallel retries spread out")
+	retryOn := fs.String("retry-on", defaultRetryOn, "Comma-separated HTTP codes (503), classes (5xx) or error codes (timeout) to retry")
+	timeout := fs.Duration("timeout", 0, "Overall time limit for the whole job, e.g. 2h (0 means no limit)")
+	fs.DurationVar(timeout, "total-deadline", 0, "Same as -timeout")
+	objectTimeout := fs.Duration("object-timeout", 0, "Time limit for each object transfer attempt, e.g. 1m, extended by object size with -min-throughput (0 means no limit)")
+	listTimeout := fs.Duration("list-timeout", 0, "Time limit for listing source objects, e.g. 10m (0 means no limit)")
+	minThroughput := fs.String("min-throughput", "1MiB", "Minimum expected download `rate` per second, object timeout grows by size divided by it (0 keeps fixed timeout)")
+	failureManifest := fs.String("failure-manifest", "", "Write URLs of objects which were not transferred to this file on failure")
+	responseHeaderTimeout := fs.Duration("response-header-timeout", 0, "Time to wait for response headers after request is sent (0 means no limit)")
+	idleConnTimeout := fs.Duration("idle-conn-timeout", 90*time.Second, "Time before idle keep-alive connection is closed")
+	tlsHandshakeTimeout := fs.Duration("tls-handshake-timeout", 10*time.Second, "Time limit for TLS handshake")
+	dialTimeout := fs.Duration("dial-timeout", 30*time.Second, "Time limit for establishing TCP connection")
+	reconnectAttempts := fs.Int("reconnect-attempts", 5, "Reopen broken object download at current offset this many times (0 disables)")
+	maxMemory := fs.String("max-memory", "", "Soft memory limit, e.g. 512MiB, sizes copy buffers and workers pool (defaults to GOMEMLIMIT)")
+	pprofAddr := fs.String("pprof-addr", "", "Serve pprof profiles and runtime metrics on this address, e.g. localhost:6060")
+	deterministic := fs.Bool("deterministic", false, "Fix listing, scheduling and output order so repeated runs produce identical logs and manifests")
+	planOut := fs.String("plan-out", "", "Write planned transfers with sizes and destinations to this JSON file and exit, for review or a scheduler")
+	planIn := fs.String("plan-in", "", "Transfer exactly the objects of -plan-out file, it replaces source and destination arguments")
+	manifest := fs.String("manifest", "", "Copy exactly the objects of CSV (source,destination[,md5[,crc32c]]) or JSON manifest, relative destinations are under 'path'")
+	var include, exclude NameFilters
+	fs.Var(&include, "include", "Copy only listed objects matching this `pattern`: glob (\"*.csv\" matches base name, \"logs/**\" full name) or \"re:REGEXP\" (repeatable)")
+	fs.Var(&exclude, "exclude", "Skip listed objects matching this `pattern`, e.g. \"*.tmp\", \"_SUCCESS\" or \"re:/tmp-[0-9]+/\" (repeatable)")
+	var rename RenameRules
+	fs.Var(&rename, "rename", "Sed-style `rule` applied to object names before computing destination path, e.g. 's|^logs/|archive/|' (repeatable)")
+	stripPrefix := fs.Bool("strip-prefix", false, "Place files relative to source prefix, e.g. gs://b/logs/2024/a.gz as path/a.gz instead of path/logs/2024/a.gz")
+	flatten := fs.Bool("flatten", false, "Place all files directly in destination path by base name of objects, same names fail (see -on-conflict)")
+	onConflict := fs.String("on-conflict", "fail", "When objects map to same destination: \"fail\", \"skip\", \"overwrite\", \"rename\" (numeric suffix) or \"rename-hash\"")
+	nameCase := fs.String("name-case", "preserve", "Case of destination names derived from objects: \"lower\", \"upper\" or \"preserve\"")
+	dateLayout := fs.String("date-layout", "", "Place files under YYYY/MM/DD/ of object \"updated\", \"created\", \"custom-time\" or \"metadata:KEY\" time")
+	createDirs := fs.Bool("create-dirs", true, "Create destination path with missing parents")
+	noCreateDirs := fs.Bool("no-create-dirs", false, "Require destination directory to exist, so typos do not create new trees")
+	createEmptyDirs := fs.Bool("create-empty-dirs", false, "Create empty directories for folder placeholder objects (\"path/\", \"path_$folder$\"), HNS and managed folders")
+	encryptionKey := fs.String("encryption-key", "", "Customer-supplied encryption key (CSEK) of all downloaded and uploaded objects: base64 AES-256 key or \"env:NAME\" of variable holding it")
+	keyResolver := fs.String("key-resolver", "", "Command or http(s):// URL supplying base64 encryption key (CSEK) of each object, \"{}\" is replaced by its URL, e.g. 'vault-key {}'")
+	validateCmd := fs.String("validate-cmd", "", "Command run for each downloaded file, \"{}\" is replaced by its path; failure removes the file, e.g. 'parquet-check {}'")
+	configFile := fs.String("config", "", "JSON config file with notify, credentials, concurrency, mirrors, bandwidth and prices sections")
+	checksumIndex := fs.String("checksum-index", "", "Write binary index of downloaded files (name, size, CRC32C, offset in tar) for later \"spot-verify\"")
+	deadLetter := fs.String("dead-letter", "", "Append NDJSON records with error context and attempt history of permanently failed objects to this file")
+	continueOnError := fs.Bool("continue-on-error", false, "Keep copying after failed objects, print table of failures at end and exit non-zero if any failed")
+	inputList := fs.String("I", "", "Copy objects listed in local file, GCS object or stdin (\"-\"), one gs:// URL per line")
+	queue := fs.String("queue", "", "Copy batches of object URLs pulled from Pub/Sub subscription \"projects/P/subscriptions/S\" (see enqueue), shared by any number of workers; comma-separated subscriptions are priority lanes, earlier ones are drained first")
+	queueIdle := fs.Duration("queue-idle", 0, "Exit -queue worker after queue was empty this long (0 keeps running)")
+	stateFile := fs.String("state-file", "", "Record object generations of downloaded files here, unchanged objects are not downloaded again")
+	pipeTo := fs.String("pipe-to", "", "Stream all objects as tar into this long-lived command instead of writing files, e.g. 'loader --tar -'")
+	billingProject := fs.String("billing-project", "", "Project billed for requests to requester-pays buckets (userProject)")
+	archive := fs.String("archive", "", "Stream all objects into single archive of this format (tar, tar.gz or zip) written to destination file (\"-\" for stdout)")
+	pipeAck := fs.Bool("pipe-ack", false, "-pipe-to command confirms each entry by printing its name on stdout, only confirmed objects are recorded in state")
+	noVerify := fs.Bool("no-verify", false, "Do not verify downloaded data against MD5/CRC32C of object, for raw speed")
+	noDecompress := fs.Bool("no-decompress", false, "Write objects with Content-Encoding gzip as stored (gzipped) instead of decompressing them")
+	keepCorrupt := fs.Bool("keep-corrupt", false, "Keep files failing checksum verification as <file>.corrupt instead of removing them")
+	eventBasedHold := fs.Bool("event-based-hold", false, "Place event-based hold on uploaded objects, they can not be overwritten or deleted until it is released")
+	temporaryHold := fs.Bool("temporary-hold", false, "Place temporary hold on uploaded objects")
+	customTime := fs.String("custom-time", "", "Set customTime of uploaded objects (used by lifecycle rules): RFC 3339 time or \"mtime\" of each file")
+	retainFor := fs.Duration("retain-for", 0, "Retain uploaded objects for this long, e.g. 720h; bucket needs object retention enabled")
+	retentionMode := fs.String("retention-mode", "unlocked", "Mode of -retain-for: \"unlocked\" (may be shortened by privileged users) or \"locked\" (final)")
+	verifyComposite := fs.Bool("verify-composite", false, "Verify objects without MD5 (composite) by CRC32C of downloaded data and report their component count")
+	ifGenerationMatch := fs.Int64("if-generation-match", 0, "Copy single object only if it still has this generation, fails with precondition_failed otherwise")
+	resume := fs.Bool("resume", false, "Download into <file>.partial and continue interrupted downloads of same generation from saved offset")
+	slices := fs.Int("slices", 0, "Download objects larger than -slice-size in this many parallel byte ranges, for single large objects (0 disables)")
+	sliceSize := fs.String("slice-size", "64MiB", "Size of byte ranges of -slices, auto picks it and slicing threshold from measured per-stream throughput")
+	hedge := fs.Float64("hedge", 0, "Start second download of objects taking this many times longer than median object, first finished one is kept (0 disables)")
+	processes := fs.Int("processes", 0, "Transfer objects in this many worker processes, for checksum and validation heavy jobs on large machines")
+	worker := fs.String("worker", "", "Internal: socket of coordinating process, runs this process as worker")
+	bandwidthShare := fs.Int("bandwidth-share", 1, "Internal: divide bandwidth limits of config by this, set for worker processes")
+	noAdaptiveRate := fs.Bool("no-adaptive-rate", false, "Do not slow down requests to buckets answering rateLimitExceeded/slowDown, only retry them")
+	injectFaults := fs.String("inject-faults", "", "Internal: inject transport faults for testing, e.g. \"error-rate=0.1,latency=50ms,truncate=1MiB,seed=7\"")
+	stateDB := fs.String("state-db", "", "Like -state-file for massive syncs: journal written as objects finish, compacted snapshot at the end")
+	metadataSidecar := fs.Bool("metadata-sidecar", false, "Write \"<file>.gcs.json\" with object attributes (generation, checksums, metadata) next to each download")
+	mtimeFromCustomTime := fs.Bool("mtime-from-custom-time", false, "Set modification time of downloaded files to customTime of objects which have one")
+	preserveMtime := fs.Bool("preserve-mtime", false, "Set modification time of downloaded files to that of objects: \"goog-reserved-file-mtime\" metadata of uploads, otherwise update time")
+	metaJSON := fs.Bool("meta-json", false, "Write \"<file>.meta.json\" with custom metadata (key/value pairs) of object next to each download")
+	aclSidecar := fs.Bool("acl-sidecar", false, "Write object ACLs and bucket IAM bindings next to each downloaded file as <file>.acl.json")
+	var endpoints EndpointFlags
+	fs.Var(&endpoints, "endpoint", "API `endpoint` \"https://host[:port]\" tried in given order, next one is used on regional errors (repeatable)")
+	readLocation := fs.String("read-location", "", "Prefer regional endpoint of dual-region bucket location, e.g. \"us-east1\", global endpoint is fallback")
+	userAgent := fs.String("user-agent", "", "Prepend this to User-Agent header of all API requests")
+	headers := HeaderFlags{}
+	fs.Var(headers, "header", "Extra `header` sent with all API requests, e.g. \"X-Audit-Id: job-42\" (repeatable)")
+	allowEscape := fs.Bool("allow-escape", false, "Allow object names with \"..\" to be written outside of destination path")
+	quiet := fs.Bool("quiet", false, "Print only errors and warnings, no per-object messages or progress line (cron, CI)")
+	noClobber := fs.Bool("no-clobber", false, "Skip objects whose destination file already exists")
+	newerOnly := fs.Bool("newer-only", false, "Skip objects whose destination file is newer, or has same size and modification time")
+	preflight := fs.Bool("preflight", false, "Print number of objects and bytes to transfer before starting")
+	dryRun := fs.Bool("dry-run", false, "Print planned transfers with sizes and total, nothing is created or written")
+	fs.BoolVar(dryRun, "n", false, "Same as -dry-run")
+	estimateCost := fs.Bool("estimate-cost", false, "Print estimated egress, retrieval and operation cost of planned transfers before starting (prices of -config)")
+	egressNetwork := fs.String("egress-network", defaultEgressNetwork, "Network data goes to for -estimate-cost: \"internet\", \"same-region\", \"same-continent\", \"cross-continent\" or one of config prices")
+	confirmObjects := fs.Int("confirm-objects", 0, "Ask for confirmation when more objects would be transferred (0 disables)")
+	confirmBytes := fs.String("confirm-bytes", "", "Ask for confirmation when more data would be transferred, e.g. 10GiB")
+	assumeYes := fs.Bool("y", false, "Answer yes to confirmation prompts")
+	traceID := fs.String("trace-id", "", "Correlation ID sent with all API requests (audit logs) and added to log lines and manifests, \"auto\" generates one")
+	verifyInterval := fs.Duration("verify-interval", 15*time.Minute, "Time between comparisons of mirrors in verify mode")
+	controlSocket := fs.String("control-socket", "", "Unix socket path accepting \"pause\", \"resume\" and \"status\" commands")
+	fs.Parse(args)
+
+	if *errorFormat != "text" && *errorFormat != "json" {
+		exception(fmt.Errorf("unsupported errors format: %s", *errorFormat))
+	}
+	console.ErrorFormat = *errorFormat
+
+	if *traceID == "auto" {
+		*traceID = newTraceID()
+	}
+	if *traceID != "" {
+		// Custom audit headers are recorded in Cloud Audit Logs
+		http.Header(headers).Set("X-Goog-Custom-Audit-Trace-Id", *traceID)
+		console.TraceID = *traceID
+	}
+
+	if *nameCase != "lower" && *nameCase != "upper" && *nameCase != "preserve" {
+		exception(fmt.Errorf("unsupported name case: %s", *nameCase))
+	}
+	switch *onConflict {
+	case "fail", "skip", "overwrite", "rename", "rename-hash":
+	default:
+		exception(fmt.Errorf("unsupported conflict policy: %s", *onConflict))
 	}
 
-	isMultiThread := flag.Bool("m", false, "Run command in multi-threading mode")
-	flag.Parse()
+	if err := validDateLayout(*dateLayout); err != nil {
+		exception(err)
+	}
 
-	argLen := len(flag.Args())
-	if argLen != 2 {
-		fmt.Printf("Unexpected arguments count: %d instead of 2\n\n", argLen)
-		flag.Usage()
-		os.Exit(1)
+	fileConfig := &FileConfig{}
+	if *configFile != "" {
+		var err error
+		if fileConfig, err = LoadFileConfig(*configFile); err != nil {
+			exception(err)
+		}
 	}
 
-	uri := flag.Arg(0)
-	destinationPath := flag.Arg(1)
+	prices := mergePrices(fileConfig.Prices)
+	if err := prices.CheckNetwork(*egressNetwork); err != nil {
+		exception(err)
+	}
 
-	bucketName, prefix, err := parseGCSUrl(uri)
+	memLimit, err := memoryLimit(*maxMemory)
 	if err != nil {
 		exception(err)
 	}
 
+	if *stateFile != "" && *stateDB != "" {
+		exception(fmt.Errorf("-state-file and -state-db can not be used together"))
+	}
+	if *readLocation != "" {
+		if len(endpoints) > 0 {
+			exception(fmt.Errorf("-read-location and -endpoint can not be used together"))
+		}
+		endpoints = locationEndpoints(*readLocation)
+	}
+	if *queueIdle < 0 {
+		exception(fmt.Errorf("-queue-idle must not be negative"))
+	}
+	if *ifGenerationMatch < 0 {
+		exception(fmt.Errorf("-if-generation-match must be positive"))
+	}
+	if *jobs < 0 {
+		exception(fmt.Errorf("-j must be positive"))
+	}
+	if *jobs > 0 {
+		*isMultiThread = true
+	}
+	if *hedge < 0 || (*hedge > 0 && *hedge < 1) {
+		exception(fmt.Errorf("-hedge must be at least 1"))
+	}
+	if *noVerify && (*verifyComposite || *keepCorrupt) {
+		exception(fmt.Errorf("-no-verify can not be used with -verify-composite or -keep-corrupt"))
+	}
+	var csek []byte
+	if *encryptionKey != "" {
+		if *keyResolver != "" {
+			exception(fmt.Errorf("-encryption-key and -key-resolver can not be used together"))
+		}
+		var err error
+		if csek, err = parseEncryptionKey(*encryptionKey); err != nil {
+			exception(err)
+		}
+	}
+	var mode string
+	switch strings.ToLower(*retentionMode) {
+	case "unlocked":
+		mode = "Unlocked"
+	case "locked":
+		mode = "Locked"
+	default:
+		exception(fmt.Errorf("unsupported retention mode: %s", *retentionMode))
+	}
+	if *retainFor < 0 {
+		exception(fmt.Errorf("-retain-for must be positive"))
+	}
+	if _, err := parseCustomTime(*customTime); err != nil {
+		exception(err)
+	}
+	if *hedge > 0 && *resume {
+		exception(fmt.Errorf("-hedge and -resume can not be used together"))
+	}
+	if *hedge > 0 && (*aclSidecar || *metadataSidecar || *metaJSON) {
+		exception(fmt.Errorf("-hedge can not be used with sidecars"))
+	}
+	if *checksumIndex != "" && *processes > 0 {
+		exception(fmt.Errorf("-checksum-index can not be used with -processes"))
+	}
+	if *processes > 0 && *deterministic {
+		exception(fmt.Errorf("-processes can not be used with -deterministic"))
+	}
+
+	throughput, err := parseSize(*minThroughput)
+	if err != nil {
+		exception(fmt.Errorf("invalid -min-throughput value: %w", err))
+	}
+	var confirmSize int64
+	if *confirmBytes != "" {
+		if confirmSize, err = parseSize(*confirmBytes); err != nil {
+			exception(fmt.Errorf("invalid -confirm-bytes value: %w", err))
+		}
+	}
+	var sliceBytes int64 // <= 0 is auto
+	if *sliceSize != "auto" {
+		if sliceBytes, err = parseSize(*sliceSize); err != nil || sliceBytes == 0 {
+			exception(fmt.Errorf("invalid -slice-size value: %s", *sliceSize))
+		}
+	} else if *slices < 2 {
+		exception(fmt.Errorf("-slice-size auto needs -slices as upper bound of parallel ranges"))
+	}
+	if *slices > 1 && *resume {
+		exception(fmt.Errorf("-slices and -resume can not be used together"))
+	}
+	if *objectTimeout < 0 || *listTimeout < 0 {
+		exception(fmt.Errorf("-object-timeout and -list-timeout must not be negative"))
+	}
+
+	var faults *FaultConfig
+	if *injectFaults != "" {
+		if faults, err = ParseFaultConfig(*injectFaults); err != nil {
+			exception(err)
+		}
+	}
+
+	var quota *QuotaLimiter
+	if !*noAdaptiveRate {
+		quota = NewQuotaLimiter(!*quiet && *worker == "")
+	}
+
+	retry, err := NewRetryPolicy(*retryMaxAttempts, *retryInitialBackoff, *retryMaxBackoff, *retryJitter, *retryOn)
+	if err != nil {
+		exception(err)
+	}
+
+	argLen := len(fs.Args())
+	command := "cp"
+	uri := fs.Arg(0)
+	destinationPath := fs.Arg(1)
+	var bucketName, prefix, sourcePath, destBucket, destPrefix string
+	var generation int64
+	var glob *regexp.Regexp
+
+	// Piped objects have no destination argument
+	destArgs := 1
+	if *pipeTo != "" {
+		destArgs = 0
+	}
+
+	if name != "cp" && (*planIn != "" || *manifest != "" || *queue != "" || *inputList != "") {
+		exception(fmt.Errorf("-plan-in, -manifest, -queue and -I replace source, they can not be used with %s", name))
+	}
+
+	var plan *TransferPlan
+	if *planIn != "" {
+		// Plan replaces arguments, objects are not listed again
+		if argLen != 0 || *manifest != "" || *inputList != "" || *queue != "" || *planOut != "" {
+			exception(fmt.Errorf("-plan-in replaces source and destination, it can not be used with arguments, -manifest, -I, -queue or -plan-out"))
+		}
+		if plan, err = LoadTransferPlan(*planIn); err != nil {
+			exception(err)
+		}
+		command, uri, destinationPath = plan.Command, plan.Source, plan.Destination
+		switch command {
+		case "upload":
+			sourcePath, uri, destinationPath = plan.Source, plan.Destination, ""
+		case "copy":
+			if destBucket, destPrefix, err = parseGCSUrl(plan.Destination); err != nil {
+				exception(err)
+			}
+			destinationPath = ""
+		}
+		if command != "cp" {
+			if err := checkRemoteFlags(fs, command); err != nil {
+				exception(err)
+			}
+		}
+		if uri != "" {
+			if bucketName, prefix, err = parseGCSUrl(uri); err != nil {
+				exception(err)
+			}
+		}
+	} else if *manifest != "" {
+		// Manifest replaces source argument
+		if *queue != "" {
+			exception(fmt.Errorf("-manifest and -queue can not be used together"))
+		}
+		if argLen > destArgs {
+			fmt.Printf("Unexpected arguments count: %d instead of at most %d with manifest\n\n", argLen, destArgs)
+			fs.Usage()
+			os.Exit(1)
+		}
+		uri, destinationPath = "", fs.Arg(0)
+	} else if *queue != "" {
+		// Queue replaces source argument, batches arrive until it is drained
+		for _, name := range strings.Split(*queue, ",") {
+			if err := checkPubSubName(name, "subscriptions"); err != nil {
+				exception(err)
+			}
+		}
+		if argLen != destArgs {
+			fmt.Printf("Unexpected arguments count: %d instead of %d with -queue\n\n", argLen, destArgs)
+			fs.Usage()
+			os.Exit(1)
+		}
+		switch {
+		case *inputList != "", *ifGenerationMatch != 0, *planOut != "":
+			exception(fmt.Errorf("-queue replaces source, it can not be used with -I, -plan-out or -if-generation-match"))
+		case *dateLayout != "":
+			exception(fmt.Errorf("-date-layout needs listing attributes, it can not be used with -queue"))
+		case *processes > 0:
+			exception(fmt.Errorf("-queue workers are separate processes already, -processes can not be used with it"))
+		case *preflight, *estimateCost, *dryRun, *confirmObjects > 0, *confirmBytes != "":
+			exception(fmt.Errorf("-queue job has no known size, -preflight, -estimate-cost, -dry-run and confirmations can not be used with it"))
+		}
+		uri, destinationPath = "", fs.Arg(0)
+	} else if *inputList != "" {
+		// URL list replaces source argument, gsutil style "-I path" reads it from piped stdin
+		destinationPath = fs.Arg(0)
+		if argLen == 0 && destArgs == 1 && pipedListDestination(*inputList) {
+			*inputList, destinationPath, argLen = stdinList, *inputList, 1
+		}
+		if argLen != destArgs {
+			fmt.Printf("Unexpected arguments count: %d instead of %d with -I\n\n", argLen, destArgs)
+			fs.Usage()
+			os.Exit(1)
+		}
+		if *dateLayout != "" {
+			exception(fmt.Errorf("-date-layout needs listing attributes, it can not be used with -I"))
+		}
+		if *inputList == stdinList && (*confirmObjects > 0 || *confirmBytes != "") && !*assumeYes {
+			exception(fmt.Errorf("URL list is read from stdin, confirmation prompts need -y"))
+		}
+		uri = ""
+	} else if name == "verify" {
+		// Daemon compares mirrors of config file, no transfers
+		if argLen != 0 {
+			fmt.Printf("Unexpected arguments count: %d instead of 0\n\n", argLen)
+			fs.Usage()
+			os.Exit(1)
+		}
+		switch {
+		case len(fileConfig.Mirrors) == 0:
+			exception(fmt.Errorf("verify needs \"mirrors\" in -config file"))
+		case *pprofAddr == "":
+			exception(fmt.Errorf("verify exports drift metrics, it needs -pprof-addr"))
+		case *verifyInterval <= 0:
+			exception(fmt.Errorf("-verify-interval must be positive"))
+		}
+		command, uri = "verify", ""
+	} else {
+		// Interactive mode picks destination path later
+		if name == "browse" {
+			if *pipeTo != "" {
+				exception(fmt.Errorf("-pipe-to can not be used with browse"))
+			}
+			command, destArgs, destinationPath = name, 0, ""
+		}
+		if argLen != 1+destArgs {
+			fmt.Printf("Unexpected arguments count: %d instead of %d\n\n", argLen, 1+destArgs)
+			fs.Usage()
+			os.Exit(1)
+		}
+
+		// Local source with GCS destination is an upload
+		if isUpload(uri, destinationPath) {
+			if err := checkRemoteFlags(fs, "upload"); err != nil {
+				exception(err)
+			}
+			command = "upload"
+			sourcePath, uri, destinationPath = uri, destinationPath, ""
+		}
+
+		// Objects are copied server-side between buckets
+		if isBucketCopy(uri, destinationPath) {
+			if err := checkRemoteFlags(fs, "copy"); err != nil {
+				exception(err)
+			}
+			command = "copy"
+			if destBucket, destPrefix, err = parseGCSUrl(destinationPath); err != nil {
+				exception(err)
+			}
+			destinationPath = ""
+		}
+
+		bucketName, prefix, generation, err = parseVersionedUrl(uri)
+		if err != nil {
+			exception(err)
+		}
+		if hasGlob(prefix) && command != "upload" && command != "browse" {
+			if glob, err = compileGlob(prefix); err != nil {
+				exception(err)
+			}
+		}
+		// Generation names one stored version, it is read instead of listing
+		if generation != 0 && (command != "cp" || glob != nil || strings.HasSuffix(prefix, "/") || *ifGenerationMatch != 0 || *planOut != "") {
+			exception(fmt.Errorf("generation suffix selects single object to download, it can not be used with wildcards, prefixes, -if-generation-match, -plan-out, uploads, copies or browse: %s", uri))
+		}
+	}
+
+	if *ifGenerationMatch != 0 && (*manifest != "" || *inputList != "" || plan != nil || command == "browse") {
+		exception(fmt.Errorf("-if-generation-match needs URL of single object, not -manifest, -I, -plan-in or browse"))
+	}
+	if *planOut != "" && command == "verify" {
+		exception(fmt.Errorf("verify has no transfers to plan"))
+	}
+	if len(include)+len(exclude) > 0 && (*manifest != "" || *inputList != "" || *queue != "" || plan != nil || command == "upload" || command == "verify" || command == "browse") {
+		exception(fmt.Errorf("-include and -exclude filter listed objects, they can not be used with -manifest, -I, -queue, -plan-in, uploads, verify or browse"))
+	}
+	if (*stripPrefix || *flatten) && (*manifest != "" || plan != nil) {
+		exception(fmt.Errorf("destinations of -manifest and -plan-in are fixed, -strip-prefix and -flatten can not be used with them"))
+	}
+	if *stripPrefix && uri == "" {
+		exception(fmt.Errorf("-strip-prefix needs source prefix, it can not be used with -I or -queue"))
+	}
+	if *flatten && *createEmptyDirs {
+		exception(fmt.Errorf("-flatten creates no directories, it can not be used with -create-empty-dirs"))
+	}
+	// Prefix is removed first, rename rules see names relative to it like rsync
+	if *stripPrefix {
+		if strip := strippedPrefix(prefix, glob != nil); strip != "" {
+			rename = append(RenameRules{{Pattern: regexp.MustCompile("^" + regexp.QuoteMeta(strip))}}, rename...)
+		}
+	}
+	if *noClobber && *newerOnly {
+		exception(fmt.Errorf("-no-clobber and -newer-only can not be used together"))
+	}
+	if *encryptionKey != "" && command == "copy" {
+		exception(fmt.Errorf("-encryption-key can not be used with bucket copies"))
+	}
+	if *dryRun && (*planOut != "" || command == "verify") {
+		exception(fmt.Errorf("-dry-run can not be used with -plan-out or verify"))
+	}
+
+	if command != "upload" {
+		if err := checkUploadFlags(fs, command); err != nil {
+			exception(err)
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "create-dirs" && *createDirs && *noCreateDirs {
+			exception(fmt.Errorf("-create-dirs and -no-create-dirs can not be used together"))
+		}
+	})
+
+	// Archive replaces destination directory, destination argument names its file
+	if *archive != "" {
+		format, _ := splitArchiveSink(*archive + ":")
+		switch {
+		case format != *archive:
+			exception(fmt.Errorf("unknown -archive format %q, want one of %s", *archive, strings.Join(archiveFormats, ", ")))
+		case *pipeTo != "" || *planIn != "" || command == "verify" || command == "browse":
+			exception(fmt.Errorf("-archive can not be used with -pipe-to, -plan-in, verify or browse"))
+		case destinationPath == "":
+			exception(fmt.Errorf("-archive needs destination file (\"-\" for stdout)"))
+		case isSinkDestination(destinationPath) && destinationPath != stdoutSink:
+			exception(fmt.Errorf("-archive writes file, destination %s can not be used with it", destinationPath))
+		}
+		destinationPath = *archive + ":" + destinationPath
+	}
+
+	// Other sinks have no local files for features working on them, state records what was sent
+	sink, target := "", ""
+	if isSinkDestination(destinationPath) {
+		sink, destinationPath = destinationPath, ""
+		target = sink
+	}
+	if *pipeTo != "" {
+		target = "-pipe-to"
+	}
+	if target != "" {
+		switch {
+		case *validateCmd != "", *aclSidecar, *metadataSidecar, *metaJSON, *mtimeFromCustomTime, *preserveMtime:
+			exception(fmt.Errorf("-validate-cmd, sidecars, -mtime-from-custom-time and -preserve-mtime need local files, they can not be used with %s", target))
+		case *checksumIndex != "" && (!strings.HasPrefix(sink, "tar:") || sink == "tar:-"):
+			exception(fmt.Errorf("-checksum-index needs local files or tar:FILE archive, it can not be used with %s", target))
+		case (*pipeTo != "" || isArchiveSink(sink)) && (*isMultiThread || *processes > 0):
+			exception(fmt.Errorf("archive stream is written one object at a time, it can not be used with -m or -processes"))
+		case *processes > 0:
+			exception(fmt.Errorf("-processes can not be used with %s", target))
+		case *hedge > 0:
+			exception(fmt.Errorf("-hedge writes second attempt to local staging file, it can not be used with %s", target))
+		case *resume, *keepCorrupt:
+			exception(fmt.Errorf("-resume and -keep-corrupt keep local files, they can not be used with %s", target))
+		case *noClobber, *newerOnly:
+			exception(fmt.Errorf("-no-clobber and -newer-only compare existing files, they can not be used with %s", target))
+		}
+		// Messages must not mix with archive or object data
+		if _, path := splitArchiveSink(sink); path == "-" || sink == stdoutSink {
+			console.RedirectStdout(os.Stderr)
+		}
+	}
+
+	if destinationPath, err = normalizePath(destinationPath); err != nil {
+		exception(err)
+	}
+	if sourcePath, err = normalizePath(sourcePath); err != nil {
+		exception(err)
+	}
+
 	return &Config{
 		isMultiThread:   *isMultiThread,
+		Jobs:            *jobs,
+		Command:         command,
+		SourcePath:      sourcePath,
+		DestBucket:      destBucket,
+		DestPrefix:      destPrefix,
 		Uri:             uri,
 		BucketName:      bucketName,
 		Prefix:          prefix,
+		Generation:      generation,
+		BillingProject:  *billingProject,
+		Glob:            glob,
+		Include:         include,
+		Exclude:         exclude,
 		DestinationPath: destinationPath,
+		ControlSocket:   *controlSocket,
+		Retry:           retry,
+		Timeout:         *timeout,
+		ObjectTimeout:   *objectTimeout,
+		ListTimeout:     *listTimeout,
+		MinThroughput:   throughput,
+		FailureManifest: *failureManifest,
+		Transport: &TransportConfig{
+			ResponseHeaderTimeout: *responseHeaderTimeout,
+			IdleConnTimeout:       *idleConnTimeout,
+			TLSHandshakeTimeout:   *tlsHandshakeTimeout,
+			DialTimeout:           *dialTimeout,
+			UserAgent:             *userAgent,
+			Headers:               headers,
+			Endpoints:             endpoints,
+			Faults:                faults,
+			Quota:                 quota,
+		},
+		ReconnectAttempts:   *reconnectAttempts,
+		MaxMemory:           memLimit,
+		PprofAddr:           *pprofAddr,
+		Deterministic:       *deterministic,
+		Manifest:            *manifest,
+		Plan:                plan,
+		PlanOut:             *planOut,
+		Rename:              rename,
+		Flatten:             *flatten,
+		NameCase:            *nameCase,
+		OnConflict:          *onConflict,
+		DateLayout:          *dateLayout,
+		CreateEmptyDirs:     *createEmptyDirs,
+		CreateDirs:          *createDirs && !*noCreateDirs,
+		ValidateCmd:         strings.Fields(*validateCmd),
+		KeyResolver:         *keyResolver,
+		EncryptionKey:       csek,
+		Notify:              fileConfig.Notify,
+		Credentials:         fileConfig.Credentials,
+		Concurrency:         fileConfig.Concurrency,
+		Mirrors:             fileConfig.Mirrors,
+		Bandwidth:           fileConfig.Bandwidth,
+		BandwidthShare:      *bandwidthShare,
+		VerifyInterval:      *verifyInterval,
+		DeadLetter:          *deadLetter,
+		ChecksumIndex:       *checksumIndex,
+		ContinueOnError:     *continueOnError,
+		InputList:           *inputList,
+		Queue:               *queue,
+		QueueIdle:           *queueIdle,
+		TraceID:             *traceID,
+		StateFile:           *stateFile,
+		StateDB:             *stateDB,
+		IfGenerationMatch:   *ifGenerationMatch,
+		VerifyComposite:     *verifyComposite,
+		NoVerify:            *noVerify,
+		NoDecompress:        *noDecompress,
+		KeepCorrupt:         *keepCorrupt,
+		EventBasedHold:      *eventBasedHold,
+		TemporaryHold:       *temporaryHold,
+		RetainFor:           *retainFor,
+		CustomTime:          *customTime,
+		RetentionMode:       mode,
+		Resume:              *resume,
+		Slices:              *slices,
+		SliceSize:           sliceBytes,
+		Hedge:               *hedge,
+		Sink:                sink,
+		PipeTo:              strings.Fields(*pipeTo),
+		PipeAck:             *pipeAck,
+		Processes:           *processes,
+		Worker:              *worker,
+		CommandFlags:        args[:len(args)-fs.NArg()],
+		CommandArgs:         fs.Args(),
+		ACLSidecar:          *aclSidecar,
+		MetadataSidecar:     *metadataSidecar,
+		MtimeFromCustomTime: *mtimeFromCustomTime,
+		PreserveMtime:       *preserveMtime,
+		MetaJSONSidecar:     *metaJSON,
+		Preflight:           *preflight,
+		NoClobber:           *noClobber,
+		NewerOnly:           *newerOnly,
+		DryRun:              *dryRun,
+		EstimateCost:        *estimateCost,
+		EgressNetwork:       *egressNetwork,
+		Prices:              prices,
+		ConfirmObjects:      *confirmObjects,
+		ConfirmBytes:        confirmSize,
+		AssumeYes:           *assumeYes,
+		Quiet:               *quiet,
+		AllowEscape:         *allowEscape,
 	}
 }
 
 /*
-	Create new storage object
+	Create new storage object from arguments of cp, browse or verify command
 */
-func NewStorage() *Storage {
-	cfg := NewConfig()
-
-	ctx := context.Background()
-	client, err := storage.NewClient(ctx)
+func NewStorage(name string, args []string) *Storage {
+	s, err := NewStorageWithConfig(NewConfig(name, args))
 	if err != nil {
 		exception(err)
 	}
 
-	return &Storage{
-		Ctx:    ctx,
-		Client: client,
-		Config: cfg,
+	return s
+}
+
+/*
+	Create new storage object from parsed configuration
+*/
+func NewStorageWithConfig(cfg *Config) (*Storage, error) {
+	// Whole job shares cancelable context, optionally with deadline
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if cfg.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(serviceCtx, cfg.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(serviceCtx)
+	}
+
+	hc, err := newHTTPClient(ctx, cfg.Transport, defaultCredentials)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	client, err := storage.NewClient(ctx, clientOptions(hc)...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	routes, err := newClientRoutes(ctx, cfg)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	var deadLetters *DeadLetterLog
+	if cfg.DeadLetter != "" {
+		deadLetters = NewDeadLetterLog(cfg.DeadLetter, cfg.TraceID)
+	}
+
+	// Dry run must not leave empty index or archive, nor start -pipe-to command
+	var index *ChecksumIndex
+	if !cfg.DryRun {
+		if index, err = NewChecksumIndex(cfg); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+
+	var state *StateFile
+	switch {
+	case cfg.StateFile != "":
+		state, err = LoadStateFile(cfg.StateFile)
+	case cfg.StateDB != "":
+		state, err = OpenStateDB(cfg.StateDB)
 	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	var queue WorkQueue
+	if cfg.Queue != "" {
+		if queue, err = NewQueue(ctx, cfg.Transport, cfg.Queue); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+
+	var acls *ACLExporter
+	if cfg.ACLSidecar {
+		acls = NewACLExporter()
+	}
+
+	var sink Sink = &LocalSink{}
+	if !cfg.DryRun {
+		if sink, err = NewSink(cfg); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+
+	// Service manager starts dependent units once job is set up, worker processes are not the service
+	if cfg.Worker == "" {
+		serviceReady()
+	}
+
+	return &Storage{
+		Ctx:         ctx,
+		Cancel:      cancel,
+		Client:      client,
+		Config:      cfg,
+		Status:      NewJobStatus(),
+		Pauser:      NewPauser(),
+		Buffers:     NewBufferPool(defaultBufferSize),
+		HTTP:        hc,
+		Endpoint:    jsonEndpoint(),
+		DeadLetters: deadLetters,
+		Index:       index,
+		State:       state,
+		ACLs:        acls,
+		Routes:      routes,
+		Sink:        sink,
+		Limits:      NewConcurrencyLimits(cfg.Concurrency),
+		Keys:        NewKeyResolver(cfg.KeyResolver, cfg.EncryptionKey),
+		Hedger:      NewHedger(cfg.Hedge),
+		Bandwidth:   NewBandwidthLimiter(cfg.Bandwidth, cfg.BandwidthShare, !cfg.Quiet && cfg.Worker == ""),
+		Failures:    NewFailureReport(cfg.ContinueOnError),
+		Queue:       queue,
+		Deletes:     NewRateLimiter(cfg.MaxQPS),
+		Streams:     &StreamMeter{},
+	}, nil
 }
 
 /*
 	List bucket objects by prefix
 */
-func (s *Storage) ListObjects() ([]string, error) {
-	ctx, cancel := context.WithTimeout(s.Ctx, time.Second*30)
+func (s *Storage) ListObjects() ([]*storage.ObjectAttrs, error) {
+	ctx, cancel := s.listContext()
 	defer cancel()
 
-	prefix := s.Config.Prefix
-	// It helps to make relevant filtration by prefix
-	if prefix != "" && !strings.HasSuffix(prefix, "/") && filepath.Ext(prefix) == "" {
-		prefix += "/"
+	// Wildcards are matched here, listing needs literal part only
+	prefix := listingPrefix(s.Config.Prefix)
+	if s.Config.Glob != nil {
+		prefix = globPrefix(s.Config.Prefix)
 	}
 
-	it := s.Client.Bucket(s.Config.BucketName).Objects(ctx, &storage.Query{
-		Prefix: prefix,
-	})
-
-	var objects []string
-	for {
-		attrs, err := it.Next()
-		if err == iterator.Done {
-			break
+	var objects []*storage.ObjectAttrs
+	if s.Config.Generation != 0 {
+		// Noncurrent generations are not listed, attributes of exact one are read instead
+		attrs, err := s.Bucket(s.Config.BucketName).Object(s.Config.Prefix).Generation(s.Config.Generation).Attrs(ctx)
+		if err != nil && err != storage.ErrObjectNotExist {
+			return nil, fmt.Errorf("Object(%q).Attrs: %w", s.Config.Prefix, err)
+		}
+		if attrs != nil {
+			objects = append(objects, attrs)
+		}
+	} else {
+		it := s.Bucket(s.Config.BucketName).Objects(ctx, &storage.Query{
+			Prefix: prefix,
+		})
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			objects = append(objects, attrs)
 		}
+	}
+
+	// Empty folders have no objects to be listed
+	if s.Config.CreateEmptyDirs {
+		folders, err := s.ListFolders(ctx, prefix)
 		if err != nil {
 			return nil, err
 		}
-		objects = append(objects, attrs.Name)
+		objects = mergeFolders(objects, s.Config.BucketName, folders)
+	}
+
+	if s.Config.Glob != nil {
+		matched := objects[:0]
+		for _, attrs := range objects {
+			if s.Config.Glob.MatchString(attrs.Name) {
+				matched = append(matched, attrs)
+			}
+		}
+		objects = matched
+	}
+
+	if len(s.Config.Include)+len(s.Config.Exclude) > 0 {
+		selected := objects[:0]
+		for _, attrs := range objects {
+			if selectName(s.Config.Include, s.Config.Exclude, attrs.Name) {
+				selected = append(selected, attrs)
+			}
+		}
+		objects = selected
 	}
 
 	if len(objects) == 0 {
-		return nil, fmt.Errorf("no URLs matched: %s", s.Config.Uri)
+		return nil, fmt.Errorf("%w: %s", ErrNoURLsMatched, s.Config.Uri)
 	}
 
 	return objects, nil
 }
 
 /*
-	Download object from bucket
+	Prefix of listing, path without extension is a "directory"
 */
-func (s *Storage) DownloadObject(object string) error {
-	ctx, cancel := context.WithTimeout(s.Ctx, time.Second*60)
-	defer cancel()
+func listingPrefix(prefix string) string {
+	// It helps to make relevant filtration by prefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") && filepath.Ext(prefix) == "" {
+		prefix += "/"
+	}
+
+	return prefix
+}
+
+/*
+	Download object from bucket, canceled parent context stops the attempt
+*/
+func (s *Storage) DownloadObject(parent context.Context, t *Transfer) (err error) {
+	size := int64(-1)
+	if t.Attrs != nil {
+		size = t.Attrs.Size
+	}
+	ctx, deadline := s.NewObjectDeadline(parent, size)
+	defer deadline.Stop()
+	defer func() {
+		err = deadline.Err(err)
+	}()
 
-	sr, err := s.Client.Bucket(s.Config.BucketName).Object(object).NewReader(ctx)
+	object := t.Object
+	progress := s.Status.Start(t.statusKey())
+
+	if t.Directory {
+		s.Printf(t.URI(), "Creating %s => %s\n", object, t.Destination)
+		return s.Sink.Mkdir(ctx, t)
+	}
+
+	// Condition also applies to reconnects, data of newer generation is never mixed in
+	handle := s.Bucket(t.Bucket).Object(object)
+	if t.Generation != 0 {
+		handle = handle.Generation(t.Generation)
+	}
+	if s.Config.IfGenerationMatch != 0 {
+		handle = handle.If(storage.Conditions{GenerationMatch: s.Config.IfGenerationMatch})
+	}
+	if handle, err = s.Keys.Apply(ctx, t, handle); err != nil {
+		return err
+	}
+	// Stored gzip data is read as is, so checksums of object verify it; it is decompressed here unless -no-decompress
+	handle = handle.ReadCompressed(true)
+	var sr *storage.Reader
+	offset := int64(0)
+	if s.Config.Resume {
+		sr, offset, err = s.openResumable(ctx, handle, t)
+	} else {
+		sr, err = handle.NewReader(ctx)
+	}
+	transcode := err == nil && sr.Attrs.ContentEncoding == "gzip" && !s.Config.NoDecompress
+	if transcode && offset > 0 {
+		// Partial file holds decompressed data, its size is no offset of stored data
+		sr.Close()
+		removePartial(t)
+		s.Printf(t.URI(), "Object %s is decompressed, starting over\n", object)
+		sr, err = handle.NewReader(ctx)
+		offset = 0
+	}
 	if err != nil {
-		return fmt.Errorf("Object(%q).NewReader: %v", object, err)
+		if s.Config.IfGenerationMatch != 0 && errorCode(err) == "precondition_failed" {
+			return fmt.Errorf("Object(%q).NewReader: generation is not %d: %w", object, s.Config.IfGenerationMatch, err)
+		}
+		return fmt.Errorf("Object(%q).NewReader: %w", object, err)
+	}
+	reader := s.newReconnectingReader(ctx, t, handle, sr, offset)
+	defer reader.Close()
+
+	fpath := t.Destination
+
+	// Resumable download writes partial file next to destination instead of sink
+	var out SinkFile
+	attrs := sr.Attrs
+	if transcode {
+		attrs.Size = -1 // <= decompressed size is known at the end only
+	}
+	if s.Config.Resume {
+		out, err = createPartial(t, sr.Attrs.Generation, offset)
+	} else {
+		out, err = s.Sink.Create(ctx, t, &attrs)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Incomplete or corrupted copy must not be left behind
+	closed := false
+	defer func() {
+		if !closed {
+			out.Abort()
+		}
+	}()
+
+	s.Printf(t.URI(), "Copying %s => %s\n", object, fpath)
+
+	atomic.StoreInt64(&progress.Size, sr.Attrs.Size)
+	atomic.StoreInt64(&progress.Written, offset)
+	deadline.SetSize(sr.Attrs.Size - offset)
+
+	buf := s.Buffers.Get()
+	defer s.Buffers.Put(buf)
+
+	writers := []io.Writer{out, progress}
+	checksums := newChecksumWriter(t)
+
+	// Checksums of manifest win, others come from object; gzip data is hashed as stored, before decompression
+	composite := false
+	if checksums == nil && !s.Config.NoVerify {
+		expected, err := s.objectChecksums(ctx, t, sr.Attrs.Generation)
+		if err != nil {
+			return err
+		}
+		checksums = newChecksumWriter(expected)
+		composite = s.Config.VerifyComposite && len(expected.MD5) == 0
+	}
+	if checksums == nil && s.Index != nil && !transcode {
+		checksums = indexChecksums()
+	}
+	var indexed *checksumWriter // <= CRC32C of written data for index
+	if s.Index != nil {
+		indexed = checksums
+		if transcode {
+			indexed = indexChecksums()
+		}
+	}
+	if checksums != nil {
+		writers = append(writers, checksums)
+		if offset > 0 {
+			if err := out.(*resumeFile).hashPartial(checksums, *buf); err != nil {
+				return err
+			}
+		}
+	}
+
+	var written int64
+	if slices, sliceSize := s.sliceCount(sr, out, offset); slices > 0 {
+		s.logSlicing(t, object, slices, sliceSize)
+		if written, err = s.copySliced(ctx, t, handle, sr, out, progress, slices, sliceSize); err != nil {
+			return err
+		}
+		if checksums != nil {
+			if err := hashSliced(out, written, checksums, *buf); err != nil {
+				return err
+			}
+		}
+	} else if transcode {
+		// Progress and checksums see stored data, file and index decompressed one
+		stored := []io.Writer{progress}
+		if checksums != nil {
+			stored = append(stored, checksums)
+		}
+		file := []io.Writer{out}
+		if indexed != nil {
+			file = append(file, indexed)
+		}
+		src := io.TeeReader(s.Bandwidth.Reader(ctx, s.Pauser.Reader(ctx, reader)), io.MultiWriter(stored...))
+		if written, err = copyDecompressed(io.MultiWriter(file...), src, *buf); err != nil {
+			return err
+		}
+	} else {
+		started := time.Now()
+		written, err = io.CopyBuffer(io.MultiWriter(writers...), s.Bandwidth.Reader(ctx, s.Pauser.Reader(ctx, reader)), *buf)
+		s.Streams.Observe(written, time.Since(started))
+		if err != nil {
+			return fmt.Errorf("io.CopyBuffer: %w", err)
+		}
+	}
+
+	if checksums != nil {
+		if err := checksums.Verify(); err != nil {
+			discardPartial(out)
+			if s.Config.KeepCorrupt {
+				if kept, ok := out.(KeepingFile); ok {
+					closed = true
+					if kerr := kept.Keep(fpath + corruptSuffix); kerr != nil {
+						return kerr
+					}
+					s.Printf(t.URI(), "Kept corrupt copy of %s as %s\n", object, fpath+corruptSuffix)
+				}
+			}
+			return err
+		}
+	}
+	if composite {
+		components, err := s.ComponentCount(ctx, t.Bucket, t.Object, sr.Attrs.Generation)
+		if err != nil {
+			return err
+		}
+		s.Printf(t.URI(), "Verified %s by crc32c %s, %d components\n", object,
+			base64.StdEncoding.EncodeToString(checksums.transfer.CRC32C), components)
+	}
+
+	// State records data once reader of stream confirmed it
+	record := func() {
+		if s.State != nil {
+			s.State.Set(t.stateKey(), &StateEntry{
+				URI:            t.URI(),
+				Generation:     sr.Attrs.Generation,
+				Metageneration: sr.Attrs.Metageneration,
+				Size:           offset + written,
+			})
+		}
+	}
+	confirming, _ := out.(ConfirmingFile)
+	if confirming != nil {
+		confirming.Confirmed(record)
 	}
-	defer sr.Close()
 
-	fpath := filepath.Join(s.Config.DestinationPath, object)
+	closed = true
+	if err := out.Close(); err != nil {
+		return err
+	}
 
-	// Create directory path if it does not exist (mkdir -p)
-	if os.MkdirAll(filepath.Dir(fpath), os.ModePerm) != nil {
-		return fmt.Errorf("os.MkdirAll: %v", err)
+	if len(s.Config.ValidateCmd) > 0 {
+		if err := s.Validate(s.Ctx, fpath); err != nil { // <= not limited by download timeout
+			os.Remove(fpath)
+			return err
+		}
+	}
+	if s.Index != nil {
+		entry, err := s.indexEntry(t, fpath, out, offset+written, indexed)
+		if err == nil {
+			err = s.Index.Add(entry)
+		}
+		if err != nil {
+			return err
+		}
 	}
 
-	out, err := os.Create(fpath)
+	if s.ACLs != nil {
+		if err := s.WriteACLSidecar(ctx, t, sr.Attrs.Generation); err != nil {
+			return err
+		}
+	}
+	if s.Config.MetadataSidecar {
+		if err := s.WriteMetadataSidecar(ctx, t, sr.Attrs.Generation); err != nil {
+			return err
+		}
+	}
+	if s.Config.MetaJSONSidecar {
+		if err := s.WriteMetaJSON(ctx, t, sr.Attrs.Generation); err != nil {
+			return err
+		}
+	}
+	if s.Config.MtimeFromCustomTime || s.Config.PreserveMtime {
+		if err := s.RestoreMtime(ctx, t, fpath, sr.Attrs.Generation); err != nil {
+			return err
+		}
+	}
+
+	if confirming == nil {
+		record()
+	}
+
+	return nil
+}
+
+/*
+	Skip transfer of file which is up to date according to state, files of previous runs are kept until object data changes
+*/
+func (s *Storage) SkipUpToDate(t *Transfer) bool {
+	if s.State == nil || t.Directory {
+		return false
+	}
+	if fresh, err := s.UpToDate(t); err != nil || !fresh {
+		return false
+	}
+
+	s.Printf(t.URI(), "Up to date %s => %s\n", t.Object, t.Destination)
+	s.skipTransfer(t)
+
+	return true
+}
+
+/*
+	Skip download onto existing file: always with -no-clobber, with -newer-only unless object was modified after file
+*/
+func (s *Storage) SkipExisting(t *Transfer) bool {
+	if !s.Config.NoClobber && !s.Config.NewerOnly || t.Directory {
+		return false
+	}
+	info, err := os.Stat(t.Destination)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+
+	reason := "file exists"
+	if s.Config.NewerOnly {
+		// Listing already has modification time, otherwise ask for attributes only
+		attrs := t.Attrs
+		if attrs == nil || attrs.Updated.IsZero() {
+			ctx, cancel := s.objectContext()
+			defer cancel()
+
+			if attrs, err = s.Bucket(t.Bucket).Object(t.Object).Attrs(ctx); err != nil {
+				return false // <= download reports the error
+			}
+		}
+
+		local, remote := info.ModTime().Unix(), objectMtime(attrs).Unix()
+		switch {
+		case local > remote:
+			reason = "file is newer"
+		case local == remote && info.Size() == attrs.Size:
+			reason = "file has same size and modification time"
+		default:
+			return false
+		}
+	}
+
+	s.Printf(t.URI(), "Skipping %s => %s: %s\n", t.Object, t.Destination, reason)
+	s.skipTransfer(t)
+
+	return true
+}
+
+/*
+	Count skipped transfer as done, its size as transferred
+*/
+func (s *Storage) skipTransfer(t *Transfer) {
+	if s.Log != nil {
+		s.Log.Done(t.URI())
+	}
+	size := int64(0)
+	if t.Attrs != nil {
+		size = t.Attrs.Size
+	}
+	s.Status.Skip(t.URI(), size)
+}
+
+/*
+	Download object with pausing, retries and progress tracking
+*/
+func (s *Storage) TransferObject(t *Transfer) error {
+	if err := s.Pauser.Wait(s.Ctx); err != nil {
+		return err
+	}
+
+	if s.SkipUpToDate(t) || s.SkipExisting(t) {
+		return nil
+	}
+
+	var history []AttemptRecord
+	attempt, err := s.Retry(t.URI(), func() error {
+		// Slot is held per attempt, not while waiting to retry
+		release, err := s.acquireSlot(s.Ctx, t)
+		if err != nil {
+			return err
+		}
+		started := time.Now()
+		err = s.HedgedDownload(t)
+		release()
+		if err != nil {
+			history = append(history, AttemptRecord{
+				Attempt:  len(history) + 1,
+				Started:  started.UTC(),
+				Duration: time.Since(started).Round(time.Millisecond).String(),
+				Code:     errorCode(err),
+				Message:  err.Error(),
+			})
+		}
+		return err
+	})
+	if s.Log != nil {
+		s.Log.Done(t.URI())
+	}
 	if err != nil {
-		return fmt.Errorf("os.Create: %v", err)
+		s.Status.AddError(err)
+
+		// Objects interrupted by job cancellation or deadline did not fail permanently
+		if s.DeadLetters != nil && s.Ctx.Err() == nil {
+			if derr := s.DeadLetters.Add(t, err, history); derr != nil {
+				console.Error(derr)
+			}
+		}
+		return &TransferError{Object: t.Object, Attempt: attempt, Err: err}
+	}
+
+	s.Status.Finish(t.URI())
+
+	return nil
+}
+
+/*
+	Run transfer of object without local destination file with pausing, retries and progress tracking
+*/
+func (s *Storage) RetryTransfer(t *Transfer, op func(*Transfer) error) error {
+	if err := s.Pauser.Wait(s.Ctx); err != nil {
+		return err
 	}
-	defer out.Close()
 
-	fmt.Printf("Copying %s => %s\n", object, fpath)
+	attempt, err := s.Retry(t.URI(), func() error {
+		release, err := s.acquireSlot(s.Ctx, t)
+		if err != nil {
+			return err
+		}
+		defer release()
 
-	_, err = io.Copy(out, sr)
+		return op(t)
+	})
 	if err != nil {
-		return fmt.Errorf("io.Copy: %v", err)
+		s.Status.AddError(err)
+		return &TransferError{Object: t.Object, Attempt: attempt, Err: err}
 	}
 
+	s.Status.Finish(t.URI())
+
 	return nil
 }
 
 /*
-	Background worker for multi-threading mode
+	Download objects sequentially or with workers pool, stops on first error
 */
-func (s *Storage) DownloadObjectWithWorker(objects <-chan string, wg *sync.WaitGroup) {
-	defer wg.Done()
+func (s *Storage) DownloadObjects(transfers []*Transfer) error {
+	objectsCount := len(transfers)
 
-	// Read objects channel and download each object
-	for obj := range objects {
-		if err := s.DownloadObject(obj); err != nil {
-			exception(err)
+	// Same data always gives same order of work and messages
+	if s.Config.Deterministic {
+		sort.Slice(transfers, func(i, j int) bool {
+			return transfers[i].URI() < transfers[j].URI()
+		})
+
+		keys := make([]string, 0, objectsCount)
+		for _, t := range transfers {
+			keys = append(keys, t.URI())
 		}
+		s.Log = NewOrderedLog(keys)
 	}
+
+	return s.RunTransfers(transfers, s.TransferObject)
 }
 
 /*
-	Validate and parse GCS uri ("gs://")
+	Run transfers sequentially or with workers pool, stops on first error unless -continue-on-error
+*/
+func (s *Storage) RunTransfers(transfers []*Transfer, transfer func(*Transfer) error) error {
+	objectsCount := len(transfers)
+	s.Status.SetTotal(objectsCount, plannedBytes(transfers))
+	stop := s.ShowProgress()
+	defer stop()
+
+	// Multi-Threading mode
+	if s.Config.isMultiThread {
+		workersCount := s.PlanMemory(s.PoolSize(objectsCount))
+
+		// First error cancels the job, other workers stop
+		stats, err := s.RunPool(workersCount, objectsCount, func(i int) (int64, error) {
+			t := transfers[i]
+			if err := transfer(t); err != nil {
+				return 0, err
+			}
+			return s.Status.Transferred(t.URI()), nil
+		})
+		s.PrintWorkerStats(stats)
+		if err != nil {
+			return err
+		}
+
+		return s.Failures.Err(objectsCount)
+	}
+
+	// Usual mode
+	s.PlanMemory(1)
+	for _, t := range transfers {
+		if err := transfer(t); err != nil && !s.Failures.Add(s.Ctx, err) {
+			return err
+		}
+	}
+
+	return s.Failures.Err(objectsCount)
+}
+
+/*
+	Size copy buffers to fit memory limit, returns allowed workers count
+*/
+func (s *Storage) PlanMemory(workers int) int {
+	// Each range of sliced download has own buffer
+	streams := 1
+	if s.Config.Slices > 1 {
+		streams = s.Config.Slices
+	}
+	bufferSize, maxStreams := planMemory(s.Config.MaxMemory, workers*streams)
+	s.Buffers = NewBufferPool(bufferSize)
+	maxWorkers := maxStreams / streams
+	if maxWorkers < 1 {
+		maxWorkers = 1
+	}
+
+	if s.Config.MaxMemory > 0 && !s.Config.Quiet {
+		console.Printf("Memory limit %s: %d worker(s) with %s copy buffers\n",
+			formatBytes(s.Config.MaxMemory), maxWorkers, formatBytes(int64(bufferSize)))
+	}
+
+	return maxWorkers
+}
+
+/*
+	Write failure manifest and exit, code depends on failure reason
+*/
+func (s *Storage) Abort(transfers []*Transfer, err error) {
+	code := exitFailure
+	if errors.Is(s.Ctx.Err(), context.DeadlineExceeded) {
+		code = exitDeadlineExceeded
+		err = fmt.Errorf("job timeout %s exceeded: %w", s.Config.Timeout, err)
+	} else if sig := s.Interrupted(); sig != nil {
+		code = signalExitCode(sig)
+		err = s.interruptError(err)
+	}
+
+	// Messages of objects interrupted by failure are still printed
+	if s.Log != nil {
+		s.Log.Flush()
+	}
+	var failures *FailuresError
+	if errors.As(err, &failures) {
+		printFailures(failures)
+	}
+
+	if s.Config.FailureManifest != "" {
+		var uris []string
+		for _, t := range transfers {
+			if !s.Status.Completed(t.URI()) {
+				uris = append(uris, t.URI())
+			}
+		}
+		// Listing failed, whole source has to be retried
+		if transfers == nil && s.Config.Uri != "" {
+			uris = append(uris, s.Config.Uri)
+		}
+		sort.Strings(uris)
+
+		if werr := writeFailureManifest(s.Config.FailureManifest, uris, s.Config.TraceID); werr != nil {
+			console.Error(werr)
+		} else {
+			console.Printf("Failure manifest with %d URLs written to %s\n", len(uris), s.Config.FailureManifest)
+		}
+	}
+
+	if s.DeadLetters != nil {
+		s.DeadLetters.Close()
+	}
+	if ierr := s.Index.Close(); ierr != nil {
+		console.Error(ierr)
+	}
+	// Keep progress of finished objects for next run
+	if s.State != nil {
+		if serr := s.State.Save(); serr != nil {
+			console.Error(serr)
+		}
+	}
+
+	s.Notify(err)
+	exceptionWithCode(err, code)
+}
+
+/*
+	Write URLs which were not transferred, one per line
+*/
+func writeFailureManifest(path string, uris []string, traceID string) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("os.Create: %w", err)
+	}
+	defer out.Close()
+
+	// Comment lines are skipped when manifest is passed to -I
+	if traceID != "" {
+		if _, err := fmt.Fprintf(out, "# trace-id: %s\n", traceID); err != nil {
+			return fmt.Errorf("fmt.Fprintf: %w", err)
+		}
+	}
+
+	for _, uri := range uris {
+		if _, err := fmt.Fprintln(out, uri); err != nil {
+			return fmt.Errorf("fmt.Fprintln: %w", err)
+		}
+	}
+
+	return out.Close()
+}
+
+/*
+	Validate and parse GCS uri ("gs://"), generation suffix is refused where live objects are expected
 */
 func parseGCSUrl(uri string) (string, string, error) {
+	bucket, path, generation, err := parseVersionedUrl(uri)
+	if err == nil && generation != 0 {
+		return "", "", fmt.Errorf("generation suffix #%d can only be used with source object of download: %s", generation, uri)
+	}
+
+	return bucket, path, err
+}
+
+/*
+	Parse "gs://bucket/object#generation" like gsutil, generation is 0 without numeric suffix
+*/
+func parseVersionedUrl(uri string) (string, string, int64, error) {
 	const scheme = "gs://"
 
 	if !strings.HasPrefix(uri, scheme) {
-		return "", "", fmt.Errorf("scheme must be \"%s\": %s", scheme, uri)
+		return "", "", 0, fmt.Errorf("scheme must be \"%s\": %s", scheme, uri)
 	}
 
 	u, err := url.Parse(uri)
 	if err != nil {
-		return "", "", fmt.Errorf("could not parse uri: %s", uri)
+		return "", "", 0, fmt.Errorf("could not parse uri: %s", uri)
 	}
 
 	bucket := u.Host
 	if bucket == "" {
-		return "", "", fmt.Errorf("could not parse bucket name: %s", uri)
+		return "", "", 0, fmt.Errorf("could not parse bucket name: %s", uri)
 	}
 
 	path := u.Path
 	if path != "" {
 		path = strings.Replace(path, "/", "", 1)
 	}
+	// "?" wildcard and object names with it are not a query
+	if u.RawQuery != "" || u.ForceQuery {
+		path += "?" + u.RawQuery
+	}
+	// Other "#" are part of object name too
+	generation := int64(0)
+	if u.Fragment != "" || strings.HasSuffix(uri, "#") {
+		if n, err := strconv.ParseInt(u.Fragment, 10, 64); err == nil && n > 0 && path != "" {
+			generation = n
+		} else {
+			path += "#" + u.Fragment
+		}
+	}
 
-	return bucket, path, nil
+	return bucket, path, generation, nil
 }
 
 /*
 	General exception wrapper
 */
 func exception(err error) {
-	fmt.Printf("CommandException: %v\n", err)
-	os.Exit(1)
+	exceptionWithCode(err, exitFailure)
+}
+
+/*
+	Exception wrapper with specific exit code
+*/
+func exceptionWithCode(err error, code int) {
+	console.Status("")
+	console.Error(err)
+	console.Flush()
+	os.Exit(code)
 }
 
 func main() {
+	defer console.Close()
 
-	storage := NewStorage()
-	defer storage.Client.Close()
+	runCommand(os.Args[1:])
+}
 
-	objects, err := storage.ListObjects()
-	if err != nil {
-		exception(err)
+/*
+	Copy objects: download, upload or bucket copy depending on arguments
+*/
+func runCopyCommand(args []string) {
+	runStorage(NewStorage("cp", args))
+}
+
+/*
+	Browse bucket interactively, selected objects are downloaded
+*/
+func runBrowseCommand(args []string) {
+	runStorage(NewStorage("browse", args))
+}
+
+/*
+	Compare mirrors of config file with their local copies until stopped
+*/
+func runVerifyCommand(args []string) {
+	runStorage(NewStorage("verify", args))
+}
+
+/*
+	Run job of cp, browse or verify command
+*/
+func runStorage(storage *Storage) {
+	// Worker process gets objects from coordinating process, see -processes
+	if storage.Config.Worker != "" {
+		console.TraceID = "" // <= added once by coordinator
+		if err := storage.RunWorker(); err != nil {
+			exception(err)
+		}
+		return
 	}
 
-	objectsCount := len(objects)
+	defer storage.Client.Close()
+	for _, route := range storage.Routes {
+		defer route.Client.Close()
+	}
+	if storage.DeadLetters != nil {
+		defer storage.DeadLetters.Close()
+	}
+	if storage.State != nil {
+		defer storage.State.Close()
+	}
 
-	// Multi-Threading mode
-	if storage.Config.isMultiThread {
-		var wg sync.WaitGroup
-		objectsChan := make(chan string, objectsCount)
+	// Print job status on SIGUSR1
+	storage.Status.HandleSignals()
 
-		workersCount := runtime.NumCPU() // <= workers pool size
-		if objectsCount < workersCount { // <= reduces unnecessary workers
-			workersCount = objectsCount
+	if storage.Config.PprofAddr != "" {
+		if err := storage.ServeDebug(storage.Config.PprofAddr); err != nil {
+			exception(err)
 		}
+	}
+
+	// Pause and resume on SIGTSTP/SIGCONT or control socket commands
+	storage.HandlePauseSignals()
 
-		// Create background workers pool
-		for w := 1; w <= workersCount; w++ {
-			wg.Add(1)
-			go storage.DownloadObjectWithWorker(objectsChan, &wg)
+	// Cancel on SIGINT/SIGTERM, failure manifest and state are written before exit
+	defer storage.HandleCancelSignals()()
+	if storage.Config.ControlSocket != "" {
+		closeSocket, err := storage.ServeControlSocket(storage.Config.ControlSocket)
+		if err != nil {
+			exception(err)
 		}
+		defer closeSocket()
+	}
 
-		// Send objects to channel
-		for j := 0; j < objectsCount; j++ {
-			objectsChan <- objects[j]
+	if storage.Config.Command == "verify" {
+		if err := storage.RunVerifyDaemon(); err != nil {
+			exception(err)
 		}
+		return
+	}
 
-		close(objectsChan)
-		wg.Wait()
+	if storage.Queue != nil {
+		if failed, err := storage.RunQueueWorker(); err != nil {
+			storage.Abort(failed, err)
+		}
+		if err := storage.Sink.Close(); err != nil {
+			storage.Abort(nil, err)
+		}
+		if err := storage.Index.Close(); err != nil {
+			storage.Abort(nil, err)
+		}
+		storage.Notify(nil)
+		return
+	}
 
-	} else {
-		// Usual mode
-		for _, obj := range objects {
-			if err := storage.DownloadObject(obj); err != nil {
+	// Uploads and bucket copies share pool, retries and limits of downloads
+	if command := storage.Config.Command; command == "upload" || command == "copy" {
+		plan, run := storage.PlanUploads, storage.UploadObjects
+		if command == "copy" {
+			plan, run = storage.PlanCopies, storage.CopyObjects
+		}
+
+		transfers, err := storage.PlanOrLoad(plan)
+		if err != nil {
+			storage.Abort(nil, err)
+		}
+		if storage.Config.PlanOut != "" {
+			if err := storage.SavePlan(transfers); err != nil {
 				exception(err)
 			}
+			return
+		}
+		if storage.Config.DryRun {
+			storage.PrintDryRun(transfers)
+			return
+		}
+		if err := storage.Preflight(transfers, os.Stdin); err != nil {
+			exception(err)
+		}
+		if err := run(transfers); err != nil {
+			storage.Abort(transfers, err)
+		}
+
+		if !storage.Config.Quiet {
+			console.Printf("Operation completed over %d objects.\n", len(transfers))
+		}
+		storage.Notify(nil)
+		return
+	}
+
+	transfers, err := storage.PlanOrLoad(storage.Plan)
+	if err != nil {
+		storage.Abort(nil, err)
+	}
+
+	// Nothing was marked in interactive mode
+	if len(transfers) == 0 {
+		return
+	}
+	if storage.Config.PlanOut != "" {
+		if err := storage.SavePlan(transfers); err != nil {
+			exception(err)
 		}
+		return
+	}
+	if storage.Config.DryRun {
+		storage.PrintDryRun(transfers)
+		return
 	}
 
-	fmt.Printf("Operation completed over %d objects.\n", objectsCount)
+	// Declined job is not a failure of transfers, no manifest or notification
+	if err := storage.Preflight(transfers, os.Stdin); err != nil {
+		exception(err)
+	}
+
+	download := storage.DownloadObjects
+	if storage.Config.Processes > 0 {
+		download = storage.DownloadObjectsWithProcesses
+	}
+	if err := download(transfers); err != nil {
+		// Other objects are complete, archive or stream of them is finished
+		if errors.Is(err, ErrTransfersFailed) {
+			if cerr := storage.Sink.Close(); cerr != nil {
+				console.Error(cerr)
+			}
+		}
+		storage.Abort(transfers, err)
+	}
+	if err := storage.Sink.Close(); err != nil {
+		storage.Abort(transfers, err)
+	}
+	if err := storage.Index.Close(); err != nil {
+		storage.Abort(transfers, err)
+	}
+
+	if storage.State != nil {
+		if err := storage.State.Save(); err != nil {
+			exception(err)
+		}
+	}
+
+	if !storage.Config.Quiet {
+		console.Printf("Operation completed over %d objects.\n", len(transfers))
+	}
+	storage.Notify(nil)
 }
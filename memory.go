@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultBufferSize = 256 << 10
+	minBufferSize     = 32 << 10
+	maxBufferSize     = 1 << 20
+)
+
+type BufferPool struct {
+	Size int
+	pool sync.Pool
+}
+
+/*
+	Create pool of copy buffers of given size
+*/
+func NewBufferPool(size int) *BufferPool {
+	bp := &BufferPool{Size: size}
+	bp.pool.New = func() interface{} {
+		b := make([]byte, bp.Size)
+		return &b
+	}
+
+	return bp
+}
+
+/*
+	Take buffer from pool
+*/
+func (bp *BufferPool) Get() *[]byte {
+	return bp.pool.Get().(*[]byte)
+}
+
+/*
+	Return buffer to pool
+*/
+func (bp *BufferPool) Put(b *[]byte) {
+	bp.pool.Put(b)
+}
+
+/*
+	Apply soft memory limit and size copy buffers and workers to fit into it
+*/
+func planMemory(limit int64, workers int) (bufferSize int, maxWorkers int) {
+	if limit <= 0 {
+		return defaultBufferSize, workers
+	}
+
+	// Half of the limit is left for client, TLS and runtime overhead
+	budget := limit / 2
+	perWorker := budget / int64(workers)
+
+	switch {
+	case perWorker > maxBufferSize:
+		return maxBufferSize, workers
+	case perWorker >= minBufferSize:
+		return int(perWorker), workers
+	}
+
+	maxWorkers = int(budget / minBufferSize)
+	if maxWorkers < 1 {
+		maxWorkers = 1
+	}
+
+	return minBufferSize, maxWorkers
+}
+
+/*
+	Resolve memory limit from flag or GOMEMLIMIT environment variable
+*/
+func memoryLimit(flagValue string) (int64, error) {
+	value, source := flagValue, "-max-memory"
+	if value == "" {
+		value, source = os.Getenv("GOMEMLIMIT"), "GOMEMLIMIT"
+	}
+	if value == "" || value == "off" {
+		return 0, nil
+	}
+
+	limit, err := parseSize(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s value: %w", source, err)
+	}
+
+	// Runtime already applies GOMEMLIMIT itself
+	if source == "-max-memory" {
+		setMemoryLimit(limit)
+	}
+
+	return limit, nil
+}
+
+/*
+	Parse size with optional binary or decimal unit suffix (512MiB, 1.5G, 100KB)
+*/
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		factor float64
+	}{
+		{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30}, {"tib", 1 << 40},
+		{"kb", 1e3}, {"mb", 1e6}, {"gb", 1e9}, {"tb", 1e12},
+		{"k", 1 << 10}, {"m", 1 << 20}, {"g", 1 << 30}, {"t", 1 << 40},
+		{"b", 1},
+	}
+
+	value := strings.ToLower(strings.TrimSpace(s))
+	factor := 1.0
+	for _, u := range units {
+		if strings.HasSuffix(value, u.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, u.suffix))
+			factor = u.factor
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("could not parse size: %s", s)
+	}
+
+	return int64(n * factor), nil
+}
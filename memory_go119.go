@@ -0,0 +1,15 @@
+//go:build go1.19
+// +build go1.19
+
+package main
+
+import (
+	"runtime/debug"
+)
+
+/*
+	Set runtime soft memory limit (same as GOMEMLIMIT)
+*/
+func setMemoryLimit(limit int64) {
+	debug.SetMemoryLimit(limit)
+}
@@ -0,0 +1,10 @@
+//go:build !go1.19
+// +build !go1.19
+
+package main
+
+/*
+	Runtime soft memory limit requires Go 1.19, only buffers are sized
+*/
+func setMemoryLimit(limit int64) {
+}
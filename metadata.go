@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+type MetadataSidecar struct {
+	URI                 string            `json:"uri"`
+	Bucket              string            `json:"bucket"`
+	Name                string            `json:"name"`
+	Generation          int64             `json:"generation"`
+	Metageneration      int64             `json:"metageneration"`
+	Size                int64             `json:"size"`
+	ContentType         string            `json:"content_type,omitempty"`
+	ContentEncoding     string            `json:"content_encoding,omitempty"`
+	ContentLanguage     string            `json:"content_language,omitempty"`
+	ContentDisposition  string            `json:"content_disposition,omitempty"`
+	CacheControl        string            `json:"cache_control,omitempty"`
+	StorageClass        string            `json:"storage_class,omitempty"`
+	MD5                 string            `json:"md5,omitempty"` // <= base64, as shown by gsutil
+	CRC32C              string            `json:"crc32c"`
+	ComponentCount      int64             `json:"component_count,omitempty"` // <= composite objects, verifiable by CRC32C only
+	ETag                string            `json:"etag,omitempty"`
+	KMSKeyName          string            `json:"kms_key_name,omitempty"`
+	Created             time.Time         `json:"created"`
+	Updated             time.Time         `json:"updated"`
+	CustomTime          *time.Time        `json:"custom_time,omitempty"`
+	RetentionExpiration *time.Time        `json:"retention_expiration,omitempty"`
+	EventBasedHold      bool              `json:"event_based_hold,omitempty"`
+	TemporaryHold       bool              `json:"temporary_hold,omitempty"`
+	Metadata            map[string]string `json:"metadata,omitempty"`
+}
+
+/*
+	Write "<file>.gcs.json" sidecar with attributes of downloaded object generation
+*/
+func (s *Storage) WriteMetadataSidecar(ctx context.Context, t *Transfer, generation int64) error {
+	attrs, err := s.generationAttrs(ctx, t, generation)
+	if err != nil {
+		return err
+	}
+
+	sidecar := NewMetadataSidecar(attrs)
+	if sidecar.MD5 == "" {
+		if sidecar.ComponentCount, err = s.ComponentCount(ctx, t.Bucket, t.Object, generation); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(sidecar, "", "  ")
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	if err := os.WriteFile(t.Destination+".gcs.json", append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("os.WriteFile: %w", err)
+	}
+
+	return nil
+}
+
+/*
+	Write "<file>.meta.json" sidecar with custom metadata of downloaded object generation, "{}" when it has none
+*/
+func (s *Storage) WriteMetaJSON(ctx context.Context, t *Transfer, generation int64) error {
+	attrs, err := s.generationAttrs(ctx, t, generation)
+	if err != nil {
+		return err
+	}
+
+	metadata := attrs.Metadata
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	if err := os.WriteFile(t.Destination+".meta.json", append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("os.WriteFile: %w", err)
+	}
+
+	return nil
+}
+
+/*
+	Convert object attributes to sidecar record
+*/
+func NewMetadataSidecar(attrs *storage.ObjectAttrs) *MetadataSidecar {
+	crc32c := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc32c, attrs.CRC32C)
+
+	sidecar := &MetadataSidecar{
+		URI:                fmt.Sprintf("gs://%s/%s", attrs.Bucket, attrs.Name),
+		Bucket:             attrs.Bucket,
+		Name:               attrs.Name,
+		Generation:         attrs.Generation,
+		Metageneration:     attrs.Metageneration,
+		Size:               attrs.Size,
+		ContentType:        attrs.ContentType,
+		ContentEncoding:    attrs.ContentEncoding,
+		ContentLanguage:    attrs.ContentLanguage,
+		ContentDisposition: attrs.ContentDisposition,
+		CacheControl:       attrs.CacheControl,
+		StorageClass:       attrs.StorageClass,
+		CRC32C:             base64.StdEncoding.EncodeToString(crc32c),
+		ETag:               attrs.Etag,
+		KMSKeyName:         attrs.KMSKeyName,
+		Created:            attrs.Created,
+		Updated:            attrs.Updated,
+		EventBasedHold:     attrs.EventBasedHold,
+		TemporaryHold:      attrs.TemporaryHold,
+		Metadata:           attrs.Metadata,
+	}
+
+	// Composite objects have no MD5
+	if len(attrs.MD5) > 0 {
+		sidecar.MD5 = base64.StdEncoding.EncodeToString(attrs.MD5)
+	}
+	if !attrs.CustomTime.IsZero() {
+		sidecar.CustomTime = &attrs.CustomTime
+	}
+	if !attrs.RetentionExpirationTime.IsZero() {
+		sidecar.RetentionExpiration = &attrs.RetentionExpirationTime
+	}
+
+	return sidecar
+}
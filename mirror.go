@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+type MirrorRule struct {
+	Source string `json:"source"` // <= gs://bucket/prefix
+	Local  string `json:"local"`  // <= directory downloaded into, object names are relative to it
+}
+
+type DriftReport struct {
+	Objects    int       `json:"objects"`
+	Missing    int       `json:"missing"`    // <= no local file
+	Stale      int       `json:"stale"`      // <= object changed after local file was written
+	Mismatched int       `json:"mismatched"` // <= local file differs from object it is not older than
+	Checked    time.Time `json:"checked"`
+	Duration   string    `json:"duration"`
+	Error      string    `json:"error,omitempty"` // <= comparison failed, counters are of previous run
+}
+
+type DriftMonitor struct {
+	mu      sync.Mutex
+	reports map[string]*DriftReport // <= source => last comparison
+}
+
+/*
+	Check mirror rule of config file
+*/
+func (r *MirrorRule) Check() error {
+	if _, _, err := parseGCSUrl(r.Source); err != nil {
+		return err
+	}
+	if r.Local == "" {
+		return fmt.Errorf("local path of %s is empty", r.Source)
+	}
+
+	return nil
+}
+
+/*
+	Compare objects under source prefix with local mirror, nothing is written
+*/
+func (s *Storage) VerifyMirror(ctx context.Context, rule *MirrorRule) (*DriftReport, error) {
+	started := time.Now()
+	report := &DriftReport{}
+
+	bucket, prefix, err := parseGCSUrl(rule.Source)
+	if err != nil {
+		return nil, err
+	}
+	local, err := normalizePath(rule.Local)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := s.Buffers.Get()
+	defer s.Buffers.Put(buf)
+
+	it := s.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Bucket(%q).Objects: %w", bucket, err)
+		}
+		if strings.HasSuffix(attrs.Name, "/") || strings.HasSuffix(attrs.Name, hadoopFolderSuffix) {
+			continue
+		}
+		report.Objects++
+
+		fpath, err := safeJoin(local, attrs.Name, false)
+		if err != nil {
+			return nil, err
+		}
+		same, modified, err := s.sameContent(ctx, fpath, attrs, *buf)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			report.Missing++
+		case err != nil:
+			return nil, err
+		case same:
+		case modified.Before(attrs.Updated):
+			report.Stale++
+		default:
+			report.Mismatched++
+		}
+	}
+
+	report.Checked = time.Now().UTC()
+	report.Duration = time.Since(started).Round(time.Millisecond).String()
+
+	return report, nil
+}
+
+/*
+	Compare local file with object by size and checksum, returns modification time of file
+*/
+func (s *Storage) sameContent(ctx context.Context, fpath string, attrs *storage.ObjectAttrs, buf []byte) (bool, time.Time, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return false, time.Time{}, fmt.Errorf("os.Stat: %w", err)
+	}
+	// Local copy of stored gzip object is decompressed, only its data can be compared
+	if attrs.ContentEncoding == "gzip" {
+		same, err := s.sameDecompressed(ctx, f, attrs, buf)
+		return same, info.ModTime(), err
+	}
+	if info.Size() != attrs.Size {
+		return false, info.ModTime(), nil
+	}
+
+	// Composite objects have CRC32C only
+	expected := &Transfer{Bucket: attrs.Bucket, Object: attrs.Name, MD5: attrs.MD5}
+	if len(attrs.MD5) == 0 {
+		expected.CRC32C = make([]byte, crc32.Size)
+		binary.BigEndian.PutUint32(expected.CRC32C, attrs.CRC32C)
+	}
+	checksums := newChecksumWriter(expected)
+	if _, err := io.CopyBuffer(checksums, f, buf); err != nil {
+		return false, time.Time{}, fmt.Errorf("io.CopyBuffer: %w", err)
+	}
+
+	return checksums.Verify() == nil, info.ModTime(), nil
+}
+
+/*
+	Compare mirrors of config file every interval until job is canceled, drift is exported as "drift" metrics
+*/
+func (s *Storage) RunVerifyDaemon() error {
+	monitor := &DriftMonitor{reports: map[string]*DriftReport{}}
+	expvar.Publish("drift", expvar.Func(monitor.Metrics))
+
+	ticker := time.NewTicker(s.Config.VerifyInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, rule := range s.Config.Mirrors {
+			report, err := s.VerifyMirror(s.Ctx, rule)
+			if s.Ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				console.Error(fmt.Errorf("verify %s: %w", rule.Source, err))
+			} else {
+				console.Printf("Verified %s against %s: %d objects, %d missing, %d stale, %d mismatched\n",
+					rule.Source, rule.Local, report.Objects, report.Missing, report.Stale, report.Mismatched)
+			}
+			monitor.Set(rule.Source, report, err)
+		}
+
+		select {
+		case <-s.Ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+/*
+	Record comparison result, failed run keeps counters of previous one
+*/
+func (dm *DriftMonitor) Set(source string, report *DriftReport, err error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	if err != nil {
+		report = &DriftReport{}
+		if prev, ok := dm.reports[source]; ok {
+			*report = *prev
+		}
+		report.Error = err.Error()
+	}
+	dm.reports[source] = report
+}
+
+/*
+	Drift gauges of all mirrors
+*/
+func (dm *DriftMonitor) Metrics() interface{} {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	metrics := make(map[string]DriftReport, len(dm.reports))
+	for source, report := range dm.reports {
+		metrics[source] = *report
+	}
+
+	return metrics
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+type RenameRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string // <= in regexp.Expand syntax
+	Global      bool
+}
+
+type RenameRules []*RenameRule
+
+var sedReference = regexp.MustCompile(`\\[0-9&\\]|&|\$`)
+
+/*
+	Parse sed-style rule "s/old/new/[gi]", any delimiter may be used instead of "/"
+*/
+func ParseRenameRule(rule string) (*RenameRule, error) {
+	if len(rule) < 4 || rule[0] != 's' {
+		return nil, fmt.Errorf("rename rule must look like s/old/new/: %s", rule)
+	}
+
+	delim := rule[1:2]
+	parts := splitUnescaped(rule[2:], delim[0])
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("rename rule must look like s/old/new/: %s", rule)
+	}
+
+	pattern := parts[0]
+	rr := &RenameRule{}
+	for _, f := range parts[2] {
+		switch f {
+		case 'g':
+			rr.Global = true
+		case 'i':
+			pattern = "(?i)" + pattern
+		default:
+			return nil, fmt.Errorf("unsupported rename rule flag %q: %s", f, rule)
+		}
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("regexp.Compile: %w", err)
+	}
+	rr.Pattern = re
+
+	// Convert sed references (\1, &) to regexp.Expand ones (${1}, ${0})
+	rr.Replacement = sedReference.ReplaceAllStringFunc(parts[1], func(ref string) string {
+		switch ref {
+		case "&":
+			return "${0}"
+		case "$":
+			return "$$"
+		case `\&`:
+			return "&"
+		case `\\`:
+			return `\`
+		}
+		return "${" + ref[1:] + "}"
+	})
+
+	return rr, nil
+}
+
+/*
+	Split string by delimiter which is not escaped with backslash, escaped delimiters are unescaped
+*/
+func splitUnescaped(s string, delim byte) []string {
+	var parts []string
+	var part strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == delim:
+			part.WriteByte(delim)
+			i++
+		case s[i] == '\\' && i+1 < len(s):
+			part.WriteString(s[i : i+2])
+			i++
+		case s[i] == delim:
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteByte(s[i])
+		}
+	}
+
+	// Trailing flags have no closing delimiter
+	return append(parts, part.String())
+}
+
+/*
+	Apply rule to name, only first match is replaced unless rule is global
+*/
+func (rr *RenameRule) Apply(name string) string {
+	if rr.Global {
+		return rr.Pattern.ReplaceAllString(name, rr.Replacement)
+	}
+
+	match := rr.Pattern.FindStringSubmatchIndex(name)
+	if match == nil {
+		return name
+	}
+	result := rr.Pattern.ExpandString(nil, rr.Replacement, name, match)
+
+	return name[:match[0]] + string(result) + name[match[1]:]
+}
+
+func (rules *RenameRules) String() string {
+	return ""
+}
+
+/*
+	Add rule from repeated flag
+*/
+func (rules *RenameRules) Set(value string) error {
+	rule, err := ParseRenameRule(value)
+	if err != nil {
+		return err
+	}
+	*rules = append(*rules, rule)
+
+	return nil
+}
+
+/*
+	Apply all rules in order
+*/
+func (rules RenameRules) Apply(name string) string {
+	for _, rule := range rules {
+		name = rule.Apply(name)
+	}
+
+	return name
+}
+
+/*
+	Part of source prefix removed from object names by -strip-prefix: literal prefix up to its last "/",
+	so single object keeps its base name and "logs/2024" lists like "logs/2024/"
+*/
+func strippedPrefix(prefix string, glob bool) string {
+	if glob {
+		prefix = globPrefix(prefix)
+	} else {
+		prefix = listingPrefix(prefix)
+	}
+
+	return prefix[:strings.LastIndex(prefix, "/")+1]
+}
+
+/*
+	Transform case of name: "lower", "upper" or "preserve"
+*/
+func applyNameCase(name, mode string) string {
+	switch mode {
+	case "lower":
+		return strings.ToLower(name)
+	case "upper":
+		return strings.ToUpper(name)
+	}
+
+	return name
+}
+
+/*
+	Check date layout source of -date-layout flag
+*/
+func validDateLayout(layout string) error {
+	switch {
+	case layout == "", layout == "updated", layout == "created", layout == "custom-time":
+		return nil
+	case strings.HasPrefix(layout, "metadata:") && len(layout) > len("metadata:"):
+		return nil
+	}
+
+	return fmt.Errorf("unsupported date layout: %s", layout)
+}
+
+/*
+	Build "YYYY/MM/DD" partition path from object time selected by layout
+*/
+func datePartition(attrs *storage.ObjectAttrs, layout string) (string, error) {
+	var t time.Time
+
+	switch layout {
+	case "updated":
+		t = attrs.Updated
+	case "created":
+		t = attrs.Created
+	case "custom-time":
+		t = attrs.CustomTime
+	default:
+		key := strings.TrimPrefix(layout, "metadata:")
+		value, ok := attrs.Metadata[key]
+		if !ok {
+			return "", fmt.Errorf("object %s has no metadata %q for date layout", attrs.Name, key)
+		}
+
+		var err error
+		if t, err = parseDate(value); err != nil {
+			return "", fmt.Errorf("object %s metadata %q: %w", attrs.Name, key, err)
+		}
+	}
+
+	if t.IsZero() {
+		return "", fmt.Errorf("object %s has no %s time for date layout", attrs.Name, layout)
+	}
+
+	return t.UTC().Format("2006/01/02"), nil
+}
+
+/*
+	Parse RFC 3339 timestamp or plain YYYY-MM-DD date
+*/
+func parseDate(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02"} {
+		if t, err := time.Parse(layout, strings.TrimSpace(value)); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("unsupported date format: %s", value)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+type NotifyConfig struct {
+	On    string       `json:"on,omitempty"` // <= "always" (default) or "failure"
+	Slack *SlackConfig `json:"slack,omitempty"`
+	SMTP  *SMTPConfig  `json:"smtp,omitempty"`
+}
+
+type SlackConfig struct {
+	WebhookURL string `json:"webhook_url"`
+}
+
+type SMTPConfig struct {
+	Addr        string   `json:"addr"` // <= host:port
+	Username    string   `json:"username,omitempty"`
+	Password    string   `json:"password,omitempty"`
+	PasswordEnv string   `json:"password_env,omitempty"` // <= environment variable holding password
+	From        string   `json:"from"`
+	To          []string `json:"to"`
+}
+
+/*
+	Validate notifiers config
+*/
+func (nc *NotifyConfig) Check() error {
+	if nc.On != "" && nc.On != "always" && nc.On != "failure" {
+		return fmt.Errorf("\"on\" must be \"always\" or \"failure\": %s", nc.On)
+	}
+	if nc.Slack != nil && nc.Slack.WebhookURL == "" {
+		return fmt.Errorf("slack webhook_url is required")
+	}
+	if nc.SMTP != nil && (nc.SMTP.Addr == "" || nc.SMTP.From == "" || len(nc.SMTP.To) == 0) {
+		return fmt.Errorf("smtp addr, from and to are required")
+	}
+
+	return nil
+}
+
+/*
+	Send end-of-run summary to configured notifiers, failures are only reported
+*/
+func (s *Storage) Notify(jobErr error) {
+	nc := s.Config.Notify
+	if nc == nil || (jobErr == nil && nc.On == "failure") {
+		return
+	}
+
+	subject, body := s.runSummary(jobErr)
+
+	if nc.Slack != nil {
+		if err := sendSlack(nc.Slack, subject+"\n"+body); err != nil {
+			console.Errorf("Slack notification failed: %v\n", err)
+		}
+	}
+	if nc.SMTP != nil {
+		if err := sendMail(nc.SMTP, subject, body); err != nil {
+			console.Errorf("Email notification failed: %v\n", err)
+		}
+	}
+}
+
+func (s *Storage) runSummary(jobErr error) (string, string) {
+	source := s.Config.Uri
+	if s.Config.Manifest != "" {
+		source = s.Config.Manifest
+	}
+	host, _ := os.Hostname()
+
+	result := "completed"
+	if jobErr != nil {
+		result = "FAILED"
+	}
+	subject := fmt.Sprintf("gcs-cp %s: %s => %s", result, source, s.Config.DestinationPath)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Host: %s\n", host)
+	if s.Config.TraceID != "" {
+		fmt.Fprintf(&b, "Trace ID: %s\n", s.Config.TraceID)
+	}
+	fmt.Fprintf(&b, "%s\n", s.Status.Summary())
+	if jobErr != nil {
+		fmt.Fprintf(&b, "Error: %v\n", jobErr)
+	}
+
+	return subject, b.String()
+}
+
+func sendSlack(cfg *SlackConfig, text string) error {
+	payload, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+
+	// Default client, storage transport would add Google credentials
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(cfg.WebhookURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("http.Post: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+
+	return nil
+}
+
+func sendMail(cfg *SMTPConfig, subject, body string) error {
+	password := cfg.Password
+	if cfg.PasswordEnv != "" {
+		password = os.Getenv(cfg.PasswordEnv)
+	}
+
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		host := cfg.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", cfg.Username, password, host)
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n\r\n%s",
+		cfg.From, strings.Join(cfg.To, ", "), subject, time.Now().Format(time.RFC1123Z),
+		strings.ReplaceAll(body, "\n", "\r\n"))
+
+	if err := smtp.SendMail(cfg.Addr, auth, cfg.From, cfg.To, []byte(msg)); err != nil {
+		return fmt.Errorf("smtp.SendMail: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+type consoleMessage struct {
+	out    io.Writer
+	text   string
+	status bool          // <= replaces current status line
+	flush  chan struct{} // <= closed once all previous messages are written
+}
+
+type Console struct {
+	Stdout      io.Writer
+	Stderr      io.Writer
+	Terminal    bool   // <= status line updates are drawn only on terminals
+	ErrorFormat string // <= "text" or "json"
+	TraceID     string // <= prefixes every message line when set
+
+	messages  chan consoleMessage
+	done      chan struct{}
+	status    string
+	closeOnce sync.Once
+}
+
+// Shared console for all goroutines
+var console = NewConsole(os.Stdout, os.Stderr)
+
+/*
+	Create console and start output coordinator goroutine
+*/
+func NewConsole(stdout, stderr io.Writer) *Console {
+	c := &Console{
+		Stdout:      stdout,
+		Stderr:      stderr,
+		Terminal:    isTerminal(stdout),
+		ErrorFormat: "text",
+		messages:    make(chan consoleMessage, 256),
+		done:        make(chan struct{}),
+	}
+	go c.run()
+
+	return c
+}
+
+/*
+	Output coordinator: the only writer of stdout and stderr
+*/
+func (c *Console) run() {
+	defer close(c.done)
+
+	for msg := range c.messages {
+		if msg.flush != nil {
+			close(msg.flush)
+			continue
+		}
+
+		if msg.status {
+			if !c.Terminal {
+				continue
+			}
+			c.status = msg.text
+			fmt.Fprintf(c.Stdout, "\r\033[K%s", c.status)
+			continue
+		}
+
+		// Clear status line, print message and redraw status below it
+		if c.status != "" {
+			fmt.Fprint(c.Stdout, "\r\033[K")
+		}
+		fmt.Fprint(msg.out, msg.text)
+		if c.status != "" && strings.HasSuffix(msg.text, "\n") {
+			fmt.Fprint(c.Stdout, c.status)
+		}
+	}
+
+	// Leave cursor on a clean line
+	if c.status != "" {
+		fmt.Fprintln(c.Stdout)
+	}
+}
+
+/*
+	Print formatted message to stdout
+*/
+func (c *Console) Printf(format string, a ...interface{}) {
+	c.messages <- consoleMessage{out: c.Stdout, text: c.prefix(fmt.Sprintf(format, a...))}
+}
+
+/*
+	Print formatted message to stderr
+*/
+func (c *Console) Errorf(format string, a ...interface{}) {
+	c.messages <- consoleMessage{out: c.Stderr, text: c.prefix(fmt.Sprintf(format, a...))}
+}
+
+/*
+	Report error as prose on stdout or as JSON record on stderr
+*/
+func (c *Console) Error(err error) {
+	if c.ErrorFormat != "json" {
+		c.Printf("CommandException: %v\n", err)
+		return
+	}
+
+	record := NewErrorRecord(err)
+	record.TraceID = c.TraceID
+
+	// JSON lines are not prefixed
+	line, _ := json.Marshal(record)
+	c.messages <- consoleMessage{out: c.Stderr, text: string(line) + "\n"}
+}
+
+/*
+	Prefix each line of message with trace ID
+*/
+func (c *Console) prefix(text string) string {
+	if c.TraceID == "" || text == "" {
+		return text
+	}
+
+	lines := strings.SplitAfter(text, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = "[" + c.TraceID + "] " + line
+		}
+	}
+
+	return strings.Join(lines, "")
+}
+
+/*
+	Write stdout messages elsewhere, e.g. when stdout carries data
+*/
+func (c *Console) RedirectStdout(w io.Writer) {
+	c.Flush()
+	c.Stdout = w // <= coordinator is idle until next message
+	c.Terminal = isTerminal(w)
+}
+
+/*
+	Replace status line (e.g. progress), empty text removes it
+*/
+func (c *Console) Status(format string, a ...interface{}) {
+	c.messages <- consoleMessage{status: true, text: fmt.Sprintf(format, a...)}
+}
+
+/*
+	Wait until all queued messages are written
+*/
+func (c *Console) Flush() {
+	flush := make(chan struct{})
+	c.messages <- consoleMessage{flush: flush}
+	<-flush
+}
+
+/*
+	Flush queued messages and stop coordinator, safe to call multiple times
+*/
+func (c *Console) Close() {
+	c.closeOnce.Do(func() {
+		close(c.messages)
+	})
+	<-c.done
+}
+
+/*
+	Check if writer is an interactive terminal
+*/
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+type OrderedLog struct {
+	mu      sync.Mutex
+	index   map[string]int // <= object => position in scheduling order
+	pending map[int][]string
+	done    map[int]bool
+	next    int
+}
+
+/*
+	Create log emitting per-object messages in scheduling order
+*/
+func NewOrderedLog(objects []string) *OrderedLog {
+	ol := &OrderedLog{
+		index:   make(map[string]int, len(objects)),
+		pending: map[int][]string{},
+		done:    map[int]bool{},
+	}
+	for i, obj := range objects {
+		ol.index[obj] = i
+	}
+
+	return ol
+}
+
+/*
+	Queue message of object, unknown objects are printed immediately
+*/
+func (ol *OrderedLog) Printf(object string, format string, a ...interface{}) {
+	ol.mu.Lock()
+	defer ol.mu.Unlock()
+
+	i, ok := ol.index[object]
+	if !ok {
+		console.Printf(format, a...)
+		return
+	}
+	ol.pending[i] = append(ol.pending[i], fmt.Sprintf(format, a...))
+}
+
+/*
+	Mark object as finished and print messages which are next in order
+*/
+func (ol *OrderedLog) Done(object string) {
+	ol.mu.Lock()
+	defer ol.mu.Unlock()
+
+	if i, ok := ol.index[object]; ok {
+		ol.done[i] = true
+	}
+	for ol.done[ol.next] {
+		ol.emit(ol.next)
+		ol.next++
+	}
+}
+
+/*
+	Print all queued messages in order, e.g. before exit
+*/
+func (ol *OrderedLog) Flush() {
+	ol.mu.Lock()
+	defer ol.mu.Unlock()
+
+	for ; ol.next < len(ol.index); ol.next++ {
+		ol.emit(ol.next)
+	}
+}
+
+func (ol *OrderedLog) emit(i int) {
+	for _, text := range ol.pending[i] {
+		console.Printf("%s", text)
+	}
+	delete(ol.pending, i)
+	delete(ol.done, i)
+}
+
+/*
+	Print message related to object, ordered in deterministic mode
+*/
+func (s *Storage) Printf(object string, format string, a ...interface{}) {
+	if s.Config.Quiet {
+		return
+	}
+	if s.Log != nil {
+		s.Log.Printf(object, format, a...)
+		return
+	}
+	console.Printf(format, a...)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	Expand leading "~" to home directory and clean path, empty path is kept
+*/
+func normalizePath(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+
+	if path == "~" || strings.HasPrefix(path, "~/") || strings.HasPrefix(path, "~"+string(filepath.Separator)) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("os.UserHomeDir: %w", err)
+		}
+		path = filepath.Join(home, path[1:])
+	}
+
+	return filepath.Clean(path), nil
+}
+
+/*
+	Join object name to destination root, names escaping root via ".." are refused unless allowed
+*/
+func safeJoin(root, name string, allowEscape bool) (string, error) {
+	path := filepath.Join(root, name)
+	if allowEscape {
+		return path, nil
+	}
+
+	// Join cleans "..", relative path shows where cleaned name ended up
+	base := root
+	if base == "" {
+		base = "."
+	}
+	rel, err := filepath.Rel(base, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: object %s would be written to %s outside of %s (use -allow-escape)",
+			ErrPathEscape, name, path, base)
+	}
+
+	return path, nil
+}
+
+/*
+	Check that destination directory exists unless missing path may be created
+*/
+func (s *Storage) CheckDestination() error {
+	if s.Config.CreateDirs || s.Config.DestinationPath == "" {
+		return nil
+	}
+
+	info, err := os.Stat(s.Config.DestinationPath)
+	if err != nil {
+		return fmt.Errorf("destination must exist with -no-create-dirs: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("destination is not a directory: %s", s.Config.DestinationPath)
+	}
+
+	return nil
+}
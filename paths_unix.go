@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+)
+
+/*
+	Create directory with parents (mkdir -p)
+*/
+func mkdirAll(path string) error {
+	return os.MkdirAll(path, os.ModePerm)
+}
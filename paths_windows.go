@@ -0,0 +1,42 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	Create directory with parents, for UNC paths (\\server\share\dir) only directories below share are created
+*/
+func mkdirAll(path string) error {
+	path = filepath.Clean(path)
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return nil
+	}
+
+	// Server and share are volume of UNC path, they can not be created or even listed without permissions
+	volume := filepath.VolumeName(path)
+	current, rest := volume, path[len(volume):]
+	if strings.HasPrefix(rest, `\`) {
+		current, rest = volume+`\`, rest[1:]
+	}
+	for _, part := range strings.Split(rest, `\`) {
+		if part == "" {
+			continue
+		}
+		current = filepath.Join(current, part)
+
+		if err := os.Mkdir(current, os.ModePerm); err != nil && !os.IsExist(err) {
+			// Other worker could create it in the meantime
+			if info, serr := os.Stat(current); serr != nil || !info.IsDir() {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
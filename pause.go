@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+type Pauser struct {
+	mu      sync.Mutex
+	paused  bool
+	resumed chan struct{} // <= closed on resume
+}
+
+type pausingReader struct {
+	ctx    context.Context
+	reader io.Reader
+	pauser *Pauser
+}
+
+/*
+	Create new pause/resume gate
+*/
+func NewPauser() *Pauser {
+	return &Pauser{}
+}
+
+/*
+	Stop scheduling new objects and reading new chunks
+*/
+func (p *Pauser) Pause() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.paused {
+		return false
+	}
+	p.paused = true
+	p.resumed = make(chan struct{})
+
+	return true
+}
+
+/*
+	Continue paused transfers
+*/
+func (p *Pauser) Resume() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.paused {
+		return false
+	}
+	p.paused = false
+	close(p.resumed)
+
+	return true
+}
+
+/*
+	Toggle pause state, returns true if transfers got paused
+*/
+func (p *Pauser) Toggle() bool {
+	if p.Pause() {
+		return true
+	}
+	p.Resume()
+
+	return false
+}
+
+/*
+	Check pause state
+*/
+func (p *Pauser) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.paused
+}
+
+/*
+	Block while transfers are paused
+*/
+func (p *Pauser) Wait(ctx context.Context) error {
+	p.mu.Lock()
+	paused, resumed := p.paused, p.resumed
+	p.mu.Unlock()
+
+	if !paused {
+		return nil
+	}
+
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+	Wrap reader to block between chunks while paused
+*/
+func (p *Pauser) Reader(ctx context.Context, r io.Reader) io.Reader {
+	return &pausingReader{ctx: ctx, reader: r, pauser: p}
+}
+
+func (r *pausingReader) Read(b []byte) (int, error) {
+	if err := r.pauser.Wait(r.ctx); err != nil {
+		return 0, err
+	}
+
+	return r.reader.Read(b)
+}
+
+/*
+	Report pause state changes on console
+*/
+func (s *Storage) SetPaused(paused bool) {
+	if paused {
+		if s.Pauser.Pause() {
+			console.Printf("Paused: in-flight objects stop after current chunk, no new objects are started\n")
+		}
+		return
+	}
+
+	if s.Pauser.Resume() {
+		console.Printf("Resumed\n")
+	}
+}
+
+/*
+	Serve local control socket accepting "pause", "resume" and "status" commands
+*/
+func (s *Storage) ServeControlSocket(path string) (func(), error) {
+	// Remove stale socket left by previous run
+	if _, err := os.Stat(path); err == nil {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("os.Remove: %w", err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("net.Listen: %w", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleControlConn(conn)
+		}
+	}()
+
+	return func() {
+		listener.Close()
+		os.Remove(path)
+	}, nil
+}
+
+func (s *Storage) handleControlConn(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		switch command := strings.TrimSpace(scanner.Text()); command {
+		case "pause":
+			s.SetPaused(true)
+			fmt.Fprintln(conn, "paused")
+		case "resume":
+			s.SetPaused(false)
+			fmt.Fprintln(conn, "running")
+		case "status":
+			state := "running"
+			if s.Pauser.Paused() {
+				state = "paused"
+			}
+			fmt.Fprintf(conn, "state: %s\n%s", state, s.Status.Snapshot())
+		case "":
+		default:
+			fmt.Fprintf(conn, "unknown command: %s\n", command)
+		}
+	}
+}
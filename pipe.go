@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+type pipeProcess struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	acks  *ackQueue // <= nil without -pipe-ack
+}
+
+/*
+	Entries written to command which it did not confirm yet, confirmations come in order of entries
+*/
+type ackQueue struct {
+	mu      sync.Mutex
+	pending []pendingAck
+	err     error
+	done    chan struct{}
+}
+
+type pendingAck struct {
+	name      string
+	confirmed func()
+}
+
+/*
+	Start long-lived command reading tar stream of all objects on stdin, with ack it confirms each entry by printing its name
+*/
+func NewPipeSink(args []string, ack bool) (*TarSink, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("cmd.StdinPipe: %w", err)
+	}
+
+	process := &pipeProcess{cmd: cmd, stdin: stdin}
+	var stdout io.Reader
+	if ack {
+		if stdout, err = cmd.StdoutPipe(); err != nil {
+			return nil, fmt.Errorf("cmd.StdoutPipe: %w", err)
+		}
+		process.acks = &ackQueue{done: make(chan struct{})}
+	} else {
+		cmd.Stdout = os.Stderr // <= stdout of this process has messages
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("cmd.Start: %w", err)
+	}
+	if process.acks != nil {
+		go process.acks.run(stdout)
+	}
+
+	sink := NewTarSink(stdin)
+	sink.closer = process
+	sink.acks = process.acks
+
+	return sink, nil
+}
+
+/*
+	End input of command and wait until it processed and confirmed everything
+*/
+func (p *pipeProcess) Close() error {
+	p.stdin.Close()
+
+	// Output must be read fully before waiting for command
+	var ackErr error
+	if p.acks != nil {
+		ackErr = p.acks.wait()
+	}
+	if err := p.cmd.Wait(); err != nil {
+		return fmt.Errorf("-pipe-to command: %w", err)
+	}
+
+	return ackErr
+}
+
+/*
+	Wait for confirmation of entry, readers may read ahead so writing continues meanwhile
+*/
+func (q *ackQueue) push(name string, confirmed func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.pending = append(q.pending, pendingAck{name: name, confirmed: confirmed})
+}
+
+/*
+	Match confirmation lines of command with written entries
+*/
+func (q *ackQueue) run(r io.Reader) {
+	defer close(q.done)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		name := scanner.Text()
+		shown := name // <= e.g. data echoed by wrong command
+		if len(shown) > 200 {
+			shown = shown[:200] + "..."
+		}
+
+		q.mu.Lock()
+		var next pendingAck
+		switch {
+		case q.err != nil:
+		case len(q.pending) == 0:
+			q.err = fmt.Errorf("%w: -pipe-to command confirmed %q which was not written", ErrSinkBroken, shown)
+		case q.pending[0].name != name:
+			q.err = fmt.Errorf("%w: -pipe-to command confirmed %q instead of %q", ErrSinkBroken, shown, q.pending[0].name)
+		default:
+			next = q.pending[0]
+			q.pending = q.pending[1:]
+		}
+		q.mu.Unlock()
+
+		// Output is drained after error too, command must not block on it
+		if next.confirmed != nil {
+			next.confirmed()
+		}
+	}
+}
+
+/*
+	Error of confirmations so far
+*/
+func (q *ackQueue) Err() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.err
+}
+
+/*
+	Wait until command closed its output, all entries must be confirmed
+*/
+func (q *ackQueue) wait() error {
+	<-q.done
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.err != nil {
+		return q.err
+	}
+	if len(q.pending) > 0 {
+		return fmt.Errorf("%w: -pipe-to command exited before confirming %d objects, first %s",
+			ErrSinkBroken, len(q.pending), q.pending[0].name)
+	}
+
+	return nil
+}
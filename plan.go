@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+const planVersion = 1
+
+/*
+	Planned job of -plan-out, executed later by -plan-in without listing again, e.g. after review or by a scheduler
+*/
+type TransferPlan struct {
+	Version     int                `json:"version"`
+	Command     string             `json:"command"`     // <= "cp" (download), "upload" or "copy"
+	Source      string             `json:"source"`      // <= gs:// URL of downloads and copies, local path of uploads, empty for -manifest and -I
+	Destination string             `json:"destination"` // <= local path or sink of downloads, gs:// URL of uploads and copies
+	Created     time.Time          `json:"created"`
+	Objects     int                `json:"objects"`
+	Bytes       int64              `json:"bytes"` // <= estimate, objects of unknown size are not counted
+	Transfers   []*PlannedTransfer `json:"transfers"`
+}
+
+type PlannedTransfer struct {
+	Source      string         `json:"source"`      // <= gs:// URL, local file of uploads
+	Destination string         `json:"destination"` // <= local file, gs:// URL of uploads and copies
+	Object      *PlannedObject `json:"object,omitempty"`
+	MD5         string         `json:"md5,omitempty"` // <= expected checksums of manifest, hex
+	CRC32C      string         `json:"crc32c,omitempty"`
+	Directory   bool           `json:"directory,omitempty"`
+}
+
+/*
+	Listed object or local file of upload, nil for manifest and URL list entries
+*/
+type PlannedObject struct {
+	Size         int64      `json:"size"`
+	Generation   int64      `json:"generation,omitempty"` // <= copies and verification use this generation
+	MD5          string     `json:"md5,omitempty"`        // <= hex, listed downloads are verified by them
+	CRC32C       string     `json:"crc32c,omitempty"`
+	CustomTime   *time.Time `json:"custom_time,omitempty"`
+	StorageClass string     `json:"storage_class,omitempty"` // <= cost estimate of -plan-in
+}
+
+/*
+	Describe planned transfers of job
+*/
+func NewTransferPlan(cfg *Config, transfers []*Transfer) *TransferPlan {
+	plan := &TransferPlan{
+		Version:     planVersion,
+		Command:     cfg.Command,
+		Source:      cfg.Uri,
+		Destination: cfg.DestinationPath,
+		Created:     time.Now().UTC(),
+		Objects:     len(transfers),
+		Transfers:   make([]*PlannedTransfer, 0, len(transfers)),
+	}
+	switch cfg.Command {
+	case "browse":
+		plan.Command = "cp" // <= objects are selected already
+	case "upload":
+		plan.Source, plan.Destination = cfg.SourcePath, cfg.Uri
+	case "copy":
+		plan.Destination = fmt.Sprintf("gs://%s/%s", cfg.DestBucket, cfg.DestPrefix)
+	}
+	if cfg.Sink != "" {
+		plan.Destination = cfg.Sink
+	}
+
+	for _, t := range transfers {
+		pt := &PlannedTransfer{
+			Source:      t.URI(),
+			Destination: t.Destination,
+			MD5:         hex.EncodeToString(t.MD5),
+			CRC32C:      hex.EncodeToString(t.CRC32C),
+			Directory:   t.Directory,
+		}
+		if plan.Command == "upload" {
+			pt.Source, pt.Destination = t.Destination, t.URI()
+		}
+		if t.Attrs != nil {
+			pt.Object = &PlannedObject{Size: t.Attrs.Size, Generation: t.Attrs.Generation, MD5: hex.EncodeToString(t.Attrs.MD5),
+				StorageClass: t.Attrs.StorageClass}
+			if t.Attrs.Generation != 0 {
+				pt.Object.CRC32C = fmt.Sprintf("%08x", t.Attrs.CRC32C) // <= local files of uploads have none yet
+			}
+			if !t.Attrs.CustomTime.IsZero() {
+				pt.Object.CustomTime = &t.Attrs.CustomTime
+			}
+			plan.Bytes += t.Attrs.Size
+		}
+		plan.Transfers = append(plan.Transfers, pt)
+	}
+
+	return plan
+}
+
+/*
+	Transfers of -plan-in, or planned by given function
+*/
+func (s *Storage) PlanOrLoad(plan func() ([]*Transfer, error)) ([]*Transfer, error) {
+	if s.Config.Plan == nil {
+		return plan()
+	}
+	if s.Config.Command == "cp" {
+		if err := s.CheckDestination(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s.Config.Plan.NewTransfers()
+}
+
+/*
+	Write plan of -plan-out instead of transferring
+*/
+func (s *Storage) SavePlan(transfers []*Transfer) error {
+	plan := NewTransferPlan(s.Config, transfers)
+	if err := plan.Save(s.Config.PlanOut); err != nil {
+		return err
+	}
+	console.Printf("Plan of %d objects (%s) written to %s\n", plan.Objects, formatBytes(plan.Bytes), s.Config.PlanOut)
+	if s.Config.EstimateCost {
+		console.Printf("%s", s.EstimateCost(transfers))
+	}
+
+	return nil
+}
+
+/*
+	Print transfers of -dry-run with sizes and total instead of running them
+*/
+func (s *Storage) PrintDryRun(transfers []*Transfer) {
+	e := EstimateTransfers(transfers)
+	for _, t := range transfers {
+		if t.Directory {
+			console.Printf("Would create directory %s\n", t.Destination)
+			continue
+		}
+		source, destination := t.URI(), t.Destination
+		if s.Config.Command == "upload" {
+			source, destination = destination, source
+		}
+		size := "unknown size"
+		if t.Attrs != nil && t.Attrs.Size >= 0 {
+			size = formatBytes(t.Attrs.Size)
+		}
+		console.Printf("Would copy %s => %s (%s)\n", source, destination, size)
+	}
+
+	unknown := ""
+	if e.Unknown > 0 {
+		unknown = fmt.Sprintf(" (%d of unknown size)", e.Unknown)
+	}
+	console.Printf("Dry run: %d objects, %s would be transferred%s\n", e.Objects, formatBytes(e.Bytes), unknown)
+	if s.Config.EstimateCost {
+		console.Printf("%s", s.EstimateCost(transfers))
+	}
+}
+
+/*
+	Read plan of -plan-in
+*/
+func LoadTransferPlan(path string) (*TransferPlan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile: %w", err)
+	}
+
+	plan := &TransferPlan{}
+	if err := json.Unmarshal(data, plan); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	if plan.Version != planVersion {
+		return nil, fmt.Errorf("plan %s has unsupported version %d", path, plan.Version)
+	}
+	switch plan.Command {
+	case "cp", "upload", "copy":
+	default:
+		return nil, fmt.Errorf("plan %s has unsupported command %q", path, plan.Command)
+	}
+	if len(plan.Transfers) == 0 {
+		return nil, fmt.Errorf("plan has no transfers: %s", path)
+	}
+
+	return plan, nil
+}
+
+/*
+	Write plan as indented JSON, so it can be reviewed and edited
+*/
+func (p *TransferPlan) Save(path string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0666); err != nil {
+		return fmt.Errorf("os.WriteFile: %w", err)
+	}
+
+	return nil
+}
+
+/*
+	Transfers of plan, entries edited by hand are checked like manifest entries
+*/
+func (p *TransferPlan) NewTransfers() ([]*Transfer, error) {
+	transfers := make([]*Transfer, 0, len(p.Transfers))
+	destinations := map[string]string{}
+
+	for i, pt := range p.Transfers {
+		t, err := pt.Transfer(p.Command)
+		if err != nil {
+			return nil, fmt.Errorf("plan entry %d: %w", i+1, err)
+		}
+		if prev, ok := destinations[t.Destination]; ok {
+			return nil, fmt.Errorf("plan entry %d: destination %s is already used by %s", i+1, t.Destination, prev)
+		}
+		destinations[t.Destination] = t.URI()
+		transfers = append(transfers, t)
+	}
+
+	return transfers, nil
+}
+
+/*
+	Convert planned transfer of command, object URL is source of downloads and copies and destination of uploads
+*/
+func (pt *PlannedTransfer) Transfer(command string) (*Transfer, error) {
+	remote, other := pt.Source, pt.Destination
+	if command == "upload" {
+		remote, other = other, remote
+	}
+	bucket, object, err := parseGCSUrl(remote)
+	if err != nil {
+		return nil, err
+	}
+	if object == "" || other == "" || (command == "copy" && !strings.HasPrefix(other, "gs://")) {
+		return nil, fmt.Errorf("invalid transfer %s => %s", pt.Source, pt.Destination)
+	}
+
+	t := &Transfer{Bucket: bucket, Object: object, Destination: other, Directory: pt.Directory}
+	if po := pt.Object; po != nil {
+		t.Attrs = &storage.ObjectAttrs{Bucket: bucket, Name: object, Size: po.Size, Generation: po.Generation, StorageClass: po.StorageClass}
+		if t.Attrs.MD5, err = decodeChecksum(po.MD5, md5.Size); err != nil {
+			return nil, fmt.Errorf("object md5: %w", err)
+		}
+		if po.CRC32C != "" {
+			crc32c, err := strconv.ParseUint(po.CRC32C, 16, 32)
+			if err != nil {
+				return nil, fmt.Errorf("object crc32c: invalid checksum value: %s", po.CRC32C)
+			}
+			t.Attrs.CRC32C = uint32(crc32c)
+		}
+	}
+	if t.MD5, err = decodeChecksum(pt.MD5, md5.Size); err != nil {
+		return nil, fmt.Errorf("md5: %w", err)
+	}
+	if t.CRC32C, err = decodeChecksum(pt.CRC32C, crc32.Size); err != nil {
+		return nil, fmt.Errorf("crc32c: %w", err)
+	}
+
+	return t, nil
+}
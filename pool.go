@@ -0,0 +1,100 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+type WorkerStats struct {
+	ID      int
+	Objects int
+	Bytes   int64
+	Errors  int
+	Busy    time.Duration
+}
+
+/*
+	Workers pool size: -j or number of CPUs, not more than objects
+*/
+func (s *Storage) PoolSize(objects int) int {
+	workers := s.Config.Jobs
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if objects < workers { // <= reduces unnecessary workers
+		workers = objects
+	}
+
+	return workers
+}
+
+/*
+	Run work for each item in workers pool, first error cancels the job and remaining items are skipped,
+	unless it is collected for -continue-on-error
+*/
+func (s *Storage) RunPool(workers, items int, work func(i int) (int64, error)) ([]*WorkerStats, error) {
+	var wg sync.WaitGroup
+	var once sync.Once
+	var jobErr error
+
+	fail := func(err error) {
+		once.Do(func() {
+			jobErr = err
+			s.Cancel()
+		})
+	}
+
+	jobs := make(chan int, items)
+	for i := 0; i < items; i++ {
+		jobs <- i
+	}
+	close(jobs)
+
+	stats := make([]*WorkerStats, workers)
+	for w := range stats {
+		stats[w] = &WorkerStats{ID: w + 1}
+
+		wg.Add(1)
+		go func(ws *WorkerStats) {
+			defer wg.Done()
+
+			for i := range jobs {
+				// Drain remaining items once job is canceled
+				if s.Ctx.Err() != nil {
+					continue
+				}
+
+				started := time.Now()
+				n, err := work(i)
+				ws.Busy += time.Since(started)
+				ws.Objects++
+				if err != nil {
+					ws.Errors++
+					if !s.Failures.Add(s.Ctx, err) {
+						fail(err)
+					}
+					continue
+				}
+				ws.Bytes += n
+			}
+		}(stats[w])
+	}
+	wg.Wait()
+
+	return stats, jobErr
+}
+
+/*
+	Print per-worker counters after pool finished, timings differ between runs so not in deterministic mode
+*/
+func (s *Storage) PrintWorkerStats(stats []*WorkerStats) {
+	if s.Config.Deterministic || len(stats) < 2 {
+		return
+	}
+
+	for _, ws := range stats {
+		console.Printf("Worker %d: %d objects, %s, %d errors, busy %s\n",
+			ws.ID, ws.Objects, formatBytes(ws.Bytes), ws.Errors, ws.Busy.Round(time.Millisecond))
+	}
+}
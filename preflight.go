@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type PreflightEstimate struct {
+	Objects int
+	Bytes   int64
+	Unknown int // <= objects without listing size (manifest and URL list entries)
+}
+
+/*
+	Sum objects and bytes of planned transfers
+*/
+func EstimateTransfers(transfers []*Transfer) PreflightEstimate {
+	var e PreflightEstimate
+	for _, t := range transfers {
+		e.Objects++
+		if t.Attrs == nil || t.Attrs.Size < 0 {
+			e.Unknown++
+			continue
+		}
+		e.Bytes += t.Attrs.Size
+	}
+
+	return e
+}
+
+/*
+	Print planned transfer size and ask for confirmation when it exceeds thresholds
+*/
+func (s *Storage) Preflight(transfers []*Transfer, in io.Reader) error {
+	cfg := s.Config
+	if !cfg.Preflight && cfg.ConfirmObjects == 0 && cfg.ConfirmBytes == 0 && !cfg.EstimateCost {
+		return nil
+	}
+
+	e := EstimateTransfers(transfers)
+	unknown := ""
+	if e.Unknown > 0 {
+		unknown = fmt.Sprintf(" (%d of unknown size)", e.Unknown)
+	}
+	console.Printf("Preflight: %d objects, %s to transfer%s\n", e.Objects, formatBytes(e.Bytes), unknown)
+	if cfg.EstimateCost {
+		console.Printf("%s", s.EstimateCost(transfers))
+	}
+
+	over := (cfg.ConfirmObjects > 0 && e.Objects > cfg.ConfirmObjects) ||
+		(cfg.ConfirmBytes > 0 && e.Bytes > cfg.ConfirmBytes)
+	if !over || cfg.AssumeYes {
+		return nil
+	}
+
+	return confirm("Transfer exceeds confirmation threshold, continue?", in)
+}
+
+/*
+	Ask question on console, only "y" or "yes" answer continues
+*/
+func confirm(question string, in io.Reader) error {
+	// Prompt has to be shown before blocking on input
+	console.Printf("%s [y/N] ", question)
+	console.Flush()
+
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && answer == "" {
+		console.Printf("\n")
+		return fmt.Errorf("%w: no answer", ErrNotConfirmed)
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+
+	return ErrNotConfirmed
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	progressInterval  = 500 * time.Millisecond
+	progressSmoothing = 5 * time.Second // <= rate follows changes within about this time
+	progressNameWidth = 40              // <= longer names are shortened, line must not wrap
+)
+
+/*
+	Throughput smoothed by exponential moving average, so ETA does not jump with each sample
+*/
+type rateMeter struct {
+	bytes int64
+	at    time.Time
+	rate  float64 // <= bytes per second
+}
+
+/*
+	Add sample of total bytes transferred, returns current rate
+*/
+func (m *rateMeter) Update(bytes int64, now time.Time) float64 {
+	if !m.at.IsZero() {
+		if elapsed := now.Sub(m.at).Seconds(); elapsed > 0 {
+			current := math.Max(float64(bytes-m.bytes), 0) / elapsed // <= dropped hedges lower total
+			if m.rate == 0 {
+				m.rate = current
+			} else {
+				m.rate += (1 - math.Exp(-elapsed/progressSmoothing.Seconds())) * (current - m.rate)
+			}
+		}
+	}
+	m.bytes, m.at = bytes, now
+
+	return m.rate
+}
+
+/*
+	Draw progress line until returned function is called, only on terminals and without -quiet
+*/
+func (s *Storage) ShowProgress() func() {
+	meter := &rateMeter{}
+	aggregate := s.Config.isMultiThread || s.Config.Processes > 0
+
+	return s.showStatusLine(func(snapshot ProgressSnapshot, now time.Time) string {
+		return formatProgress(snapshot, meter.Update(snapshot.Bytes, now), aggregate)
+	})
+}
+
+/*
+	Draw status line of job until returned function is called, only on terminals and without -quiet
+*/
+func (s *Storage) showStatusLine(line func(snapshot ProgressSnapshot, now time.Time) string) func() {
+	if s.Config.Quiet || !console.Terminal {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				console.Status("%s", line(s.Status.Progress(), now))
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+		console.Status("")
+	}
+}
+
+/*
+	Progress line: object in flight with its own size and ETA, or whole job with parallel transfers
+*/
+func formatProgress(snapshot ProgressSnapshot, rate float64, aggregate bool) string {
+	var fields []string
+
+	if !aggregate && len(snapshot.InFlight) > 0 {
+		p := snapshot.InFlight[0]
+		fields = append(fields, shortenName(p.Name)+" "+formatPortion(p.Written, p.Size), formatRate(rate))
+		if p.Size > 0 {
+			fields = append(fields, "ETA "+formatETA(p.Size-p.Written, rate))
+		}
+		fields = append(fields, fmt.Sprintf("object %d/%d", snapshot.Done+1, snapshot.Total))
+		return strings.Join(fields, " | ")
+	}
+
+	fields = append(fields, fmt.Sprintf("Objects %d/%d", snapshot.Done, snapshot.Total),
+		formatPortion(snapshot.Bytes, snapshot.TotalBytes), formatRate(rate))
+	if snapshot.TotalBytes > 0 {
+		fields = append(fields, "ETA "+formatETA(snapshot.TotalBytes-snapshot.Bytes, rate))
+	}
+	if len(snapshot.InFlight) > 0 {
+		fields = append(fields, fmt.Sprintf("%d in flight", len(snapshot.InFlight)))
+	}
+
+	return strings.Join(fields, " | ")
+}
+
+/*
+	Bytes done of total with percentage, total 0 means unknown
+*/
+func formatPortion(done, total int64) string {
+	if total <= 0 {
+		return formatBytes(done)
+	}
+
+	return fmt.Sprintf("%s/%s (%.1f%%)", formatBytes(done), formatBytes(total), float64(done)*100/float64(total))
+}
+
+/*
+	Keep end of long object name, it differs between objects
+*/
+func shortenName(name string) string {
+	if len(name) <= progressNameWidth {
+		return name
+	}
+
+	return "..." + name[len(name)-progressNameWidth+3:]
+}
+
+func formatRate(rate float64) string {
+	return formatBytes(int64(rate)) + "/s"
+}
+
+/*
+	Time left at current rate, "?" until data flows
+*/
+func formatETA(remaining int64, rate float64) string {
+	if remaining <= 0 {
+		return "0s"
+	}
+	if rate < 1 {
+		return "?"
+	}
+
+	return time.Duration(float64(remaining) / rate * float64(time.Second)).Round(time.Second).String()
+}
+
+/*
+	Listed size of all transfers, 0 when size of some objects is not known (e.g. -manifest)
+*/
+func plannedBytes(transfers []*Transfer) int64 {
+	var total int64
+	for _, t := range transfers {
+		if t.Attrs == nil {
+			return 0
+		}
+		total += t.Attrs.Size
+	}
+
+	return total
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+const (
+	defaultQueueBatch = 100
+	queueLease        = time.Minute     // <= ack deadline of pulled message, extended while it is copied
+	queuePoll         = 5 * time.Second // <= pause after empty pull
+	queueSettleTime   = 30 * time.Second
+	queueMaxDelay     = 10 * time.Minute // <= longest ack deadline of Pub/Sub
+)
+
+var pubsubName = regexp.MustCompile(`^projects/[^/]+/(topics|subscriptions)/[^/]+$`)
+
+/*
+	Shared queue of object URL batches, drained by any number of cooperating workers
+*/
+type WorkQueue interface {
+	Publish(ctx context.Context, data []byte) error
+	Pull(ctx context.Context) (*QueueMessage, error) // <= nil message when queue has nothing to deliver now
+	Extend(ctx context.Context, msg *QueueMessage, lease time.Duration) error
+	Ack(ctx context.Context, msg *QueueMessage) error
+	Nack(ctx context.Context, msg *QueueMessage, delay time.Duration) error // <= message is delivered again after delay, maybe to other worker
+}
+
+type QueueMessage struct {
+	ID   string
+	Data []byte
+
+	ackID string
+	lane  int // <= index of PriorityQueue lane which delivered it
+}
+
+/*
+	Queues in priority order, pull takes message of first lane which has one; bulk message in flight
+	is finished, urgent ones are copied before the next one
+*/
+type PriorityQueue struct {
+	Lanes []WorkQueue
+}
+
+/*
+	Work queue of Pub/Sub topic (publishing) or subscription (pulling)
+*/
+type PubSubQueue struct {
+	Name    string
+	service *pubsub.Service
+}
+
+/*
+	Check Pub/Sub resource name of given kind, "topics" or "subscriptions"
+*/
+func checkPubSubName(name, kind string) error {
+	match := pubsubName.FindStringSubmatch(name)
+	if match == nil || match[1] != kind {
+		return fmt.Errorf("invalid Pub/Sub name %q, want projects/PROJECT/%s/NAME", name, kind)
+	}
+
+	return nil
+}
+
+/*
+	Application default credentials with Pub/Sub scope, storage ones do not grant it
+*/
+func pubsubCredentials(ctx context.Context) (oauth2.TokenSource, error) {
+	creds, err := google.FindDefaultCredentials(ctx, pubsub.PubsubScope)
+	if err != nil {
+		return nil, fmt.Errorf("google.FindDefaultCredentials: %w", err)
+	}
+
+	return creds.TokenSource, nil
+}
+
+/*
+	Connect to Pub/Sub, PUBSUB_EMULATOR_HOST selects emulator without credentials
+*/
+func NewPubSubQueue(ctx context.Context, cfg *TransportConfig, name string) (*PubSubQueue, error) {
+	// Storage endpoints, quota and faults do not apply, pulls wait for messages longer than response header timeout
+	transport := &TransportConfig{
+		IdleConnTimeout:     cfg.IdleConnTimeout,
+		TLSHandshakeTimeout: cfg.TLSHandshakeTimeout,
+		DialTimeout:         cfg.DialTimeout,
+		UserAgent:           cfg.UserAgent,
+		Headers:             cfg.Headers,
+	}
+
+	credentials := pubsubCredentials
+	host := os.Getenv("PUBSUB_EMULATOR_HOST")
+	if host != "" {
+		credentials = nil
+	}
+	hc, err := newHTTPClient(ctx, transport, credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []option.ClientOption{option.WithHTTPClient(hc)}
+	if host != "" {
+		opts = append(opts, option.WithEndpoint("http://"+host+"/"))
+	}
+	service, err := pubsub.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("pubsub.NewService: %w", err)
+	}
+
+	return &PubSubQueue{Name: name, service: service}, nil
+}
+
+func (q *PubSubQueue) Publish(ctx context.Context, data []byte) error {
+	_, err := q.service.Projects.Topics.Publish(q.Name, &pubsub.PublishRequest{
+		Messages: []*pubsub.PubsubMessage{{Data: base64.StdEncoding.EncodeToString(data)}},
+	}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("Topics.Publish: %s: %w", q.Name, err)
+	}
+
+	return nil
+}
+
+func (q *PubSubQueue) Pull(ctx context.Context) (*QueueMessage, error) {
+	resp, err := q.service.Projects.Subscriptions.Pull(q.Name, &pubsub.PullRequest{MaxMessages: 1}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("Subscriptions.Pull: %s: %w", q.Name, err)
+	}
+	if len(resp.ReceivedMessages) == 0 {
+		return nil, nil
+	}
+
+	received := resp.ReceivedMessages[0]
+	data, err := base64.StdEncoding.DecodeString(received.Message.Data)
+	if err != nil {
+		return nil, fmt.Errorf("message %s: %w", received.Message.MessageId, err)
+	}
+
+	return &QueueMessage{ID: received.Message.MessageId, Data: data, ackID: received.AckId}, nil
+}
+
+func (q *PubSubQueue) Extend(ctx context.Context, msg *QueueMessage, lease time.Duration) error {
+	_, err := q.service.Projects.Subscriptions.ModifyAckDeadline(q.Name, &pubsub.ModifyAckDeadlineRequest{
+		AckIds:             []string{msg.ackID},
+		AckDeadlineSeconds: int64(lease / time.Second),
+		ForceSendFields:    []string{"AckDeadlineSeconds"}, // <= zero releases message
+	}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("Subscriptions.ModifyAckDeadline: %s: %w", q.Name, err)
+	}
+
+	return nil
+}
+
+func (q *PubSubQueue) Ack(ctx context.Context, msg *QueueMessage) error {
+	_, err := q.service.Projects.Subscriptions.Acknowledge(q.Name, &pubsub.AcknowledgeRequest{
+		AckIds: []string{msg.ackID},
+	}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("Subscriptions.Acknowledge: %s: %w", q.Name, err)
+	}
+
+	return nil
+}
+
+func (q *PubSubQueue) Nack(ctx context.Context, msg *QueueMessage, delay time.Duration) error {
+	return q.Extend(ctx, msg, delay)
+}
+
+/*
+	Connect to comma-separated Pub/Sub subscriptions, several of them are lanes of PriorityQueue
+*/
+func NewQueue(ctx context.Context, cfg *TransportConfig, names string) (WorkQueue, error) {
+	var lanes []WorkQueue
+	for _, name := range strings.Split(names, ",") {
+		queue, err := NewPubSubQueue(ctx, cfg, name)
+		if err != nil {
+			return nil, err
+		}
+		lanes = append(lanes, queue)
+	}
+	if len(lanes) == 1 {
+		return lanes[0], nil
+	}
+
+	return &PriorityQueue{Lanes: lanes}, nil
+}
+
+/*
+	Publish to lane of highest priority
+*/
+func (q *PriorityQueue) Publish(ctx context.Context, data []byte) error {
+	return q.Lanes[0].Publish(ctx, data)
+}
+
+func (q *PriorityQueue) Pull(ctx context.Context) (*QueueMessage, error) {
+	for i, lane := range q.Lanes {
+		msg, err := lane.Pull(ctx)
+		if err != nil || msg != nil {
+			if msg != nil {
+				msg.lane = i
+			}
+			return msg, err
+		}
+	}
+
+	return nil, nil
+}
+
+func (q *PriorityQueue) Extend(ctx context.Context, msg *QueueMessage, lease time.Duration) error {
+	return q.Lanes[msg.lane].Extend(ctx, msg, lease)
+}
+
+func (q *PriorityQueue) Ack(ctx context.Context, msg *QueueMessage) error {
+	return q.Lanes[msg.lane].Ack(ctx, msg)
+}
+
+func (q *PriorityQueue) Nack(ctx context.Context, msg *QueueMessage, delay time.Duration) error {
+	return q.Lanes[msg.lane].Nack(ctx, msg, delay)
+}
+
+/*
+	Publish objects under source URLs to Pub/Sub topic in batches for workers of "-queue"
+*/
+func runEnqueueCommand(args []string) {
+	fs := flag.NewFlagSet("enqueue", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s enqueue [OPTIONS] -topic projects/P/topics/T bucket_name[/path]...\n\nOptions:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	common := addCommandFlags(fs)
+	topic := fs.String("topic", "", "Pub/Sub topic receiving batches of object URLs, \"projects/PROJECT/topics/NAME\"")
+	batch := fs.Int("batch", defaultQueueBatch, "Object URLs per message, each message is copied and retried as a whole")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 || *topic == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if err := checkPubSubName(*topic, "topics"); err != nil {
+		exception(err)
+	}
+	if *batch <= 0 {
+		exception(fmt.Errorf("-batch must be positive"))
+	}
+
+	type source struct{ bucket, prefix string }
+	var sources []source
+	for _, uri := range fs.Args() {
+		bucket, prefix, err := parseGCSUrl(uri)
+		if err != nil {
+			exception(err)
+		}
+		sources = append(sources, source{bucket, prefix})
+	}
+
+	s, err := common.storage("enqueue")
+	if err != nil {
+		exception(err)
+	}
+	defer s.Client.Close()
+
+	queue, err := NewPubSubQueue(s.Ctx, s.Config.Transport, *topic)
+	if err != nil {
+		exception(err)
+	}
+
+	objects, messages := 0, 0
+	for _, src := range sources {
+		if err := s.CheckAccess(src.bucket, permList); err != nil {
+			exception(err)
+		}
+		n, m, err := s.EnqueueObjects(queue, src.bucket, src.prefix, *batch)
+		if err != nil {
+			exception(err)
+		}
+		objects, messages = objects+n, messages+m
+	}
+
+	console.Printf("Published %d objects in %d messages to %s\n", objects, messages, *topic)
+}
+
+/*
+	List objects by prefix and publish their URLs, returns counts of objects and messages
+*/
+func (s *Storage) EnqueueObjects(queue WorkQueue, bucket, prefix string, batch int) (int, int, error) {
+	uri := fmt.Sprintf("gs://%s/%s", bucket, prefix)
+
+	var entries []*storage.ObjectAttrs
+	attempt, err := s.Retry(uri, func() (err error) {
+		entries, err = s.ListLevel(bucket, prefix, true)
+		return err
+	})
+	if err != nil {
+		return 0, 0, &TransferError{Object: prefix, Attempt: attempt, Err: err}
+	}
+
+	var urls []string
+	for _, attrs := range entries {
+		// Folder placeholders are not copied, workers know no sizes to tell them
+		if strings.HasSuffix(attrs.Name, "/") || attrs.Size == 0 && strings.HasSuffix(attrs.Name, hadoopFolderSuffix) {
+			continue
+		}
+		urls = append(urls, fmt.Sprintf("gs://%s/%s", bucket, attrs.Name))
+	}
+	if len(urls) == 0 {
+		return 0, 0, fmt.Errorf("%w: %s", ErrNoURLsMatched, uri)
+	}
+
+	messages := 0
+	for start := 0; start < len(urls); start += batch {
+		end := start + batch
+		if end > len(urls) {
+			end = len(urls)
+		}
+		data := []byte(strings.Join(urls[start:end], "\n") + "\n")
+
+		// Duplicate of lost attempt is harmless, delivery is at least once anyway
+		attempt, err := s.Retry(uri, func() error {
+			return queue.Publish(s.Ctx, data)
+		})
+		if err != nil {
+			return start, messages, &TransferError{Object: prefix, Attempt: attempt, Err: err}
+		}
+		messages++
+	}
+
+	return len(urls), messages, nil
+}
+
+/*
+	Copy batches of queue until it stays empty for -queue-idle, other workers share the queue;
+	messages of stopped workers are delivered again once their lease expires.
+	Returns objects of done messages which failed permanently, for failure manifest
+*/
+func (s *Storage) RunQueueWorker() ([]*Transfer, error) {
+	if err := s.CheckDestination(); err != nil {
+		return nil, err
+	}
+
+	poll := queuePoll
+	if idle := s.Config.QueueIdle; idle > 0 && idle/4 < poll {
+		poll = idle / 4
+	}
+
+	copied := 0
+	var failed []*Transfer
+	releases := map[string]int{} // <= message ID => releases by this worker, IDs are unique across topics of project
+	idleSince := time.Now()
+	for {
+		var msg *QueueMessage
+		_, err := s.Retry(s.Config.Queue, func() (err error) {
+			msg, err = s.Queue.Pull(s.Ctx)
+			return err
+		})
+		if err != nil {
+			return failed, err
+		}
+
+		if msg == nil {
+			if s.Config.QueueIdle > 0 && time.Since(idleSince) >= s.Config.QueueIdle {
+				if !s.Config.Quiet {
+					console.Printf("Queue was empty for %s, %d objects copied.\n", s.Config.QueueIdle, copied)
+				}
+				if len(failed) > 0 {
+					return failed, fmt.Errorf("%w: %d of %d objects failed permanently", ErrTransfersFailed, len(failed), copied+len(failed))
+				}
+				return nil, nil
+			}
+			select {
+			case <-time.After(poll):
+			case <-s.Ctx.Done():
+				return failed, s.Ctx.Err()
+			}
+			continue
+		}
+
+		transfers, err := s.copyQueueMessage(msg, releases)
+		for _, t := range transfers {
+			if s.Status.Completed(t.URI()) {
+				copied++
+			} else {
+				failed = append(failed, t)
+			}
+		}
+		if err != nil {
+			return failed, err
+		}
+		idleSince = time.Now()
+	}
+}
+
+/*
+	Copy objects of message, returns its transfers once it is done. Message is done unless some failure
+	may pass on later delivery, such message is released after backoff
+*/
+func (s *Storage) copyQueueMessage(msg *QueueMessage, releases map[string]int) ([]*Transfer, error) {
+	objects, err := readURLList(bytes.NewReader(msg.Data), "message "+msg.ID)
+	var transfers []*Transfer
+	if err == nil {
+		transfers, err = s.NewTransfers(objects)
+	}
+	if err != nil {
+		// Delivering it again can not help, other workers would fail the same way
+		console.Error(err)
+		return nil, s.settleMessage(msg, s.Queue.Ack)
+	}
+
+	// Every object of batch is tried, message is settled as a whole
+	s.Failures = NewFailureReport(true)
+	stop := s.holdMessage(msg)
+	err = s.DownloadObjects(transfers)
+	stop()
+
+	var failures *FailuresError
+	if errors.As(err, &failures) && s.Ctx.Err() == nil && !s.retryableFailures(failures) {
+		// Permanent failures fail the same way on every delivery, they are in -dead-letter already
+		delete(releases, msg.ID)
+	} else if err != nil {
+		delay := s.releaseDelay(releases[msg.ID] + 1)
+		releases[msg.ID]++
+		release := func(ctx context.Context, msg *QueueMessage) error {
+			return s.Queue.Nack(ctx, msg, delay)
+		}
+		if nerr := s.settleMessage(msg, release); nerr != nil {
+			console.Error(nerr)
+		}
+		if failures != nil && s.Ctx.Err() == nil && s.Config.ContinueOnError {
+			printFailures(failures)
+			console.Printf("Message %s is released, delivered again in %s\n", msg.ID, delay)
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// Message is done once progress is kept
+	if s.State != nil {
+		if err := s.State.Save(); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.settleMessage(msg, s.Queue.Ack); err != nil {
+		return nil, err
+	}
+	if failures == nil {
+		return transfers, nil
+	}
+	if s.Config.ContinueOnError {
+		printFailures(failures)
+		console.Printf("Message %s is done, %d objects failed permanently\n", msg.ID, len(failures.Failures))
+		return transfers, nil
+	}
+
+	return transfers, failures
+}
+
+/*
+	Delay before released message is delivered again: retry backoff of its release by this worker,
+	whole seconds of ack deadline
+*/
+func (s *Storage) releaseDelay(release int) time.Duration {
+	delay := s.Config.Retry.Backoff(release + 1)
+	if delay > queueMaxDelay {
+		delay = queueMaxDelay
+	}
+
+	return (delay + time.Second - 1).Truncate(time.Second)
+}
+
+/*
+	Check if any failed object may be copied by later delivery, as decided by -retry-on
+*/
+func (s *Storage) retryableFailures(failures *FailuresError) bool {
+	for _, failure := range failures.Failures {
+		if s.Config.Retry.ShouldRetry(failure) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+	Extend lease of message while it is copied, returned function stops it
+*/
+func (s *Storage) holdMessage(msg *QueueMessage) func() {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(queueLease / 3)
+		defer ticker.Stop()
+		for {
+			if err := s.Queue.Extend(s.Ctx, msg, queueLease); err != nil && s.Ctx.Err() == nil {
+				console.Errorf("Extending lease of message %s failed: %v\n", msg.ID, err)
+			}
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			case <-s.Ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+/*
+	Acknowledge or release message, also when job was canceled
+*/
+func (s *Storage) settleMessage(msg *QueueMessage, settle func(context.Context, *QueueMessage) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queueSettleTime)
+	defer cancel()
+
+	return settle(ctx, msg)
+}
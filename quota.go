@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	quotaMinRate       = 1.0              // <= requests per second a throttled bucket keeps
+	quotaProbeInterval = 10 * time.Second // <= rate is raised after this long without throttling
+	quotaProbeFactor   = 1.25
+	quotaWindow        = 10 * time.Second // <= requests are counted over this time to know rate before throttling
+	quotaHold          = time.Second      // <= concurrent requests are throttled together, rate is reduced once
+	quotaBodyLimit     = 64 << 10
+)
+
+// Reasons of Storage API responses asking client to send fewer requests
+var throttleReasons = []string{"rateLimitExceeded", "userRateLimitExceeded", "slowDown", "SlowDown"}
+
+/*
+	Request rate of each bucket, reduced when API reports rate limits and raised again step by step while it does not
+*/
+type QuotaLimiter struct {
+	Announce bool // <= print rate changes
+
+	mu      sync.Mutex
+	buckets map[string]*bucketQuota
+}
+
+type bucketQuota struct {
+	rate        float64 // <= requests per second, 0 is not limited
+	ceiling     float64 // <= rate before first throttling, limit is lifted once probing reaches it
+	next        time.Time
+	throttledAt time.Time
+	probedAt    time.Time
+	windowAt    time.Time
+	requests    int
+}
+
+type quotaTransport struct {
+	base  http.RoundTripper
+	quota *QuotaLimiter
+}
+
+/*
+	Create limiter, buckets are not limited until they are throttled
+*/
+func NewQuotaLimiter(announce bool) *QuotaLimiter {
+	return &QuotaLimiter{Announce: announce, buckets: map[string]*bucketQuota{}}
+}
+
+/*
+	Current request rate limit of bucket, 0 when it is not limited
+*/
+func (l *QuotaLimiter) Rate(bucket string, now time.Time) float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	q, ok := l.buckets[bucket]
+	if !ok {
+		return 0
+	}
+	l.probe(bucket, q, now)
+
+	return q.rate
+}
+
+/*
+	Wait for request slot of bucket, requests of unlimited buckets are only counted
+*/
+func (l *QuotaLimiter) Wait(ctx context.Context, bucket string) error {
+	now := time.Now()
+
+	l.mu.Lock()
+	q := l.bucket(bucket)
+	if now.Sub(q.windowAt) > quotaWindow {
+		q.windowAt = now
+		q.requests = 0
+	}
+	q.requests++
+	l.probe(bucket, q, now)
+	if q.rate == 0 {
+		l.mu.Unlock()
+		return nil
+	}
+
+	start := q.next
+	if start.Before(now) {
+		start = now
+	}
+	q.next = start.Add(time.Duration(float64(time.Second) / q.rate))
+	l.mu.Unlock()
+
+	if start == now {
+		return nil
+	}
+	timer := time.NewTimer(start.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+	Halve request rate of throttled bucket, first throttling starts from rate of recent requests
+*/
+func (l *QuotaLimiter) Throttled(bucket, reason string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	q := l.bucket(bucket)
+	if now.Sub(q.throttledAt) < quotaHold {
+		return
+	}
+	q.throttledAt = now
+
+	if q.rate == 0 {
+		elapsed := now.Sub(q.windowAt).Seconds()
+		if elapsed < 1 {
+			elapsed = 1
+		}
+		q.rate = float64(q.requests) / elapsed
+		q.ceiling = q.rate
+	}
+	q.rate /= 2
+	if q.rate < quotaMinRate {
+		q.rate = quotaMinRate
+	}
+
+	if l.Announce {
+		console.Errorf("Bucket %s throttled (%s), reducing request rate to %.1f/s\n", bucket, reason, q.rate)
+	}
+}
+
+func (l *QuotaLimiter) bucket(name string) *bucketQuota {
+	q, ok := l.buckets[name]
+	if !ok {
+		q = &bucketQuota{windowAt: time.Now()}
+		l.buckets[name] = q
+	}
+
+	return q
+}
+
+/*
+	Raise rate of throttled bucket after each quiet probe interval, lift limit once rate before throttling is reached
+*/
+func (l *QuotaLimiter) probe(bucket string, q *bucketQuota, now time.Time) {
+	if q.rate == 0 {
+		return
+	}
+	last := q.throttledAt
+	if q.probedAt.After(last) {
+		last = q.probedAt
+	}
+	if now.Sub(last) < quotaProbeInterval {
+		return
+	}
+
+	q.probedAt = now
+	q.rate *= quotaProbeFactor
+	if q.rate < q.ceiling {
+		return
+	}
+	q.rate = 0
+	if l.Announce {
+		console.Errorf("Bucket %s no longer throttled, request rate limit lifted\n", bucket)
+	}
+}
+
+func (t *quotaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	bucket := requestBucket(req.URL)
+	if bucket == "" {
+		return t.base.RoundTrip(req)
+	}
+	if err := t.quota.Wait(req.Context(), bucket); err != nil {
+		return nil, err
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err == nil {
+		if reason := throttleReason(resp); reason != "" {
+			t.quota.Throttled(bucket, reason, time.Now())
+		}
+	}
+
+	return resp, err
+}
+
+/*
+	Bucket of JSON API, upload or XML API request, empty for project level requests
+*/
+func requestBucket(u *url.URL) string {
+	p := u.Path
+	for _, prefix := range []string{"/upload/storage/v1/b/", "/storage/v1/b/", "/b/"} {
+		if strings.HasPrefix(p, prefix) {
+			return strings.SplitN(p[len(prefix):], "/", 2)[0]
+		}
+	}
+	if strings.HasPrefix(p, "/storage/") || strings.HasPrefix(p, "/upload/") || strings.HasPrefix(p, "/batch/") {
+		return ""
+	}
+
+	// XML API: /bucket/object
+	return strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)[0]
+}
+
+/*
+	Check if API error names rate limit, 503 responses do so with reason slowDown
+*/
+func slowDown(apiErr *googleapi.Error) bool {
+	for _, reason := range throttleReasons {
+		if strings.Contains(apiErr.Body, reason) {
+			return true
+		}
+		for _, item := range apiErr.Errors {
+			if item.Reason == reason {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+/*
+	Reason of response asking to slow down: any 429, or 503 naming rate limit; body is kept readable for client
+*/
+func throttleReason(resp *http.Response) string {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return ""
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, quotaBodyLimit))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+	if err == nil {
+		for _, reason := range throttleReasons {
+			if bytes.Contains(body, []byte(reason)) {
+				return reason
+			}
+		}
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return resp.Status
+	}
+
+	return ""
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"io"
+
+	"cloud.google.com/go/storage"
+)
+
+type reconnectingReader struct {
+	ctx         context.Context
+	object      *storage.ObjectHandle
+	reader      *storage.Reader
+	offset      int64
+	attempts    int
+	maxAttempts int
+	storage     *Storage
+	uri         string // <= key of ordered output, same as lines of transfer
+}
+
+/*
+	Wrap object reader to reopen it at current offset when connection breaks
+*/
+func (s *Storage) newReconnectingReader(ctx context.Context, t *Transfer, object *storage.ObjectHandle, reader *storage.Reader, offset int64) io.ReadCloser {
+	// Gzip objects are read whole, offsets of decompressed data are none of stored one
+	if s.Config.ReconnectAttempts == 0 || reader.Attrs.ContentEncoding == "gzip" {
+		return reader
+	}
+
+	return &reconnectingReader{
+		ctx:         ctx,
+		object:      object.Generation(reader.Attrs.Generation), // <= never mix generations
+		reader:      reader,
+		offset:      offset, // <= resumed range starts there
+		maxAttempts: s.Config.ReconnectAttempts,
+		storage:     s,
+		uri:         t.URI(),
+	}
+}
+
+func (r *reconnectingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.offset += int64(n)
+
+	if err == nil || err == io.EOF || r.ctx.Err() != nil || !r.storage.Config.Retry.ShouldRetry(err) {
+		return n, err
+	}
+	if r.attempts >= r.maxAttempts {
+		return n, err
+	}
+
+	r.attempts++
+	r.storage.Printf(r.uri, "Reconnecting %s at offset %d (attempt %d/%d): %v\n",
+		r.object.ObjectName(), r.offset, r.attempts, r.maxAttempts, err)
+
+	reader, rerr := r.object.NewRangeReader(r.ctx, r.offset, -1)
+	if rerr != nil {
+		return n, rerr
+	}
+	r.reader.Close()
+	r.reader = reader
+
+	// Bytes read before failure are valid
+	return n, nil
+}
+
+func (r *reconnectingReader) Close() error {
+	return r.reader.Close()
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	defaultDeleteBatch = 100
+	maxDeleteBatch     = 100 // <= calls per batch request allowed by JSON API
+)
+
+/*
+	Fixed request rate of -max-qps, requests wait for their slots
+*/
+type RateLimiter struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+/*
+	Create limiter of requests per second, nil when rate is not limited
+*/
+func NewRateLimiter(qps float64) *RateLimiter {
+	if qps <= 0 {
+		return nil
+	}
+
+	return &RateLimiter{interval: time.Duration(float64(time.Second) / qps)}
+}
+
+/*
+	Wait until n requests may be sent, nil limiter never waits
+*/
+func (l *RateLimiter) Wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+
+	now := time.Now()
+	l.mu.Lock()
+	start := l.next
+	if start.Before(now) {
+		start = now
+	}
+	l.next = start.Add(time.Duration(n) * l.interval)
+	l.mu.Unlock()
+
+	if !start.After(now) {
+		return nil
+	}
+	timer := time.NewTimer(start.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+	Delete objects in batch requests of up to batch objects, in workers pool with -m. Failed objects of batch
+	are reported with it; job stops after first failed batch unless -continue-on-error
+*/
+func (s *Storage) RemoveObjects(removals []*Transfer, batch int) error {
+	if batch <= 0 || batch > maxDeleteBatch {
+		batch = maxDeleteBatch
+	}
+
+	// Batch request goes to one bucket, it is sent with credentials of that bucket
+	var batches [][]*Transfer
+	for start := 0; start < len(removals); {
+		end := start + 1
+		for end < len(removals) && end-start < batch && removals[end].Bucket == removals[start].Bucket {
+			end++
+		}
+		batches = append(batches, removals[start:end])
+		start = end
+	}
+
+	s.Status.SetTotal(len(removals), 0)
+	stop := s.ShowRemoveProgress()
+	defer stop()
+
+	remove := func(i int) (int64, error) {
+		failures := s.removeBatch(batches[i])
+		if len(failures) == 0 {
+			return 0, nil
+		}
+		console.Errorf("Batch %d of %d: %d of %d objects failed\n", i+1, len(batches), len(failures), len(batches[i]))
+		for _, failure := range failures[:len(failures)-1] {
+			if !s.Failures.Add(s.Ctx, failure) {
+				return 0, failure
+			}
+		}
+		return 0, failures[len(failures)-1] // <= recorded like failed object of transfers
+	}
+
+	if s.Config.isMultiThread {
+		if _, err := s.RunPool(s.PoolSize(len(batches)), len(batches), remove); err != nil {
+			return err
+		}
+		return s.Failures.Err(len(removals))
+	}
+
+	for i := range batches {
+		if _, err := remove(i); err != nil && !s.Failures.Add(s.Ctx, err) {
+			return err
+		}
+	}
+
+	return s.Failures.Err(len(removals))
+}
+
+/*
+	Delete objects of one bucket by batch request, retried for objects which are not deleted yet;
+	returns failed objects
+*/
+func (s *Storage) removeBatch(batch []*Transfer) []*TransferError {
+	for _, t := range batch {
+		s.Printf(t.Object, "Removing %s\n", t.URI())
+	}
+	bucket, uri := batch[0].Bucket, batch[0].URI()
+
+	if len(batch) == 1 {
+		err := s.Deletes.Wait(s.Ctx, 1)
+		if err == nil {
+			err = s.RemoveObject(bucket, batch[0].Object)
+		}
+		if err != nil {
+			if te, ok := err.(*TransferError); ok {
+				return []*TransferError{te}
+			}
+			return []*TransferError{{Object: batch[0].Object, Attempt: 1, Err: err}}
+		}
+		s.Status.Finish(uri)
+		return nil
+	}
+
+	pending := batch
+	failed := map[*Transfer]error{}
+	tries := 0
+	attempt, err := s.Retry(uri, func() error {
+		tries++
+		if err := s.Deletes.Wait(s.Ctx, len(pending)); err != nil {
+			return err
+		}
+		ctx, cancel := s.objectContext()
+		defer cancel()
+
+		errs, err := s.deleteBatch(ctx, bucket, pending)
+		if err != nil {
+			return err
+		}
+		var retry []*Transfer
+		var retryErr error
+		for i, t := range pending {
+			switch err := errs[i]; {
+			case err == nil, tries > 1 && errors.Is(err, storage.ErrObjectNotExist): // <= deleted by lost attempt
+				s.Status.Finish(t.URI())
+			case s.Config.Retry.ShouldRetry(err):
+				retry = append(retry, t)
+				if retryErr == nil {
+					retryErr = err
+				}
+			default:
+				failed[t] = s.explainImmutable(ctx, bucket, t.Object, err)
+			}
+		}
+		pending = retry
+		return retryErr
+	})
+	for _, t := range pending {
+		failed[t] = err
+	}
+
+	var failures []*TransferError
+	for _, t := range batch {
+		if err, ok := failed[t]; ok {
+			failures = append(failures, &TransferError{Object: t.Object, Attempt: attempt, Err: err})
+		}
+	}
+
+	return failures
+}
+
+/*
+	Send one batch request deleting objects of bucket, returns error of each object's delete call
+*/
+func (s *Storage) deleteBatch(ctx context.Context, bucket string, objects []*Transfer) ([]error, error) {
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("url.Parse: %w", err)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for i, t := range objects {
+		call, err := url.Parse(s.bucketURL(bucket, "o/"+url.PathEscape(t.Object), nil))
+		if err != nil {
+			return nil, fmt.Errorf("url.Parse: %w", err)
+		}
+		part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/http"}, "Content-Id": {"<" + strconv.Itoa(i+1) + ">"}})
+		if err != nil {
+			return nil, fmt.Errorf("multipart.CreatePart: %w", err)
+		}
+		fmt.Fprintf(part, "DELETE %s HTTP/1.1\r\nHost: %s\r\n\r\n", call.RequestURI(), call.Host)
+	}
+	if err := mw.Close(); err != nil {
+		return nil, fmt.Errorf("multipart.Close: %w", err)
+	}
+
+	// Batch endpoint is next to JSON API path, e.g. /batch/storage/v1
+	batchURL := &url.URL{Scheme: endpoint.Scheme, Host: endpoint.Host, Path: "/batch" + strings.TrimSuffix(endpoint.Path, "/")}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, batchURL.String(), &body)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequest: %w", err)
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+
+	_, hc := s.route(bucket)
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("batch delete: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return nil, fmt.Errorf("batch delete: %w", err)
+	}
+
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("batch delete: %w", err)
+	}
+	errs := make([]error, len(objects))
+	answered := 0
+	parts := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("batch delete: %w", err)
+		}
+		id := strings.TrimPrefix(strings.Trim(part.Header.Get("Content-ID"), "<>"), "response-")
+		i, err := strconv.Atoi(id)
+		if err != nil || i < 1 || i > len(objects) {
+			return nil, fmt.Errorf("batch delete: unknown response part %q", id)
+		}
+		callResp, err := http.ReadResponse(bufio.NewReader(part), req)
+		if err != nil {
+			return nil, fmt.Errorf("batch delete: %w", err)
+		}
+		if err := googleapi.CheckResponse(callResp); err != nil {
+			var apiErr *googleapi.Error
+			if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+				err = storage.ErrObjectNotExist
+			}
+			errs[i-1] = fmt.Errorf("Object(%q).Delete: %w", objects[i-1].Object, err)
+		}
+		callResp.Body.Close()
+		answered++
+	}
+	if answered != len(objects) {
+		return nil, fmt.Errorf("batch delete: %d responses for %d objects", answered, len(objects))
+	}
+
+	return errs, nil
+}
+
+/*
+	Draw progress line of deletions with rate and ETA by objects, they have no bytes to count
+*/
+func (s *Storage) ShowRemoveProgress() func() {
+	meter := &rateMeter{}
+
+	return s.showStatusLine(func(snapshot ProgressSnapshot, now time.Time) string {
+		return formatRemoveProgress(snapshot, meter.Update(int64(snapshot.Done), now))
+	})
+}
+
+func formatRemoveProgress(snapshot ProgressSnapshot, rate float64) string {
+	fields := []string{fmt.Sprintf("Deleted %d/%d objects", snapshot.Done, snapshot.Total)}
+	if snapshot.Total > 0 {
+		fields[0] += fmt.Sprintf(" (%.1f%%)", float64(snapshot.Done)*100/float64(snapshot.Total))
+	}
+	fields = append(fields, fmt.Sprintf("%.1f objects/s", rate), "ETA "+formatETA(int64(snapshot.Total-snapshot.Done), rate))
+
+	return strings.Join(fields, " | ")
+}
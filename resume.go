@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	partialSuffix    = ".partial"
+	resumeSuffix     = ".partial.json"
+	resumeCheckpoint = 16 << 20 // <= bytes written between saved offsets
+)
+
+type ResumeState struct {
+	URI        string `json:"uri"`
+	Generation int64  `json:"generation"` // <= partial data is of this generation only
+	Offset     int64  `json:"offset"`     // <= bytes of partial file synced to disk
+}
+
+/*
+	Partial file of -resume, renamed to destination once complete
+*/
+type resumeFile struct {
+	file      *os.File
+	t         *Transfer
+	state     ResumeState
+	unsaved   int64
+	discarded bool // <= data is corrupt, partial file must not be resumed
+}
+
+/*
+	Open object for resumable download, reading continues at saved offset of same generation
+*/
+func (s *Storage) openResumable(ctx context.Context, handle *storage.ObjectHandle, t *Transfer) (*storage.Reader, int64, error) {
+	state := loadResumeState(t)
+	if state != nil {
+		// Versioned buckets keep replaced generation readable, so it is compared with the one to download
+		generation, err := s.wantedGeneration(ctx, handle, t)
+		if err != nil {
+			return nil, 0, err // <= partial file is kept for next attempt
+		}
+		if state.Generation != generation {
+			s.Printf(t.URI(), "Object %s changed since partial download, starting over\n", t.Object)
+			removePartial(t)
+			state = nil
+		}
+	}
+
+	if state != nil {
+		// Range of old generation is not found once object was replaced
+		sr, err := handle.Generation(state.Generation).NewRangeReader(ctx, state.Offset, -1)
+		var apiErr *googleapi.Error
+		switch {
+		case err == nil:
+			s.Printf(t.URI(), "Resuming %s at offset %d\n", t.Object, state.Offset)
+			return sr, state.Offset, nil
+		case errors.Is(err, storage.ErrObjectNotExist):
+			s.Printf(t.URI(), "Object %s changed since partial download, starting over\n", t.Object)
+		case errors.As(err, &apiErr) && apiErr.Code == 416:
+			// Nothing left to read, safest is to read it again
+		default:
+			return nil, 0, err // <= partial file is kept for next attempt
+		}
+		removePartial(t)
+	}
+
+	sr, err := handle.NewReader(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return sr, 0, nil
+}
+
+/*
+	Generation the download is of: explicit #generation, -if-generation-match, listed or live one
+*/
+func (s *Storage) wantedGeneration(ctx context.Context, handle *storage.ObjectHandle, t *Transfer) (int64, error) {
+	switch {
+	case t.Generation != 0:
+		return t.Generation, nil
+	case s.Config.IfGenerationMatch != 0:
+		return s.Config.IfGenerationMatch, nil
+	case t.Attrs != nil && t.Attrs.Generation != 0:
+		return t.Attrs.Generation, nil
+	}
+
+	attrs, err := handle.Attrs(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("Object(%q).Attrs: %w", t.Object, err)
+	}
+
+	return attrs.Generation, nil
+}
+
+/*
+	Saved offset of partial file, nil when there is nothing to resume
+*/
+func loadResumeState(t *Transfer) *ResumeState {
+	data, err := os.ReadFile(t.Destination + resumeSuffix)
+	if err != nil {
+		return nil
+	}
+
+	state := &ResumeState{}
+	if err := json.Unmarshal(data, state); err != nil || state.URI != t.URI() || state.Offset <= 0 {
+		return nil
+	}
+	info, err := os.Stat(t.Destination + partialSuffix)
+	if err != nil || info.Size() < state.Offset {
+		return nil
+	}
+
+	return state
+}
+
+/*
+	Remove partial file and its state
+*/
+func removePartial(t *Transfer) {
+	os.Remove(t.Destination + partialSuffix)
+	os.Remove(t.Destination + resumeSuffix)
+}
+
+/*
+	Open partial file at offset, data after it was written but not saved and is replaced
+*/
+func createPartial(t *Transfer, generation, offset int64) (*resumeFile, error) {
+	if err := mkdirAll(filepath.Dir(t.Destination)); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll: %w", err)
+	}
+
+	f, err := os.OpenFile(t.Destination+partialSuffix, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("os.OpenFile: %w", err)
+	}
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("os.Truncate: %w", err)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("os.Seek: %w", err)
+	}
+
+	rf := &resumeFile{file: f, t: t, state: ResumeState{URI: t.URI(), Generation: generation, Offset: offset}}
+	if err := rf.save(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return rf, nil
+}
+
+/*
+	Feed data resumed from to checksum, so whole object is verified
+*/
+func (rf *resumeFile) hashPartial(w io.Writer, buf []byte) error {
+	f, err := os.Open(rf.file.Name())
+	if err != nil {
+		return fmt.Errorf("os.Open: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := io.CopyBuffer(w, io.LimitReader(f, rf.state.Offset), buf); err != nil {
+		return fmt.Errorf("io.CopyBuffer: %w", err)
+	}
+
+	return nil
+}
+
+func (rf *resumeFile) Write(b []byte) (int, error) {
+	n, err := rf.file.Write(b)
+	rf.unsaved += int64(n)
+	if err != nil {
+		return n, err
+	}
+
+	if rf.unsaved >= resumeCheckpoint {
+		if err := rf.checkpoint(); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+/*
+	Sync written data and save its offset
+*/
+func (rf *resumeFile) checkpoint() error {
+	if err := rf.file.Sync(); err != nil {
+		return fmt.Errorf("os.Sync: %w", err)
+	}
+	rf.state.Offset += rf.unsaved
+	rf.unsaved = 0
+
+	return rf.save()
+}
+
+func (rf *resumeFile) save() error {
+	data, err := json.Marshal(rf.state)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	if err := os.WriteFile(rf.t.Destination+resumeSuffix, data, 0666); err != nil {
+		return fmt.Errorf("os.WriteFile: %w", err)
+	}
+
+	return nil
+}
+
+/*
+	Complete download, partial file replaces destination
+*/
+func (rf *resumeFile) Close() error {
+	if err := rf.file.Close(); err != nil {
+		return fmt.Errorf("os.Close: %w", err)
+	}
+	if err := os.Rename(rf.file.Name(), rf.t.Destination); err != nil {
+		return fmt.Errorf("os.Rename: %w", err)
+	}
+	os.Remove(rf.t.Destination + resumeSuffix)
+
+	return nil
+}
+
+/*
+	Keep partial file for next run, unless its data was found corrupt
+*/
+func (rf *resumeFile) Abort() error {
+	if rf.discarded {
+		rf.file.Close()
+		removePartial(rf.t)
+		return nil
+	}
+
+	err := rf.checkpoint()
+	rf.file.Close()
+
+	return err
+}
+
+/*
+	Move partial file aside for inspection, it is not resumed
+*/
+func (rf *resumeFile) Keep(path string) error {
+	rf.file.Close()
+	os.Remove(rf.t.Destination + resumeSuffix)
+	if err := os.Rename(rf.file.Name(), path); err != nil {
+		os.Remove(rf.file.Name())
+		return fmt.Errorf("os.Rename: %w", err)
+	}
+
+	return nil
+}
+
+/*
+	Mark partial file of failed verification, next attempt starts over
+*/
+func discardPartial(out SinkFile) {
+	if rf, ok := out.(*resumeFile); ok {
+		rf.discarded = true
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+var ErrObjectImmutable = errors.New("object is immutable")
+
+/*
+	Holds and retention of object, storage client does not expose object retention
+*/
+type ObjectProtection struct {
+	EventBasedHold          bool      `json:"eventBasedHold"`
+	TemporaryHold           bool      `json:"temporaryHold"`
+	RetentionExpirationTime time.Time `json:"retentionExpirationTime"` // <= retention policy of bucket
+	Retention               *struct {
+		Mode            string    `json:"mode"`
+		RetainUntilTime time.Time `json:"retainUntilTime"`
+	} `json:"retention"`
+}
+
+type ImmutableError struct {
+	Object  string
+	Reasons []string // <= holds and retention blocking the change
+}
+
+func (e *ImmutableError) Error() string {
+	return fmt.Sprintf("%s can not be overwritten or deleted: %s", e.Object, strings.Join(e.Reasons, ", "))
+}
+
+func (e *ImmutableError) Unwrap() error {
+	return ErrObjectImmutable
+}
+
+/*
+	Reasons why object can not be changed now, empty when none applies
+*/
+func (p *ObjectProtection) Reasons(now time.Time) []string {
+	var reasons []string
+	if p.EventBasedHold {
+		reasons = append(reasons, "event-based hold")
+	}
+	if p.TemporaryHold {
+		reasons = append(reasons, "temporary hold")
+	}
+	if now.Before(p.RetentionExpirationTime) {
+		reasons = append(reasons, "bucket retention policy until "+p.RetentionExpirationTime.Format(time.RFC3339))
+	}
+	if p.Retention != nil && now.Before(p.Retention.RetainUntilTime) {
+		reasons = append(reasons, fmt.Sprintf("%s object retention until %s",
+			strings.ToLower(p.Retention.Mode), p.Retention.RetainUntilTime.Format(time.RFC3339)))
+	}
+
+	return reasons
+}
+
+/*
+	Read holds and retention of object
+*/
+func (s *Storage) objectProtection(ctx context.Context, bucket, object string) (*ObjectProtection, error) {
+	query := url.Values{"fields": {"eventBasedHold,temporaryHold,retentionExpirationTime,retention"}}
+	uri := s.bucketURL(bucket, "o/"+url.PathEscape(object), query)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequest: %w", err)
+	}
+	_, hc := s.route(bucket)
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Object(%q).protection: %w", object, err)
+	}
+	defer resp.Body.Close()
+
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return nil, fmt.Errorf("Object(%q).protection: %w", object, err)
+	}
+
+	protection := &ObjectProtection{}
+	if err := json.NewDecoder(resp.Body).Decode(protection); err != nil {
+		return nil, fmt.Errorf("json.Decode: %w", err)
+	}
+
+	return protection, nil
+}
+
+/*
+	Explain refused overwrite or deletion by holds and retention of existing object, other errors are kept
+*/
+func (s *Storage) explainImmutable(ctx context.Context, bucket, object string, err error) error {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusForbidden {
+		return err
+	}
+
+	protection, perr := s.objectProtection(ctx, bucket, object)
+	if perr != nil {
+		return err
+	}
+	reasons := protection.Reasons(time.Now())
+	if len(reasons) == 0 {
+		return err // <= permission really is missing
+	}
+
+	return &ImmutableError{Object: fmt.Sprintf("gs://%s/%s", bucket, object), Reasons: reasons}
+}
+
+/*
+	Retain uploaded generation for -retain-for, bucket must have object retention enabled
+*/
+func (s *Storage) SetRetention(ctx context.Context, bucket, object string, generation int64) error {
+	until := time.Now().Add(s.Config.RetainFor).UTC()
+	body, err := json.Marshal(map[string]interface{}{
+		"retention": map[string]string{"mode": s.Config.RetentionMode, "retainUntilTime": until.Format(time.RFC3339)},
+	})
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+
+	// Condition keeps retention off newer generation written meanwhile
+	query := url.Values{"ifGenerationMatch": {fmt.Sprint(generation)}}
+	uri := s.bucketURL(bucket, "o/"+url.PathEscape(object), query)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, uri, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("http.NewRequest: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	_, hc := s.route(bucket)
+	resp, err := hc.Do(req)
+	if err != nil {
+		return fmt.Errorf("Object(%q).retention: %w", object, err)
+	}
+	defer resp.Body.Close()
+
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return fmt.Errorf("Object(%q).retention: %w", object, err)
+	}
+
+	return nil
+}
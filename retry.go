@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	defaultRetryOn     = "429,5xx,timeout,network,connection_interrupted"
+	defaultRetryJitter = 0.5
+)
+
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Jitter         float64         // <= up to this fraction of backoff is dropped at random, so workers do not retry in step
+	RetryOn        map[string]bool // <= HTTP codes ("503"), classes ("5xx") or error codes ("timeout")
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+/*
+	Create retry policy from flag values
+*/
+func NewRetryPolicy(maxAttempts int, initialBackoff, maxBackoff time.Duration, jitter float64, retryOn string) (*RetryPolicy, error) {
+	if maxAttempts < 1 {
+		return nil, fmt.Errorf("retry max attempts must be at least 1: %d", maxAttempts)
+	}
+	if initialBackoff < 0 || maxBackoff < initialBackoff {
+		return nil, fmt.Errorf("invalid retry backoff range: %s..%s", initialBackoff, maxBackoff)
+	}
+	if jitter < 0 || jitter > 1 {
+		return nil, fmt.Errorf("retry jitter must be between 0 and 1: %g", jitter)
+	}
+
+	policy := &RetryPolicy{
+		MaxAttempts:    maxAttempts,
+		InitialBackoff: initialBackoff,
+		MaxBackoff:     maxBackoff,
+		Jitter:         jitter,
+		RetryOn:        map[string]bool{},
+		rng:            rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, item := range strings.Split(retryOn, ",") {
+		if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+			policy.RetryOn[item] = true
+		}
+	}
+
+	return policy, nil
+}
+
+/*
+	Check if error should be retried according to policy
+*/
+func (p *RetryPolicy) ShouldRetry(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		code := strconv.Itoa(apiErr.Code)
+		if p.RetryOn[code] || p.RetryOn[code[:1]+"xx"] {
+			return true
+		}
+	}
+
+	return p.RetryOn[errorCode(err)]
+}
+
+/*
+	Backoff delay before given retry attempt (2, 3, ...)
+*/
+func (p *RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := p.InitialBackoff
+	for i := 2; i < attempt && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+
+	return delay
+}
+
+/*
+	Delay before given retry attempt after error: jittered backoff, or longer Retry-After of server up to max backoff
+*/
+func (p *RetryPolicy) Delay(attempt int, err error) time.Duration {
+	delay := p.Backoff(attempt)
+	if p.Jitter > 0 && p.rng != nil {
+		p.mu.Lock()
+		delay -= time.Duration(p.rng.Float64() * p.Jitter * float64(delay))
+		p.mu.Unlock()
+	}
+
+	if after := retryAfter(err); after > delay {
+		delay = after
+		if delay > p.MaxBackoff {
+			delay = p.MaxBackoff
+		}
+	}
+
+	return delay
+}
+
+/*
+	Wait asked for by Retry-After header of throttled or unavailable response, 0 without one
+*/
+func retryAfter(err error) time.Duration {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Header == nil {
+		return 0
+	}
+
+	value := apiErr.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return time.Until(at)
+	}
+
+	return 0
+}
+
+/*
+	Run operation until it succeeds, fails permanently or attempts are exhausted
+*/
+func (s *Storage) Retry(name string, op func() error) (int, error) {
+	policy := s.Config.Retry
+
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil {
+			return attempt, nil
+		}
+		if attempt >= policy.MaxAttempts || !policy.ShouldRetry(err) {
+			return attempt, err
+		}
+
+		delay := policy.Delay(attempt+1, err)
+		s.Status.AddError(err)
+		s.Printf(name, "Retrying %s in %s (attempt %d/%d): %v\n", name, delay, attempt+1, policy.MaxAttempts, err)
+
+		select {
+		case <-time.After(delay):
+		case <-s.Ctx.Done():
+			return attempt, s.Ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+const fileMtimeKey = "goog-reserved-file-mtime" // <= metadata of gsutil, seconds since epoch
+
+type SyncReport struct {
+	Copied    int
+	Unchanged int
+	Removed   int // <= with -d, destination files or objects missing at source
+}
+
+/*
+	Run "rsync" command: transfer only files which differ from destination, in either direction
+*/
+func runRsyncCommand(args []string) {
+	fs := flag.NewFlagSet("rsync", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s rsync [OPTIONS] bucket_name[/path] directory\n", os.Args[0])
+		fmt.Printf("       %s rsync [OPTIONS] directory bucket_name[/path]\n\nOptions:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	common := addCommandFlags(fs)
+	isMultiThread := fs.Bool("m", false, "Run command in multi-threading mode")
+	jobs := fs.Int("j", 0, "Workers pool size of multi-threading mode (defaults to number of CPUs), implies -m")
+	remove := fs.Bool("d", false, "Delete destination files (or objects) which do not exist at source")
+	checksum := fs.Bool("c", false, "Compare CRC32C/MD5 of files with same size even when modification time matches")
+	continueOnError := fs.Bool("continue-on-error", false, "Keep copying after failed files, nothing is deleted with -d then")
+	maxQPS := fs.Float64("max-qps", 0, "Maximum object deletions per second of -d, batched ones count each (0 is not limited)")
+	dryRun := fs.Bool("dry-run", false, "Print files to copy and remove, nothing is changed")
+	fs.BoolVar(dryRun, "n", false, "Same as -dry-run")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *jobs < 0 {
+		exception(fmt.Errorf("-j must be positive"))
+	}
+	if *maxQPS < 0 {
+		exception(fmt.Errorf("-max-qps must not be negative"))
+	}
+
+	cfg, err := common.newConfig("rsync")
+	if err != nil {
+		exception(err)
+	}
+	upload := isUpload(fs.Arg(0), fs.Arg(1))
+	remote, local := fs.Arg(0), fs.Arg(1)
+	if upload {
+		remote, local = local, remote
+	}
+	if !strings.HasPrefix(remote, "gs://") || strings.HasPrefix(local, "gs://") {
+		exception(fmt.Errorf("rsync needs one gs:// URL and one local directory"))
+	}
+
+	if err := setSyncPaths(cfg, remote, local, upload); err != nil {
+		exception(err)
+	}
+	cfg.isMultiThread = *isMultiThread || *jobs > 0
+	cfg.Jobs = *jobs
+	cfg.CreateDirs = true
+	cfg.OnConflict = "fail"
+	cfg.NameCase = "preserve"
+	cfg.ReconnectAttempts = 5
+	cfg.ContinueOnError = *continueOnError
+	cfg.DryRun = *dryRun
+	cfg.MaxQPS = *maxQPS
+
+	s, err := NewStorageWithConfig(cfg)
+	if err != nil {
+		exception(err)
+	}
+	defer s.Client.Close()
+
+	sync := s.SyncDownload
+	if upload {
+		sync = s.SyncUpload
+	}
+	report, transfers, err := sync(*remove, *checksum)
+	if err != nil {
+		s.Abort(transfers, err)
+	}
+	if *dryRun {
+		console.Printf("Dry run of %s: %d to copy, %d unchanged, %d to remove\n",
+			fs.Arg(1), report.Copied, report.Unchanged, report.Removed)
+		return
+	}
+	console.Printf("Synchronized %s: %d copied, %d unchanged, %d removed\n",
+		fs.Arg(1), report.Copied, report.Unchanged, report.Removed)
+}
+
+/*
+	Set bucket, prefix and directory of sync, prefix is a directory and its relative paths are compared
+*/
+func setSyncPaths(cfg *Config, remote, local string, upload bool) error {
+	var err error
+	if cfg.BucketName, cfg.Prefix, err = parseGCSUrl(remote); err != nil {
+		return err
+	}
+	if hasGlob(cfg.Prefix) {
+		return fmt.Errorf("rsync needs prefix, not wildcards: %s", remote)
+	}
+	if cfg.Prefix != "" && !strings.HasSuffix(cfg.Prefix, "/") {
+		cfg.Prefix += "/"
+	}
+	cfg.Uri = "gs://" + cfg.BucketName + "/" + cfg.Prefix
+
+	dir, err := normalizePath(local)
+	if err != nil {
+		return err
+	}
+	if upload {
+		cfg.SourcePath = dir
+		return nil
+	}
+
+	// Objects are placed relative to prefix, like files of upload
+	cfg.DestinationPath = dir
+	cfg.Rename = RenameRules{{Pattern: regexp.MustCompile("^" + regexp.QuoteMeta(cfg.Prefix))}}
+
+	return nil
+}
+
+/*
+	Download objects differing from files of destination directory, with remove also delete files without objects
+*/
+func (s *Storage) SyncDownload(remove, checksum bool) (*SyncReport, []*Transfer, error) {
+	listed, err := s.Plan()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	report := &SyncReport{}
+	keep := map[string]bool{}
+	buf := s.Buffers.Get()
+	var transfers []*Transfer
+	for _, t := range listed {
+		if t.Directory {
+			continue
+		}
+		keep[t.Destination] = true
+
+		changed, err := s.syncChanged(t.Destination, t.Attrs, checksum, *buf)
+		if err != nil {
+			s.Buffers.Put(buf)
+			return nil, nil, err
+		}
+		if !changed {
+			report.Unchanged++
+			if s.Config.DryRun {
+				continue
+			}
+			// Same data found by checksum is not read again next time
+			mtime := objectMtime(t.Attrs)
+			if err := os.Chtimes(t.Destination, mtime, mtime); err != nil {
+				s.Buffers.Put(buf)
+				return nil, nil, fmt.Errorf("os.Chtimes: %w", err)
+			}
+			continue
+		}
+		transfers = append(transfers, t)
+	}
+	s.Buffers.Put(buf)
+
+	if s.Config.DryRun {
+		s.PrintDryRun(transfers)
+		report.Copied = len(transfers)
+	} else if err := s.DownloadObjects(transfers); err != nil {
+		return report, transfers, err
+	}
+
+	// Modification time of object lets next run skip file without reading it
+	for _, t := range transfers {
+		if s.Config.DryRun {
+			break
+		}
+		mtime := objectMtime(t.Attrs)
+		if err := os.Chtimes(t.Destination, mtime, mtime); err != nil {
+			return report, transfers, fmt.Errorf("os.Chtimes: %w", err)
+		}
+		report.Copied++
+	}
+
+	if remove {
+		err := filepath.WalkDir(s.Config.DestinationPath, func(fpath string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || keep[fpath] {
+				return err
+			}
+			report.Removed++
+			if s.Config.DryRun {
+				s.Printf(fpath, "Would remove %s\n", fpath)
+				return nil
+			}
+			s.Printf(fpath, "Removing %s\n", fpath)
+			if err := os.Remove(fpath); err != nil {
+				return err
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return report, transfers, fmt.Errorf("filepath.WalkDir: %w", err)
+		}
+	}
+
+	return report, transfers, nil
+}
+
+/*
+	Upload files differing from objects under prefix, with remove also delete objects without files
+*/
+func (s *Storage) SyncUpload(remove, checksum bool) (*SyncReport, []*Transfer, error) {
+	local, err := s.PlanUploads()
+	if err != nil {
+		return nil, nil, err
+	}
+	if remove {
+		if err := s.CheckAccess(s.Config.BucketName, permList, permDelete); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Empty prefix is fine, everything is uploaded
+	var objects []*storage.ObjectAttrs
+	attempt, err := s.Retry(s.Config.Uri, func() error {
+		objects, err = s.ListLevel(s.Config.BucketName, s.Config.Prefix, true)
+		return err
+	})
+	if err != nil {
+		return nil, nil, &TransferError{Object: s.Config.Uri, Attempt: attempt, Err: err}
+	}
+	remote := map[string]*storage.ObjectAttrs{}
+	for _, attrs := range objects {
+		remote[attrs.Name] = attrs
+	}
+
+	report := &SyncReport{}
+	buf := s.Buffers.Get()
+	var transfers []*Transfer
+	for _, t := range local {
+		attrs, ok := remote[t.Object]
+		delete(remote, t.Object)
+
+		changed := !ok
+		if ok {
+			if changed, err = s.syncChanged(t.Destination, attrs, checksum, *buf); err != nil {
+				s.Buffers.Put(buf)
+				return nil, nil, err
+			}
+		}
+		if changed {
+			transfers = append(transfers, t)
+		} else {
+			report.Unchanged++
+		}
+	}
+	s.Buffers.Put(buf)
+
+	if s.Config.DryRun {
+		s.PrintDryRun(transfers)
+	} else if err := s.UploadObjects(transfers); err != nil {
+		return report, transfers, err
+	}
+	report.Copied = len(transfers)
+
+	if remove {
+		names := make([]string, 0, len(remote))
+		for name := range remote {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var removals []*Transfer
+		for _, name := range names {
+			if strings.HasSuffix(name, "/") || strings.HasSuffix(name, hadoopFolderSuffix) {
+				continue // <= folder placeholders have no files
+			}
+			report.Removed++
+			if s.Config.DryRun {
+				s.Printf(name, "Would remove gs://%s/%s\n", s.Config.BucketName, name)
+				continue
+			}
+			removals = append(removals, &Transfer{Bucket: s.Config.BucketName, Object: name})
+		}
+		if len(removals) > 0 {
+			if err := s.RemoveObjects(removals, defaultDeleteBatch); err != nil {
+				return report, transfers, err
+			}
+		}
+	}
+
+	return report, transfers, nil
+}
+
+/*
+	Check if file differs from object: by size, then by modification time, then by checksum
+*/
+func (s *Storage) syncChanged(fpath string, attrs *storage.ObjectAttrs, checksum bool, buf []byte) (bool, error) {
+	info, err := os.Stat(fpath)
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("os.Stat: %w", err)
+	}
+	// Stored gzip object has size of compressed data, file is compared with decompressed one
+	if info.Size() != attrs.Size && attrs.ContentEncoding != "gzip" {
+		return true, nil
+	}
+	if !checksum && info.ModTime().Unix() == objectMtime(attrs).Unix() {
+		return false, nil
+	}
+
+	same, _, err := s.sameContent(s.Ctx, fpath, attrs, buf)
+
+	return !same, err
+}
+
+/*
+	Modification time of uploaded file kept in metadata, update time of other objects
+*/
+func objectMtime(attrs *storage.ObjectAttrs) time.Time {
+	if value, ok := attrs.Metadata[fileMtimeKey]; ok {
+		if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return time.Unix(seconds, 0)
+		}
+	}
+
+	return attrs.Updated
+}
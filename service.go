@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Jobs stop once service manager asks for it, outside of a service it is never canceled
+var serviceCtx, stopService = context.WithCancel(context.Background())
+
+var serviceName = regexp.MustCompile(`^[A-Za-z0-9_.@-]+$`)
+
+type ServiceOptions struct {
+	Name    string
+	User    bool   // <= systemd user unit instead of system unit
+	UnitDir string // <= directory of unit file, default depends on User
+	Args    []string
+}
+
+/*
+	Run "service" command: install, uninstall or run gcs-cp command line as managed service
+*/
+func runServiceCommand(args []string) {
+	fs := flag.NewFlagSet("service", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s service install|uninstall|run [OPTIONS] -- [gcs-cp arguments]\n\nOptions:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	name := fs.String("name", "gcs-cp", "Service name")
+	user := fs.Bool("user", false, "Install systemd user unit instead of system unit (not on Windows)")
+	unitDir := fs.String("unit-dir", "", "Directory of systemd unit file (defaults to /etc/systemd/system or ~/.config/systemd/user)")
+
+	if len(args) == 0 || (args[0] != "install" && args[0] != "uninstall" && args[0] != "run") {
+		fs.Usage()
+		os.Exit(1)
+	}
+	command := args[0]
+	fs.Parse(args[1:])
+
+	if !serviceName.MatchString(*name) {
+		exception(fmt.Errorf("invalid service name: %q", *name))
+	}
+	opts := &ServiceOptions{Name: *name, User: *user, UnitDir: *unitDir, Args: fs.Args()}
+	if command != "uninstall" && len(opts.Args) == 0 {
+		exception(fmt.Errorf("service %s needs gcs-cp arguments after --, e.g. -- verify -config mirrors.json -pprof-addr :6060", command))
+	}
+
+	var err error
+	switch command {
+	case "install":
+		err = installService(opts)
+	case "uninstall":
+		err = uninstallService(opts)
+	case "run":
+		err = runService(opts)
+	}
+	if err != nil {
+		exception(err)
+	}
+}
+
+/*
+	Tell systemd about state of service ("READY=1", "STOPPING=1"), without NOTIFY_SOCKET there is nobody to tell
+*/
+func notifyService(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:] // <= abstract socket
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("sd_notify: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("sd_notify: %w", err)
+	}
+
+	return nil
+}
+
+/*
+	Report readiness once job is set up, so dependent units start after it
+*/
+func serviceReady() {
+	if err := notifyService("READY=1"); err != nil {
+		console.Error(err)
+	}
+}
+
+/*
+	Systemd unit running command line through "service run"
+*/
+func systemdUnit(opts *ServiceOptions, executable string) string {
+	command := []string{systemdQuote(executable), "service", "run", "-name", opts.Name, "--"}
+	for _, arg := range opts.Args {
+		command = append(command, systemdQuote(arg))
+	}
+	target := "multi-user.target"
+	if opts.User {
+		target = "default.target"
+	}
+
+	return fmt.Sprintf(`[Unit]
+Description=gcs-cp %s
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=notify
+ExecStart=%s
+Restart=on-failure
+RestartSec=10
+TimeoutStopSec=60
+
+[Install]
+WantedBy=%s
+`, opts.Name, strings.Join(command, " "), target)
+}
+
+/*
+	Quote argument of ExecStart, "%" and "$" are expanded by systemd otherwise
+*/
+func systemdQuote(arg string) string {
+	arg = strings.ReplaceAll(arg, "%", "%%")
+	arg = strings.ReplaceAll(arg, "$", "$$")
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\;") {
+		return arg
+	}
+
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
@@ -0,0 +1,104 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+)
+
+/*
+	Directory of unit file: -unit-dir, systemd user units or system units
+*/
+func (opts *ServiceOptions) unitPath() (string, error) {
+	dir := opts.UnitDir
+	switch {
+	case dir != "":
+	case opts.User:
+		config, err := os.UserConfigDir()
+		if err != nil {
+			return "", fmt.Errorf("os.UserConfigDir: %w", err)
+		}
+		dir = filepath.Join(config, "systemd", "user")
+	default:
+		dir = "/etc/systemd/system"
+	}
+
+	return filepath.Join(dir, opts.Name+".service"), nil
+}
+
+/*
+	Write systemd unit of command line, it is enabled by systemctl
+*/
+func installService(opts *ServiceOptions) error {
+	path, err := opts.unitPath()
+	if err != nil {
+		return err
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("os.Executable: %w", err)
+	}
+
+	if err := mkdirAll(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("os.MkdirAll: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(systemdUnit(opts, executable)), 0644); err != nil {
+		return fmt.Errorf("os.WriteFile: %w", err)
+	}
+
+	console.Printf("Installed %s\nStart it with: systemctl %sdaemon-reload && systemctl %senable --now %s\n",
+		path, opts.systemctlScope(), opts.systemctlScope(), opts.Name)
+
+	return nil
+}
+
+/*
+	Remove systemd unit, service should be stopped first
+*/
+func uninstallService(opts *ServiceOptions) error {
+	path, err := opts.unitPath()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("service %s is not installed: %s", opts.Name, path)
+		}
+		return fmt.Errorf("os.Remove: %w", err)
+	}
+
+	console.Printf("Removed %s\nStop it with: systemctl %sdisable --now %s\n", path, opts.systemctlScope(), opts.Name)
+
+	return nil
+}
+
+func (opts *ServiceOptions) systemctlScope() string {
+	if opts.User {
+		return "--user "
+	}
+
+	return ""
+}
+
+/*
+	Run command line under systemd, SIGTERM of service stop cancels job so daemons finish current round
+*/
+func runService(opts *ServiceOptions) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	go func() {
+		<-signals
+		notifyService("STOPPING=1")
+		stopService()
+	}()
+
+	runCommand(opts.Args)
+
+	return nil
+}
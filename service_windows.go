@@ -0,0 +1,119 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+type serviceHandler struct {
+	args []string
+}
+
+/*
+	Register Windows service of command line, started automatically with system
+*/
+func installService(opts *ServiceOptions) error {
+	if opts.User || opts.UnitDir != "" {
+		return fmt.Errorf("-user and -unit-dir are options of systemd units")
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("os.Executable: %w", err)
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("mgr.Connect: %w", err)
+	}
+	defer m.Disconnect()
+
+	args := append([]string{"service", "run", "-name", opts.Name, "--"}, opts.Args...)
+	s, err := m.CreateService(opts.Name, executable, mgr.Config{
+		DisplayName: "gcs-cp " + opts.Name,
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return fmt.Errorf("mgr.CreateService: %w", err)
+	}
+	defer s.Close()
+
+	console.Printf("Installed service %s\nStart it with: sc start %s\n", opts.Name, opts.Name)
+
+	return nil
+}
+
+/*
+	Remove Windows service, running service is removed once it stops
+*/
+func uninstallService(opts *ServiceOptions) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("mgr.Connect: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(opts.Name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed: %w", opts.Name, err)
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("mgr.Delete: %w", err)
+	}
+
+	console.Printf("Removed service %s\n", opts.Name)
+
+	return nil
+}
+
+/*
+	Run command line under service control manager, in console it runs as is
+*/
+func runService(opts *ServiceOptions) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return fmt.Errorf("svc.IsWindowsService: %w", err)
+	}
+	if !isService {
+		runCommand(opts.Args)
+		return nil
+	}
+
+	return svc.Run(opts.Name, &serviceHandler{args: opts.Args})
+}
+
+/*
+	Report service running while command runs, stop and shutdown requests cancel its job
+*/
+func (h *serviceHandler) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runCommand(h.args)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case <-done:
+			status <- svc.Status{State: svc.StopPending}
+			return false, 0
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				stopService()
+			}
+		}
+	}
+}
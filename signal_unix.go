@@ -0,0 +1,51 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+/*
+	Subscribe to status snapshot signal
+*/
+func notifyStatusSignal(c chan<- os.Signal) bool {
+	signal.Notify(c, syscall.SIGUSR1)
+	return true
+}
+
+/*
+	Start worker process in own process group, terminal signals reach coordinating process only
+*/
+func setWorkerProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+/*
+	Cancel worker process with SIGTERM, objects in flight roll back their partial files
+*/
+func stopWorkerProcess(p *os.Process) error {
+	return p.Signal(syscall.SIGTERM)
+}
+
+/*
+	Toggle pause on SIGTSTP (Ctrl-Z), resume on SIGCONT
+*/
+func (s *Storage) HandlePauseSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTSTP, syscall.SIGCONT)
+
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGCONT {
+				s.SetPaused(false)
+				continue
+			}
+			s.SetPaused(!s.Pauser.Paused())
+		}
+	}()
+}
@@ -0,0 +1,35 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+/*
+	Status snapshot signal is not available on Windows
+*/
+func notifyStatusSignal(c chan<- os.Signal) bool {
+	return false
+}
+
+/*
+	Worker processes share console of coordinating process on Windows
+*/
+func setWorkerProcessGroup(cmd *exec.Cmd) {
+}
+
+/*
+	SIGTERM is not available on Windows, worker process is killed
+*/
+func stopWorkerProcess(p *os.Process) error {
+	return p.Kill()
+}
+
+/*
+	Pause signals are not available on Windows, use control socket instead
+*/
+func (s *Storage) HandlePauseSignals() {
+}
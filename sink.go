@@ -0,0 +1,666 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+var ErrSinkBroken = errors.New("sink broken")
+
+const (
+	corruptSuffix = ".corrupt" // <= kept copy of data failing verification
+	tempSuffix    = ".tmp-"    // <= data in progress, followed by random part
+	stdoutSink    = "-"        // <= destination argument streaming single object to stdout
+)
+
+// Formats of "FORMAT:FILE" archive destinations and -archive
+var archiveFormats = []string{"tar", "tar.gz", "zip"}
+
+/*
+	Destination of downloaded data, new output targets implement it without changes of download pipeline
+*/
+type Sink interface {
+	Mkdir(ctx context.Context, t *Transfer) error                                                // <= folder placeholder
+	Create(ctx context.Context, t *Transfer, attrs *storage.ReaderObjectAttrs) (SinkFile, error) // <= one object
+	Close() error                                                                                // <= after all objects
+}
+
+/*
+	Data of one object, either closed once complete or aborted on failure
+*/
+type SinkFile interface {
+	io.Writer
+	Close() error
+	Abort() error
+}
+
+/*
+	Sink file which is complete only once reader confirmed it, e.g. -pipe-ack
+*/
+type ConfirmingFile interface {
+	SinkFile
+	Confirmed(fn func()) // <= set before Close
+}
+
+/*
+	Sink file which can be set aside instead of removed, e.g. -keep-corrupt
+*/
+type KeepingFile interface {
+	SinkFile
+	Keep(path string) error // <= instead of Close or Abort
+}
+
+/*
+	Sink file stored inside archive, e.g. entry of tar file
+*/
+type ArchivedFile interface {
+	SinkFile
+	ArchiveOffset() int64 // <= of data, after entry header
+}
+
+/*
+	Create sink of config: -pipe-to command, destination argument "tar:FILE", "tar.gz:FILE" or "zip:FILE" ("-" for stdout),
+	"-", http(s):// URL prefix or local directory
+*/
+func NewSink(cfg *Config) (Sink, error) {
+	destination := cfg.Sink
+	switch {
+	case len(cfg.PipeTo) > 0:
+		return NewPipeSink(cfg.PipeTo, cfg.PipeAck)
+	case destination == stdoutSink:
+		return &StdoutSink{w: os.Stdout}, nil
+	case isArchiveSink(destination):
+		format, path := splitArchiveSink(destination)
+		if path == "-" {
+			return newArchiveSink(format, os.Stdout, nil), nil
+		}
+
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, fmt.Errorf("os.Create: %w", err)
+		}
+
+		return newArchiveSink(format, f, f), nil
+	case isHTTPSink(destination):
+		return &HTTPSink{Prefix: destination, Client: newPlainHTTPClient(cfg.Transport)}, nil
+	}
+
+	return &LocalSink{}, nil
+}
+
+/*
+	Check if destination argument selects other sink than local directory
+*/
+func isSinkDestination(destination string) bool {
+	return destination == stdoutSink || isArchiveSink(destination) || isHTTPSink(destination)
+}
+
+func isArchiveSink(destination string) bool {
+	format, _ := splitArchiveSink(destination)
+	return format != ""
+}
+
+/*
+	Format and path of "FORMAT:FILE" destination, empty format for other destinations
+*/
+func splitArchiveSink(destination string) (string, string) {
+	for _, format := range archiveFormats {
+		if path := strings.TrimPrefix(destination, format+":"); path != destination {
+			return format, path
+		}
+	}
+
+	return "", ""
+}
+
+/*
+	Archive sink writing to w, closer (file or nil for stdout) is closed after archive is finished
+*/
+func newArchiveSink(format string, w io.Writer, closer io.Closer) Sink {
+	switch format {
+	case "tar.gz":
+		gz := gzip.NewWriter(w)
+		sink := NewTarSink(gz)
+		sink.closer = closers{gz, closer}
+		return sink
+	case "zip":
+		return &ZipSink{zw: zip.NewWriter(w), closer: closer}
+	}
+
+	sink := NewTarSink(w)
+	sink.closer = closer
+
+	return sink
+}
+
+// Closed in order, compressor before its file
+type closers []io.Closer
+
+func (c closers) Close() error {
+	for _, closer := range c {
+		if closer == nil {
+			continue
+		}
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func isHTTPSink(destination string) bool {
+	return strings.HasPrefix(destination, "http://") || strings.HasPrefix(destination, "https://")
+}
+
+/*
+	Name of transfer inside non-local sink, relative slash-separated path
+*/
+func sinkName(t *Transfer) string {
+	return strings.TrimPrefix(filepath.ToSlash(t.Destination), "/")
+}
+
+// Files and directories under destination path
+type LocalSink struct{}
+
+type localFile struct {
+	*os.File
+	path string // <= destination, file is renamed into place once complete
+}
+
+func (LocalSink) Mkdir(ctx context.Context, t *Transfer) error {
+	if err := mkdirAll(t.Destination); err != nil {
+		return fmt.Errorf("os.MkdirAll: %w", err)
+	}
+
+	return nil
+}
+
+func (LocalSink) Create(ctx context.Context, t *Transfer, attrs *storage.ReaderObjectAttrs) (SinkFile, error) {
+	// Create directory path if it does not exist (mkdir -p)
+	if err := mkdirAll(filepath.Dir(t.Destination)); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll: %w", err)
+	}
+
+	// Data is written next to destination, crash or failure never leaves truncated file under its name
+	f, err := createTemp(t.Destination)
+	if err != nil {
+		return nil, err
+	}
+
+	return &localFile{File: f, path: t.Destination}, nil
+}
+
+/*
+	Create new file "path.tmp-<random>" in directory of path, with mode of os.Create
+*/
+func createTemp(path string) (*os.File, error) {
+	for i := 0; ; i++ {
+		f, err := os.OpenFile(path+tempSuffix+randomSuffix(), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, os.ErrExist) || i == 10 {
+			return nil, fmt.Errorf("os.OpenFile: %w", err)
+		}
+	}
+}
+
+func randomSuffix() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+func (LocalSink) Close() error {
+	return nil
+}
+
+/*
+	Move complete file into place, replacing older copy
+*/
+func (f *localFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("os.Close: %w", err)
+	}
+	if err := os.Rename(f.Name(), f.path); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("os.Rename: %w", err)
+	}
+
+	return nil
+}
+
+/*
+	Remove incomplete file
+*/
+func (f *localFile) Abort() error {
+	f.File.Close()
+
+	return os.Remove(f.Name())
+}
+
+/*
+	Move file aside for inspection
+*/
+func (f *localFile) Keep(path string) error {
+	f.File.Close()
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("os.Rename: %w", err)
+	}
+
+	return nil
+}
+
+// Tar stream, one entry at a time
+type TarSink struct {
+	mu     sync.Mutex
+	tw     *tar.Writer
+	out    *countingWriter // <= archive position of entries
+	closer io.Closer       // <= file or process opened by sink
+	acks   *ackQueue       // <= reader confirms entries, -pipe-ack only
+	broken bool            // <= entry was cut short, stream can not continue
+}
+
+type tarFile struct {
+	sink      *TarSink
+	name      string
+	offset    int64
+	remaining int64
+	confirmed func()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func NewTarSink(w io.Writer) *TarSink {
+	out := &countingWriter{w: w}
+
+	return &TarSink{tw: tar.NewWriter(out), out: out}
+}
+
+func (s *TarSink) Mkdir(ctx context.Context, t *Transfer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.broken {
+		return ErrSinkBroken
+	}
+	name := strings.TrimSuffix(sinkName(t), "/") + "/"
+	if err := s.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: 0755}); err != nil {
+		s.broken = true
+		return fmt.Errorf("tar.WriteHeader: %w", err)
+	}
+
+	return nil
+}
+
+/*
+	Start entry, stream is locked until it is closed or aborted
+*/
+func (s *TarSink) Create(ctx context.Context, t *Transfer, attrs *storage.ReaderObjectAttrs) (SinkFile, error) {
+	s.mu.Lock()
+
+	if s.broken {
+		s.mu.Unlock()
+		return nil, ErrSinkBroken
+	}
+	if s.acks != nil {
+		if err := s.acks.Err(); err != nil {
+			s.broken = true
+			s.mu.Unlock()
+			return nil, err
+		}
+	}
+	// Header needs size before data
+	if attrs.Size < 0 {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("tar entry %s: object size is unknown", t.Object)
+	}
+
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     sinkName(t),
+		Size:     attrs.Size,
+		Mode:     0644,
+		ModTime:  attrs.LastModified,
+	}
+	if err := s.tw.WriteHeader(header); err != nil {
+		s.broken = true
+		s.mu.Unlock()
+		return nil, fmt.Errorf("tar.WriteHeader: %w", err)
+	}
+
+	return &tarFile{sink: s, name: header.Name, offset: s.out.n, remaining: attrs.Size}, nil
+}
+
+/*
+	Finish archive, stdout is left open
+*/
+func (s *TarSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.tw.Close(); err != nil {
+		return fmt.Errorf("tar.Close: %w", err)
+	}
+	if s.closer != nil {
+		if err := s.closer.Close(); err != nil {
+			return err // <= *os.PathError or error of command
+		}
+	}
+
+	return nil
+}
+
+func (f *tarFile) ArchiveOffset() int64 {
+	return f.offset
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+
+	return n, err
+}
+
+func (f *tarFile) Write(b []byte) (int, error) {
+	n, err := f.sink.tw.Write(b)
+	f.remaining -= int64(n)
+	if err != nil {
+		return n, fmt.Errorf("tar.Write: %w", err)
+	}
+
+	return n, nil
+}
+
+func (f *tarFile) Close() error {
+	defer f.sink.mu.Unlock()
+
+	// Size of header must match, e.g. not with decompressive transcoding
+	if f.remaining != 0 {
+		f.sink.broken = true
+		return fmt.Errorf("%w: tar entry is %d bytes short", ErrSinkBroken, f.remaining)
+	}
+	if err := f.sink.tw.Flush(); err != nil {
+		f.sink.broken = true
+		return fmt.Errorf("tar.Flush: %w", err)
+	}
+	if f.confirmed != nil {
+		if f.sink.acks != nil {
+			f.sink.acks.push(f.name, f.confirmed)
+		} else {
+			f.confirmed()
+		}
+	}
+
+	return nil
+}
+
+/*
+	Call function once reader confirmed entry, on close when it does not confirm entries
+*/
+func (f *tarFile) Confirmed(fn func()) {
+	f.confirmed = fn
+}
+
+/*
+	Partial entry can not be taken back, following objects fail too
+*/
+func (f *tarFile) Abort() error {
+	defer f.sink.mu.Unlock()
+
+	f.sink.broken = true
+
+	return nil
+}
+
+// Zip stream, one entry at a time; sizes follow data, so entries of unknown size can be written
+type ZipSink struct {
+	mu     sync.Mutex
+	zw     *zip.Writer
+	closer io.Closer // <= file opened by sink
+	broken bool      // <= entry was cut short, stream can not continue
+}
+
+type zipFile struct {
+	sink *ZipSink
+	w    io.Writer
+}
+
+func (s *ZipSink) Mkdir(ctx context.Context, t *Transfer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.broken {
+		return ErrSinkBroken
+	}
+	if _, err := s.zw.Create(strings.TrimSuffix(sinkName(t), "/") + "/"); err != nil {
+		s.broken = true
+		return fmt.Errorf("zip.Create: %w", err)
+	}
+
+	return nil
+}
+
+/*
+	Start entry, stream is locked until it is closed or aborted
+*/
+func (s *ZipSink) Create(ctx context.Context, t *Transfer, attrs *storage.ReaderObjectAttrs) (SinkFile, error) {
+	s.mu.Lock()
+
+	if s.broken {
+		s.mu.Unlock()
+		return nil, ErrSinkBroken
+	}
+	header := &zip.FileHeader{Name: sinkName(t), Method: zip.Deflate, Modified: attrs.LastModified}
+	header.SetMode(0644)
+	w, err := s.zw.CreateHeader(header)
+	if err != nil {
+		s.broken = true
+		s.mu.Unlock()
+		return nil, fmt.Errorf("zip.CreateHeader: %w", err)
+	}
+
+	return &zipFile{sink: s, w: w}, nil
+}
+
+/*
+	Write central directory, stdout is left open
+*/
+func (s *ZipSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.zw.Close(); err != nil {
+		return fmt.Errorf("zip.Close: %w", err)
+	}
+	if s.closer != nil {
+		if err := s.closer.Close(); err != nil {
+			return err // <= *os.PathError
+		}
+	}
+
+	return nil
+}
+
+func (f *zipFile) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	if err != nil {
+		return n, fmt.Errorf("zip.Write: %w", err)
+	}
+
+	return n, nil
+}
+
+/*
+	Entry ends with next one, its data is pushed out already
+*/
+func (f *zipFile) Close() error {
+	defer f.sink.mu.Unlock()
+
+	if err := f.sink.zw.Flush(); err != nil {
+		f.sink.broken = true
+		return fmt.Errorf("zip.Flush: %w", err)
+	}
+
+	return nil
+}
+
+/*
+	Partial entry can not be taken back, following objects fail too
+*/
+func (f *zipFile) Abort() error {
+	defer f.sink.mu.Unlock()
+
+	f.sink.broken = true
+
+	return nil
+}
+
+// Data of single object written to stdout as is
+type StdoutSink struct {
+	w      io.Writer
+	broken bool // <= data was written by failed attempt, retry would repeat it
+}
+
+type stdoutFile struct {
+	sink    *StdoutSink
+	written int64
+}
+
+func (s *StdoutSink) Mkdir(ctx context.Context, t *Transfer) error {
+	return nil
+}
+
+func (s *StdoutSink) Create(ctx context.Context, t *Transfer, attrs *storage.ReaderObjectAttrs) (SinkFile, error) {
+	if s.broken {
+		return nil, fmt.Errorf("%w: part of %s was written to stdout before attempt failed", ErrSinkBroken, t.URI())
+	}
+
+	return &stdoutFile{sink: s}, nil
+}
+
+func (s *StdoutSink) Close() error {
+	return nil
+}
+
+func (f *stdoutFile) Write(b []byte) (int, error) {
+	n, err := f.sink.w.Write(b)
+	f.written += int64(n)
+	if err != nil {
+		return n, fmt.Errorf("%w: %v", ErrSinkBroken, err) // <= reader of pipe went away
+	}
+
+	return n, nil
+}
+
+func (f *stdoutFile) Close() error {
+	return nil
+}
+
+/*
+	Written data can not be taken back, attempt without data may be retried
+*/
+func (f *stdoutFile) Abort() error {
+	if f.written > 0 {
+		f.sink.broken = true
+	}
+
+	return nil
+}
+
+// HTTP PUT of each object to prefix + relative path
+type HTTPSink struct {
+	Prefix string
+	Client *http.Client
+}
+
+type httpFile struct {
+	*io.PipeWriter
+	done chan error
+}
+
+func (s *HTTPSink) Mkdir(ctx context.Context, t *Transfer) error {
+	return nil
+}
+
+/*
+	Start PUT request, body is streamed from written data; context of attempt is derived from job, canceling either stops request
+*/
+func (s *HTTPSink) Create(ctx context.Context, t *Transfer, attrs *storage.ReaderObjectAttrs) (SinkFile, error) {
+	pr, pw := io.Pipe()
+	url := strings.TrimSuffix(s.Prefix, "/") + "/" + sinkName(t)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, pr)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequest: %w", err)
+	}
+	req.ContentLength = attrs.Size
+	if attrs.ContentType != "" {
+		req.Header.Set("Content-Type", attrs.ContentType)
+	}
+
+	f := &httpFile{PipeWriter: pw, done: make(chan error, 1)}
+	go func() {
+		resp, err := s.Client.Do(req)
+		if err == nil {
+			err = googleapi.CheckResponse(resp)
+			resp.Body.Close()
+		}
+		pr.CloseWithError(err) // <= unblocks writer when server gives up early
+		f.done <- err
+	}()
+
+	return f, nil
+}
+
+func (s *HTTPSink) Close() error {
+	return nil
+}
+
+/*
+	Finish body and wait for response
+*/
+func (f *httpFile) Close() error {
+	f.PipeWriter.Close()
+	if err := <-f.done; err != nil {
+		return fmt.Errorf("http.Put: %w", err)
+	}
+
+	return nil
+}
+
+func (f *httpFile) Abort() error {
+	f.PipeWriter.CloseWithError(errors.New("download aborted"))
+	<-f.done
+
+	return nil
+}
+
+/*
+	Check if objects are written as local files, other sinks leave nothing to check or validate
+*/
+func (cfg *Config) LocalFiles() bool {
+	return cfg.Sink == "" && len(cfg.PipeTo) == 0
+}
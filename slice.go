@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+/*
+	Sink file which may be written at offsets and read back for verification, as local files
+*/
+type sliceFile interface {
+	io.WriterAt
+	io.ReaderAt
+}
+
+type offsetWriter struct {
+	file   io.WriterAt
+	offset int64
+}
+
+const (
+	autoSliceTime    = 4 * time.Second // <= objects which one stream reads faster are not sliced
+	autoSliceMin     = 8 << 20         // <= smaller ranges spend more on requests than they gain
+	autoStreamRate   = 32 << 20        // <= bytes per second assumed until first stream is measured
+	streamRateSample = 1 << 20         // <= shorter reads measure latency rather than throughput
+	streamRateWeight = 0.3             // <= share of newest sample in rate
+)
+
+/*
+	Per-stream download throughput of the job, smoothed over finished reads; used by -slice-size auto
+*/
+type StreamMeter struct {
+	mu   sync.Mutex
+	rate float64 // <= bytes per second, 0 until measured
+}
+
+/*
+	Add read of one stream, short reads are ignored
+*/
+func (m *StreamMeter) Observe(bytes int64, elapsed time.Duration) {
+	if bytes < streamRateSample || elapsed <= 0 {
+		return
+	}
+	current := float64(bytes) / elapsed.Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.rate == 0 {
+		m.rate = current
+	} else {
+		m.rate += streamRateWeight * (current - m.rate)
+	}
+}
+
+/*
+	Current per-stream rate, false before any stream was measured
+*/
+func (m *StreamMeter) Rate() (float64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.rate, m.rate > 0
+}
+
+/*
+	Number and size of parallel ranges of download, 0 streams object as usual. Fixed -slice-size splits
+	larger objects into ranges of it; auto slices objects which one stream reads longer than autoSliceTime
+	into ranges which streams read in about that time
+*/
+func (s *Storage) sliceCount(sr *storage.Reader, out SinkFile, offset int64) (int, int64) {
+	if s.Config.Slices < 2 || offset > 0 || sr.Attrs.ContentEncoding == "gzip" {
+		return 0, 0
+	}
+	if _, ok := out.(sliceFile); !ok {
+		return 0, 0
+	}
+
+	size, sliceSize := sr.Attrs.Size, s.Config.SliceSize
+	if sliceSize == 0 {
+		rate, _ := s.Streams.Rate()
+		if rate == 0 {
+			rate = autoStreamRate
+		}
+		sliceSize = int64(math.Ceil(rate*autoSliceTime.Seconds()/(1<<20))) << 20 // <= whole MiB
+		if sliceSize < autoSliceMin {
+			sliceSize = autoSliceMin
+		}
+	}
+	if size <= sliceSize {
+		return 0, 0
+	}
+
+	slices := int((size + sliceSize - 1) / sliceSize)
+	if slices > s.Config.Slices {
+		slices = s.Config.Slices
+	}
+
+	return slices, sliceSize
+}
+
+/*
+	Log slicing decision, auto mode tells which stream rate it was based on
+*/
+func (s *Storage) logSlicing(t *Transfer, object string, slices int, sliceSize int64) {
+	if s.Config.SliceSize > 0 {
+		s.Printf(t.URI(), "Slicing %s into %d parallel ranges\n", object, slices)
+		return
+	}
+
+	basis := "assumed"
+	rate, measured := s.Streams.Rate()
+	if measured {
+		basis = "measured"
+	} else {
+		rate = autoStreamRate
+	}
+	s.Printf(t.URI(), "Slicing %s into %d parallel ranges of %s (%s/s per stream %s)\n",
+		object, slices, formatBytes(sliceSize), formatBytes(int64(rate)), basis)
+}
+
+/*
+	Download chunks of sliceSize in parallel and write them at their offsets, opened reader serves first chunk
+*/
+func (s *Storage) copySliced(ctx context.Context, t *Transfer, handle *storage.ObjectHandle, sr *storage.Reader, out SinkFile, progress io.Writer, slices int, sliceSize int64) (int64, error) {
+	size := sr.Attrs.Size
+	file := out.(sliceFile)
+	handle = handle.Generation(sr.Attrs.Generation) // <= never mix generations
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	chunks := make(chan int64, int((size+sliceSize-1)/sliceSize))
+	for offset := sliceSize; offset < size; offset += sliceSize {
+		chunks <- offset
+	}
+	close(chunks)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	for i := 0; i < slices; i++ {
+		wg.Add(1)
+		go func(first bool) {
+			defer wg.Done()
+			buf := s.Buffers.Get()
+			defer s.Buffers.Put(buf)
+
+			if first {
+				if err := s.copyChunk(ctx, t, handle, sr, file, progress, 0, sliceSize, *buf); err != nil {
+					fail(err)
+					return
+				}
+			}
+			for offset := range chunks {
+				if ctx.Err() != nil {
+					return
+				}
+				length := sliceSize
+				if offset+length > size {
+					length = size - offset
+				}
+				if err := s.copyChunk(ctx, t, handle, nil, file, progress, offset, length, *buf); err != nil {
+					fail(err)
+					return
+				}
+			}
+		}(i == 0)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return 0, firstErr
+	}
+
+	return size, nil
+}
+
+/*
+	Copy byte range of object into file, broken connections reopen rest of range like reconnecting reader
+*/
+func (s *Storage) copyChunk(ctx context.Context, t *Transfer, handle *storage.ObjectHandle, reader io.ReadCloser, file io.WriterAt, progress io.Writer, offset, length int64, buf []byte) error {
+	done := int64(0)
+	for attempt := 0; ; attempt++ {
+		if reader == nil {
+			rr, err := handle.NewRangeReader(ctx, offset+done, length-done)
+			if err != nil {
+				return fmt.Errorf("Object(%q).NewRangeReader: %w", handle.ObjectName(), err)
+			}
+			reader = rr
+		}
+
+		w := &offsetWriter{file: file, offset: offset + done}
+		started := time.Now()
+		n, err := io.CopyBuffer(io.MultiWriter(w, progress), s.Bandwidth.Reader(ctx, s.Pauser.Reader(ctx, io.LimitReader(reader, length-done))), buf)
+		s.Streams.Observe(n, time.Since(started))
+		reader.Close()
+		reader = nil
+		done += n
+
+		switch {
+		case err == nil && done == length:
+			return nil
+		case err == nil:
+			err = io.ErrUnexpectedEOF // <= range ended early
+		case ctx.Err() != nil || !s.Config.Retry.ShouldRetry(err):
+			return fmt.Errorf("io.CopyBuffer: %w", err)
+		}
+		if attempt >= s.Config.ReconnectAttempts {
+			return fmt.Errorf("io.CopyBuffer: %w", err)
+		}
+		s.Printf(t.URI(), "Reconnecting %s at offset %d (attempt %d/%d): %v\n",
+			handle.ObjectName(), offset+done, attempt+1, s.Config.ReconnectAttempts, err)
+	}
+}
+
+/*
+	Feed stitched file to checksums, chunks arrive out of order so data is read back once complete
+*/
+func hashSliced(out SinkFile, size int64, w io.Writer, buf []byte) error {
+	if _, err := io.CopyBuffer(w, io.NewSectionReader(out.(sliceFile), 0, size), buf); err != nil {
+		return fmt.Errorf("io.CopyBuffer: %w", err)
+	}
+
+	return nil
+}
+
+func (w *offsetWriter) Write(b []byte) (int, error) {
+	n, err := w.file.WriteAt(b, w.offset)
+	w.offset += int64(n)
+
+	return n, err
+}
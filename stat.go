@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+	Print all attributes of objects, as JSON lines with -json
+*/
+func runStatCommand(args []string) {
+	fs := flag.NewFlagSet("stat", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s stat [OPTIONS] bucket_name/object...\n\nOptions:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	common := addCommandFlags(fs)
+	jsonOut := fs.Bool("json", false, "Print one JSON object per object (NDJSON) with fields of metadata sidecars")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	type target struct{ uri, bucket, object string }
+	var targets []target
+	for _, uri := range fs.Args() {
+		bucket, object, err := parseGCSUrl(uri)
+		if err != nil {
+			exception(err)
+		}
+		if object == "" || strings.HasSuffix(object, "/") {
+			exception(fmt.Errorf("stat needs object URL: %s", uri))
+		}
+		targets = append(targets, target{uri, bucket, object})
+	}
+
+	s, err := common.storage("stat")
+	if err != nil {
+		exception(err)
+	}
+	defer s.Client.Close()
+
+	for _, t := range targets {
+		stat, err := s.StatObject(t.bucket, t.object)
+		if err != nil {
+			exception(err)
+		}
+		if *jsonOut {
+			line, err := json.Marshal(stat)
+			if err != nil {
+				exception(fmt.Errorf("json.Marshal: %w", err))
+			}
+			console.Printf("%s\n", line)
+			continue
+		}
+		console.Printf("%s", formatObjectStat(stat))
+	}
+}
+
+/*
+	Attributes of live object generation, with component count of composite objects
+*/
+func (s *Storage) StatObject(bucket, object string) (*MetadataSidecar, error) {
+	var stat *MetadataSidecar
+	attempt, err := s.Retry(fmt.Sprintf("gs://%s/%s", bucket, object), func() error {
+		ctx, cancel := s.objectContext()
+		defer cancel()
+
+		attrs, err := s.Bucket(bucket).Object(object).Attrs(ctx)
+		if err != nil {
+			return fmt.Errorf("Object(%q).Attrs: %w", object, err)
+		}
+		stat = NewMetadataSidecar(attrs)
+		if stat.MD5 == "" {
+			stat.ComponentCount, err = s.ComponentCount(ctx, bucket, object, attrs.Generation)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, &TransferError{Object: object, Attempt: attempt, Err: err}
+	}
+
+	return stat, nil
+}
+
+/*
+	Aligned attribute lines like "gsutil stat", unset optional attributes are left out
+*/
+func formatObjectStat(stat *MetadataSidecar) string {
+	var b strings.Builder
+	line := func(name string, value interface{}) {
+		fmt.Fprintf(&b, "    %-22s %v\n", name+":", value)
+	}
+	optional := func(name, value string) {
+		if value != "" {
+			line(name, value)
+		}
+	}
+
+	fmt.Fprintf(&b, "%s:\n", stat.URI)
+	line("Creation time", stat.Created.UTC().Format(time.RFC3339))
+	line("Update time", stat.Updated.UTC().Format(time.RFC3339))
+	if stat.CustomTime != nil {
+		line("Custom time", stat.CustomTime.UTC().Format(time.RFC3339))
+	}
+	optional("Storage class", stat.StorageClass)
+	line("Content-Length", stat.Size)
+	optional("Content-Type", stat.ContentType)
+	optional("Content-Encoding", stat.ContentEncoding)
+	optional("Content-Language", stat.ContentLanguage)
+	optional("Content-Disposition", stat.ContentDisposition)
+	optional("Cache-Control", stat.CacheControl)
+	if len(stat.Metadata) > 0 {
+		fmt.Fprintf(&b, "    Metadata:\n")
+		keys := make([]string, 0, len(stat.Metadata))
+		for key := range stat.Metadata {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(&b, "        %-18s %s\n", key+":", stat.Metadata[key])
+		}
+	}
+	line("Hash (crc32c)", stat.CRC32C)
+	optional("Hash (md5)", stat.MD5)
+	if stat.ComponentCount > 0 {
+		line("Component-Count", stat.ComponentCount)
+	}
+	optional("ETag", stat.ETag)
+	line("Generation", stat.Generation)
+	line("Metageneration", stat.Metageneration)
+	optional("KMS key", stat.KMSKeyName)
+	if stat.EventBasedHold {
+		line("Event-Based Hold", "Enabled")
+	}
+	if stat.TemporaryHold {
+		line("Temporary Hold", "Enabled")
+	}
+	if stat.RetentionExpiration != nil {
+		line("Retention expiration", stat.RetentionExpiration.UTC().Format(time.RFC3339))
+	}
+
+	return b.String()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type StateEntry struct {
+	URI            string    `json:"uri"`
+	Generation     int64     `json:"generation"`
+	Metageneration int64     `json:"metageneration"`
+	Size           int64     `json:"size"`
+	LastSeen       time.Time `json:"last_seen"` // <= last run which found object up to date or downloaded it
+}
+
+type StateFile struct {
+	mu      sync.Mutex
+	path    string
+	Objects map[string]*StateEntry `json:"objects"` // <= destination path => downloaded object version
+
+	db            bool     // <= NDJSON snapshot with journal instead of single JSON document
+	journal       *os.File // <= appended records of current run, database only
+	journalFailed bool
+}
+
+/*
+	Load state of previous runs, missing file means empty state
+*/
+func LoadStateFile(path string) (*StateFile, error) {
+	sf := &StateFile{path: path, Objects: map[string]*StateEntry{}}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return sf, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile: %w", err)
+	}
+
+	if err := json.Unmarshal(data, sf); err != nil {
+		return nil, fmt.Errorf("state file %s: %w", path, err)
+	}
+	if sf.Objects == nil {
+		sf.Objects = map[string]*StateEntry{}
+	}
+
+	return sf, nil
+}
+
+/*
+	Get recorded version of destination file
+*/
+func (sf *StateFile) Get(destination string) *StateEntry {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	return sf.Objects[destination]
+}
+
+/*
+	Record downloaded version of destination file
+*/
+func (sf *StateFile) Set(destination string, entry *StateEntry) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	entry.LastSeen = time.Now().UTC()
+	sf.Objects[destination] = entry
+	if sf.journal != nil {
+		sf.appendJournal(destination, entry)
+	}
+}
+
+/*
+	Mark entry of up to date file as seen in this run, saved with next snapshot only
+*/
+func (sf *StateFile) Touch(destination string) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	if entry, ok := sf.Objects[destination]; ok {
+		entry.LastSeen = time.Now().UTC()
+	}
+}
+
+/*
+	Close journal of state database
+*/
+func (sf *StateFile) Close() error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	if sf.journal == nil {
+		return nil
+	}
+	err := sf.journal.Close()
+	sf.journal = nil
+
+	return err
+}
+
+/*
+	Write state atomically, readers never see partial file
+*/
+func (sf *StateFile) Save() error {
+	if sf.db {
+		sf.mu.Lock()
+		defer sf.mu.Unlock()
+
+		return sf.compact()
+	}
+
+	sf.mu.Lock()
+	data, err := json.MarshalIndent(sf, "", "  ")
+	sf.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(sf.path), filepath.Base(sf.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("os.CreateTemp: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("os.Write: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("os.Close: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), sf.path); err != nil {
+		return fmt.Errorf("os.Rename: %w", err)
+	}
+
+	return nil
+}
+
+/*
+	Check if destination file still holds current object data, metadata-only changes do not count
+*/
+func (s *Storage) UpToDate(t *Transfer) (bool, error) {
+	entry := s.State.Get(t.Destination)
+	if entry == nil || entry.URI != t.URI() {
+		return false, nil
+	}
+
+	// Local file was removed or modified, other sinks keep no copy to check
+	if s.Config.LocalFiles() {
+		info, err := os.Stat(t.Destination)
+		if err != nil || info.Size() != entry.Size {
+			return false, nil
+		}
+	}
+
+	// Listing already has current generation, otherwise ask for attributes only
+	attrs := t.Attrs
+	var err error
+	if attrs == nil || attrs.Generation == 0 {
+		ctx, cancel := s.objectContext()
+		defer cancel()
+
+		if attrs, err = s.Bucket(t.Bucket).Object(t.Object).Attrs(ctx); err != nil {
+			return false, fmt.Errorf("Object(%q).Attrs: %w", t.Object, err)
+		}
+	}
+
+	if attrs.Generation != entry.Generation {
+		return false, nil
+	}
+	if attrs.Metageneration != entry.Metageneration {
+		s.State.Set(t.Destination, &StateEntry{
+			URI:            entry.URI,
+			Generation:     entry.Generation,
+			Metageneration: attrs.Metageneration,
+			Size:           entry.Size,
+		})
+	} else {
+		s.State.Touch(t.Destination)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+type stateRecord struct {
+	Destination string `json:"destination"`
+	*StateEntry
+}
+
+/*
+	Open state database: NDJSON snapshot compacted on save and journal appended as objects finish
+*/
+func OpenStateDB(path string) (*StateFile, error) {
+	sf := &StateFile{path: path, db: true, Objects: map[string]*StateEntry{}}
+
+	// Journal records are newer than snapshot, unfinished compaction is replayed safely
+	for _, name := range []string{path, path + ".journal"} {
+		if err := sf.replay(name); err != nil {
+			return nil, err
+		}
+	}
+
+	journal, err := os.OpenFile(path+".journal", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("os.OpenFile: %w", err)
+	}
+	sf.journal = journal
+
+	return sf, nil
+}
+
+func (sf *StateFile) replay(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("os.Open: %w", err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			var record stateRecord
+			if jerr := json.Unmarshal(line, &record); jerr != nil || record.StateEntry == nil {
+				return fmt.Errorf("state database %s line %d: invalid record", path, n)
+			}
+			sf.Objects[record.Destination] = record.StateEntry
+		}
+		// Last line without newline is a write interrupted by crash
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("bufio.ReadBytes: %w", err)
+		}
+	}
+}
+
+/*
+	Append record to journal, so finished objects survive crash before save
+*/
+func (sf *StateFile) appendJournal(destination string, entry *StateEntry) {
+	data, err := json.Marshal(stateRecord{Destination: destination, StateEntry: entry})
+	if err == nil {
+		_, err = sf.journal.Write(append(data, '\n'))
+	}
+	if err != nil && !sf.journalFailed {
+		sf.journalFailed = true // <= reported once, state is still saved at the end
+		console.Errorf("State journal write failed: %v\n", err)
+	}
+}
+
+/*
+	Write compacted snapshot atomically and empty journal
+*/
+func (sf *StateFile) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(sf.path), filepath.Base(sf.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("os.CreateTemp: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	// Sorted like keys of JSON state file, so snapshots can be compared
+	destinations := make([]string, 0, len(sf.Objects))
+	for destination := range sf.Objects {
+		destinations = append(destinations, destination)
+	}
+	sort.Strings(destinations)
+
+	out := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(out)
+	for _, destination := range destinations {
+		record := stateRecord{Destination: destination, StateEntry: sf.Objects[destination]}
+		if err := encoder.Encode(record); err != nil {
+			tmp.Close()
+			return fmt.Errorf("json.Encode: %w", err)
+		}
+	}
+	if err := out.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("bufio.Flush: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("os.Close: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), sf.path); err != nil {
+		return fmt.Errorf("os.Rename: %w", err)
+	}
+
+	if sf.journal != nil {
+		if err := sf.journal.Truncate(0); err != nil {
+			return fmt.Errorf("os.Truncate: %w", err)
+		}
+	}
+
+	return nil
+}
+
+/*
+	Remove entries not seen for given time and, optionally, entries with missing local file
+*/
+func (sf *StateFile) Prune(olderThan time.Duration, missing bool) int {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	cutoff := time.Now().Add(-olderThan)
+	pruned := 0
+	for destination, entry := range sf.Objects {
+		stale := olderThan > 0 && entry.LastSeen.Before(cutoff)
+		if !stale && missing {
+			_, err := os.Stat(destination)
+			stale = errors.Is(err, os.ErrNotExist)
+		}
+		if stale {
+			delete(sf.Objects, destination)
+			pruned++
+		}
+	}
+
+	return pruned
+}
+
+/*
+	Run "state" maintenance command: prune or compact
+*/
+func runStateCommand(args []string) {
+	fs := flag.NewFlagSet("state", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s state prune|compact [OPTIONS] -state-db path|-state-file path\n\nOptions:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	stateDB := fs.String("state-db", "", "State database to maintain")
+	stateFile := fs.String("state-file", "", "JSON state file to maintain")
+	olderThan := fs.Duration("older-than", 0, "Prune entries of objects not seen in runs for this long, e.g. 720h")
+	missing := fs.Bool("missing", false, "Prune entries whose local file does not exist")
+
+	if len(args) == 0 || (args[0] != "prune" && args[0] != "compact") {
+		fs.Usage()
+		os.Exit(1)
+	}
+	command := args[0]
+	fs.Parse(args[1:])
+
+	var sf *StateFile
+	var err error
+	switch {
+	case *stateDB != "" && *stateFile == "":
+		sf, err = OpenStateDB(*stateDB)
+	case *stateFile != "" && *stateDB == "":
+		sf, err = LoadStateFile(*stateFile)
+	default:
+		fs.Usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		exception(err)
+	}
+	defer sf.Close()
+
+	total := len(sf.Objects)
+	if command == "prune" {
+		if *olderThan <= 0 && !*missing {
+			exception(fmt.Errorf("prune needs -older-than or -missing"))
+		}
+		pruned := sf.Prune(*olderThan, *missing)
+		console.Printf("Pruned %d of %d entries.\n", pruned, total)
+	}
+
+	if err := sf.Save(); err != nil {
+		exception(err)
+	}
+	console.Printf("State of %d entries saved to %s\n", len(sf.Objects), sf.path)
+}
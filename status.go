@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const recentErrorsLimit = 10
+
+type ObjectProgress struct {
+	Name    string
+	Size    int64 // <= known once object reader is open
+	Written int64 // <= updated atomically while copying
+	Started time.Time
+}
+
+type ProgressSnapshot struct {
+	Total      int
+	Done       int
+	Bytes      int64 // <= finished and in flight objects
+	TotalBytes int64
+	InFlight   []ObjectProgress // <= sorted by name
+}
+
+type JobStatus struct {
+	mu         sync.Mutex
+	Started    time.Time
+	Total      int
+	Done       int
+	Bytes      int64 // <= bytes of finished objects
+	TotalBytes int64 // <= listed size of objects still to transfer, 0 when unknown
+	InFlight   map[string]*ObjectProgress
+	Errors     []string
+
+	completed map[string]int64 // <= finished object => bytes written
+}
+
+/*
+	Create new job status tracker
+*/
+func NewJobStatus() *JobStatus {
+	return &JobStatus{
+		Started:   time.Now(),
+		InFlight:  map[string]*ObjectProgress{},
+		completed: map[string]int64{},
+	}
+}
+
+/*
+	Set number of objects in the job and their size, 0 when it is not known
+*/
+func (js *JobStatus) SetTotal(total int, bytes int64) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	js.Total = total
+	js.TotalBytes = bytes
+}
+
+/*
+	Register object transfer start
+*/
+func (js *JobStatus) Start(name string) *ObjectProgress {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	p := &ObjectProgress{Name: name, Started: time.Now()}
+	js.InFlight[name] = p
+
+	return p
+}
+
+/*
+	Register object transfer end
+*/
+func (js *JobStatus) Finish(name string) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	var written int64
+	if p, ok := js.InFlight[name]; ok {
+		written = atomic.LoadInt64(&p.Written)
+		js.Bytes += written
+		delete(js.InFlight, name)
+	}
+	js.completed[name] = written
+	js.Done++
+}
+
+/*
+	Register object skipped without transfer, its size is not expected anymore
+*/
+func (js *JobStatus) Skip(name string, size int64) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	if js.TotalBytes > 0 {
+		js.TotalBytes -= size
+	}
+	delete(js.InFlight, name)
+	js.completed[name] = 0
+	js.Done++
+}
+
+/*
+	Move progress of other transfer to name, e.g. when second attempt replaces first one
+*/
+func (js *JobStatus) Move(from, name string) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	if p, ok := js.InFlight[from]; ok {
+		delete(js.InFlight, from)
+		p.Name = name
+		js.InFlight[name] = p
+	}
+}
+
+/*
+	Forget progress of abandoned transfer, it is not counted as finished
+*/
+func (js *JobStatus) Drop(name string) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	delete(js.InFlight, name)
+}
+
+/*
+	Check if object transfer has finished
+*/
+func (js *JobStatus) Completed(name string) bool {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	_, ok := js.completed[name]
+
+	return ok
+}
+
+/*
+	Bytes written by finished object transfer, zero for skipped objects
+*/
+func (js *JobStatus) Transferred(name string) int64 {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	return js.completed[name]
+}
+
+/*
+	Remember error, only last few errors are kept
+*/
+func (js *JobStatus) AddError(err error) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	js.Errors = append(js.Errors, fmt.Sprintf("%s %v", time.Now().Format(time.RFC3339), err))
+	if len(js.Errors) > recentErrorsLimit {
+		js.Errors = js.Errors[len(js.Errors)-recentErrorsLimit:]
+	}
+}
+
+/*
+	Machine-readable job counters
+*/
+func (js *JobStatus) Metrics() map[string]interface{} {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	bytes := js.Bytes
+	for _, p := range js.InFlight {
+		bytes += atomic.LoadInt64(&p.Written)
+	}
+
+	return map[string]interface{}{
+		"objects_total":     js.Total,
+		"objects_done":      js.Done,
+		"objects_in_flight": len(js.InFlight),
+		"bytes":             bytes,
+		"errors":            len(js.Errors),
+		"elapsed_seconds":   time.Since(js.Started).Seconds(),
+	}
+}
+
+/*
+	Consistent copy of counters and objects in flight, e.g. for progress line
+*/
+func (js *JobStatus) Progress() ProgressSnapshot {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	snapshot := ProgressSnapshot{Total: js.Total, Done: js.Done, Bytes: js.Bytes, TotalBytes: js.TotalBytes}
+	for _, p := range js.InFlight {
+		object := ObjectProgress{
+			Name:    p.Name,
+			Size:    atomic.LoadInt64(&p.Size),
+			Written: atomic.LoadInt64(&p.Written),
+			Started: p.Started,
+		}
+		snapshot.InFlight = append(snapshot.InFlight, object)
+		snapshot.Bytes += object.Written
+	}
+	sort.Slice(snapshot.InFlight, func(i, j int) bool {
+		return snapshot.InFlight[i].Name < snapshot.InFlight[j].Name
+	})
+
+	return snapshot
+}
+
+/*
+	Human-readable status report
+*/
+func (js *JobStatus) Snapshot() string {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	var inFlight []*ObjectProgress
+	bytes := js.Bytes
+	for _, p := range js.InFlight {
+		inFlight = append(inFlight, p)
+		bytes += atomic.LoadInt64(&p.Written)
+	}
+	sort.Slice(inFlight, func(i, j int) bool {
+		return inFlight[i].Name < inFlight[j].Name
+	})
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "=== Job status (elapsed %s) ===\n", time.Since(js.Started).Round(time.Second))
+	fmt.Fprintf(&b, "Objects: %d/%d done, %d in flight\n", js.Done, js.Total, len(inFlight))
+	fmt.Fprintf(&b, "Bytes:   %s transferred\n", formatBytes(bytes))
+
+	if len(inFlight) > 0 {
+		fmt.Fprintln(&b, "In flight:")
+		for _, p := range inFlight {
+			written := atomic.LoadInt64(&p.Written)
+			size := atomic.LoadInt64(&p.Size)
+			percent := 0.0
+			if size > 0 {
+				percent = float64(written) * 100 / float64(size)
+			}
+			fmt.Fprintf(&b, "  %s %s/%s (%.1f%%) %s\n", p.Name, formatBytes(written), formatBytes(size),
+				percent, time.Since(p.Started).Round(time.Second))
+		}
+	}
+
+	if len(js.Errors) > 0 {
+		fmt.Fprintln(&b, "Recent errors:")
+		for _, e := range js.Errors {
+			fmt.Fprintf(&b, "  %s\n", e)
+		}
+	}
+
+	return b.String()
+}
+
+/*
+	Print status snapshot to stderr on each status signal (SIGUSR1)
+*/
+func (js *JobStatus) HandleSignals() {
+	signals := make(chan os.Signal, 1)
+	if !notifyStatusSignal(signals) {
+		return
+	}
+
+	go func() {
+		for range signals {
+			console.Errorf("%s", js.Snapshot())
+		}
+	}()
+}
+
+/*
+	Writer counting bytes of object in progress
+*/
+func (p *ObjectProgress) Write(b []byte) (int, error) {
+	atomic.AddInt64(&p.Written, int64(len(b)))
+	return len(b), nil
+}
+
+/*
+	Format bytes count with binary units
+*/
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+/*
+	One line summary of finished job
+*/
+func (js *JobStatus) Summary() string {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	return fmt.Sprintf("Objects: %d/%d done, %s transferred in %s",
+		js.Done, js.Total, formatBytes(js.Bytes), time.Since(js.Started).Round(time.Second))
+}
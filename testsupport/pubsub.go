@@ -0,0 +1,180 @@
+package testsupport
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	ID         string
+	Data       string // <= base64 as sent by client
+	Deliveries int
+
+	ackID      string
+	leaseUntil time.Time // <= delivered again after it, unless acknowledged
+}
+
+/*
+	Minimal Pub/Sub REST API: publish, pull, acknowledge and modifyAckDeadline, suitable for PUBSUB_EMULATOR_HOST
+*/
+type PubSubServer struct {
+	URL string
+
+	mu            sync.Mutex
+	srv           *httptest.Server
+	nextID        int
+	topics        map[string][]string      // <= topic => subscriptions
+	subscriptions map[string][]*Message    // <= unacknowledged messages by subscription
+	deadlines     map[string]time.Duration // <= ack deadline by subscription
+}
+
+/*
+	Start in-memory Pub/Sub server without topics
+*/
+func NewPubSubServer() *PubSubServer {
+	s := &PubSubServer{
+		topics:        map[string][]string{},
+		subscriptions: map[string][]*Message{},
+		deadlines:     map[string]time.Duration{},
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.srv.URL
+
+	return s
+}
+
+/*
+	Shutdown server
+*/
+func (s *PubSubServer) Close() {
+	s.srv.Close()
+}
+
+/*
+	Create subscription of topic, messages are delivered again after ack deadline
+*/
+func (s *PubSubServer) CreateSubscription(topic, name string, ackDeadline time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.topics[topic] = append(s.topics[topic], name)
+	s.subscriptions[name] = nil
+	s.deadlines[name] = ackDeadline
+}
+
+/*
+	Unacknowledged messages of subscription
+*/
+func (s *PubSubServer) Messages(name string) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var messages []Message
+	for _, m := range s.subscriptions[name] {
+		messages = append(messages, *m)
+	}
+
+	return messages
+}
+
+func (s *PubSubServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	// Paths are "/v1/projects/P/topics/T:publish" and "/v1/projects/P/subscriptions/S:pull"
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	colon := strings.LastIndex(path, ":")
+	if r.Method != http.MethodPost || colon < 0 {
+		http.Error(w, `{"error":{"code":404,"message":"not found"}}`, http.StatusNotFound)
+		return
+	}
+	name, method := path[:colon], path[colon+1:]
+
+	var req struct {
+		Messages []struct {
+			Data string `json:"data"`
+		} `json:"messages"`
+		MaxMessages        int      `json:"maxMessages"`
+		AckIds             []string `json:"ackIds"`
+		AckDeadlineSeconds int      `json:"ackDeadlineSeconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":{"code":400,"message":"bad request"}}`, http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subscriptions, isTopic := s.topics[name]
+	messages, isSubscription := s.subscriptions[name]
+	var resp interface{}
+	switch {
+	case method == "publish" && isTopic:
+		var ids []string
+		for _, m := range req.Messages {
+			s.nextID++
+			id := fmt.Sprint(s.nextID)
+			for _, sub := range subscriptions {
+				s.subscriptions[sub] = append(s.subscriptions[sub], &Message{ID: id, Data: m.Data})
+			}
+			ids = append(ids, id)
+		}
+		resp = map[string]interface{}{"messageIds": ids}
+
+	case method == "pull" && isSubscription:
+		now := time.Now()
+		received := []map[string]interface{}{}
+		for _, m := range messages {
+			if len(received) >= req.MaxMessages || now.Before(m.leaseUntil) {
+				continue
+			}
+			s.nextID++
+			m.ackID = fmt.Sprintf("ack-%d", s.nextID) // <= earlier deliveries can not acknowledge it
+			m.leaseUntil = now.Add(s.deadlines[name])
+			m.Deliveries++
+			received = append(received, map[string]interface{}{
+				"ackId":   m.ackID,
+				"message": map[string]interface{}{"messageId": m.ID, "data": m.Data},
+			})
+		}
+		resp = map[string]interface{}{"receivedMessages": received}
+
+	case method == "acknowledge" && isSubscription:
+		var kept []*Message
+		for _, m := range messages {
+			if !contains(req.AckIds, m.ackID) {
+				kept = append(kept, m)
+			}
+		}
+		s.subscriptions[name] = kept
+		resp = map[string]interface{}{}
+
+	case method == "modifyAckDeadline" && isSubscription:
+		for _, m := range messages {
+			if contains(req.AckIds, m.ackID) {
+				m.leaseUntil = time.Now().Add(time.Duration(req.AckDeadlineSeconds) * time.Second)
+			}
+		}
+		resp = map[string]interface{}{}
+
+	default:
+		http.Error(w, `{"error":{"code":404,"message":"resource not found"}}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,972 @@
+package testsupport
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Object struct {
+	Bucket          string
+	Name            string
+	Content         []byte
+	ContentType     string
+	ContentEncoding string // <= "gzip" objects are decompressed unless client accepts gzip
+	Metadata        map[string]string
+	Generation      int64 // <= assigned by server
+	Metageneration  int64
+	ComponentCount  int64  // <= composite object, has no MD5
+	EncryptionKey   []byte // <= customer-supplied key, media requests must send it
+	EventBasedHold  bool   // <= holds and retention refuse overwrite and deletion
+	TemporaryHold   bool
+	RetentionMode   string
+	RetainUntil     time.Time
+	CustomTime      time.Time         // <= zero when object has none
+	ACL             map[string]string // <= entity => role of object access controls
+	Created         time.Time
+	Updated         time.Time
+}
+
+type Fault struct {
+	Method string // <= empty matches any method
+	Path   string // <= substring of request path
+	Code   int
+	Times  int
+}
+
+type Server struct {
+	URL            string
+	BytesPerSecond int64               // <= throttles media downloads, 0 means unlimited
+	RewriteChunk   int64               // <= bytes copied per rewrite call, 0 copies at once
+	Folders        map[string][]string // <= HNS folders by bucket, buckets without entry are flat
+	Token          string              // <= required bearer token, empty accepts any request
+	Permissions    map[string][]string // <= granted permissions by bucket, buckets without entry grant all
+	Versioned      map[string]bool     // <= buckets keeping replaced and deleted objects as noncurrent generations
+	RequesterPays  map[string]bool     // <= buckets refusing requests without billed user project
+
+	mu         sync.Mutex
+	srv        *httptest.Server
+	generation int64
+	objects    map[string]map[string]*Object // <= bucket => name => object
+	noncurrent map[string][]*Object          // <= older generations by bucket, listed with versions=true
+	faults     []*Fault
+	truncate   map[string]int64
+	stall      map[string]int // <= media responses of object hanging until request is canceled
+	corrupt    map[string]int // <= media responses of object with flipped byte and without hashes
+	requests   []string
+	active     int // <= media responses in progress
+	maxActive  int
+}
+
+/*
+	Start in-memory server speaking subset of GCS JSON and media APIs used by gcs-cp
+*/
+func NewServer() *Server {
+	s := &Server{
+		generation: 1000,
+		objects:    map[string]map[string]*Object{},
+		noncurrent: map[string][]*Object{},
+		truncate:   map[string]int64{},
+		stall:      map[string]int{},
+		corrupt:    map[string]int{},
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.srv.URL
+
+	return s
+}
+
+/*
+	Shutdown server
+*/
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+/*
+	JSON API endpoint, suitable for STORAGE_EMULATOR_HOST
+*/
+func (s *Server) Endpoint() string {
+	return s.URL + "/storage/v1/"
+}
+
+/*
+	Create empty bucket
+*/
+func (s *Server) CreateBucket(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.objects[name] == nil {
+		s.objects[name] = map[string]*Object{}
+	}
+}
+
+/*
+	Store object, bucket is created if needed, replaced object gets new generation
+*/
+func (s *Server) PutObject(obj Object) *Object {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.putLocked(obj)
+}
+
+func (s *Server) putLocked(obj Object) *Object {
+	if s.objects[obj.Bucket] == nil {
+		s.objects[obj.Bucket] = map[string]*Object{}
+	}
+
+	s.generation++
+	now := time.Now().UTC()
+	obj.Generation = s.generation
+	obj.Metageneration = 1
+	if obj.Created.IsZero() {
+		obj.Created = now
+	}
+	if obj.Updated.IsZero() {
+		obj.Updated = obj.Created
+	}
+	if obj.ContentType == "" {
+		obj.ContentType = "application/octet-stream"
+	}
+	if prev := s.objects[obj.Bucket][obj.Name]; prev != nil && s.Versioned[obj.Bucket] {
+		s.noncurrent[obj.Bucket] = append(s.noncurrent[obj.Bucket], prev)
+	}
+	s.objects[obj.Bucket][obj.Name] = &obj
+
+	return &obj
+}
+
+/*
+	Store plain object
+*/
+func (s *Server) Put(bucket, name string, content []byte) *Object {
+	return s.PutObject(Object{Bucket: bucket, Name: name, Content: content})
+}
+
+/*
+	Seed bucket with fixtures: object name => content
+*/
+func (s *Server) Seed(bucket string, fixtures map[string]string) {
+	s.CreateBucket(bucket)
+	for name, content := range fixtures {
+		s.Put(bucket, name, []byte(content))
+	}
+}
+
+/*
+	Fail next requests matching method and path substring with HTTP code
+*/
+func (s *Server) Fail(method, path string, code, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = append(s.faults, &Fault{Method: method, Path: path, Code: code, Times: times})
+}
+
+/*
+	Drop connection of next media response of object after n bytes
+*/
+func (s *Server) Truncate(bucket, name string, n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.truncate[bucket+"/"+name] = n
+}
+
+/*
+	Hang next media responses of object until client gives up, e.g. to simulate straggler
+*/
+func (s *Server) Stall(bucket, name string, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stall[bucket+"/"+name] = times
+}
+
+/*
+	Flip first byte of next media responses of object, hashes are left out as by some proxies
+*/
+func (s *Server) Corrupt(bucket, name string, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.corrupt[bucket+"/"+name] = times
+}
+
+/*
+	Requests handled so far as "METHOD path"
+*/
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.requests...)
+}
+
+/*
+	Highest number of media responses served at the same time
+*/
+func (s *Server) MaxConcurrentMedia() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.maxActive
+}
+
+/*
+	Count handled requests with given method and path substring
+*/
+func (s *Server) CountRequests(method, path string) int {
+	n := 0
+	for _, r := range s.Requests() {
+		if strings.HasPrefix(r, method+" ") && strings.Contains(r, path) {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	for _, f := range s.faults {
+		if f.Times > 0 && (f.Method == "" || f.Method == r.Method) && strings.Contains(r.URL.Path, f.Path) {
+			f.Times--
+			s.mu.Unlock()
+			writeError(w, f.Code, "injected fault")
+			return
+		}
+	}
+	s.mu.Unlock()
+
+	if s.Token != "" && r.Header.Get("Authorization") != "Bearer "+s.Token {
+		writeError(w, http.StatusUnauthorized, "Invalid Credentials")
+		return
+	}
+
+	path := r.URL.EscapedPath()
+	if path == "/batch/storage/v1" && r.Method == http.MethodPost {
+		s.serveBatch(w, r)
+		return
+	}
+	if s.RequesterPays[requestBucket(path)] && r.URL.Query().Get("userProject") == "" && r.Header.Get("X-Goog-User-Project") == "" {
+		writeError(w, http.StatusBadRequest, "Bucket is a requester pays bucket but no user project provided.")
+		return
+	}
+	if strings.HasPrefix(path, "/storage/v1/b/") {
+		s.serveJSON(w, r, segments(strings.TrimPrefix(path, "/storage/v1/b/")))
+		return
+	}
+	// Storage client sets emulator host without "/storage/v1" as JSON endpoint after first upload
+	if strings.HasPrefix(path, "/b/") && r.URL.Query().Get("alt") == "json" {
+		s.serveJSON(w, r, segments(strings.TrimPrefix(path, "/b/")))
+		return
+	}
+	if strings.HasPrefix(path, "/upload/storage/v1/b/") {
+		s.serveUpload(w, r, segments(strings.TrimPrefix(path, "/upload/storage/v1/b/")))
+		return
+	}
+	s.serveMedia(w, r)
+}
+
+/*
+	Batch of JSON API requests in multipart/mixed body, each part is served like separate request
+*/
+func (s *Server) serveBatch(w http.ResponseWriter, r *http.Request) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || params["boundary"] == "" {
+		writeError(w, http.StatusBadRequest, "batch request is not multipart/mixed")
+		return
+	}
+
+	var body bytes.Buffer
+	out := multipart.NewWriter(&body)
+	parts := multipart.NewReader(r.Body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		req, err := http.ReadRequest(bufio.NewReader(part))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		req = req.WithContext(r.Context())
+		if req.Header.Get("Authorization") == "" {
+			req.Header.Set("Authorization", r.Header.Get("Authorization")) // <= parts are authorized by batch
+		}
+
+		rec := httptest.NewRecorder()
+		s.serveHTTP(rec, req)
+		id := strings.Trim(part.Header.Get("Content-ID"), "<>")
+		pw, err := out.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/http"}, "Content-Id": {"<response-" + id + ">"}})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		rec.Result().Write(pw)
+	}
+	out.Close()
+
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+out.Boundary())
+	w.Write(body.Bytes())
+}
+
+/*
+	Bucket of JSON, upload or media request path
+*/
+func requestBucket(path string) string {
+	for _, prefix := range []string{"/upload/storage/v1/b/", "/storage/v1/b/", "/b/", "/"} {
+		if strings.HasPrefix(path, prefix) {
+			return segments(strings.TrimPrefix(path, prefix))[0]
+		}
+	}
+
+	return ""
+}
+
+func segments(p string) []string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		if v, err := url.PathUnescape(part); err == nil {
+			parts[i] = v
+		}
+	}
+
+	return parts
+}
+
+func (s *Server) serveJSON(w http.ResponseWriter, r *http.Request, seg []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket := seg[0]
+	objects, ok := s.objects[bucket]
+	if !ok {
+		writeError(w, http.StatusNotFound, "The specified bucket does not exist.")
+		return
+	}
+
+	switch {
+	case len(seg) == 1:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"kind": "storage#bucket", "name": bucket})
+	case len(seg) == 2 && seg[1] == "o":
+		s.list(w, bucket, r.URL.Query())
+	case len(seg) == 2 && (seg[1] == "folders" || seg[1] == "managedFolders"):
+		folders, ok := s.Folders[bucket]
+		if !ok && seg[1] == "folders" {
+			writeError(w, http.StatusBadRequest, "The bucket does not support hierarchical namespace.")
+			return
+		}
+		var items []interface{}
+		for _, name := range folders {
+			if seg[1] == "folders" && strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+				items = append(items, map[string]interface{}{"bucket": bucket, "name": name})
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"kind": "storage#" + seg[1], "items": items})
+	case len(seg) == 3 && seg[1] == "iam" && seg[2] == "testPermissions":
+		requested := r.URL.Query()["permissions"]
+		granted, ok := s.Permissions[bucket]
+		if !ok {
+			granted = requested
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"kind": "storage#testIamPermissionsResponse", "permissions": granted})
+	case len(seg) == 3 && seg[1] == "o":
+		// Generation of deleted object is still readable in versioned bucket
+		obj := s.generationLocked(bucket, seg[2], r.URL.Query().Get("generation"))
+		if obj == nil || r.Method != http.MethodGet && obj != objects[seg[2]] {
+			writeError(w, http.StatusNotFound, "No such object: "+bucket+"/"+seg[2])
+			return
+		}
+		switch r.Method {
+		case http.MethodDelete:
+			if reason := obj.protection(); reason != "" {
+				writeError(w, http.StatusForbidden, reason)
+				return
+			}
+			if s.Versioned[bucket] {
+				s.noncurrent[bucket] = append(s.noncurrent[bucket], obj)
+			}
+			delete(objects, seg[2])
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case http.MethodPatch:
+			s.patch(w, r, obj)
+			return
+		}
+		writeJSON(w, http.StatusOK, objectJSON(obj))
+	case len(seg) == 4 && seg[1] == "o" && seg[3] == "acl":
+		obj := s.generationLocked(bucket, seg[2], r.URL.Query().Get("generation"))
+		if obj == nil {
+			writeError(w, http.StatusNotFound, "No such object: "+bucket+"/"+seg[2])
+			return
+		}
+		entities := make([]string, 0, len(obj.ACL))
+		for entity := range obj.ACL {
+			entities = append(entities, entity)
+		}
+		sort.Strings(entities)
+		items := []interface{}{}
+		for _, entity := range entities {
+			items = append(items, map[string]interface{}{"kind": "storage#objectAccessControl", "entity": entity, "role": obj.ACL[entity]})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"kind": "storage#objectAccessControls", "items": items})
+	case len(seg) == 8 && seg[1] == "o" && seg[3] == "rewriteTo" && seg[4] == "b" && seg[6] == "o":
+		s.rewrite(w, r, objects[seg[2]], seg[5], seg[7])
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+/*
+	Live object or requested generation of it, replaced generations are gone unless bucket is versioned
+*/
+func (s *Server) generationLocked(bucket, name, generation string) *Object {
+	obj := s.objects[bucket][name]
+	if generation == "" || obj != nil && generation == strconv.FormatInt(obj.Generation, 10) {
+		return obj
+	}
+	for _, old := range s.noncurrent[bucket] {
+		if old.Name == name && generation == strconv.FormatInt(old.Generation, 10) {
+			return old
+		}
+	}
+
+	return nil
+}
+
+/*
+	Update holds and retention of object
+*/
+func (s *Server) patch(w http.ResponseWriter, r *http.Request, obj *Object) {
+	if match := r.URL.Query().Get("ifGenerationMatch"); match != "" && match != strconv.FormatInt(obj.Generation, 10) {
+		writeError(w, http.StatusPreconditionFailed, "At least one of the pre-conditions you specified did not hold.")
+		return
+	}
+
+	var patch struct {
+		EventBasedHold *bool `json:"eventBasedHold"`
+		TemporaryHold  *bool `json:"temporaryHold"`
+		Retention      *struct {
+			Mode            string    `json:"mode"`
+			RetainUntilTime time.Time `json:"retainUntilTime"`
+		} `json:"retention"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if patch.EventBasedHold != nil {
+		obj.EventBasedHold = *patch.EventBasedHold
+	}
+	if patch.TemporaryHold != nil {
+		obj.TemporaryHold = *patch.TemporaryHold
+	}
+	if patch.Retention != nil {
+		if obj.RetentionMode == "Locked" && patch.Retention.RetainUntilTime.Before(obj.RetainUntil) {
+			writeError(w, http.StatusForbidden, "Locked retention can not be shortened.")
+			return
+		}
+		obj.RetentionMode, obj.RetainUntil = patch.Retention.Mode, patch.Retention.RetainUntilTime
+	}
+	obj.Metageneration++
+
+	writeJSON(w, http.StatusOK, objectJSON(obj))
+}
+
+/*
+	Reason why object can not be overwritten or deleted, empty if it can
+*/
+func (o *Object) protection() string {
+	name := o.Bucket + "/" + o.Name
+	switch {
+	case o.EventBasedHold:
+		return "Object '" + name + "' is under active Event-Based hold and cannot be deleted, overwritten or archived until hold is removed."
+	case o.TemporaryHold:
+		return "Object '" + name + "' is under active Temporary hold and cannot be deleted, overwritten or archived until hold is removed."
+	case time.Now().Before(o.RetainUntil):
+		return "Object '" + name + "' is subject to object retention and cannot be deleted, overwritten or archived until " + o.RetainUntil.Format(time.RFC3339)
+	}
+
+	return ""
+}
+
+/*
+	Server-side copy, with RewriteChunk set it takes several calls continued by rewrite token
+*/
+func (s *Server) rewrite(w http.ResponseWriter, r *http.Request, src *Object, bucket, name string) {
+	q := r.URL.Query()
+	if src == nil || (q.Get("sourceGeneration") != "" && q.Get("sourceGeneration") != strconv.FormatInt(src.Generation, 10)) {
+		writeError(w, http.StatusNotFound, "No such object")
+		return
+	}
+	if _, ok := s.objects[bucket]; !ok {
+		writeError(w, http.StatusNotFound, "The specified bucket does not exist.")
+		return
+	}
+	if prev, ok := s.objects[bucket][name]; ok && prev.protection() != "" {
+		writeError(w, http.StatusForbidden, prev.protection())
+		return
+	}
+
+	size := int64(len(src.Content))
+	copied := size
+	if s.RewriteChunk > 0 {
+		done, _ := strconv.ParseInt(q.Get("rewriteToken"), 10, 64)
+		if copied = done + s.RewriteChunk; copied < size {
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"kind":                "storage#rewriteResponse",
+				"totalBytesRewritten": strconv.FormatInt(copied, 10),
+				"objectSize":          strconv.FormatInt(size, 10),
+				"done":                false,
+				"rewriteToken":        strconv.FormatInt(copied, 10),
+			})
+			return
+		}
+	}
+
+	obj := s.putLocked(Object{Bucket: bucket, Name: name, Content: src.Content, ContentType: src.ContentType, Metadata: src.Metadata})
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"kind":                "storage#rewriteResponse",
+		"totalBytesRewritten": strconv.FormatInt(size, 10),
+		"objectSize":          strconv.FormatInt(size, 10),
+		"done":                true,
+		"resource":            objectJSON(obj),
+	})
+}
+
+func (s *Server) list(w http.ResponseWriter, bucket string, q url.Values) {
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+
+	var matched []*Object
+	for name, obj := range s.objects[bucket] {
+		if strings.HasPrefix(name, prefix) {
+			matched = append(matched, obj)
+		}
+	}
+	if q.Get("versions") == "true" {
+		for _, obj := range s.noncurrent[bucket] {
+			if strings.HasPrefix(obj.Name, prefix) {
+				matched = append(matched, obj)
+			}
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		if matched[i].Name != matched[j].Name {
+			return matched[i].Name < matched[j].Name
+		}
+		return matched[i].Generation < matched[j].Generation
+	})
+
+	var items []interface{}
+	var prefixes []string
+	seen := map[string]bool{}
+	for _, obj := range matched {
+		name := obj.Name
+		if delimiter != "" {
+			rest := strings.TrimPrefix(name, prefix)
+			if i := strings.Index(rest, delimiter); i >= 0 {
+				p := prefix + rest[:i+len(delimiter)]
+				if !seen[p] {
+					seen[p] = true
+					prefixes = append(prefixes, p)
+				}
+				continue
+			}
+		}
+		items = append(items, objectJSON(obj))
+	}
+
+	// Page token is offset of first item, prefixes are sent with first page
+	start, _ := strconv.Atoi(q.Get("pageToken"))
+	if start > len(items) {
+		start = len(items)
+	}
+	resp := map[string]interface{}{"kind": "storage#objects"}
+	end := len(items)
+	if max, _ := strconv.Atoi(q.Get("maxResults")); max > 0 && start+max < end {
+		end = start + max
+		resp["nextPageToken"] = strconv.Itoa(end)
+	}
+	if start < end {
+		resp["items"] = items[start:end]
+	}
+	if start == 0 && len(prefixes) > 0 {
+		resp["prefixes"] = prefixes
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+/*
+	Serve object data at /{bucket}/{object}, as requested by storage client readers
+*/
+func (s *Server) serveMedia(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) != 2 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	bucket, name := parts[0], parts[1]
+
+	s.mu.Lock()
+	obj := s.generationLocked(bucket, name, r.URL.Query().Get("generation"))
+	limit, truncated := s.truncate[bucket+"/"+name]
+	delete(s.truncate, bucket+"/"+name)
+	stalled := s.stall[bucket+"/"+name] > 0
+	if stalled {
+		s.stall[bucket+"/"+name]--
+	}
+	corrupted := s.corrupt[bucket+"/"+name] > 0
+	if corrupted {
+		s.corrupt[bucket+"/"+name]--
+	}
+	s.mu.Unlock()
+
+	if obj == nil {
+		writeError(w, http.StatusNotFound, "No such object: "+bucket+"/"+name)
+		return
+	}
+	if stalled {
+		<-r.Context().Done()
+		return
+	}
+
+	s.mu.Lock()
+	s.active++
+	if s.active > s.maxActive {
+		s.maxActive = s.active
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.active--
+		s.mu.Unlock()
+	}()
+	if match := r.URL.Query().Get("ifGenerationMatch"); match != "" && match != strconv.FormatInt(obj.Generation, 10) {
+		writeError(w, http.StatusPreconditionFailed, "At least one of the pre-conditions you specified did not hold.")
+		return
+	}
+	if len(obj.EncryptionKey) > 0 && r.Header.Get("X-Goog-Encryption-Key") != base64.StdEncoding.EncodeToString(obj.EncryptionKey) {
+		writeError(w, http.StatusBadRequest, "The target object is encrypted by a customer-supplied encryption key.")
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", obj.ContentType)
+	h.Set("X-Goog-Generation", strconv.FormatInt(obj.Generation, 10))
+	h.Set("X-Goog-Metageneration", strconv.FormatInt(obj.Metageneration, 10))
+	h.Set("X-Goog-Hash", "crc32c="+crc32cString(obj.Content)+",md5="+md5String(obj.Content))
+	h.Set("Last-Modified", obj.Updated.Format(http.TimeFormat))
+
+	// Decompressive transcoding serves whole object, hashes still describe stored data
+	content := obj.Content
+	transcoded := false
+	if obj.ContentEncoding == "gzip" {
+		h.Set("X-Goog-Stored-Content-Encoding", "gzip")
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			h.Set("Content-Encoding", "gzip")
+		} else {
+			gz, err := gzip.NewReader(bytes.NewReader(obj.Content))
+			if err == nil {
+				content, err = io.ReadAll(gz)
+			}
+			if err != nil {
+				writeError(w, http.StatusServiceUnavailable, "object can not be decompressed")
+				return
+			}
+			transcoded = true
+		}
+	}
+
+	size := int64(len(content))
+	start, end := int64(0), size-1
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); strings.HasPrefix(rng, "bytes=") && !transcoded {
+		bounds := strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)
+		if bounds[0] == "" {
+			n, _ := strconv.ParseInt(bounds[1], 10, 64)
+			if start = size - n; start < 0 {
+				start = 0
+			}
+		} else {
+			start, _ = strconv.ParseInt(bounds[0], 10, 64)
+			if len(bounds) == 2 && bounds[1] != "" {
+				end, _ = strconv.ParseInt(bounds[1], 10, 64)
+			}
+		}
+		if end >= size {
+			end = size - 1
+		}
+		if start >= size && size > 0 {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "range not satisfiable")
+			return
+		}
+		status = http.StatusPartialContent
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+		h.Del("X-Goog-Hash") // <= hashes describe whole object
+	}
+
+	body := content[start : end+1]
+	if corrupted && len(body) > 0 {
+		body = append([]byte{body[0] ^ 0xff}, body[1:]...)
+		h.Del("X-Goog-Hash")
+	}
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	if truncated && limit < int64(len(body)) {
+		w.Write(body[:limit])
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		// Closed connection is observed by client as unexpected EOF
+		if hj, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				conn.Close()
+			}
+		}
+		return
+	}
+
+	writeThrottled(w, r, body, s.BytesPerSecond)
+}
+
+/*
+	Write body in chunks of 1/10 of rate per 100ms, stops when client goes away
+*/
+/*
+	Multipart object upload, checksums sent with metadata are verified like GCS does
+*/
+func (s *Server) serveUpload(w http.ResponseWriter, r *http.Request, seg []string) {
+	if r.Method != http.MethodPost || len(seg) != 2 || seg[1] != "o" || r.URL.Query().Get("uploadType") != "multipart" {
+		writeError(w, http.StatusNotImplemented, "only multipart uploads are supported")
+		return
+	}
+
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+
+	var meta struct {
+		Name            string            `json:"name"`
+		ContentType     string            `json:"contentType"`
+		ContentEncoding string            `json:"contentEncoding"`
+		Metadata        map[string]string `json:"metadata"`
+		CRC32C          string            `json:"crc32c"`
+		MD5Hash         string            `json:"md5Hash"`
+		EventBasedHold  bool              `json:"eventBasedHold"`
+		TemporaryHold   bool              `json:"temporaryHold"`
+		CustomTime      time.Time         `json:"customTime"`
+	}
+	part, err := mr.NextPart()
+	if err == nil {
+		err = json.NewDecoder(part).Decode(&meta)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "metadata part: "+err.Error())
+		return
+	}
+
+	var content []byte
+	if part, err = mr.NextPart(); err == nil {
+		content, err = io.ReadAll(part)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "media part: "+err.Error())
+		return
+	}
+	if meta.ContentType == "" {
+		meta.ContentType = part.Header.Get("Content-Type")
+	}
+
+	if meta.CRC32C != "" && meta.CRC32C != crc32cString(content) {
+		writeError(w, http.StatusBadRequest, "Provided CRC32C \""+meta.CRC32C+"\" doesn't match calculated CRC32C \""+crc32cString(content)+"\".")
+		return
+	}
+	if meta.MD5Hash != "" && meta.MD5Hash != md5String(content) {
+		writeError(w, http.StatusBadRequest, "Provided MD5 hash \""+meta.MD5Hash+"\" doesn't match calculated MD5 hash \""+md5String(content)+"\".")
+		return
+	}
+	if name := r.URL.Query().Get("name"); name != "" {
+		meta.Name = name
+	}
+	// Customer-supplied key encrypts new object, later reads must send it
+	key, err := base64.StdEncoding.DecodeString(r.Header.Get("X-Goog-Encryption-Key"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid encryption key.")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	objects, ok := s.objects[seg[0]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "The specified bucket does not exist.")
+		return
+	}
+	if prev, ok := objects[meta.Name]; ok && prev.protection() != "" {
+		writeError(w, http.StatusForbidden, prev.protection())
+		return
+	}
+
+	obj := s.putLocked(Object{
+		Bucket:          seg[0],
+		Name:            meta.Name,
+		Content:         content,
+		ContentType:     meta.ContentType,
+		ContentEncoding: meta.ContentEncoding,
+		Metadata:        meta.Metadata,
+		EventBasedHold:  meta.EventBasedHold,
+		TemporaryHold:   meta.TemporaryHold,
+		CustomTime:      meta.CustomTime,
+		EncryptionKey:   key,
+	})
+	writeJSON(w, http.StatusOK, objectJSON(obj))
+}
+
+/*
+	Stored object, nil if it does not exist
+*/
+func (s *Server) Object(bucket, name string) *Object {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.objects[bucket][name]
+}
+
+func writeThrottled(w http.ResponseWriter, r *http.Request, body []byte, bps int64) {
+	if bps <= 0 {
+		w.Write(body)
+		return
+	}
+
+	chunk := int(bps / 10)
+	if chunk < 1 {
+		chunk = 1
+	}
+	for len(body) > 0 {
+		n := chunk
+		if n > len(body) {
+			n = len(body)
+		}
+		if _, err := w.Write(body[:n]); err != nil {
+			return
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		body = body[n:]
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func objectJSON(o *Object) map[string]interface{} {
+	m := map[string]interface{}{
+		"kind":           "storage#object",
+		"id":             fmt.Sprintf("%s/%s/%d", o.Bucket, o.Name, o.Generation),
+		"bucket":         o.Bucket,
+		"name":           o.Name,
+		"size":           strconv.Itoa(len(o.Content)),
+		"contentType":    o.ContentType,
+		"generation":     strconv.FormatInt(o.Generation, 10),
+		"metageneration": strconv.FormatInt(o.Metageneration, 10),
+		"storageClass":   "STANDARD",
+		"timeCreated":    o.Created.Format(time.RFC3339Nano),
+		"updated":        o.Updated.Format(time.RFC3339Nano),
+		"crc32c":         crc32cString(o.Content),
+		"md5Hash":        md5String(o.Content),
+		"etag":           fmt.Sprintf("E%d", o.Generation),
+	}
+	if len(o.Metadata) > 0 {
+		m["metadata"] = o.Metadata
+	}
+	if o.ContentEncoding != "" {
+		m["contentEncoding"] = o.ContentEncoding
+	}
+	if o.EventBasedHold {
+		m["eventBasedHold"] = true
+	}
+	if o.TemporaryHold {
+		m["temporaryHold"] = true
+	}
+	if !o.CustomTime.IsZero() {
+		m["customTime"] = o.CustomTime.Format(time.RFC3339Nano)
+	}
+	if !o.RetainUntil.IsZero() {
+		m["retention"] = map[string]interface{}{"mode": o.RetentionMode, "retainUntilTime": o.RetainUntil.Format(time.RFC3339)}
+	}
+	if o.ComponentCount > 0 {
+		m["componentCount"] = o.ComponentCount
+		delete(m, "md5Hash")
+	}
+
+	return m
+}
+
+func crc32cString(b []byte) string {
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.Checksum(b, crc32.MakeTable(crc32.Castagnoli)))
+
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func md5String(b []byte) string {
+	sum := md5.Sum(b)
+
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+			"errors":  []interface{}{map[string]interface{}{"message": message, "reason": http.StatusText(code)}},
+		},
+	})
+}
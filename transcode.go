@@ -0,0 +1,55 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"cloud.google.com/go/storage"
+)
+
+/*
+	Decompress stored gzip data into file, concatenated members are decompressed one after another
+*/
+func copyDecompressed(dst io.Writer, src io.Reader, buf []byte) (int64, error) {
+	gz, err := gzip.NewReader(src)
+	if err != nil {
+		return 0, fmt.Errorf("gzip.NewReader: %w", err)
+	}
+	defer gz.Close()
+
+	written, err := io.CopyBuffer(dst, gz, buf)
+	if err != nil {
+		return written, fmt.Errorf("gzip.Reader: %w", err)
+	}
+
+	return written, nil
+}
+
+/*
+	Compare local file with decompressed data of stored gzip object, sizes and checksums of object are of stored data
+*/
+func (s *Storage) sameDecompressed(ctx context.Context, f *os.File, attrs *storage.ObjectAttrs, buf []byte) (bool, error) {
+	local := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	size, err := io.CopyBuffer(local, f, buf)
+	if err != nil {
+		return false, fmt.Errorf("io.CopyBuffer: %w", err)
+	}
+
+	r, err := s.Bucket(attrs.Bucket).Object(attrs.Name).Generation(attrs.Generation).ReadCompressed(true).NewReader(ctx)
+	if err != nil {
+		return false, fmt.Errorf("Object(%q).NewReader: %w", attrs.Name, err)
+	}
+	defer r.Close()
+
+	remote := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	written, err := copyDecompressed(remote, r, buf)
+	if err != nil {
+		return false, err
+	}
+
+	return written == size && local.Sum32() == remote.Sum32(), nil
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+type Transfer struct {
+	Bucket      string
+	Object      string
+	Generation  int64  // <= exact generation of versioned source URL, 0 reads live object
+	Destination string // <= local file path
+	MD5         []byte // <= expected checksums, empty when unknown
+	CRC32C      []byte
+	Attrs       *storage.ObjectAttrs // <= listing attributes, nil for manifest entries
+	Directory   bool                 // <= folder placeholder materialized as empty directory
+
+	hedgeOf *Transfer // <= set for second attempt of straggler, written to staging destination
+}
+
+type ManifestEntry struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination,omitempty"`
+	MD5         string `json:"md5,omitempty"`
+	CRC32C      string `json:"crc32c,omitempty"`
+}
+
+type checksumWriter struct {
+	transfer *Transfer
+	md5      hash.Hash
+	crc32c   hash.Hash32
+}
+
+/*
+	Source URL of transfer, also used as its key
+*/
+func (t *Transfer) URI() string {
+	return fmt.Sprintf("gs://%s/%s", t.Bucket, t.Object)
+}
+
+/*
+	Key of in-flight progress, second attempt of straggler is tracked separately
+*/
+func (t *Transfer) statusKey() string {
+	if t.hedgeOf != nil {
+		return t.URI() + " (hedge)"
+	}
+
+	return t.URI()
+}
+
+/*
+	Destination recorded in state, staging file of second attempt is renamed to it
+*/
+func (t *Transfer) stateKey() string {
+	if t.hedgeOf != nil {
+		return t.hedgeOf.Destination
+	}
+
+	return t.Destination
+}
+
+/*
+	Plan transfers from manifest, interactive selection or source listing
+*/
+func (s *Storage) Plan() ([]*Transfer, error) {
+	// Interactive mode checks destination once it is entered
+	if s.Config.Command != "browse" {
+		if err := s.CheckDestination(); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.Config.Manifest != "" {
+		return LoadManifest(s.Config.Manifest, s.Config.DestinationPath, s.Config.AllowEscape)
+	}
+
+	var objects []*storage.ObjectAttrs
+	var err error
+	attempt := 1
+
+	switch {
+	case s.Config.InputList != "":
+		attempt, err = s.Retry(s.Config.InputList, func() error {
+			objects, err = s.ReadInputList(s.Config.InputList)
+			return err
+		})
+	case s.Config.Command == "browse":
+		if objects, err = s.Browse(os.Stdin); err == nil && len(objects) > 0 {
+			if err := s.CheckDestination(); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		if err := s.CheckAccess(s.Config.BucketName, permList, permGet); err != nil {
+			return nil, err
+		}
+		attempt, err = s.Retry(s.Config.Uri, func() error {
+			objects, err = s.ListObjects()
+			return err
+		})
+	}
+	if err != nil {
+		source := s.Config.Uri
+		if s.Config.InputList != "" {
+			source = s.Config.InputList
+		}
+		return nil, &TransferError{Object: source, Attempt: attempt, Err: err}
+	}
+
+	transfers, err := s.NewTransfers(objects)
+	if err != nil {
+		return nil, err
+	}
+
+	// Prefix must name exactly one object, condition of one version does not fit others
+	if s.Config.IfGenerationMatch != 0 {
+		if len(transfers) != 1 || transfers[0].Object != s.Config.Prefix {
+			return nil, fmt.Errorf("-if-generation-match needs URL of single object, %d objects matched %s", len(transfers), s.Config.Uri)
+		}
+	}
+	// Data of several objects on stdout could not be told apart
+	if s.Config.Sink == stdoutSink {
+		files := 0
+		for _, t := range transfers {
+			if !t.Directory {
+				files++
+			}
+		}
+		if files != 1 {
+			return nil, fmt.Errorf("destination \"-\" streams single object to stdout, %d objects matched %s", files, s.Config.Uri)
+		}
+	}
+
+	return transfers, nil
+}
+
+/*
+	Plan transfers of listed objects into destination path
+*/
+func (s *Storage) NewTransfers(objects []*storage.ObjectAttrs) ([]*Transfer, error) {
+	transfers := make([]*Transfer, 0, len(objects))
+	destinations := map[string]int{} // <= destination => index of transfer
+
+	for _, attrs := range objects {
+		// Zero-byte "folder/" objects are created by consoles and other tools as folder markers
+		placeholder := attrs.Size == 0 &&
+			(strings.HasSuffix(attrs.Name, "/") || strings.HasSuffix(attrs.Name, hadoopFolderSuffix))
+		if placeholder && !s.Config.CreateEmptyDirs {
+			continue
+		}
+
+		name := strings.TrimSuffix(attrs.Name, hadoopFolderSuffix)
+		name = applyNameCase(s.Config.Rename.Apply(name), s.Config.NameCase)
+		if s.Config.Flatten {
+			name = path.Base(name)
+		}
+		if s.Config.DateLayout != "" {
+			partition, err := datePartition(attrs, s.Config.DateLayout)
+			if err != nil {
+				return nil, err
+			}
+			name = filepath.Join(partition, name)
+		}
+
+		// Object names come from bucket and may try to escape destination
+		destination, err := safeJoin(s.Config.DestinationPath, name, s.Config.AllowEscape)
+		if err != nil {
+			return nil, err
+		}
+
+		t := &Transfer{
+			Bucket:      attrs.Bucket,
+			Object:      attrs.Name,
+			Generation:  s.Config.Generation,
+			Destination: destination,
+			Attrs:       attrs,
+			Directory:   placeholder,
+		}
+
+		// Rename rules and case transform may map different objects to same file
+		if i, ok := destinations[t.Destination]; ok {
+			prev := transfers[i]
+			switch s.Config.OnConflict {
+			case "skip":
+				console.Printf("Skipping %s: destination %s is used by %s\n", attrs.Name, t.Destination, prev.Object)
+				continue
+			case "overwrite":
+				console.Printf("Replacing %s with %s: both have destination %s\n", prev.Object, attrs.Name, t.Destination)
+				transfers[i] = t
+				continue
+			case "rename", "rename-hash":
+				t.Destination = conflictName(t.Destination, attrs.Name, s.Config.OnConflict, destinations)
+				console.Printf("Renaming %s => %s: destination is used by %s\n", attrs.Name, t.Destination, prev.Object)
+			default:
+				return nil, fmt.Errorf("objects %s and %s have same destination %s (see -on-conflict)",
+					prev.Object, attrs.Name, t.Destination)
+			}
+		}
+		destinations[t.Destination] = len(transfers)
+		transfers = append(transfers, t)
+	}
+
+	return transfers, nil
+}
+
+/*
+	Find free destination with suffix before extension: numeric ("a-1.txt") or object name hash ("a-5d41402a.txt")
+*/
+func conflictName(destination, object, policy string, used map[string]int) string {
+	ext := filepath.Ext(destination)
+	base := strings.TrimSuffix(destination, ext)
+
+	if policy == "rename-hash" {
+		// Same object gets same name in every run
+		sum := sha1.Sum([]byte(object))
+		name := fmt.Sprintf("%s-%x%s", base, sum[:4], ext)
+		if _, ok := used[name]; !ok {
+			return name
+		}
+	}
+
+	for n := 1; ; n++ {
+		name := fmt.Sprintf("%s-%d%s", base, n, ext)
+		if _, ok := used[name]; !ok {
+			return name
+		}
+	}
+}
+
+/*
+	Load transfers plan from CSV or JSON manifest, relative destinations are resolved against base path
+*/
+func LoadManifest(path, base string, allowEscape bool) ([]*Transfer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile: %w", err)
+	}
+
+	var entries []ManifestEntry
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal: %w", err)
+		}
+	} else if entries, err = parseManifestCSV(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("manifest has no entries: %s", path)
+	}
+
+	transfers := make([]*Transfer, 0, len(entries))
+	destinations := map[string]string{}
+
+	for i, entry := range entries {
+		t, err := entry.Transfer(base, allowEscape)
+		if err != nil {
+			return nil, fmt.Errorf("manifest %s entry %d: %w", path, i+1, err)
+		}
+		if prev, ok := destinations[t.Destination]; ok {
+			return nil, fmt.Errorf("manifest %s entry %d: destination %s is already used by %s", path, i+1, t.Destination, prev)
+		}
+		destinations[t.Destination] = t.URI()
+		transfers = append(transfers, t)
+	}
+
+	return transfers, nil
+}
+
+/*
+	Parse manifest rows: source,destination[,md5[,crc32c]]
+*/
+func parseManifestCSV(r io.Reader) ([]ManifestEntry, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("csv.ReadAll: %w", err)
+	}
+
+	var entries []ManifestEntry
+	for i, record := range records {
+		// Optional header row
+		if i == 0 && strings.EqualFold(record[0], "source") {
+			continue
+		}
+
+		fields := make([]string, 4)
+		copy(fields, record)
+		entries = append(entries, ManifestEntry{
+			Source:      fields[0],
+			Destination: fields[1],
+			MD5:         fields[2],
+			CRC32C:      fields[3],
+		})
+	}
+
+	return entries, nil
+}
+
+/*
+	Validate manifest entry and convert it to transfer, destinations given in manifest are trusted
+*/
+func (e ManifestEntry) Transfer(base string, allowEscape bool) (*Transfer, error) {
+	bucket, object, err := parseGCSUrl(strings.TrimSpace(e.Source))
+	if err != nil {
+		return nil, err
+	}
+	if object == "" || strings.HasSuffix(object, "/") {
+		return nil, fmt.Errorf("source must be an object: %s", e.Source)
+	}
+
+	destination := strings.TrimSpace(e.Destination)
+	switch {
+	case destination == "":
+		if destination, err = safeJoin(base, object, allowEscape); err != nil {
+			return nil, err
+		}
+	case strings.HasPrefix(destination, "~"):
+		if destination, err = normalizePath(destination); err != nil {
+			return nil, err
+		}
+	case !filepath.IsAbs(destination):
+		destination = filepath.Join(base, destination)
+	}
+
+	t := &Transfer{Bucket: bucket, Object: object, Destination: destination}
+	if t.MD5, err = decodeChecksum(e.MD5, md5.Size); err != nil {
+		return nil, fmt.Errorf("md5: %w", err)
+	}
+	if t.CRC32C, err = decodeChecksum(e.CRC32C, crc32.Size); err != nil {
+		return nil, fmt.Errorf("crc32c: %w", err)
+	}
+
+	return t, nil
+}
+
+/*
+	Decode hex or base64 (as shown by gsutil) checksum value
+*/
+func decodeChecksum(value string, size int) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+
+	sum, err := hex.DecodeString(value)
+	if err != nil || len(sum) != size {
+		sum, err = base64.StdEncoding.DecodeString(value)
+	}
+	if err != nil || len(sum) != size {
+		return nil, fmt.Errorf("invalid checksum value: %s", value)
+	}
+
+	return sum, nil
+}
+
+/*
+	Create writer computing checksums expected by transfer, nil if there are none
+*/
+func newChecksumWriter(t *Transfer) *checksumWriter {
+	if len(t.MD5) == 0 && len(t.CRC32C) == 0 {
+		return nil
+	}
+
+	return &checksumWriter{
+		transfer: t,
+		md5:      md5.New(),
+		crc32c:   crc32.New(crc32.MakeTable(crc32.Castagnoli)),
+	}
+}
+
+func (w *checksumWriter) Write(b []byte) (int, error) {
+	w.md5.Write(b)
+	w.crc32c.Write(b)
+
+	return len(b), nil
+}
+
+/*
+	Compare written data with expected checksums
+*/
+func (w *checksumWriter) Verify() error {
+	if md5sum := w.md5.Sum(nil); len(w.transfer.MD5) > 0 && !bytes.Equal(md5sum, w.transfer.MD5) {
+		return fmt.Errorf("%w: md5 of %s is %s, expected %s", ErrChecksumMismatch, w.transfer.URI(),
+			base64.StdEncoding.EncodeToString(md5sum), base64.StdEncoding.EncodeToString(w.transfer.MD5))
+	}
+
+	crc32c := make([]byte, crc32.Size)
+	binary.BigEndian.PutUint32(crc32c, w.crc32c.Sum32())
+	if len(w.transfer.CRC32C) > 0 && !bytes.Equal(crc32c, w.transfer.CRC32C) {
+		return fmt.Errorf("%w: crc32c of %s is %s, expected %s", ErrChecksumMismatch, w.transfer.URI(),
+			base64.StdEncoding.EncodeToString(crc32c), base64.StdEncoding.EncodeToString(w.transfer.CRC32C))
+	}
+
+	return nil
+}
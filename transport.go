@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+type TransportConfig struct {
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	TLSHandshakeTimeout   time.Duration
+	DialTimeout           time.Duration
+	UserAgent             string
+	Headers               HeaderFlags
+	Endpoints             EndpointFlags // <= in order of preference, failover on regional errors
+	Faults                *FaultConfig  // <= injected below everything else, nil disables
+	Quota                 *QuotaLimiter // <= shared by clients of all credentials, nil disables
+}
+
+type HeaderFlags http.Header
+
+type headerTransport struct {
+	base      http.RoundTripper
+	userAgent string
+	headers   http.Header
+}
+
+func (h HeaderFlags) String() string {
+	return ""
+}
+
+/*
+	Add header from repeated "Name: value" flag
+*/
+func (h HeaderFlags) Set(value string) error {
+	i := strings.Index(value, ":")
+	name := ""
+	if i > 0 {
+		name = strings.TrimSpace(value[:i])
+	}
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return fmt.Errorf("header must look like \"Name: value\": %s", value)
+	}
+	http.Header(h).Add(name, strings.TrimSpace(value[i+1:]))
+
+	return nil
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Request must not be modified, clone it first
+	req = req.Clone(req.Context())
+	for name, values := range t.headers {
+		req.Header[name] = append(req.Header[name], values...)
+	}
+	// Client library identification is kept
+	if t.userAgent != "" {
+		req.Header.Set("User-Agent", strings.TrimSpace(t.userAgent+" "+req.Header.Get("User-Agent")))
+	}
+
+	return t.base.RoundTrip(req)
+}
+
+/*
+	Transport with timeouts of flags and proxy of environment
+*/
+func newBaseTransport(cfg *TransportConfig) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   cfg.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   100,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+/*
+	Unauthenticated client for requests outside of GCS, e.g. HTTP sink: timeouts, proxy and headers apply, credentials are never sent
+*/
+func newPlainHTTPClient(cfg *TransportConfig) *http.Client {
+	var rt http.RoundTripper = newBaseTransport(cfg)
+	if cfg.UserAgent != "" || len(cfg.Headers) > 0 {
+		rt = &headerTransport{base: rt, userAgent: cfg.UserAgent, headers: http.Header(cfg.Headers)}
+	}
+
+	return &http.Client{Transport: rt}
+}
+
+/*
+	Create authenticated HTTP client with tuned transport timeouts, nil credentials means anonymous access
+*/
+func newHTTPClient(ctx context.Context, cfg *TransportConfig, credentials credentialMinter) (*http.Client, error) {
+	var rt http.RoundTripper = newBaseTransport(cfg)
+	if cfg.Faults != nil {
+		rt = newFaultTransport(rt, cfg.Faults)
+	}
+	if cfg.Quota != nil {
+		rt = &quotaTransport{base: rt, quota: cfg.Quota}
+	}
+	if len(cfg.Endpoints) > 0 {
+		rt = &failoverTransport{base: rt, endpoints: cfg.Endpoints}
+	}
+	if cfg.UserAgent != "" || len(cfg.Headers) > 0 {
+		rt = &headerTransport{base: rt, userAgent: cfg.UserAgent, headers: http.Header(cfg.Headers)}
+	}
+
+	// Emulator does not need credentials
+	if os.Getenv("STORAGE_EMULATOR_HOST") != "" || credentials == nil {
+		transport, err := htransport.NewTransport(ctx, rt, option.WithoutAuthentication())
+		if err != nil {
+			return nil, fmt.Errorf("transport.NewTransport: %w", err)
+		}
+		return &http.Client{Transport: transport}, nil
+	}
+
+	// Rejected tokens are renewed, long jobs outlive credentials
+	source, err := newRenewingTokenSource(ctx, credentials)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := htransport.NewTransport(ctx, rt, option.WithTokenSource(source))
+	if err != nil {
+		return nil, fmt.Errorf("transport.NewTransport: %w", err)
+	}
+
+	return &http.Client{Transport: &reauthTransport{base: transport, source: source}}, nil
+}
+
+/*
+	Storage client options, emulator host without scheme (as uploads of storage client expect it) needs explicit JSON endpoint
+*/
+func clientOptions(hc *http.Client) []option.ClientOption {
+	opts := []option.ClientOption{option.WithHTTPClient(hc)}
+	if os.Getenv("STORAGE_EMULATOR_HOST") != "" {
+		opts = append(opts, option.WithEndpoint(jsonEndpoint()))
+	}
+
+	return opts
+}
+
+/*
+	Generate random trace ID in W3C trace context format (32 hex digits)
+*/
+func newTraceID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%032x", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"cloud.google.com/go/storage"
+)
+
+// Flags working on downloaded files or listings, they have no meaning for uploads and bucket copies
+var downloadOnlyFlags = []string{
+	"manifest", "I", "failure-manifest", "dead-letter", "state-file", "state-db", "processes",
+	"pipe-to", "pipe-ack", "validate-cmd", "metadata-sidecar", "acl-sidecar", "if-generation-match",
+	"verify-composite", "rename", "name-case", "on-conflict", "date-layout", "create-dirs",
+	"no-create-dirs", "create-empty-dirs", "deterministic", "allow-escape", "hedge", "resume", "no-verify", "keep-corrupt",
+	"mtime-from-custom-time", "checksum-index", "no-clobber", "newer-only",
+	"strip-prefix", "flatten", "preserve-mtime", "meta-json",
+	"no-decompress", "archive",
+}
+
+// Flags setting holds and retention of new objects, downloads and bucket copies refuse them
+var uploadOnlyFlags = []string{"event-based-hold", "temporary-hold", "retain-for", "retention-mode", "custom-time"}
+
+/*
+	Check if arguments copy local path to GCS
+*/
+func isUpload(source, destination string) bool {
+	return !strings.HasPrefix(source, "gs://") && strings.HasPrefix(destination, "gs://")
+}
+
+/*
+	Refuse download flags given with upload or bucket copy
+*/
+func checkRemoteFlags(fs *flag.FlagSet, command string) error {
+	unsupported := map[string]bool{}
+	for _, name := range downloadOnlyFlags {
+		unsupported[name] = true
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if err == nil && unsupported[f.Name] {
+			err = fmt.Errorf("-%s can not be used with %s", f.Name, command)
+		}
+	})
+
+	return err
+}
+
+/*
+	Refuse upload flags given with other commands
+*/
+func checkUploadFlags(fs *flag.FlagSet, command string) error {
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, name := range uploadOnlyFlags {
+			if err == nil && f.Name == name {
+				err = fmt.Errorf("-%s can only be used with uploads, not %s", f.Name, command)
+			}
+		}
+	})
+
+	return err
+}
+
+/*
+	Plan uploads of local file or directory tree, relative paths are kept under prefix
+*/
+func (s *Storage) PlanUploads() ([]*Transfer, error) {
+	root := s.Config.SourcePath
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("os.Stat: %w", err)
+	}
+
+	if err := s.CheckAccess(s.Config.BucketName, permCreate); err != nil {
+		return nil, err
+	}
+
+	// Single file is uploaded into "directory" prefix or as named object
+	if !info.IsDir() {
+		object := s.Config.Prefix
+		if object == "" || strings.HasSuffix(object, "/") {
+			object += filepath.Base(root)
+		}
+		return []*Transfer{s.newUpload(root, object, info.Size())}, nil
+	}
+
+	prefix := s.Config.Prefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	var transfers []*Transfer
+	err = filepath.WalkDir(root, func(fpath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil // <= directories, links and devices are not objects
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, fpath)
+		if err != nil {
+			return err
+		}
+		transfers = append(transfers, s.newUpload(fpath, prefix+filepath.ToSlash(rel), info.Size()))
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("filepath.WalkDir: %w", err)
+	}
+
+	sort.Slice(transfers, func(i, j int) bool {
+		return transfers[i].Object < transfers[j].Object
+	})
+
+	return transfers, nil
+}
+
+/*
+	Upload transfer, local file is kept as destination field
+*/
+func (s *Storage) newUpload(fpath, object string, size int64) *Transfer {
+	return &Transfer{
+		Bucket:      s.Config.BucketName,
+		Object:      object,
+		Destination: fpath,
+		Attrs:       &storage.ObjectAttrs{Bucket: s.Config.BucketName, Name: object, Size: size},
+	}
+}
+
+/*
+	Upload files sequentially or with workers pool, stops on first error
+*/
+func (s *Storage) UploadObjects(transfers []*Transfer) error {
+	return s.RunTransfers(transfers, s.TransferUpload)
+}
+
+/*
+	Upload file with pausing, retries and progress tracking
+*/
+func (s *Storage) TransferUpload(t *Transfer) error {
+	return s.RetryTransfer(t, s.UploadObject)
+}
+
+/*
+	Upload single file, CRC32C of local data is sent along so corrupted upload is rejected by GCS
+*/
+func (s *Storage) UploadObject(t *Transfer) (err error) {
+	f, err := os.Open(t.Destination)
+	if err != nil {
+		return fmt.Errorf("os.Open: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("os.Stat: %w", err)
+	}
+
+	ctx, deadline := s.NewObjectDeadline(s.Ctx, info.Size())
+	defer deadline.Stop()
+	defer func() {
+		err = deadline.Err(err)
+	}()
+
+	buf := s.Buffers.Get()
+	defer s.Buffers.Put(buf)
+
+	// Checksum needs whole file before upload starts
+	crc := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	if _, err := io.CopyBuffer(crc, f, *buf); err != nil {
+		return fmt.Errorf("io.CopyBuffer: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("os.Seek: %w", err)
+	}
+
+	progress := s.Status.Start(t.URI())
+	atomic.StoreInt64(&progress.Size, info.Size())
+
+	s.Printf(t.URI(), "Uploading %s => %s\n", t.Destination, t.URI())
+
+	// New object is encrypted with key of its URL, reads must supply it later
+	handle, err := s.Keys.Apply(ctx, t, s.Bucket(t.Bucket).Object(t.Object))
+	if err != nil {
+		return err
+	}
+
+	// Canceled context aborts upload, partial data never becomes object
+	w := handle.NewWriter(ctx)
+	w.ContentType = mime.TypeByExtension(path.Ext(t.Object))
+	w.ContentEncoding = t.Attrs.ContentEncoding
+	w.Metadata = map[string]string{fileMtimeKey: strconv.FormatInt(info.ModTime().Unix(), 10)} // <= compared by rsync
+	w.CRC32C = crc.Sum32()
+	w.EventBasedHold = s.Config.EventBasedHold
+	w.TemporaryHold = s.Config.TemporaryHold
+	w.CustomTime = s.uploadCustomTime(t, info)
+	w.SendCRC32C = true
+
+	if _, err := io.CopyBuffer(io.MultiWriter(w, progress), s.Bandwidth.Reader(ctx, s.Pauser.Reader(ctx, f)), *buf); err != nil {
+		deadline.Stop()
+		w.Close()
+		return fmt.Errorf("io.CopyBuffer: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return s.explainImmutable(ctx, t.Bucket, t.Object, fmt.Errorf("Object(%q).NewWriter: %w", t.Object, err))
+	}
+	t.Attrs = w.Attrs() // <= planned attributes are replaced by created object, e.g. its generation
+
+	if s.Config.RetainFor > 0 {
+		return s.SetRetention(ctx, t.Bucket, t.Object, w.Attrs().Generation)
+	}
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Validator output kept in error message
+const maxValidatorOutput = 512
+
+/*
+	Run validation command on downloaded file, "{}" arguments are replaced by file path
+*/
+func (s *Storage) Validate(ctx context.Context, path string) error {
+	args := make([]string, 0, len(s.Config.ValidateCmd)+1)
+	substituted := false
+	for _, arg := range s.Config.ValidateCmd {
+		if strings.Contains(arg, "{}") {
+			arg = strings.ReplaceAll(arg, "{}", path)
+			substituted = true
+		}
+		args = append(args, arg)
+	}
+	// Same as xargs, path goes last if there is no placeholder
+	if !substituted {
+		args = append(args, path)
+	}
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(output.String())
+		if len(msg) > maxValidatorOutput {
+			msg = "..." + msg[len(msg)-maxValidatorOutput:]
+		}
+		if msg != "" {
+			return fmt.Errorf("%w: %s: %v: %s", ErrValidationFailed, path, err, msg)
+		}
+		return fmt.Errorf("%w: %s: %v", ErrValidationFailed, path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	defaultWatchDebounce = 2 * time.Second
+	defaultWatchPoll     = 5 * time.Second  // <= interval of polling watcher where no notification API is used
+	watchRetryDelay      = 30 * time.Second // <= failed files are tried again after it
+)
+
+/*
+	Source of changed paths under watched directory, paths are joined to root, root itself asks for full rescan
+*/
+type DirWatcher interface {
+	Changes() <-chan string
+	Close() error
+}
+
+/*
+	Files of watched directory as uploaded by watch-local, by relative slash-separated name
+*/
+type LocalWatch struct {
+	root   string
+	remove bool
+	files  map[string]watchedFile
+}
+
+type watchedFile struct {
+	Size  int64
+	Mtime int64 // <= seconds, as kept in object metadata
+}
+
+type WatchRound struct {
+	Uploaded int
+	Renamed  int // <= copied server-side from old name instead of uploaded
+	Removed  int
+	Failed   []string // <= paths tried again later
+}
+
+/*
+	Directory watcher polling file sizes and modification times, used where notifications are not available
+*/
+type pollWatcher struct {
+	root     string
+	interval time.Duration
+	changes  chan string
+	done     chan struct{}
+}
+
+/*
+	Run "watch-local" command: upload new and modified files of directory continuously until canceled
+*/
+func runWatchLocalCommand(args []string) {
+	fs := flag.NewFlagSet("watch-local", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s watch-local [OPTIONS] directory bucket_name[/path]\n\nOptions:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	common := addCommandFlags(fs)
+	isMultiThread := fs.Bool("m", false, "Run command in multi-threading mode")
+	jobs := fs.Int("j", 0, "Workers pool size of multi-threading mode (defaults to number of CPUs), implies -m")
+	remove := fs.Bool("d", false, "Delete objects of removed files, and of old names of renamed files")
+	checksum := fs.Bool("c", false, "Compare CRC32C/MD5 of files with same size in initial sync even when modification time matches")
+	debounce := fs.Duration("debounce", defaultWatchDebounce, "Quiet time after last change before changed files are uploaded")
+	poll := fs.Duration("poll", 0, "Poll directory at this interval instead of file system notifications, e.g. on network mounts")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *jobs < 0 {
+		exception(fmt.Errorf("-j must be positive"))
+	}
+	if *debounce < 0 || *poll < 0 {
+		exception(fmt.Errorf("-debounce and -poll must not be negative"))
+	}
+	if !strings.HasPrefix(fs.Arg(1), "gs://") || strings.HasPrefix(fs.Arg(0), "gs://") {
+		exception(fmt.Errorf("watch-local needs local directory and gs:// URL"))
+	}
+
+	cfg, err := common.newConfig("watch-local")
+	if err != nil {
+		exception(err)
+	}
+	if err := setSyncPaths(cfg, fs.Arg(1), fs.Arg(0), true); err != nil {
+		exception(err)
+	}
+	if info, err := os.Stat(cfg.SourcePath); err != nil || !info.IsDir() {
+		exception(fmt.Errorf("watch-local needs existing directory: %s", cfg.SourcePath))
+	}
+	cfg.isMultiThread = *isMultiThread || *jobs > 0
+	cfg.Jobs = *jobs
+	cfg.ContinueOnError = true // <= failed files are tried again, daemon goes on
+
+	s, err := NewStorageWithConfig(cfg)
+	if err != nil {
+		exception(err)
+	}
+	defer s.Client.Close()
+	defer s.HandleCancelSignals()()
+
+	// Watching starts before initial sync, changes made during it are not missed
+	watcher, err := newDirWatcher(cfg.SourcePath, *poll)
+	if err != nil {
+		exception(err)
+	}
+	defer watcher.Close()
+
+	if err := s.WatchLocal(watcher, *remove, *checksum, *debounce); err != nil {
+		exception(err)
+	}
+}
+
+/*
+	Synchronize directory once, then upload changes reported by watcher in batches until job is canceled
+*/
+func (s *Storage) WatchLocal(watcher DirWatcher, remove, checksum bool, debounce time.Duration) error {
+	// Files changed after indexing differ from index, those changed before are seen by sync
+	watch, err := NewLocalWatch(s.Config.SourcePath, remove)
+	if err != nil {
+		return err
+	}
+
+	s.Failures = NewFailureReport(true)
+	report, _, err := s.SyncUpload(remove, checksum)
+	if s.Ctx.Err() != nil {
+		return nil
+	}
+	if err == nil {
+		err = s.Failures.Err(report.Copied)
+	}
+	if err != nil {
+		return err
+	}
+	console.Printf("Synchronized %s: %d copied, %d unchanged, %d removed; watching for changes\n",
+		s.Config.SourcePath, report.Copied, report.Unchanged, report.Removed)
+
+	pending := map[string]bool{}
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.Ctx.Done():
+			return nil
+		case path, ok := <-watcher.Changes():
+			if !ok {
+				return fmt.Errorf("watcher of %s stopped", s.Config.SourcePath)
+			}
+			pending[path] = true
+			timer.Reset(debounce) // <= batch waits for quiet time
+		case <-timer.C:
+			paths := make([]string, 0, len(pending))
+			for path := range pending {
+				paths = append(paths, path)
+			}
+			pending = map[string]bool{}
+
+			round, err := s.WatchRound(watch, paths)
+			if s.Ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				console.Error(err)
+			}
+			if round.Uploaded+round.Renamed+round.Removed > 0 || len(round.Failed) > 0 {
+				console.Printf("Watch %s: %d uploaded, %d renamed, %d removed, %d failed\n",
+					s.Config.SourcePath, round.Uploaded, round.Renamed, round.Removed, len(round.Failed))
+			}
+			for _, path := range round.Failed {
+				pending[path] = true
+			}
+			if len(round.Failed) > 0 {
+				timer.Reset(watchRetryDelay)
+			}
+		}
+	}
+}
+
+/*
+	Index files of synchronized directory
+*/
+func NewLocalWatch(root string, remove bool) (*LocalWatch, error) {
+	lw := &LocalWatch{root: root, remove: remove, files: map[string]watchedFile{}}
+	found, err := lw.scan(root)
+	if err != nil {
+		return nil, err
+	}
+	lw.files = found
+
+	return lw, nil
+}
+
+/*
+	Regular files under path (file or directory) by relative name, missing path has none
+*/
+func (lw *LocalWatch) scan(path string) (map[string]watchedFile, error) {
+	found := map[string]watchedFile{}
+	err := filepath.WalkDir(path, func(fpath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil // <= removed while walking
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(lw.root, fpath)
+		if err != nil {
+			return err
+		}
+		found[filepath.ToSlash(rel)] = watchedFile{Size: info.Size(), Mtime: info.ModTime().Unix()}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("filepath.WalkDir: %w", err)
+	}
+
+	return found, nil
+}
+
+/*
+	Upload changed files under paths, renamed files are copied from old object, vanished files removed with -d
+*/
+func (s *Storage) WatchRound(lw *LocalWatch, paths []string) (*WatchRound, error) {
+	round := &WatchRound{}
+
+	// Current files under changed paths, known files there which are gone
+	current := map[string]watchedFile{}
+	gone := map[string]watchedFile{}
+	var changed []string
+	for _, path := range paths {
+		found, err := lw.scan(path)
+		if err != nil {
+			return round, err
+		}
+		for name, file := range found {
+			current[name] = file
+		}
+		rel, err := filepath.Rel(lw.root, path)
+		if err != nil {
+			return round, fmt.Errorf("filepath.Rel: %w", err)
+		}
+		changed = append(changed, filepath.ToSlash(rel))
+	}
+	for name, file := range lw.files {
+		for _, rel := range changed {
+			under := rel == "." || name == rel || strings.HasPrefix(name, rel+"/")
+			if _, ok := current[name]; under && !ok {
+				gone[name] = file
+			}
+		}
+	}
+
+	var uploads, copies []*Transfer
+	names := make([]string, 0, len(current))
+	for name := range current {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		file := current[name]
+		known, ok := lw.files[name]
+		if ok && known == file {
+			continue
+		}
+		fpath := filepath.Join(lw.root, filepath.FromSlash(name))
+
+		// File with data of vanished one is renamed, object is copied without upload
+		if !ok {
+			if from := s.renamedFrom(gone, fpath, file); from != nil {
+				from.Destination = fmt.Sprintf("gs://%s/%s%s", s.Config.BucketName, s.Config.Prefix, name)
+				copies = append(copies, from)
+				continue
+			}
+		}
+		uploads = append(uploads, s.newUpload(fpath, s.Config.Prefix+name, file.Size))
+	}
+
+	s.Failures = NewFailureReport(true)
+	err := s.UploadObjects(uploads)
+	if err == nil || errors.Is(err, ErrTransfersFailed) {
+		err = s.CopyObjects(copies)
+	}
+	failed := map[string]bool{}
+	var failures *FailuresError
+	if errors.As(s.Failures.Err(len(uploads)+len(copies)), &failures) {
+		for _, failure := range failures.Failures {
+			failed[failure.Object] = true
+		}
+	}
+	if err != nil && !errors.Is(err, ErrTransfersFailed) {
+		return round, err
+	}
+
+	for _, t := range uploads {
+		name := strings.TrimPrefix(t.Object, s.Config.Prefix)
+		if failed[t.Object] {
+			round.Failed = append(round.Failed, t.Destination)
+			continue
+		}
+		lw.files[name] = current[name]
+		round.Uploaded++
+	}
+	for _, t := range copies {
+		_, object, _ := parseGCSUrl(t.Destination)
+		name := strings.TrimPrefix(object, s.Config.Prefix)
+		if failed[t.Object] {
+			round.Failed = append(round.Failed, filepath.Join(lw.root, filepath.FromSlash(name)))
+			continue
+		}
+		lw.files[name] = current[name]
+		round.Renamed++
+	}
+
+	// Objects of vanished files are kept unless -d, index forgets them either way
+	vanished := make([]string, 0, len(gone))
+	for name := range gone {
+		vanished = append(vanished, name)
+	}
+	sort.Strings(vanished)
+	for _, name := range vanished {
+		if lw.remove {
+			s.Printf(name, "Removing gs://%s/%s%s\n", s.Config.BucketName, s.Config.Prefix, name)
+			if err := s.RemoveObject(s.Config.BucketName, s.Config.Prefix+name); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+				console.Error(err)
+				round.Failed = append(round.Failed, filepath.Join(lw.root, filepath.FromSlash(name)))
+				continue
+			}
+			round.Removed++
+		}
+		delete(lw.files, name)
+	}
+
+	return round, nil
+}
+
+/*
+	Copy transfer of vanished object with same size, modification time and CRC32C as new file, nil when none matches
+*/
+func (s *Storage) renamedFrom(gone map[string]watchedFile, fpath string, file watchedFile) *Transfer {
+	var local uint32
+	hashed := false
+	for name, old := range gone {
+		if old != file {
+			continue
+		}
+		attrs, err := s.Bucket(s.Config.BucketName).Object(s.Config.Prefix + name).Attrs(s.Ctx)
+		if err != nil {
+			continue
+		}
+		if !hashed {
+			if local, err = fileCRC32C(fpath); err != nil {
+				return nil
+			}
+			hashed = true
+		}
+		if attrs.CRC32C != local {
+			continue
+		}
+
+		// Old object stays vanished, with -d it is removed once copies are done
+		return &Transfer{Bucket: attrs.Bucket, Object: attrs.Name, Attrs: attrs}
+	}
+
+	return nil
+}
+
+func fileCRC32C(path string) (uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("os.Open: %w", err)
+	}
+	defer f.Close()
+
+	crc := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	if _, err := io.Copy(crc, f); err != nil {
+		return 0, fmt.Errorf("io.Copy: %w", err)
+	}
+
+	return crc.Sum32(), nil
+}
+
+/*
+	Start polling watcher, first poll only records current state
+*/
+func newPollWatcher(root string, interval time.Duration) *pollWatcher {
+	w := &pollWatcher{root: root, interval: interval, changes: make(chan string, 256), done: make(chan struct{})}
+	go w.run()
+
+	return w
+}
+
+func (w *pollWatcher) Changes() <-chan string {
+	return w.changes
+}
+
+func (w *pollWatcher) Close() error {
+	close(w.done)
+	return nil
+}
+
+func (w *pollWatcher) run() {
+	lw := &LocalWatch{root: w.root}
+	previous, _ := lw.scan(w.root)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+
+		current, err := lw.scan(w.root)
+		if err != nil {
+			console.Error(err)
+			continue
+		}
+		var changed []string
+		for name, file := range current {
+			if old, ok := previous[name]; !ok || old != file {
+				changed = append(changed, name)
+			}
+		}
+		for name := range previous {
+			if _, ok := current[name]; !ok {
+				changed = append(changed, name)
+			}
+		}
+		previous = current
+
+		for _, name := range changed {
+			select {
+			case w.changes <- filepath.Join(w.root, filepath.FromSlash(name)):
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
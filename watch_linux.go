@@ -0,0 +1,153 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const inotifyMask = unix.IN_CLOSE_WRITE | unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO
+
+/*
+	Directory tree watched by inotify, each directory has own watch
+*/
+type inotifyWatcher struct {
+	root    string
+	fd      int      // <= Fd() of file would make it blocking
+	file    *os.File // <= non-blocking descriptor, Close interrupts pending read
+	changes chan string
+
+	mu   sync.Mutex
+	dirs map[int]string // <= watch descriptor => directory
+}
+
+/*
+	Watcher of directory tree: inotify, or polling at given interval
+*/
+func newDirWatcher(root string, poll time.Duration) (DirWatcher, error) {
+	if poll > 0 {
+		return newPollWatcher(root, poll), nil
+	}
+
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify_init1: %w", err)
+	}
+	w := &inotifyWatcher{
+		root:    root,
+		fd:      fd,
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		changes: make(chan string, 256),
+		dirs:    map[int]string{},
+	}
+	if err := w.addTree(root); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+	go w.run()
+
+	return w, nil
+}
+
+func (w *inotifyWatcher) Changes() <-chan string {
+	return w.changes
+}
+
+func (w *inotifyWatcher) Close() error {
+	return w.file.Close()
+}
+
+/*
+	Watch directory and its subdirectories, e.g. directory created or moved in
+*/
+func (w *inotifyWatcher) addTree(root string) error {
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil // <= removed while walking
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+
+		wd, err := unix.InotifyAddWatch(w.fd, path, inotifyMask)
+		if err != nil {
+			if errors.Is(err, unix.ENOENT) {
+				return nil
+			}
+			if errors.Is(err, unix.ENOSPC) {
+				return fmt.Errorf("inotify_add_watch: %s: limit of watches reached, raise fs.inotify.max_user_watches or use -poll", path)
+			}
+			return fmt.Errorf("inotify_add_watch: %s: %w", path, err)
+		}
+		w.mu.Lock()
+		w.dirs[wd] = path
+		w.mu.Unlock()
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("filepath.WalkDir: %w", err)
+	}
+
+	return nil
+}
+
+/*
+	Read events until watcher is closed, lost events ask for rescan of whole tree
+*/
+func (w *inotifyWatcher) run() {
+	defer close(w.changes)
+
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				console.Error(fmt.Errorf("inotify: %w", err))
+			}
+			return
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			name := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(event.Len)]
+			offset += unix.SizeofInotifyEvent + int(event.Len)
+
+			if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+				w.changes <- w.root
+				continue
+			}
+			w.mu.Lock()
+			dir, ok := w.dirs[int(event.Wd)]
+			if event.Mask&unix.IN_IGNORED != 0 {
+				delete(w.dirs, int(event.Wd))
+			}
+			w.mu.Unlock()
+			if !ok || event.Len == 0 {
+				continue
+			}
+
+			path := filepath.Join(dir, string(bytes.TrimRight(name, "\x00")))
+			if event.Mask&unix.IN_ISDIR != 0 && event.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+				if err := w.addTree(path); err != nil {
+					console.Error(err)
+				}
+			}
+			w.changes <- path
+		}
+	}
+}
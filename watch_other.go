@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"time"
+)
+
+/*
+	Watcher of directory tree, file system notifications are used on Linux only, other systems poll
+*/
+func newDirWatcher(root string, poll time.Duration) (DirWatcher, error) {
+	if poll == 0 {
+		poll = defaultWatchPoll
+	}
+
+	return newPollWatcher(root, poll), nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+type WorkerResult struct {
+	URI       string      `json:"uri"`
+	Error     string      `json:"error,omitempty"`
+	Code      string      `json:"code,omitempty"`
+	Retryable bool        `json:"retryable,omitempty"`
+	Attempt   int         `json:"attempt,omitempty"`
+	State     *StateEntry `json:"state,omitempty"` // <= downloaded version, also when state is not enabled
+}
+
+type WorkerError struct {
+	Code      string
+	Retryable bool
+	Message   string
+}
+
+func (e *WorkerError) Error() string {
+	return e.Message
+}
+
+/*
+	Download objects in worker processes, each process transfers one object at a time
+*/
+func (s *Storage) DownloadObjectsWithProcesses(transfers []*Transfer) error {
+	processes := s.Config.Processes
+	if len(transfers) < processes {
+		processes = len(transfers)
+	}
+	s.Status.SetTotal(len(transfers), plannedBytes(transfers))
+	stop := s.ShowProgress()
+	defer stop()
+
+	dir, err := os.MkdirTemp("", "gcs-cp-workers-")
+	if err != nil {
+		return fmt.Errorf("os.MkdirTemp: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "workers.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return fmt.Errorf("net.Listen: %w", err)
+	}
+	defer listener.Close()
+
+	jobs := make(chan *Transfer, len(transfers))
+	for _, t := range transfers {
+		jobs <- t
+	}
+	close(jobs)
+
+	// First error cancels the job, worker processes are stopped with its context
+	var once sync.Once
+	var jobErr error
+	fail := func(err error) {
+		once.Do(func() {
+			jobErr = err
+			s.Cancel()
+		})
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("os.Executable: %w", err)
+	}
+
+	var processesWg sync.WaitGroup
+	for i := 0; i < processes; i++ {
+		cmd := exec.Command(executable, s.workerArgs(socket, processes)...)
+		cmd.Stderr = os.Stderr
+		setWorkerProcessGroup(cmd)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			fail(fmt.Errorf("cmd.StdoutPipe: %w", err))
+			break
+		}
+		if err := cmd.Start(); err != nil {
+			fail(fmt.Errorf("cmd.Start: %w", err))
+			break
+		}
+
+		// Canceled worker rolls back objects in flight before it exits
+		exited := make(chan struct{})
+		go func() {
+			select {
+			case <-s.Ctx.Done():
+				stopWorkerProcess(cmd.Process)
+			case <-exited:
+			}
+		}()
+
+		processesWg.Add(1)
+		go func() {
+			defer processesWg.Done()
+			defer close(exited)
+
+			// Messages of workers go through shared console
+			scanner := bufio.NewScanner(stdout)
+			for scanner.Scan() {
+				console.Printf("%s\n", scanner.Text())
+			}
+			if err := cmd.Wait(); err != nil && s.Ctx.Err() == nil {
+				fail(fmt.Errorf("worker process: %w", err))
+			}
+		}()
+	}
+
+	var served int64 // <= objects done, failed or skipped
+	var connectionsWg sync.WaitGroup
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return // <= closed once all processes exited
+			}
+			connectionsWg.Add(1)
+			go func() {
+				defer connectionsWg.Done()
+				s.serveWorker(conn, jobs, &served, fail)
+			}()
+		}
+	}()
+
+	processesWg.Wait()
+	listener.Close()
+	connectionsWg.Wait()
+
+	if jobErr != nil {
+		return jobErr
+	}
+	// Stopped workers and broken connections are expected once job is canceled, objects are left undone
+	left := len(transfers) - int(atomic.LoadInt64(&served))
+	if err := s.Ctx.Err(); err != nil && left > 0 {
+		return fmt.Errorf("worker processes stopped with %d objects left: %w", left, err)
+	}
+	// Processes which were never started leave jobs behind
+	if left > 0 {
+		return fmt.Errorf("worker processes exited with %d objects left", left)
+	}
+
+	return s.Failures.Err(len(transfers))
+}
+
+/*
+	Send transfers to connected worker process one by one and collect results
+*/
+func (s *Storage) serveWorker(conn net.Conn, jobs <-chan *Transfer, served *int64, fail func(error)) {
+	defer conn.Close()
+
+	encoder := json.NewEncoder(conn)
+	decoder := json.NewDecoder(conn)
+
+	for t := range jobs {
+		// Drain remaining objects once job is canceled
+		if s.Ctx.Err() != nil || s.Pauser.Wait(s.Ctx) != nil {
+			continue
+		}
+		if s.SkipUpToDate(t) {
+			atomic.AddInt64(served, 1)
+			continue
+		}
+
+		// Concurrency limits of config apply across all processes
+		release, err := s.acquireSlot(s.Ctx, t)
+		if err != nil {
+			continue
+		}
+		progress := s.Status.Start(t.URI())
+
+		var result WorkerResult
+		if err := encoder.Encode(t); err != nil {
+			release()
+			fail(&TransferError{Object: t.Object, Attempt: 1, Err: fmt.Errorf("worker process: %w", err)})
+			return
+		}
+		err = decoder.Decode(&result)
+		release()
+		if err != nil {
+			if s.Ctx.Err() == nil {
+				fail(&TransferError{Object: t.Object, Attempt: 1, Err: fmt.Errorf("worker process: %w", err)})
+			}
+			return
+		}
+
+		if result.Error != "" && s.Ctx.Err() != nil {
+			return // <= object of stopped worker is left undone
+		}
+		atomic.AddInt64(served, 1)
+		if result.Error != "" {
+			err := &TransferError{
+				Object:  t.Object,
+				Attempt: result.Attempt,
+				Err:     &WorkerError{Code: result.Code, Retryable: result.Retryable, Message: result.Error},
+			}
+			s.Status.AddError(err)
+			if !s.Failures.Add(s.Ctx, err) {
+				fail(err)
+			}
+			continue
+		}
+
+		if result.State != nil {
+			atomic.StoreInt64(&progress.Written, result.State.Size)
+			if s.State != nil {
+				s.State.Set(t.Destination, result.State)
+			}
+		}
+		s.Status.Finish(t.URI())
+	}
+}
+
+/*
+	Command line of worker process: flags of this process with overrides and same arguments
+*/
+func (s *Storage) workerArgs(socket string, processes int) []string {
+	args := append([]string{}, s.Config.CommandFlags...)
+
+	// State, manifests, prompts and servers stay in coordinating process, later flags win
+	args = append(args,
+		"-worker="+socket,
+		"-processes=0",
+		"-m=false",
+		"-j=0",
+		"-state-file=",
+		"-state-db=",
+		"-failure-manifest=",
+		"-control-socket=",
+		"-pprof-addr=",
+		"-preflight=false",
+		"-confirm-objects=0",
+		"-confirm-bytes=",
+		fmt.Sprintf("-bandwidth-share=%d", processes), // <= processes have own limiters
+	)
+	if s.Config.TraceID != "" {
+		args = append(args, "-trace-id="+s.Config.TraceID)
+	}
+
+	return append(args, s.Config.CommandArgs...)
+}
+
+/*
+	Run worker process: transfer objects received from coordinating process until it closes connection
+*/
+func (s *Storage) RunWorker() error {
+	conn, err := net.Dial("unix", s.Config.Worker)
+	if err != nil {
+		return fmt.Errorf("net.Dial: %w", err)
+	}
+	defer conn.Close()
+
+	// Downloaded versions are reported to coordinator instead of state file
+	s.State = &StateFile{Objects: map[string]*StateEntry{}}
+
+	// Coordinator stops worker with SIGTERM, object in flight rolls back its partial file
+	defer s.HandleCancelSignals()()
+
+	encoder := json.NewEncoder(conn)
+	decoder := json.NewDecoder(conn)
+	for {
+		var t Transfer
+		if err := decoder.Decode(&t); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("json.Decode: %w", err)
+		}
+
+		result := WorkerResult{URI: t.URI()}
+		if err := s.TransferObject(&t); err != nil {
+			result.Error = err.Error()
+			result.Code = errorCode(err)
+			result.Retryable = isRetryable(err)
+
+			var te *TransferError
+			if errors.As(err, &te) {
+				result.Attempt = te.Attempt
+			}
+		} else {
+			result.State = s.State.Get(t.Destination)
+		}
+
+		if err := encoder.Encode(result); err != nil {
+			return fmt.Errorf("json.Encode: %w", err)
+		}
+	}
+}